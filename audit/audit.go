@@ -0,0 +1,155 @@
+// Package audit records who changed trust data, and how, as structured events written to pluggable sinks.
+package audit
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// Actions that are audited
+const (
+	// ActionUpdate is a push of TUF metadata
+	ActionUpdate = "update"
+	// ActionDelete is the deletion of all TUF metadata for a GUN
+	ActionDelete = "delete"
+	// ActionRotateKey is the rotation of a server-managed snapshot or timestamp key
+	ActionRotateKey = "rotate_key"
+	// ActionSignTarget is the addition of a target to the server-signed delegation of a GUN
+	ActionSignTarget = "sign_target"
+	// ActionRemoveTarget is the removal of a target from the server-signed delegation of a GUN
+	ActionRemoveTarget = "remove_target"
+	// ActionRotateRoot is the rotation of an alternate root's keys through the admin API
+	ActionRotateRoot = "admin.rotate_root"
+	// ActionReswizzle is the regeneration of alternate-rooted metadata through the admin API
+	ActionReswizzle = "admin.reswizzle"
+	// ActionFsck is a consistency check of stored metadata through the admin API
+	ActionFsck = "admin.fsck"
+	// ActionRootCSR is the creation of a root key and certificate signing request for an alternate root
+	ActionRootCSR = "admin.root_csr"
+	// ActionInstallRootCert is the installation of a CA-issued certificate as an alternate root's root key
+	ActionInstallRootCert = "admin.install_root_cert"
+)
+
+// Outcomes of audited actions
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var auditEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "apostille",
+	Subsystem: "audit",
+	Name:      "events_total",
+	Help:      "Number of audited actions, by action and outcome.",
+}, []string{"action", "outcome"})
+
+func init() {
+	prometheus.MustRegister(auditEvents)
+}
+
+// RoleVersion is a version of a role's metadata that was written
+type RoleVersion struct {
+	Role    string `json:"role"`
+	Version int    `json:"version"`
+}
+
+// Event is an audited action
+type Event struct {
+	Time       time.Time     `json:"time"`
+	Action     string        `json:"action"`
+	RequestID  string        `json:"request_id,omitempty"`
+	User       string        `json:"user,omitempty"`
+	TokenKind  string        `json:"token_kind,omitempty"`
+	RootSigner string        `json:"root_signer,omitempty"`
+	GUN        string        `json:"gun,omitempty"`
+	Roles      []RoleVersion `json:"roles,omitempty"`
+	ClientIP   string        `json:"client_ip,omitempty"`
+	Details    interface{}   `json:"details,omitempty"`
+	Outcome    string        `json:"outcome"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// AddRole records that a version of a role was written. It does nothing to a nil event, so that handlers don't need to
+// check whether they are audited.
+func (e *Event) AddRole(role string, version int) {
+	if e != nil {
+		e.Roles = append(e.Roles, RoleVersion{Role: role, Version: version})
+	}
+}
+
+// SetDetails records action-specific details, such as the options of an admin operation
+func (e *Event) SetDetails(details interface{}) {
+	if e != nil {
+		e.Details = details
+	}
+}
+
+// Finish records the outcome of the action
+func (e *Event) Finish(err error) {
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Error = err.Error()
+		return
+	}
+	e.Outcome = OutcomeSuccess
+}
+
+// Auditor writes events to every one of its sinks
+type Auditor struct {
+	sinks []Sink
+}
+
+// New creates an Auditor that writes to the given sinks
+func New(sinks ...Sink) *Auditor {
+	return &Auditor{sinks: sinks}
+}
+
+// Record writes an event to every sink. Failing to write to a sink is logged, but doesn't fail the action, which has
+// already happened. Recording with a nil Auditor does nothing.
+func (a *Auditor) Record(event *Event) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	auditEvents.WithLabelValues(event.Action, event.Outcome).Inc()
+	for _, sink := range a.sinks {
+		if err := sink.Write(event); err != nil {
+			logrus.Errorf("failed to write %s audit event for %s: %s", event.Action, event.GUN, err.Error())
+		}
+	}
+}
+
+// ctxKey is the type of the context keys the audit package sets
+type ctxKey int
+
+const (
+	ctxKeyAuditor ctxKey = iota
+	ctxKeyEvent
+)
+
+// NewContext returns a context that carries an Auditor
+func NewContext(ctx context.Context, auditor *Auditor) context.Context {
+	return context.WithValue(ctx, ctxKeyAuditor, auditor)
+}
+
+// FromContext returns the Auditor a context carries, or nil if it carries none
+func FromContext(ctx context.Context) *Auditor {
+	auditor, _ := ctx.Value(ctxKeyAuditor).(*Auditor)
+	return auditor
+}
+
+// WithEvent returns a context that carries the event for the action being handled
+func WithEvent(ctx context.Context, event *Event) context.Context {
+	return context.WithValue(ctx, ctxKeyEvent, event)
+}
+
+// EventFromContext returns the event for the action being handled, or nil if the action isn't audited
+func EventFromContext(ctx context.Context) *Event {
+	event, _ := ctx.Value(ctxKeyEvent).(*Event)
+	return event
+}
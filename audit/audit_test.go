@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRecordWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := New(NewWriterSink(&buf))
+
+	event := &Event{Action: ActionUpdate, User: "someone", GUN: "quay.io/someone/repo"}
+	event.AddRole("targets", 2)
+	event.Finish(nil)
+	auditor.Record(event)
+
+	failed := &Event{Action: ActionDelete, GUN: "quay.io/someone/repo"}
+	failed.Finish(errors.New("no such repo"))
+	auditor.Record(failed)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var written Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &written))
+	require.Equal(t, OutcomeSuccess, written.Outcome)
+	require.Equal(t, "someone", written.User)
+	require.Equal(t, []RoleVersion{{Role: "targets", Version: 2}}, written.Roles)
+	require.False(t, written.Time.IsZero())
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &written))
+	require.Equal(t, OutcomeFailure, written.Outcome)
+	require.Equal(t, "no such repo", written.Error)
+}
+
+func TestNilAuditorAndEvent(t *testing.T) {
+	ctx := context.Background()
+	require.Nil(t, FromContext(ctx))
+	require.Nil(t, EventFromContext(ctx))
+
+	// unaudited handlers can still add to their event
+	EventFromContext(ctx).AddRole("targets", 1)
+	EventFromContext(ctx).SetDetails("details")
+	FromContext(ctx).Record(&Event{Action: ActionUpdate})
+
+	auditor, event := New(), &Event{}
+	ctx = WithEvent(NewContext(ctx, auditor), event)
+	require.Equal(t, auditor, FromContext(ctx))
+	require.Equal(t, event, EventFromContext(ctx))
+}
+
+func TestSinks(t *testing.T) {
+	_, err := NewSink("missing", nil)
+	require.Error(t, err)
+	_, err = NewSink(FileSink, map[string]interface{}{})
+	require.Error(t, err)
+	require.Panics(t, func() {
+		Register(StdoutSink, nil)
+	})
+
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// the file is appended to
+	for i := 0; i < 2; i++ {
+		sink, err := NewSink(FileSink, map[string]interface{}{"path": path})
+		require.NoError(t, err)
+		New(sink).Record(&Event{Action: ActionUpdate, Outcome: OutcomeSuccess})
+	}
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(contents), "\n"))
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The sinks apostille provides
+const (
+	// StdoutSink writes JSON lines to standard output
+	StdoutSink = "stdout"
+	// FileSink appends JSON lines to the file named by the `path` option
+	FileSink = "file"
+)
+
+// Sink is somewhere audit events are written to
+type Sink interface {
+	Write(event *Event) error
+}
+
+// SinkFactory creates a sink from its options
+type SinkFactory func(options map[string]interface{}) (Sink, error)
+
+var sinks = map[string]SinkFactory{}
+
+func init() {
+	Register(StdoutSink, func(map[string]interface{}) (Sink, error) {
+		return NewWriterSink(os.Stdout), nil
+	})
+	Register(FileSink, newFileSink)
+}
+
+// Register makes a sink available by name. It panics if a sink is already registered with that name.
+func Register(name string, factory SinkFactory) {
+	if _, ok := sinks[name]; ok {
+		panic(fmt.Sprintf("audit sink %s is already registered", name))
+	}
+	sinks[name] = factory
+}
+
+// NewSink creates the sink registered as `name`
+func NewSink(name string, options map[string]interface{}) (Sink, error) {
+	factory, ok := sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("no audit sink named %s", name)
+	}
+	return factory(options)
+}
+
+// WriterSink writes each event as a line of JSON
+type WriterSink struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewWriterSink creates a WriterSink
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{encoder: json.NewEncoder(w)}
+}
+
+// Write writes an event as a line of JSON
+func (s *WriterSink) Write(event *Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.encoder.Encode(event)
+}
+
+// newFileSink opens the file named by the `path` option for appending, creating it if needed
+func newFileSink(options map[string]interface{}) (Sink, error) {
+	path, _ := options["path"].(string)
+	if path == "" {
+		return nil, fmt.Errorf("the file audit sink requires a path")
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(file), nil
+}
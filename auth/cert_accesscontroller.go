@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+)
+
+// CertAccessController authorizes requests on the admin interface made with a client certificate whose subject or
+// subject alternative names are allowed. The certificate must already have been verified by the TLS listener, which
+// has to require client certificates signed by a trusted CA.
+type CertAccessController struct {
+	allowedSubjects map[string]bool
+	allowedSANs     map[string]bool
+}
+
+// NewCertAccessController creates a CertAccessController from the `allowedSubjects` and `allowedSANs` options.
+// Subjects match either the common name or the whole distinguished name of a certificate, and SANs match its DNS
+// names, email addresses, IP addresses or URIs.
+func NewCertAccessController(options map[string]interface{}) (registryAuth.AccessController, error) {
+	subjects, err := stringList(options, "allowedSubjects")
+	if err != nil {
+		return nil, err
+	}
+	sans, err := stringList(options, "allowedSANs")
+	if err != nil {
+		return nil, err
+	}
+	if len(subjects) == 0 && len(sans) == 0 {
+		return nil, fmt.Errorf("admin certificate auth requires at least one allowed subject or SAN")
+	}
+
+	ac := &CertAccessController{
+		allowedSubjects: make(map[string]bool, len(subjects)),
+		allowedSANs:     make(map[string]bool, len(sans)),
+	}
+	for _, subject := range subjects {
+		ac.allowedSubjects[subject] = true
+	}
+	for _, san := range sans {
+		ac.allowedSANs[san] = true
+	}
+	return ac, nil
+}
+
+// Authorized authorizes requests whose client certificate is allowed for the admin root, and adds the name it was
+// allowed by to the context as the user name, so that it is logged with every admin request.
+func (ac *CertAccessController) Authorized(ctx context.Context, accessItems ...registryAuth.Access) (context.Context, error) {
+	challenge := &authChallenge{
+		realm:     AdminAuth,
+		service:   AdminAuth,
+		accessSet: newAccessSet(accessItems...),
+	}
+
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		challenge.err = fmt.Errorf("a client certificate is required")
+		return nil, challenge
+	}
+
+	cert := req.TLS.PeerCertificates[0]
+	identity, ok := ac.identity(cert)
+	if !ok {
+		challenge.err = fmt.Errorf("client certificate %q is not allowed to administer apostille", cert.Subject.String())
+		return nil, challenge
+	}
+
+	ctx = registryAuth.WithUser(ctx, registryAuth.UserInfo{Name: identity})
+	ctx = context.WithLogger(ctx, context.GetLogger(ctx, registryAuth.UserNameKey))
+	return context.WithValue(ctx, TufRootSigner, AdminAuth), nil
+}
+
+// identity returns the subject or SAN that allows a certificate, if any does
+func (ac *CertAccessController) identity(cert *x509.Certificate) (string, bool) {
+	for _, subject := range []string{cert.Subject.CommonName, cert.Subject.String()} {
+		if subject != "" && ac.allowedSubjects[subject] {
+			return subject, true
+		}
+	}
+
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if ac.allowedSANs[san] {
+			return san, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func authorizeCert(ac registryAuth.AccessController, cert *x509.Certificate) (context.Context, error) {
+	req, _ := http.NewRequest("POST", "/admin/fsck", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return ac.Authorized(context.WithRequest(context.Background(), req))
+}
+
+func TestCertAccessController(t *testing.T) {
+	ac, err := NewCertAccessController(map[string]interface{}{
+		"allowedSubjects": []interface{}{"ops", "CN=deploy,O=CoreOS"},
+		"allowedSANs":     []string{"admin.example.com", "spiffe://example.com/apostille-admin", "10.0.0.1"},
+	})
+	require.NoError(t, err)
+
+	spiffeID, err := url.Parse("spiffe://example.com/apostille-admin")
+	require.NoError(t, err)
+	allowed := map[string]*x509.Certificate{
+		"ops":                                  {Subject: pkix.Name{CommonName: "ops"}},
+		"CN=deploy,O=CoreOS":                   {Subject: pkix.Name{CommonName: "deploy", Organization: []string{"CoreOS"}}},
+		"admin.example.com":                    {Subject: pkix.Name{CommonName: "someone"}, DNSNames: []string{"other.example.com", "admin.example.com"}},
+		"spiffe://example.com/apostille-admin": {URIs: []*url.URL{spiffeID}},
+		"10.0.0.1":                             {IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+	}
+	for identity, cert := range allowed {
+		ctx, err := authorizeCert(ac, cert)
+		require.NoError(t, err, identity)
+		require.Equal(t, AdminAuth, ctx.Value(TufRootSigner))
+		require.Equal(t, identity, ctx.Value(registryAuth.UserNameKey))
+	}
+
+	for _, cert := range []*x509.Certificate{
+		nil,
+		{Subject: pkix.Name{CommonName: "deploy"}},
+		{Subject: pkix.Name{CommonName: "admin.example.com"}},
+		{DNSNames: []string{"ops"}},
+	} {
+		_, err := authorizeCert(ac, cert)
+		require.Error(t, err)
+		_, ok := err.(registryAuth.Challenge)
+		require.True(t, ok)
+	}
+}
+
+func TestCertAccessControllerOptions(t *testing.T) {
+	_, err := NewCertAccessController(map[string]interface{}{})
+	require.Error(t, err)
+	_, err = NewCertAccessController(map[string]interface{}{"allowedSubjects": 1})
+	require.Error(t, err)
+
+	ac, err := GetAccessController(AdminCertAuth, map[string]interface{}{"allowedSANs": "admin.example.com"}, RootMapping{})
+	require.NoError(t, err)
+	require.IsType(t, &CertAccessController{}, ac)
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+	registryToken "github.com/docker/distribution/registry/auth/token"
+)
+
+// multiIssuerAccessController trusts tokens from several issuers, each with its own keyserver, audience and allowed
+// roots. Each token is checked by the access controller for the issuer named by its `iss` claim.
+type multiIssuerAccessController struct {
+	// issuers are in the order they are configured; the first one issues the challenges for requests without a token
+	issuers  []*keyserverAccessController
+	byIssuer map[string]*keyserverAccessController
+}
+
+// newMultiIssuerAccessController creates an access controller for each entry of the `issuers` option. The rest of the
+// options are defaults for every issuer, so that settings such as `updateKeyInterval` don't need to be repeated.
+func newMultiIssuerAccessController(options map[string]interface{}) (*multiIssuerAccessController, error) {
+	entries, ok := options["issuers"].([]interface{})
+	if !ok || len(entries) == 0 {
+		return nil, fmt.Errorf("quay token auth option \"issuers\" must be a non-empty list")
+	}
+
+	configs := make([]tokenAccessOptions, 0, len(entries))
+	for i, entry := range entries {
+		issuerOptions, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("quay token auth issuer #%d must be a map", i)
+		}
+		merged := make(map[string]interface{}, len(options)+len(issuerOptions))
+		for key, val := range options {
+			if key != "issuers" {
+				merged[key] = val
+			}
+		}
+		for key, val := range issuerOptions {
+			merged[key] = val
+		}
+		config, err := checkOptions(merged)
+		if err != nil {
+			return nil, fmt.Errorf("quay token auth issuer #%d: %s", i, err.Error())
+		}
+		for _, other := range configs {
+			if other.issuer == config.issuer {
+				return nil, fmt.Errorf("quay token auth issuer %s is configured more than once", config.issuer)
+			}
+		}
+		configs = append(configs, config)
+	}
+
+	ac := &multiIssuerAccessController{
+		issuers:  make([]*keyserverAccessController, 0, len(configs)),
+		byIssuer: make(map[string]*keyserverAccessController, len(configs)),
+	}
+	for _, config := range configs {
+		issuer := newKeyserverAccessController(config)
+		ac.issuers = append(ac.issuers, issuer)
+		ac.byIssuer[config.issuer] = issuer
+	}
+	return ac, nil
+}
+
+// Authorized picks the issuer of the request's token, and checks the token with that issuer's access controller.
+// Requests without a token are challenged by the first issuer.
+func (ac *multiIssuerAccessController) Authorized(ctx context.Context, accessItems ...registryAuth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := ac.issuers[0]
+	if rawToken, ok := bearerToken(req); ok {
+		name, err := unverifiedIssuer(rawToken)
+		if err != nil {
+			return nil, issuer.challenge(err, accessItems)
+		}
+		if issuer, ok = ac.byIssuer[name]; !ok {
+			return nil, ac.issuers[0].challenge(fmt.Errorf("token issuer %q is not trusted", name), accessItems)
+		}
+	}
+	return issuer.Authorized(ctx, accessItems...)
+}
+
+// CheckHealth reports the first issuer whose keys can't be fetched
+func (ac *multiIssuerAccessController) CheckHealth() error {
+	for _, issuer := range ac.issuers {
+		if err := issuer.CheckHealth(); err != nil {
+			return fmt.Errorf("issuer %s: %s", issuer.issuer, err.Error())
+		}
+	}
+	return nil
+}
+
+// Close stops fetching keys for every issuer
+func (ac *multiIssuerAccessController) Close() error {
+	for _, issuer := range ac.issuers {
+		issuer.Close()
+	}
+	return nil
+}
+
+// bearerToken returns the bearer token of a request's Authorization header, if it has one
+func bearerToken(req *http.Request) (string, bool) {
+	parts := strings.Split(req.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// unverifiedIssuer reads the `iss` claim of a JWT without verifying its signature, which can only be done once the
+// issuer, and so the key, is known
+func unverifiedIssuer(rawToken string) (string, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", registryToken.ErrMalformedToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", registryToken.ErrMalformedToken
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", registryToken.ErrMalformedToken
+	}
+	return claims.Issuer, nil
+}
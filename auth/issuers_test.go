@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+	registryToken "github.com/docker/distribution/registry/auth/token"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testIssuer signs tokens with a key that its keyserver serves
+type testIssuer struct {
+	signer    jose.Signer
+	keyserver *httptest.Server
+}
+
+func newTestIssuer(t *testing.T, keyID string) *testIssuer {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: privKey, KeyID: keyID},
+	}, nil)
+	require.NoError(t, err)
+
+	pubKey, err := json.Marshal(jose.JSONWebKey{Key: &privKey.PublicKey, KeyID: keyID})
+	require.NoError(t, err)
+	var keyserver *httptest.Server
+	keyserver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/test/keys":
+			w.Write([]byte(`{"keys": [` + string(pubKey) + `]}`))
+		case "/services/test/keys/" + keyID:
+			w.Write(pubKey)
+		case "/jwks.json":
+			w.Header().Set("Cache-Control", "public, max-age=300")
+			w.Write([]byte(`{"keys": [` + string(pubKey) + `]}`))
+		case "/.well-known/openid-configuration":
+			w.Write([]byte(`{"issuer": "` + keyserver.URL + `", "jwks_uri": "` + keyserver.URL + `/jwks.json"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return &testIssuer{signer: signer, keyserver: keyserver}
+}
+
+func (i *testIssuer) token(t *testing.T, issuer, audience, root string) string {
+	token, err := jwt.Signed(i.signer).Claims(jwt.Claims{
+		Issuer:   issuer,
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Claims(AccessClaim{
+		Access: []*registryToken.ResourceActions{{Type: "repository", Name: "quay.io/user/repo", Actions: []string{"pull"}}},
+	}).Claims(ContextClaim{
+		Context: TokenContext{TufRootSigner: root},
+	}).CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func authorize(ac registryAuth.AccessController, token string) (context.Context, error) {
+	req, _ := http.NewRequest("GET", "/v2/quay.io/user/repo/_trust/tuf/root.json", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	ctx := context.WithRequest(context.Background(), req)
+	return ac.Authorized(ctx, registryAuth.Access{
+		Resource: registryAuth.Resource{Type: "repository", Name: "quay.io/user/repo"},
+		Action:   "pull",
+	})
+}
+
+func TestMultipleIssuers(t *testing.T) {
+	prod := newTestIssuer(t, "prod-key")
+	defer prod.keyserver.Close()
+	onPrem := newTestIssuer(t, "onprem-key")
+	defer onPrem.keyserver.Close()
+
+	ac, err := NewKeyserverAccessController(map[string]interface{}{
+		"service":           "test",
+		"updateKeyInterval": "1h",
+		"issuers": []interface{}{
+			map[string]interface{}{
+				"realm":     "https://quay.io",
+				"issuer":    "prod",
+				"keyserver": prod.keyserver.URL,
+			},
+			map[string]interface{}{
+				"realm":        "https://quay.example.com",
+				"issuer":       "onprem",
+				"audience":     "apostille",
+				"keyserver":    onPrem.keyserver.URL,
+				"allowedRoots": []interface{}{"signer"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer ac.(*multiIssuerAccessController).Close()
+	require.NoError(t, ac.(HealthChecker).CheckHealth())
+
+	// each issuer's tokens are checked against its own keys and audience
+	ctx, err := authorize(ac, prod.token(t, "prod", "https://quay.io", "quay"))
+	require.NoError(t, err)
+	require.Equal(t, "quay", ctx.Value(TufRootSigner))
+
+	ctx, err = authorize(ac, onPrem.token(t, "onprem", "apostille", "signer"))
+	require.NoError(t, err)
+	require.Equal(t, "signer", ctx.Value(TufRootSigner))
+
+	_, err = authorize(ac, onPrem.token(t, "onprem", "https://quay.example.com", "signer"))
+	require.Error(t, err)
+
+	// an issuer can't use another issuer's keys
+	_, err = authorize(ac, prod.token(t, "onprem", "apostille", "signer"))
+	require.Error(t, err)
+
+	// an issuer can only pick its allowed roots
+	_, err = authorize(ac, onPrem.token(t, "onprem", "apostille", "quay"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not allowed")
+
+	// unknown issuers and requests without tokens are challenged by the first issuer
+	for _, token := range []string{prod.token(t, "elsewhere", "https://quay.io", "quay"), "", "not.a.jwt"} {
+		_, err = authorize(ac, token)
+		require.Error(t, err)
+		challenge, ok := err.(registryAuth.Challenge)
+		require.True(t, ok)
+		w := httptest.NewRecorder()
+		challenge.SetHeaders(w)
+		require.Contains(t, w.Header().Get("WWW-Authenticate"), `realm="https://quay.io"`)
+	}
+}
+
+func TestMultipleIssuersOptions(t *testing.T) {
+	base := map[string]interface{}{
+		"realm":             "realm",
+		"service":           "test",
+		"keyserver":         "keyserver",
+		"updateKeyInterval": "1h",
+	}
+	withIssuers := func(issuers interface{}) map[string]interface{} {
+		options := map[string]interface{}{"issuers": issuers}
+		for key, val := range base {
+			options[key] = val
+		}
+		return options
+	}
+
+	for _, issuers := range []interface{}{
+		"prod",
+		[]interface{}{},
+		[]interface{}{"prod"},
+		[]interface{}{map[string]interface{}{"issuer": "prod", "allowedRoots": 1}},
+		[]interface{}{map[string]interface{}{"issuer": "prod"}, map[string]interface{}{"issuer": "prod"}},
+	} {
+		_, err := NewKeyserverAccessController(withIssuers(issuers))
+		require.Error(t, err)
+	}
+
+	// a single issuer may restrict its roots without listing issuers
+	options := withIssuers(nil)
+	delete(options, "issuers")
+	options["issuer"] = "prod"
+	options["allowedRoots"] = "signer,quay"
+	config, err := checkOptions(options)
+	require.NoError(t, err)
+	require.Equal(t, []string{"signer", "quay"}, config.allowedRoots)
+	require.Equal(t, "realm", config.audience)
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// minKeyRefresh is the shortest time a JWK set is used before it is fetched again, however short its cache headers
+// say it may be cached for
+var minKeyRefresh = 10 * time.Second
+
+// openIDConfiguration is the part of an OpenID provider's discovery document that apostille uses
+type openIDConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// keySource describes where keys are fetched from, for logs and health checks
+func (ac *keyserverAccessController) keySource() string {
+	switch {
+	case ac.jwksURL != "":
+		return ac.jwksURL
+	case ac.discoveryURL != "":
+		return ac.discoveryURL
+	default:
+		return ac.keyserver
+	}
+}
+
+// keySetURL returns the URL of the JWK set. For an OpenID provider, it is discovered the first time it is needed,
+// and again after fetching the JWK set fails.
+func (ac *keyserverAccessController) keySetURL() (string, error) {
+	switch {
+	case ac.jwksURL != "":
+		return ac.jwksURL, nil
+	case ac.discoveryURL == "":
+		return fmt.Sprintf("%s/services/%s/keys", ac.keyserver, ac.service), nil
+	}
+
+	ac.keysLock.RLock()
+	url := ac.discoveredJWKSURL
+	ac.keysLock.RUnlock()
+	if url != "" {
+		return url, nil
+	}
+
+	url, err := ac.discoverJWKSURL()
+	if err != nil {
+		return "", err
+	}
+	ac.keysLock.Lock()
+	ac.discoveredJWKSURL = url
+	ac.keysLock.Unlock()
+	return url, nil
+}
+
+// forgetKeySetURL makes the next fetch of the JWK set discover its URL again, in case the provider has moved it
+func (ac *keyserverAccessController) forgetKeySetURL() {
+	ac.keysLock.Lock()
+	ac.discoveredJWKSURL = ""
+	ac.keysLock.Unlock()
+}
+
+// discoverJWKSURL reads the JWK set URL from the OpenID provider's discovery document
+func (ac *keyserverAccessController) discoverJWKSURL() (string, error) {
+	url := strings.TrimSuffix(ac.discoveryURL, "/") + "/.well-known/openid-configuration"
+	logrus.Infof("discovering jwk set from: %s", url)
+	resp, err := ac.httpClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OpenID provider responded %s", resp.Status)
+	}
+
+	var config openIDConfiguration
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return "", fmt.Errorf("unable to decode OpenID configuration: %s", err.Error())
+	}
+	if config.JWKSURI == "" {
+		return "", fmt.Errorf("OpenID configuration at %s has no jwks_uri", url)
+	}
+	if config.Issuer != ac.issuer {
+		logrus.Warnf("OpenID provider at %s issues tokens as %q, but tokens from %q are expected", ac.discoveryURL, config.Issuer, ac.issuer)
+	}
+	return config.JWKSURI, nil
+}
+
+// findKeyInKeySet looks up a key that isn't in the JWK set yet by fetching the JWK set again, since a plain JWK set
+// can't be asked for a single key. Issuers publish new keys in their JWK set before signing with them.
+func (ac *keyserverAccessController) findKeyInKeySet(keyID string) (*jose.JSONWebKey, error) {
+	if err := ac.updateKeys(); err != nil {
+		return nil, err
+	}
+	ac.keysLock.RLock()
+	defer ac.keysLock.RUnlock()
+	key, ok := ac.keys[keyID]
+	if !ok {
+		return nil, errKeyNotFound{keyID: keyID, reason: "not in JWK set"}
+	}
+	return key, nil
+}
+
+// nextKeyUpdate is how long to wait before fetching the JWK set again after fetching it successfully
+func (ac *keyserverAccessController) nextKeyUpdate() time.Duration {
+	ac.keysLock.RLock()
+	defer ac.keysLock.RUnlock()
+	if ac.keysRefresh > 0 {
+		return ac.keysRefresh
+	}
+	return ac.updateKeyInterval
+}
+
+// clampKeyRefresh keeps the refresh time from cache headers between minKeyRefresh and the configured interval
+func clampKeyRefresh(refresh, limit time.Duration) time.Duration {
+	if refresh > limit {
+		return limit
+	}
+	if refresh < minKeyRefresh {
+		return minKeyRefresh
+	}
+	return refresh
+}
+
+// cacheLifetime is how long a response may be cached for according to its Cache-Control or Expires headers, and
+// whether the headers say at all
+func cacheLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-cache" || directive == "no-store":
+				return 0, true
+			case strings.HasPrefix(directive, "max-age="):
+				seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+				if err != nil || seconds < 0 {
+					continue
+				}
+				if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+					seconds -= age
+				}
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+
+	expires := header.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	expiry, err := http.ParseTime(expires)
+	if err != nil {
+		// invalid dates mean the response has already expired
+		return 0, true
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	return expiry.Sub(now), true
+}
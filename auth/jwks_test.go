@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		header   map[string]string
+		lifetime time.Duration
+		cached   bool
+	}{
+		{map[string]string{}, 0, false},
+		{map[string]string{"Cache-Control": "public, max-age=300"}, 5 * time.Minute, true},
+		{map[string]string{"Cache-Control": "max-age=300", "Age": "100"}, 200 * time.Second, true},
+		{map[string]string{"Cache-Control": "no-store"}, 0, true},
+		{map[string]string{"Cache-Control": "public", "Expires": "Thu, 01 Jun 2017 13:00:00 GMT"}, time.Hour, true},
+		{map[string]string{"Expires": "Thu, 01 Jun 2017 13:00:00 GMT", "Date": "Thu, 01 Jun 2017 12:30:00 GMT"}, 30 * time.Minute, true},
+		{map[string]string{"Expires": "0"}, 0, true},
+	}
+	for _, tc := range testCases {
+		header := http.Header{}
+		for key, val := range tc.header {
+			header.Set(key, val)
+		}
+		lifetime, cached := cacheLifetime(header, now)
+		require.Equal(t, tc.cached, cached, "%v", tc.header)
+		require.Equal(t, tc.lifetime, lifetime, "%v", tc.header)
+	}
+
+	require.Equal(t, time.Hour, clampKeyRefresh(2*time.Hour, time.Hour))
+	require.Equal(t, minKeyRefresh, clampKeyRefresh(0, time.Hour))
+	require.Equal(t, time.Minute, clampKeyRefresh(time.Minute, time.Hour))
+}
+
+func TestJWKSKeySources(t *testing.T) {
+	issuer := newTestIssuer(t, "jwks-key")
+	defer issuer.keyserver.Close()
+
+	for _, source := range []map[string]interface{}{
+		{"jwksURL": issuer.keyserver.URL + "/jwks.json"},
+		{"discoveryURL": issuer.keyserver.URL},
+	} {
+		options := map[string]interface{}{
+			"realm":             "https://issuer.example.com",
+			"issuer":            issuer.keyserver.URL,
+			"service":           "test",
+			"updateKeyInterval": "1h",
+		}
+		for key, val := range source {
+			options[key] = val
+		}
+		ac, err := NewKeyserverAccessController(options)
+		require.NoError(t, err)
+		keyserverAC := ac.(*keyserverAccessController)
+		defer keyserverAC.Close()
+
+		require.NoError(t, keyserverAC.CheckHealth())
+		require.Contains(t, keyserverAC.keys, "jwks-key")
+		// the JWK set is refreshed when its cache headers say, rather than every updateKeyInterval
+		require.Equal(t, 5*time.Minute, keyserverAC.nextKeyUpdate())
+
+		ctx, err := authorize(ac, issuer.token(t, issuer.keyserver.URL, "https://issuer.example.com", "signer"))
+		require.NoError(t, err)
+		require.Equal(t, "signer", ctx.Value(TufRootSigner))
+
+		// keys that aren't in the JWK set are looked up by fetching it again
+		other := newTestIssuer(t, "other-key")
+		other.keyserver.Close()
+		_, err = authorize(ac, other.token(t, issuer.keyserver.URL, "https://issuer.example.com", "signer"))
+		require.Error(t, err)
+		_, err = keyserverAC.findKey("other-key")
+		require.IsType(t, errKeyNotFound{}, err)
+	}
+}
+
+func TestJWKSOptions(t *testing.T) {
+	options := map[string]interface{}{
+		"realm":             "realm",
+		"issuer":            "issuer",
+		"service":           "test",
+		"updateKeyInterval": "1h",
+	}
+	_, err := checkOptions(options)
+	require.Error(t, err)
+
+	options["jwksURL"] = "https://issuer.example.com/jwks.json"
+	_, err = checkOptions(options)
+	require.NoError(t, err)
+
+	options["keyserver"] = "https://quay.io/keys"
+	_, err = checkOptions(options)
+	require.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Defaults for looking up keys that aren't in the JWK set
+const (
+	defaultMissCacheTTL      = time.Minute
+	defaultMissCacheSize     = 1000
+	defaultMaxKeyLookups     = 10
+	defaultKeyLookupInterval = time.Second
+)
+
+// Results of looking up a key ID, as counted by keyLookups
+const (
+	lookupCached       = "cached"
+	lookupFound        = "found"
+	lookupNotFound     = "not_found"
+	lookupError        = "error"
+	lookupMissCached   = "miss_cached"
+	lookupDeduplicated = "deduplicated"
+	lookupRateLimited  = "rate_limited"
+)
+
+var (
+	keyLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "keyserver",
+		Name:      "key_lookups_total",
+		Help:      "Number of JWT key IDs looked up, by result.",
+	}, []string{"result"})
+	missCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "apostille",
+		Subsystem: "keyserver",
+		Name:      "miss_cache_entries",
+		Help:      "Number of key IDs the keyserver is known not to have.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(keyLookups)
+	prometheus.MustRegister(missCacheEntries)
+}
+
+// errKeyNotFound is returned for key IDs that the keyserver doesn't have. Only these are cached as misses; other
+// errors may be transient.
+type errKeyNotFound struct {
+	keyID  string
+	reason string
+}
+
+func (err errKeyNotFound) Error() string {
+	return fmt.Sprintf("unknown key %s: %s", err.keyID, err.reason)
+}
+
+// keyLookup is a lookup of a key ID from the keyserver that other requests for the same key ID can wait for
+type keyLookup struct {
+	done chan struct{}
+	key  *jose.JSONWebKey
+	err  error
+}
+
+// keyLookupLimits bounds how key IDs that aren't in the JWK set are looked up from the keyserver
+type keyLookupLimits struct {
+	// missCacheTTL is how long a key ID the keyserver doesn't have is remembered
+	missCacheTTL time.Duration
+	// missCacheSize is how many key IDs the keyserver doesn't have are remembered
+	missCacheSize int
+	// maxKeyLookups is how many key IDs may be looked up from the keyserver per keyLookupInterval; 0 disables lookups
+	maxKeyLookups int
+	// keyLookupInterval is the interval maxKeyLookups applies to
+	keyLookupInterval time.Duration
+}
+
+// keyLookupGroup deduplicates, rate limits and caches misses of key ID lookups from the keyserver
+type keyLookupGroup struct {
+	keyLookupLimits
+	lock        sync.Mutex
+	misses      map[string]time.Time
+	inFlight    map[string]*keyLookup
+	windowStart time.Time
+	windowCount int
+}
+
+// findKey returns the key for a key ID, from the JWK set if it is there and from the keyserver otherwise.
+// Keys found on the keyserver are added to the JWK set until it is next refreshed.
+func (ac *keyserverAccessController) findKey(keyID string) (*jose.JSONWebKey, error) {
+	ac.keysLock.RLock()
+	key, ok := ac.keys[keyID]
+	ac.keysLock.RUnlock()
+	if ok {
+		keyLookups.WithLabelValues(lookupCached).Inc()
+		return key, nil
+	}
+
+	lookup, started, err := ac.lookups.start(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if !started {
+		keyLookups.WithLabelValues(lookupDeduplicated).Inc()
+		<-lookup.done
+		return lookup.key, lookup.err
+	}
+
+	lookup.key, lookup.err = ac.tryFindKey(keyID)
+	switch lookup.err.(type) {
+	case nil:
+		keyLookups.WithLabelValues(lookupFound).Inc()
+		ac.keysLock.Lock()
+		if ac.keys == nil {
+			ac.keys = make(map[string]*jose.JSONWebKey)
+		}
+		ac.keys[keyID] = lookup.key
+		ac.keysLock.Unlock()
+	case errKeyNotFound:
+		keyLookups.WithLabelValues(lookupNotFound).Inc()
+	default:
+		keyLookups.WithLabelValues(lookupError).Inc()
+	}
+	ac.lookups.finish(keyID, lookup)
+	return lookup.key, lookup.err
+}
+
+// start returns the lookup for a key ID, and whether the caller started it and so must finish it. It fails if the key
+// ID is a cached miss, or if too many lookups have been started recently.
+func (l *keyLookupGroup) start(keyID string) (*keyLookup, bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if expiry, ok := l.misses[keyID]; ok {
+		if now.Before(expiry) {
+			keyLookups.WithLabelValues(lookupMissCached).Inc()
+			return nil, false, errKeyNotFound{keyID: keyID, reason: "recently not found on keyserver"}
+		}
+		delete(l.misses, keyID)
+		missCacheEntries.Set(float64(len(l.misses)))
+	}
+	if lookup, ok := l.inFlight[keyID]; ok {
+		return lookup, false, nil
+	}
+
+	if now.Sub(l.windowStart) >= l.keyLookupInterval {
+		l.windowStart = now
+		l.windowCount = 0
+	}
+	if l.windowCount >= l.maxKeyLookups {
+		keyLookups.WithLabelValues(lookupRateLimited).Inc()
+		logrus.Warnf("not looking up key %s: more than %d key lookups in %v", keyID, l.maxKeyLookups, l.keyLookupInterval)
+		return nil, false, fmt.Errorf("too many key lookups, try again later")
+	}
+	l.windowCount++
+
+	if l.inFlight == nil {
+		l.inFlight = make(map[string]*keyLookup)
+	}
+	lookup := &keyLookup{done: make(chan struct{})}
+	l.inFlight[keyID] = lookup
+	return lookup, true, nil
+}
+
+// finish records the result of a lookup, and wakes anything waiting for it
+func (l *keyLookupGroup) finish(keyID string, lookup *keyLookup) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.inFlight, keyID)
+	close(lookup.done)
+	if _, ok := lookup.err.(errKeyNotFound); ok {
+		l.cacheMiss(keyID, time.Now())
+	}
+}
+
+// cacheMiss remembers that the keyserver doesn't have a key ID. If the cache is full, expired misses are dropped,
+// then the miss closest to expiring. The lock must be held.
+func (l *keyLookupGroup) cacheMiss(keyID string, now time.Time) {
+	if l.missCacheSize <= 0 {
+		return
+	}
+	if l.misses == nil {
+		l.misses = make(map[string]time.Time)
+	}
+	if len(l.misses) >= l.missCacheSize {
+		for id, expiry := range l.misses {
+			if !now.Before(expiry) {
+				delete(l.misses, id)
+			}
+		}
+	}
+	for len(l.misses) >= l.missCacheSize {
+		oldestID, oldest := "", time.Time{}
+		for id, expiry := range l.misses {
+			if oldestID == "" || expiry.Before(oldest) {
+				oldestID, oldest = id, expiry
+			}
+		}
+		delete(l.misses, oldestID)
+	}
+	l.misses[keyID] = now.Add(l.missCacheTTL)
+	missCacheEntries.Set(float64(len(l.misses)))
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// keyserverTestSetup serves jsonKeyID from a fake keyserver, and responds to other key IDs with `status`
+func keyserverTestSetup(t *testing.T, status int, limits keyLookupLimits) (*keyserverAccessController, *int32, *httptest.Server) {
+	var fetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if strings.HasSuffix(r.URL.Path, "/"+jsonKeyID) {
+			w.Write([]byte(validSingleJsonKey))
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	ac := &keyserverAccessController{
+		keyserver:  ts.URL,
+		service:    "test",
+		httpClient: http.DefaultClient,
+		lookups:    keyLookupGroup{keyLookupLimits: limits},
+	}
+	return ac, &fetches, ts
+}
+
+var testLookupLimits = keyLookupLimits{
+	missCacheTTL:      time.Hour,
+	missCacheSize:     10,
+	maxKeyLookups:     10,
+	keyLookupInterval: time.Hour,
+}
+
+func TestFindKeyCachesFoundKeys(t *testing.T) {
+	ac, fetches, ts := keyserverTestSetup(t, http.StatusNotFound, testLookupLimits)
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		key, err := ac.findKey(jsonKeyID)
+		require.NoError(t, err)
+		require.Equal(t, jsonKeyID, key.KeyID)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(fetches))
+	require.Contains(t, ac.keys, jsonKeyID)
+}
+
+func TestFindKeyCachesMisses(t *testing.T) {
+	limits := testLookupLimits
+	limits.missCacheTTL = 50 * time.Millisecond
+	ac, fetches, ts := keyserverTestSetup(t, http.StatusNotFound, limits)
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := ac.findKey("unknown")
+		require.IsType(t, errKeyNotFound{}, err)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(fetches))
+
+	// misses expire
+	time.Sleep(100 * time.Millisecond)
+	_, err := ac.findKey("unknown")
+	require.Error(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(fetches))
+}
+
+func TestFindKeyDoesNotCacheErrors(t *testing.T) {
+	ac, fetches, ts := keyserverTestSetup(t, http.StatusInternalServerError, testLookupLimits)
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := ac.findKey("unknown")
+		require.Error(t, err)
+		require.NotEqual(t, errKeyNotFound{}, err)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(fetches))
+}
+
+func TestFindKeyRateLimited(t *testing.T) {
+	limits := testLookupLimits
+	limits.maxKeyLookups = 2
+	ac, fetches, ts := keyserverTestSetup(t, http.StatusNotFound, limits)
+	defer ts.Close()
+
+	for _, keyID := range []string{"one", "two", "three", "four"} {
+		ac.findKey(keyID)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(fetches))
+
+	// keys already in the JWK set don't count against the limit
+	ac.keys = map[string]*jose.JSONWebKey{jsonKeyID: {KeyID: jsonKeyID}}
+	_, err := ac.findKey(jsonKeyID)
+	require.NoError(t, err)
+
+	// the limit applies per interval
+	ac.lookups.keyLookupInterval = time.Nanosecond
+	_, err = ac.findKey("five")
+	require.IsType(t, errKeyNotFound{}, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(fetches))
+}
+
+func TestFindKeyDeduplicatesLookups(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.Write([]byte(validSingleJsonKey))
+	}))
+	defer ts.Close()
+	ac := &keyserverAccessController{
+		keyserver:  ts.URL,
+		service:    "test",
+		httpClient: http.DefaultClient,
+		lookups:    keyLookupGroup{keyLookupLimits: testLookupLimits},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := ac.findKey(jsonKeyID)
+			require.NoError(t, err)
+			require.Equal(t, jsonKeyID, key.KeyID)
+		}()
+	}
+	for atomic.LoadInt32(&fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// give the other lookups time to find the one in flight
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestCacheMissIsBounded(t *testing.T) {
+	lookups := keyLookupGroup{keyLookupLimits: keyLookupLimits{missCacheTTL: time.Minute, missCacheSize: 2}}
+	now := time.Now()
+	lookups.cacheMiss("one", now)
+	lookups.cacheMiss("two", now.Add(time.Second))
+	lookups.cacheMiss("three", now.Add(2*time.Second))
+	require.Len(t, lookups.misses, 2)
+	require.NotContains(t, lookups.misses, "one")
+
+	// expired misses are dropped first
+	lookups.cacheMiss("four", now.Add(time.Hour))
+	require.Len(t, lookups.misses, 1)
+	require.Contains(t, lookups.misses, "four")
+}
@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,7 @@ import (
 	"github.com/docker/distribution/context"
 	registryAuth "github.com/docker/distribution/registry/auth"
 	registryToken "github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/go-connections/tlsconfig"
 	jose "gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -22,15 +25,43 @@ import (
 const TufRootSigner string = "com.apostille.root"
 const TufDisabled string = "$disabled"
 
+// TokenKind is the context key for the kind of token a request was authorized with
+const TokenKind string = "com.apostille.kind"
+
+// Defaults for the optional keyserver options
+const (
+	// defaultKeyserverTimeout is how long a request to the keyserver may take
+	defaultKeyserverTimeout = 10 * time.Second
+	// defaultMaxKeyAgeIntervals is how many refresh intervals the JWK set may go without being fetched before the
+	// access controller is reported unhealthy
+	defaultMaxKeyAgeIntervals = 3
+)
+
+// minUpdateKeyBackoff is how long to wait before retrying the first failed fetch of the JWK set. Each further failure
+// doubles the wait, up to the refresh interval.
+var minUpdateKeyBackoff = time.Second
+
 // keyserverAccessController implements the auth.AccessController interface.
 type keyserverAccessController struct {
 	realm             string
 	issuer            string
 	service           string
+	audience          string
+	allowedRoots      []string
 	keyserver         string
+	jwksURL           string
+	discoveryURL      string
 	updateKeyInterval time.Duration
+	maxKeyAge         time.Duration
+	httpClient        *http.Client
 	keysLock          sync.RWMutex
 	keys              map[string]*jose.JSONWebKey
+	keysUpdated       time.Time
+	keysRefresh       time.Duration
+	discoveredJWKSURL string
+	lookups           keyLookupGroup
+	stop              chan struct{}
+	stopOnce          sync.Once
 }
 
 // tokenAccessOptions is a convenience type for handling
@@ -39,8 +70,16 @@ type tokenAccessOptions struct {
 	realm             string
 	issuer            string
 	service           string
+	audience          string
+	allowedRoots      []string
 	keyserver         string
+	jwksURL           string
+	discoveryURL      string
 	updateKeyInterval time.Duration
+	maxKeyAge         time.Duration
+	timeout           time.Duration
+	tlsConfig         *tls.Config
+	keyLookupLimits
 }
 
 type Keys struct {
@@ -62,7 +101,7 @@ type ContextClaim struct {
 func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	var opts tokenAccessOptions
 
-	keys := []string{"realm", "issuer", "service", "keyserver", "updateKeyInterval"}
+	keys := []string{"realm", "issuer", "service", "updateKeyInterval"}
 	vals := make([]string, 0, len(keys))
 	for _, key := range keys {
 		val, ok := options[key].(string)
@@ -72,66 +111,262 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 		vals = append(vals, val)
 	}
 
-	val, err := time.ParseDuration(vals[4])
+	val, err := time.ParseDuration(vals[3])
 	if err != nil {
 		return opts, fmt.Errorf("invalid duration specified for key refresh interval: %s",
 			err.Error())
 	}
 
-	opts.realm, opts.issuer, opts.service, opts.keyserver = vals[0], vals[1], vals[2], vals[3]
+	opts.realm, opts.issuer, opts.service = vals[0], vals[1], vals[2]
 	opts.updateKeyInterval = val
+
+	// the rest of the options are optional
+	optional := func(key string) (string, error) {
+		val, ok := options[key]
+		if !ok {
+			return "", nil
+		}
+		str, ok := val.(string)
+		if !ok {
+			return "", fmt.Errorf("quay token auth option %q must be a string", key)
+		}
+		return str, nil
+	}
+
+	// keys come from a quay keyserver, a plain JWK set, or the JWK set of an OpenID provider
+	sources := 0
+	for key, val := range map[string]*string{
+		"keyserver":    &opts.keyserver,
+		"jwksURL":      &opts.jwksURL,
+		"discoveryURL": &opts.discoveryURL,
+	} {
+		if *val, err = optional(key); err != nil {
+			return opts, err
+		}
+		if *val != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return opts, fmt.Errorf("quay token auth requires exactly one of the options \"keyserver\", \"jwksURL\" and \"discoveryURL\"")
+	}
+
+	durations := []struct {
+		key          string
+		defaultValue time.Duration
+		val          *time.Duration
+	}{
+		{"timeout", defaultKeyserverTimeout, &opts.timeout},
+		{"maxKeyAge", defaultMaxKeyAgeIntervals * opts.updateKeyInterval, &opts.maxKeyAge},
+		{"missCacheTTL", defaultMissCacheTTL, &opts.missCacheTTL},
+		{"keyLookupInterval", defaultKeyLookupInterval, &opts.keyLookupInterval},
+	}
+	for _, duration := range durations {
+		str, err := optional(duration.key)
+		if err != nil {
+			return opts, err
+		}
+		*duration.val = duration.defaultValue
+		if str == "" {
+			continue
+		}
+		if *duration.val, err = time.ParseDuration(str); err != nil || *duration.val <= 0 {
+			return opts, fmt.Errorf("invalid duration specified for %s: %s", duration.key, str)
+		}
+	}
+
+	counts := []struct {
+		key          string
+		defaultValue int
+		val          *int
+	}{
+		{"missCacheSize", defaultMissCacheSize, &opts.missCacheSize},
+		{"maxKeyLookups", defaultMaxKeyLookups, &opts.maxKeyLookups},
+	}
+	for _, count := range counts {
+		str, err := optional(count.key)
+		if err != nil {
+			return opts, err
+		}
+		*count.val = count.defaultValue
+		if str == "" {
+			continue
+		}
+		if *count.val, err = strconv.Atoi(str); err != nil || *count.val < 0 {
+			return opts, fmt.Errorf("invalid count specified for %s: %s", count.key, str)
+		}
+	}
+
+	// tokens are expected to be issued for the realm, unless another audience is configured
+	if opts.audience, err = optional("audience"); err != nil {
+		return opts, err
+	}
+	if opts.audience == "" {
+		opts.audience = opts.realm
+	}
+	if opts.allowedRoots, err = stringList(options, "allowedRoots"); err != nil {
+		return opts, err
+	}
+
+	tlsOpts := tlsconfig.Options{}
+	for key, val := range map[string]*string{
+		"caBundle":      &tlsOpts.CAFile,
+		"tlsClientCert": &tlsOpts.CertFile,
+		"tlsClientKey":  &tlsOpts.KeyFile,
+	} {
+		if *val, err = optional(key); err != nil {
+			return opts, err
+		}
+	}
+	if (tlsOpts.CertFile == "") != (tlsOpts.KeyFile == "") {
+		return opts, fmt.Errorf("quay token auth requires both tlsClientCert and tlsClientKey for client authentication")
+	}
+	if opts.tlsConfig, err = tlsconfig.Client(tlsOpts); err != nil {
+		return opts, err
+	}
 	return opts, nil
 }
 
-// NewKeyserverAccessController creates a keyserverAccessController using the given options.
+// stringList reads an optional auth option that lists strings, either as a list or as a comma-separated string
+func stringList(options map[string]interface{}, key string) ([]string, error) {
+	switch val := options[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if val == "" {
+			return nil, nil
+		}
+		return strings.Split(val, ","), nil
+	case []string:
+		return val, nil
+	case []interface{}:
+		list := make([]string, 0, len(val))
+		for _, item := range val {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("auth option %q must be a list of strings", key)
+			}
+			list = append(list, str)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("auth option %q must be a list of strings", key)
+	}
+}
+
+// NewKeyserverAccessController creates a keyserverAccessController using the given options. If the options list
+// `issuers`, an access controller that trusts each of them is created instead.
 func NewKeyserverAccessController(options map[string]interface{}) (registryAuth.AccessController, error) {
+	if _, ok := options["issuers"]; ok {
+		return newMultiIssuerAccessController(options)
+	}
 	config, err := checkOptions(options)
 	if err != nil {
 		return nil, err
 	}
+	return newKeyserverAccessController(config), nil
+}
+
+// newKeyserverAccessController creates a keyserverAccessController, and starts fetching keys from its keyserver
+func newKeyserverAccessController(config tokenAccessOptions) *keyserverAccessController {
 	accessController := &keyserverAccessController{
 		realm:             config.realm,
 		issuer:            config.issuer,
 		service:           config.service,
+		audience:          config.audience,
+		allowedRoots:      config.allowedRoots,
 		keyserver:         config.keyserver,
+		jwksURL:           config.jwksURL,
+		discoveryURL:      config.discoveryURL,
 		updateKeyInterval: config.updateKeyInterval,
+		maxKeyAge:         config.maxKeyAge,
+		httpClient: &http.Client{
+			Timeout:   config.timeout,
+			Transport: &http.Transport{TLSClientConfig: config.tlsConfig},
+		},
+		lookups: keyLookupGroup{keyLookupLimits: config.keyLookupLimits},
+		stop:    make(chan struct{}),
 	}
-	accessController.updateKeys()
-	go func() {
-		for {
-			select {
-			case <-time.After(accessController.updateKeyInterval):
-				logrus.Debug("performing fetch of JWKs")
-				accessController.updateKeys()
-			}
+	err := accessController.updateKeys()
+	go accessController.refreshKeys(err)
+	return accessController
+}
+
+// refreshKeys periodically fetches the JWK set until the access controller is closed. Failed fetches are retried with
+// exponential backoff; `err` is the result of the fetch before it was started.
+func (ac *keyserverAccessController) refreshKeys(err error) {
+	failures := 0
+	for {
+		wait := ac.nextKeyUpdate()
+		if err != nil {
+			failures++
+			wait = updateKeyBackoff(failures, ac.updateKeyInterval)
+			logrus.Warnf("failed to fetch JWKs %d times in a row, retrying in %v", failures, wait)
+		} else {
+			failures = 0
 		}
-	}()
-	return accessController, nil
+
+		select {
+		case <-time.After(wait):
+			logrus.Debug("performing fetch of JWKs")
+			err = ac.updateKeys()
+		case <-ac.stop:
+			logrus.Debug("stopped fetching JWKs")
+			return
+		}
+	}
+}
+
+// updateKeyBackoff is how long to wait before retrying after `failures` failed fetches of the JWK set in a row
+func updateKeyBackoff(failures int, limit time.Duration) time.Duration {
+	backoff := minUpdateKeyBackoff
+	for i := 1; i < failures && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		return limit
+	}
+	return backoff
+}
+
+// CheckHealth reports an error if the JWK set hasn't been fetched successfully within the maximum key age, since
+// tokens signed by new keys can't be verified until it is.
+func (ac *keyserverAccessController) CheckHealth() error {
+	ac.keysLock.RLock()
+	defer ac.keysLock.RUnlock()
+	if ac.keysUpdated.IsZero() {
+		return fmt.Errorf("JWK set has not been fetched from %s", ac.keySource())
+	}
+	if age := time.Since(ac.keysUpdated); age > ac.maxKeyAge {
+		return fmt.Errorf("JWK set was last fetched from %s %v ago", ac.keySource(), age)
+	}
+	return nil
+}
+
+// Close stops periodically fetching keys from the keyserver.
+func (ac *keyserverAccessController) Close() error {
+	ac.stopOnce.Do(func() {
+		close(ac.stop)
+	})
+	return nil
 }
 
 // Authorized handles checking whether the given request is authorized
 // for actions on resources described by the given access items.
 func (ac *keyserverAccessController) Authorized(ctx context.Context, accessItems ...registryAuth.Access) (context.Context, error) {
-	challenge := &authChallenge{
-		realm:     ac.realm,
-		service:   ac.service,
-		accessSet: newAccessSet(accessItems...),
-	}
+	challenge := ac.challenge(nil, accessItems)
 
 	req, err := context.GetRequest(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	parts := strings.Split(req.Header.Get("Authorization"), " ")
-
-	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+	rawToken, ok := bearerToken(req)
+	if !ok {
 		challenge.err = registryToken.ErrTokenRequired
 		return nil, challenge
 	}
 
-	rawToken := parts[1]
-
 	token, err := jwt.ParseSigned(rawToken)
 	if err != nil {
 		challenge.err = err
@@ -143,19 +378,9 @@ func (ac *keyserverAccessController) Authorized(ctx context.Context, accessItems
 	}
 	keyID := token.Headers[0].KeyID
 
-	ac.keysLock.RLock()
-	pubKey, ok := ac.keys[keyID]
-	ac.keysLock.RUnlock()
-	if !ok {
-		pubKey, err = ac.tryFindKey(keyID)
-		if err != nil {
-			challenge.err = err
-			return nil, challenge
-		}
-	}
-
+	pubKey, err := ac.findKey(keyID)
 	if err != nil {
-		challenge.err = fmt.Errorf("unable to decode JWK value: %s", err)
+		challenge.err = err
 		return nil, challenge
 	}
 
@@ -168,7 +393,7 @@ func (ac *keyserverAccessController) Authorized(ctx context.Context, accessItems
 	}
 	if err := claims.ValidateWithLeeway(jwt.Expected{
 		Issuer:   ac.issuer,
-		Audience: []string{ac.realm},
+		Audience: []string{ac.audience},
 	}, Leeway); err != nil {
 		challenge.err = err
 		return nil, challenge
@@ -187,10 +412,46 @@ func (ac *keyserverAccessController) Authorized(ctx context.Context, accessItems
 		challenge.err = errors.New("trust not enabled for repo")
 		return nil, challenge
 	}
+	if !ac.allowsRoot(tokenContext.Context.TufRootSigner) {
+		challenge.err = fmt.Errorf("issuer %s is not allowed to pick the %q root", ac.issuer, tokenContext.Context.TufRootSigner)
+		return nil, challenge
+	}
 
+	user := tokenContext.Context.User
+	if user == "" {
+		user = claims.Subject
+	}
+	if user != "" {
+		ctx = registryAuth.WithUser(ctx, registryAuth.UserInfo{Name: user})
+	}
+	ctx = context.WithValue(ctx, TokenKind, tokenContext.Context.Kind)
 	return context.WithValue(ctx, TufRootSigner, tokenContext.Context.TufRootSigner), nil
 }
 
+// challenge creates the challenge for a request this access controller doesn't authorize
+func (ac *keyserverAccessController) challenge(err error, accessItems []registryAuth.Access) *authChallenge {
+	return &authChallenge{
+		err:       err,
+		realm:     ac.realm,
+		service:   ac.service,
+		accessSet: newAccessSet(accessItems...),
+	}
+}
+
+// allowsRoot is true if tokens from this issuer may pick the named TUF root. Any root is allowed unless the allowed
+// roots are configured.
+func (ac *keyserverAccessController) allowsRoot(root string) bool {
+	if len(ac.allowedRoots) == 0 {
+		return true
+	}
+	for _, allowed := range ac.allowedRoots {
+		if allowed == root {
+			return true
+		}
+	}
+	return false
+}
+
 // AccessSet returns a set of actions available for the resource
 // actions listed in the `access` section of the token.
 func AccessSet(claim AccessClaim) accessSet {
@@ -217,14 +478,24 @@ func AccessSet(claim AccessClaim) accessSet {
 }
 
 func (ac *keyserverAccessController) updateKeys() error {
-	url := fmt.Sprintf("%s/services/%s/keys", ac.keyserver, ac.service)
+	url, err := ac.keySetURL()
+	if err != nil {
+		logrus.Errorln("failed to discover JWK Set: " + err.Error())
+		return err
+	}
 	logrus.Infof("fetching jwk from keyserver: %s", url)
-	resp, err := http.Get(url)
+	resp, err := ac.httpClient.Get(url)
 	if err != nil {
 		logrus.Errorln("failed to fetch JWK Set: " + err.Error())
+		ac.forgetKeySetURL()
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logrus.Errorf("failed to fetch JWK Set: keyserver responded %s", resp.Status)
+		ac.forgetKeySetURL()
+		return fmt.Errorf("keyserver responded %s", resp.Status)
+	}
 
 	var maybeKeys Keys
 
@@ -257,22 +528,38 @@ func (ac *keyserverAccessController) updateKeys() error {
 	if len(keys) == 0 {
 		return fmt.Errorf("no valid keys found")
 	}
+	// plain JWK sets are refreshed when their cache headers say they expire
+	var refresh time.Duration
+	if lifetime, ok := cacheLifetime(resp.Header, time.Now()); ok && ac.keyserver == "" {
+		refresh = clampKeyRefresh(lifetime, ac.updateKeyInterval)
+	}
 	ac.keysLock.Lock()
 	ac.keys = keys
+	ac.keysUpdated = time.Now()
+	ac.keysRefresh = refresh
 	ac.keysLock.Unlock()
 	logrus.Infof("successfully fetched JWK Set: %d keys", len(keys))
 	return nil
 }
 
 func (ac *keyserverAccessController) tryFindKey(keyId string) (*jose.JSONWebKey, error) {
+	if ac.keyserver == "" {
+		return ac.findKeyInKeySet(keyId)
+	}
 	url := fmt.Sprintf("%s/services/%s/keys/%s", ac.keyserver, ac.service, keyId)
 	logrus.Infof("fetching jwk from keyserver: %s", url)
 
-	resp, err := http.Get(url)
+	resp, err := ac.httpClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errKeyNotFound{keyID: keyId, reason: "not found on keyserver"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keyserver responded %s for key %s", resp.Status, keyId)
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -286,7 +573,7 @@ func (ac *keyserverAccessController) tryFindKey(keyId string) (*jose.JSONWebKey,
 	}
 
 	if !jwk.Valid() {
-		return nil, fmt.Errorf("JWK invalid: %v", jwk)
+		return nil, errKeyNotFound{keyID: keyId, reason: fmt.Sprintf("JWK invalid: %v", jwk)}
 	}
 
 	return &jwk, nil
@@ -1,8 +1,13 @@
 package auth
 
 import (
+	"encoding/pem"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -73,6 +78,35 @@ func TestTryFindKeyBadUrl(t *testing.T) {
 	ts.Close()
 }
 
+func TestKeyServerAccessControllerClose(t *testing.T) {
+	var fetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(validJsonKeys))
+	}))
+	defer ts.Close()
+
+	ac, err := NewKeyserverAccessController(map[string]interface{}{
+		"realm":             "realm",
+		"issuer":            "issuer",
+		"service":           "test",
+		"keyserver":         ts.URL,
+		"updateKeyInterval": "10ms",
+	})
+	require.NoError(t, err)
+	closer, ok := ac.(io.Closer)
+	require.True(t, ok)
+	require.NoError(t, closer.Close())
+	// closing twice is harmless
+	require.NoError(t, closer.Close())
+
+	// let any fetch that was in progress when it was closed finish
+	time.Sleep(50 * time.Millisecond)
+	stopped := atomic.LoadInt32(&fetches)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, stopped, atomic.LoadInt32(&fetches))
+}
+
 func TestCheckOptions(t *testing.T) {
 	testCases := []testCase{
 		{"", "quay token auth requires a valid option string"},
@@ -107,8 +141,109 @@ func httpTestSetup(tc testCase) (keyserverAccessController, *httptest.Server) {
 
 	}))
 	ac := keyserverAccessController{
-		keyserver: ts.URL,
-		service:   "test",
+		keyserver:  ts.URL,
+		service:    "test",
+		httpClient: http.DefaultClient,
 	}
 	return ac, ts
 }
+
+func TestCheckOptionalOptions(t *testing.T) {
+	config := map[string]interface{}{
+		"realm":             "realm",
+		"issuer":            "issuer",
+		"service":           "service",
+		"keyserver":         "keyserver",
+		"updateKeyInterval": "1m",
+	}
+	opt, err := checkOptions(config)
+	require.NoError(t, err)
+	require.Equal(t, defaultKeyserverTimeout, opt.timeout)
+	require.Equal(t, 3*time.Minute, opt.maxKeyAge)
+	require.Nil(t, opt.tlsConfig.RootCAs)
+
+	config["timeout"] = "5s"
+	config["maxKeyAge"] = "1h"
+	config["caBundle"] = "../vendor/github.com/docker/notary/fixtures/root-ca.crt"
+	opt, err = checkOptions(config)
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, opt.timeout)
+	require.Equal(t, time.Hour, opt.maxKeyAge)
+	require.NotNil(t, opt.tlsConfig.RootCAs)
+
+	invalids := []map[string]interface{}{
+		{"timeout": "soon"},
+		{"timeout": "-1s"},
+		{"maxKeyAge": 5},
+		{"caBundle": "/does/not/exist"},
+		{"tlsClientCert": "../vendor/github.com/docker/notary/fixtures/notary-server.crt"},
+	}
+	for _, invalid := range invalids {
+		invalidConfig := map[string]interface{}{}
+		for key, val := range config {
+			invalidConfig[key] = val
+		}
+		for key, val := range invalid {
+			invalidConfig[key] = val
+		}
+		_, err := checkOptions(invalidConfig)
+		require.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestUpdateKeyBackoff(t *testing.T) {
+	require.Equal(t, time.Second, updateKeyBackoff(1, time.Minute))
+	require.Equal(t, 2*time.Second, updateKeyBackoff(2, time.Minute))
+	require.Equal(t, 32*time.Second, updateKeyBackoff(6, time.Minute))
+	require.Equal(t, time.Minute, updateKeyBackoff(7, time.Minute))
+	require.Equal(t, time.Minute, updateKeyBackoff(100, time.Minute))
+}
+
+func TestKeyServerAccessControllerRetriesAndHealth(t *testing.T) {
+	defer func(backoff time.Duration) { minUpdateKeyBackoff = backoff }(minUpdateKeyBackoff)
+	minUpdateKeyBackoff = 10 * time.Millisecond
+
+	// the keyserver fails the first fetches, and uses a certificate that is only trusted through the CA bundle
+	var fetches int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(validJsonKeys))
+	}))
+	defer ts.Close()
+	caBundle, err := ioutil.TempFile("", "keyserver-ca")
+	require.NoError(t, err)
+	defer os.Remove(caBundle.Name())
+	require.NoError(t, pem.Encode(caBundle, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+	require.NoError(t, caBundle.Close())
+
+	ac, err := NewKeyserverAccessController(map[string]interface{}{
+		"realm":             "realm",
+		"issuer":            "issuer",
+		"service":           "test",
+		"keyserver":         ts.URL,
+		"updateKeyInterval": "1h",
+		"caBundle":          caBundle.Name(),
+	})
+	require.NoError(t, err)
+	defer ac.(io.Closer).Close()
+	checker := ac.(HealthChecker)
+	require.Error(t, checker.CheckHealth())
+
+	// failures are retried long before the refresh interval
+	deadline := time.Now().Add(5 * time.Second)
+	for checker.CheckHealth() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, checker.CheckHealth())
+	require.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+
+	// keys that haven't been fetched within the max key age are stale
+	keyserverAC := ac.(*keyserverAccessController)
+	keyserverAC.keysLock.Lock()
+	keyserverAC.keysUpdated = time.Now().Add(-4 * time.Hour)
+	keyserverAC.keysLock.Unlock()
+	require.Error(t, checker.CheckHealth())
+}
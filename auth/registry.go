@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+)
+
+// The access controllers apostille provides, in addition to the ones registered by docker distribution
+// (such as "htpasswd" and "token")
+const (
+	// KeyserverAuth authenticates quay tokens, which name the TUF root to use
+	KeyserverAuth = "quaytoken"
+	// TestingAuth authorizes every request for the signer root
+	TestingAuth = "testing"
+	// AdminAuth authorizes every request for the admin root
+	AdminAuth = "admin"
+	// AdminCertAuth authorizes requests with an allowed client certificate for the admin root
+	AdminCertAuth = "admincert"
+)
+
+func init() {
+	registryAuth.Register(KeyserverAuth, NewKeyserverAccessController)
+	registryAuth.Register(TestingAuth, func(map[string]interface{}) (registryAuth.AccessController, error) {
+		logrus.Warn("Test Auth config enabled - all requests will be authorized as user 'test_user'")
+		return NewConstantAccessController("signer"), nil
+	})
+	registryAuth.Register(AdminAuth, func(map[string]interface{}) (registryAuth.AccessController, error) {
+		return NewConstantAccessController("admin"), nil
+	})
+	registryAuth.Register(AdminCertAuth, NewCertAccessController)
+}
+
+// HealthChecker is implemented by access controllers that depend on other services, such as a keyserver
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// RootMapping picks the TUF root for identities authenticated by access controllers that don't choose one themselves
+type RootMapping struct {
+	// Default is the TUF root for users that aren't listed in Users. If it is empty, those users get no TUF root.
+	Default string
+	// Users maps user names to TUF roots
+	Users map[string]string
+}
+
+// IsEmpty is true if the mapping never picks a TUF root
+func (m RootMapping) IsEmpty() bool {
+	return m.Default == "" && len(m.Users) == 0
+}
+
+// Root returns the TUF root for a user
+func (m RootMapping) Root(user string) string {
+	if root, ok := m.Users[user]; ok {
+		return root
+	}
+	return m.Default
+}
+
+// GetAccessController creates the access controller registered as `name`. `options` must be a map, as parsed from
+// `auth.options`. If the mapping isn't empty, the access controller's authenticated identities are mapped to TUF roots.
+func GetAccessController(name string, options interface{}, mapping RootMapping) (registryAuth.AccessController, error) {
+	if name == "" {
+		return nil, fmt.Errorf("No auth config supplied - use 'testing' if mock auth is desired")
+	}
+	authOptions := map[string]interface{}{}
+	if options != nil {
+		var ok bool
+		if authOptions, ok = options.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("auth.options must be a map[string]interface{}")
+		}
+	}
+	ac, err := registryAuth.GetAccessController(name, authOptions)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.IsEmpty() {
+		return ac, nil
+	}
+	return NewRootMappingAccessController(ac, mapping), nil
+}
+
+// RootMappingAccessController wraps an access controller that doesn't know about TUF roots, such as docker
+// distribution's htpasswd and token access controllers, and picks the TUF root for the user it authenticates
+type RootMappingAccessController struct {
+	registryAuth.AccessController
+	mapping RootMapping
+}
+
+// NewRootMappingAccessController creates a RootMappingAccessController
+func NewRootMappingAccessController(ac registryAuth.AccessController, mapping RootMapping) *RootMappingAccessController {
+	return &RootMappingAccessController{
+		AccessController: ac,
+		mapping:          mapping,
+	}
+}
+
+// Authorized authorizes the request with the wrapped access controller, and adds the TUF root of the authenticated
+// user unless the wrapped access controller already picked one.
+func (ac *RootMappingAccessController) Authorized(ctx context.Context, accessItems ...registryAuth.Access) (context.Context, error) {
+	ctx, err := ac.AccessController.Authorized(ctx, accessItems...)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Value(TufRootSigner) != nil {
+		return ctx, nil
+	}
+
+	user, _ := ctx.Value(registryAuth.UserNameKey).(string)
+	root := ac.mapping.Root(user)
+	switch root {
+	case "":
+		return ctx, nil
+	case TufDisabled:
+		return nil, errors.New("trust not enabled for user")
+	}
+	return context.WithValue(ctx, TufRootSigner, root), nil
+}
+
+// Close stops any background work the wrapped access controller does
+func (ac *RootMappingAccessController) Close() error {
+	if closer, ok := ac.AccessController.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// CheckHealth checks the health of the wrapped access controller, if it can be checked
+func (ac *RootMappingAccessController) CheckHealth() error {
+	if checker, ok := ac.AccessController.(HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+	_ "github.com/docker/distribution/registry/auth/htpasswd"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGetAccessController(t *testing.T) {
+	for name, root := range map[string]string{TestingAuth: "signer", AdminAuth: "admin"} {
+		ac, err := GetAccessController(name, nil, RootMapping{})
+		require.NoError(t, err)
+		require.Equal(t, root, ac.(*ConstantAccessController).TUFRoot)
+	}
+
+	_, err := GetAccessController("", nil, RootMapping{})
+	require.Error(t, err)
+	_, err = GetAccessController("nope", nil, RootMapping{})
+	require.Error(t, err)
+	_, err = GetAccessController(KeyserverAuth, "not a map", RootMapping{})
+	require.Error(t, err)
+}
+
+func TestRootMappingAccessController(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apostille-htpasswd")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	htpasswd := ""
+	for _, user := range []string{"signer", "disabled", "other"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+		require.NoError(t, err)
+		htpasswd += user + ":" + string(hash) + "\n"
+	}
+	path := filepath.Join(tmpDir, "htpasswd")
+	require.NoError(t, ioutil.WriteFile(path, []byte(htpasswd), 0600))
+
+	ac, err := GetAccessController("htpasswd", map[string]interface{}{"realm": "apostille", "path": path}, RootMapping{
+		Default: "quay",
+		Users:   map[string]string{"signer": "signer", "disabled": TufDisabled},
+	})
+	require.NoError(t, err)
+	require.IsType(t, &RootMappingAccessController{}, ac)
+
+	authorize := func(user, password string) (context.Context, error) {
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth(user, password)
+		return ac.Authorized(context.WithRequest(context.Background(), req))
+	}
+
+	ctx, err := authorize("signer", "password")
+	require.NoError(t, err)
+	require.Equal(t, "signer", ctx.Value(TufRootSigner))
+	require.Equal(t, "signer", ctx.Value(registryAuth.UserNameKey))
+
+	ctx, err = authorize("other", "password")
+	require.NoError(t, err)
+	require.Equal(t, "quay", ctx.Value(TufRootSigner))
+
+	_, err = authorize("disabled", "password")
+	require.Error(t, err)
+	_, err = authorize("signer", "wrong")
+	require.Error(t, err)
+
+	// access controllers that pick a TUF root keep it
+	ac = NewRootMappingAccessController(NewConstantAccessController("admin"), RootMapping{Default: "quay"})
+	ctx, err = ac.Authorized(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "admin", ctx.Value(TufRootSigner))
+}
@@ -2,33 +2,43 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/coreos-inc/apostille/audit"
+	"github.com/coreos-inc/apostille/auth"
 	"github.com/coreos-inc/apostille/server"
+	"github.com/coreos-inc/apostille/signerpool"
+	"github.com/coreos-inc/apostille/simplesigning"
 	"github.com/coreos-inc/apostille/storage"
+	"github.com/coreos-inc/apostille/webhook"
 	"github.com/docker/distribution/health"
 	_ "github.com/docker/distribution/registry/auth/htpasswd"
 	_ "github.com/docker/distribution/registry/auth/token"
 	"github.com/docker/go-connections/tlsconfig"
 	"github.com/docker/notary"
+	"github.com/docker/notary/cryptoservice"
+	"github.com/docker/notary/passphrase"
 	notaryStorage "github.com/docker/notary/server/storage"
 	"github.com/docker/notary/signer/client"
+	"github.com/docker/notary/signer/keydbstore"
+	"github.com/docker/notary/trustmanager"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/signed"
+	tufutils "github.com/docker/notary/tuf/utils"
 	"github.com/docker/notary/utils"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 
-	"encoding/json"
-
-	"github.com/docker/notary/cryptoservice"
-	"github.com/docker/notary/tuf"
-	tufUtils "github.com/docker/notary/tuf/utils"
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
 )
@@ -40,14 +50,149 @@ const (
 // getRequiredGunPrevixes returns the required gun prefixes accepted by this server
 func getRequiredGunPrefixes(configuration *viper.Viper) ([]string, error) {
 	prefixes := configuration.GetStringSlice("repositories.gun_prefixes")
+	if err := checkGunPrefixes(prefixes); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// checkGunPrefixes checks that GUN prefixes are in the correct format
+func checkGunPrefixes(prefixes []string) error {
 	for _, prefix := range prefixes {
-		// Check that GUN prefixes are in the correct format
 		p := path.Clean(strings.TrimSpace(prefix))
 		if p+"/" != prefix || strings.HasPrefix(p, "/") || strings.HasPrefix(p, "..") {
-			return nil, fmt.Errorf("invalid GUN prefix %s", prefix)
+			return fmt.Errorf("invalid GUN prefix %s", prefix)
 		}
 	}
-	return prefixes, nil
+	return nil
+}
+
+// alternateRootOptions is the configuration for a single entry in `alternate_roots`
+type alternateRootOptions struct {
+	Name      string
+	ChannelID uint     `mapstructure:"channel_id"`
+	RootGUN   string   `mapstructure:"rootGUN"`
+	Prefixes  []string `mapstructure:"gun_prefixes"`
+	RootFile  string   `mapstructure:"root_file"`
+	RootCert  string   `mapstructure:"root_cert"`
+}
+
+// getAlternateRoots parses the alternate roots that signer-rooted metadata is swizzled under. If `alternate_roots`
+// is not set, there is a single root named "quay", stored under `root_storage.rootGUN`, that applies to every GUN.
+// Each root's channel must exist in the channels table of SQL backends.
+func getAlternateRoots(configuration *viper.Viper) ([]storage.AlternateRootConfig, error) {
+	if !configuration.IsSet("alternate_roots") {
+		return []storage.AlternateRootConfig{
+			{
+				Name:    storage.DefaultAlternateRootName,
+				Channel: storage.AlternateRoot,
+				RootGUN: data.GUN(configuration.GetString("root_storage.rootGUN")),
+			},
+		}, nil
+	}
+
+	var options []alternateRootOptions
+	if err := configuration.MarshalKey("alternate_roots", &options); err != nil {
+		return nil, fmt.Errorf("invalid alternate_roots: %s", err.Error())
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("at least one alternate root must be configured")
+	}
+
+	reservedChannels := map[uint]bool{
+		storage.SignerRoot.ID:   true,
+		notaryStorage.Staged.ID: true,
+		storage.Root.ID:         true,
+	}
+	names := make(map[string]bool)
+	roots := make([]storage.AlternateRootConfig, 0, len(options))
+	for _, option := range options {
+		switch {
+		case option.Name == "":
+			return nil, fmt.Errorf("alternate roots must have a name")
+		case option.Name == "signer" || option.Name == "admin":
+			return nil, fmt.Errorf("alternate root name %s is reserved", option.Name)
+		case names[option.Name]:
+			return nil, fmt.Errorf("alternate root %s is configured more than once", option.Name)
+		case option.ChannelID == 0 || reservedChannels[option.ChannelID]:
+			return nil, fmt.Errorf("invalid channel_id %d for alternate root %s", option.ChannelID, option.Name)
+		case option.RootGUN == "":
+			return nil, fmt.Errorf("alternate root %s must have a rootGUN", option.Name)
+		}
+		if err := checkGunPrefixes(option.Prefixes); err != nil {
+			return nil, err
+		}
+		names[option.Name] = true
+		reservedChannels[option.ChannelID] = true
+
+		roots = append(roots, storage.AlternateRootConfig{
+			Name: option.Name,
+			Channel: notaryStorage.Channel{
+				ID:   option.ChannelID,
+				Name: option.Name,
+			},
+			RootGUN:  data.GUN(option.RootGUN),
+			Prefixes: option.Prefixes,
+		})
+	}
+	return roots, nil
+}
+
+// generationOptions is the configuration in `root_storage.generation`. Durations are Go durations such as "8760h".
+type generationOptions struct {
+	KeyAlgorithms       map[string]string `mapstructure:"key_algorithms"`
+	RootKeys            int               `mapstructure:"root_keys"`
+	RootThreshold       int               `mapstructure:"root_threshold"`
+	CertificateValidity string            `mapstructure:"certificate_validity"`
+	Expiries            map[string]string `mapstructure:"expiries"`
+}
+
+// getGenerationConfig parses `root_storage.generation`, which sets the key algorithm of each role, the number of root
+// keys and their threshold, and the root certificate validity of generated roots, and the expiry of each role's
+// metadata when it is signed for an alternate root. Anything that isn't set keeps its default.
+func getGenerationConfig(configuration *viper.Viper) (storage.GenerationConfig, error) {
+	generation := storage.DefaultGenerationConfig()
+	if !configuration.IsSet("root_storage.generation") {
+		return generation, nil
+	}
+
+	var options generationOptions
+	if err := configuration.MarshalKey("root_storage.generation", &options); err != nil {
+		return generation, fmt.Errorf("invalid root_storage.generation: %s", err.Error())
+	}
+	if len(options.KeyAlgorithms) > 0 {
+		generation.KeyAlgorithms = make(map[data.RoleName]string)
+		for role, algorithm := range options.KeyAlgorithms {
+			generation.KeyAlgorithms[data.RoleName(role)] = algorithm
+		}
+	}
+	if options.RootKeys != 0 {
+		generation.RootKeys = options.RootKeys
+	}
+	if options.RootThreshold != 0 {
+		generation.RootThreshold = options.RootThreshold
+	}
+	if options.CertificateValidity != "" {
+		validity, err := time.ParseDuration(options.CertificateValidity)
+		if err != nil {
+			return generation, fmt.Errorf("invalid certificate validity: %s", options.CertificateValidity)
+		}
+		generation.CertificateValidity = validity
+	}
+	if len(options.Expiries) > 0 {
+		generation.Expiries = make(map[data.RoleName]time.Duration)
+		for role, expiry := range options.Expiries {
+			d, err := time.ParseDuration(expiry)
+			if err != nil {
+				return generation, fmt.Errorf("invalid expiry for %s: %s", role, expiry)
+			}
+			generation.Expiries[data.RoleName(role)] = d
+		}
+	}
+	if err := generation.Validate(); err != nil {
+		return generation, fmt.Errorf("invalid root_storage.generation: %s", err.Error())
+	}
+	return generation, nil
 }
 
 // getAddrAndTLSConfig gets the address for the HTTP server, and parses the optional TLS
@@ -66,6 +211,37 @@ func getAddrAndTLSConfig(configuration *viper.Viper, httpAddrKey string) (string
 	return httpAddr, tlsConfig, nil
 }
 
+// getAdminAuth parses `server.admin_tls`, which requires clients of the admin server to present a certificate signed
+// by its `client_ca_file` whose subject is in `allowed_subjects` or which has a SAN in `allowed_sans`. It returns the
+// admin server's TLS configuration, and the access controller and options that check the certificates. Without it, the
+// admin server uses the public server's TLS configuration and authorizes every request.
+func getAdminAuth(configuration *viper.Viper, publicTLS *tls.Config) (*tls.Config, string, map[string]interface{}, error) {
+	if !configuration.IsSet("server.admin_tls") {
+		logrus.Warn("server.admin_tls is not configured - anyone who can reach the admin server can administer apostille")
+		return publicTLS, auth.AdminAuth, nil, nil
+	}
+
+	tlsOpts := tlsconfig.Options{
+		CertFile:   utils.GetPathRelativeToConfig(configuration, "server.admin_tls.tls_cert_file"),
+		KeyFile:    utils.GetPathRelativeToConfig(configuration, "server.admin_tls.tls_key_file"),
+		CAFile:     utils.GetPathRelativeToConfig(configuration, "server.admin_tls.client_ca_file"),
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	if tlsOpts.CertFile == "" || tlsOpts.KeyFile == "" || tlsOpts.CAFile == "" {
+		return nil, "", nil, fmt.Errorf("server.admin_tls requires tls_cert_file, tls_key_file and client_ca_file")
+	}
+	tlsConfig, err := tlsconfig.Server(tlsOpts)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to configure admin TLS: %s", err.Error())
+	}
+
+	options := map[string]interface{}{
+		"allowedSubjects": configuration.GetStringSlice("server.admin_tls.allowed_subjects"),
+		"allowedSANs":     configuration.GetStringSlice("server.admin_tls.allowed_sans"),
+	}
+	return tlsConfig, auth.AdminCertAuth, options, nil
+}
+
 // grpcTLS sets up TLS for the GRPC connection to notary-signer
 func grpcTLS(configuration *viper.Viper) (*tls.Config, error) {
 	rootCA := utils.GetPathRelativeToConfig(configuration, "trust_service.tls_ca_file")
@@ -111,20 +287,60 @@ func getStore(configuration *viper.Viper, trust signed.CryptoService, hRegister
 		return nil, err
 	}
 
-	if err := getQuayRoot(configuration, trust, rootStore); err != nil {
+	roots, err := getAlternateRoots(configuration)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		logrus.Infof("Using %s alternate root %s", root.Name, root.RootGUN.String())
+	}
+
+	multiplexingStore := storage.NewMultiplexingStoreWithRoots(
+		store,
+		rootStore,
+		trust,
+		storage.SignerRoot,
+		storage.Root,
+		roots,
+		"targets/releases")
+
+	generation, err := getGenerationConfig(configuration)
+	if err != nil {
 		return nil, err
 	}
+	multiplexingStore.Generation = generation
+
+	if configuration.IsSet("root_storage.ca_file") {
+		rootCAs, err := getRootCAs(utils.GetPathRelativeToConfig(configuration, "root_storage.ca_file"))
+		if err != nil {
+			return nil, err
+		}
+		multiplexingStore.RootCAs = rootCAs
+	}
+
+	if configuration.IsSet("root_storage.cache_ttl") {
+		ttl, err := time.ParseDuration(configuration.GetString("root_storage.cache_ttl"))
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid root cache ttl: %s", configuration.GetString("root_storage.cache_ttl"))
+		}
+		multiplexingStore.RootCacheTTL = ttl
+	}
+	logrus.Infof("Caching alternate root for %v", multiplexingStore.RootCacheTTL)
 
-	return storage.NewMultiplexingStore(
-			store,
-			rootStore,
-			trust,
-			storage.SignerRoot,
-			storage.AlternateRoot,
-			storage.Root,
-			data.GUN(configuration.GetString("root_storage.rootGUN")),
-			"targets/releases"),
-		nil
+	return multiplexingStore, nil
+}
+
+// getRootCAs reads the PEM encoded CAs that certificates installed as the root keys of alternate roots must chain to
+func getRootCAs(caFile string) (*x509.CertPool, error) {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read root CAs: %s", err.Error())
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in root CA file %s", caFile)
+	}
+	return rootCAs, nil
 }
 
 // parseSQLStorage tries to parse out Storage from a Viper.  If backend and
@@ -206,9 +422,7 @@ func getTrustService(configuration *viper.Viper, sFactory signerFactory,
 
 	switch configuration.GetString("trust_service.type") {
 	case "local":
-		logrus.Info("Using local signing service, which requires ED25519. " +
-			"Ignoring all other trust_service parameters, including keyAlgorithm")
-		return signed.NewEd25519(), data.ED25519Key, nil
+		return getLocalTrustService(configuration, hRegister)
 
 	case "remote":
 	// continue with remote configuration below
@@ -228,6 +442,14 @@ func getTrustService(configuration *viper.Viper, sFactory signerFactory,
 		return nil, "", err
 	}
 
+	if endpoints := configuration.GetStringSlice("trust_service.endpoints"); len(endpoints) > 0 {
+		pool, err := getSignerPool(endpoints, clientTLS, sFactory, hRegister)
+		if err != nil {
+			return nil, "", err
+		}
+		return pool, keyAlgo, nil
+	}
+
 	logrus.Info("Using remote signing service")
 
 	notarySigner, err := sFactory(
@@ -255,6 +477,119 @@ func getTrustService(configuration *viper.Viper, sFactory signerFactory,
 	return notarySigner, keyAlgo, nil
 }
 
+// getSignerPool returns a trust service that spreads requests across the notary-signer replicas listed as
+// `host:port` in `trust_service.endpoints`, failing over between them. Replicas are connected to lazily, so apostille
+// starts even if none of them are up: stored trust data is still served, and updates that need signing fail until a
+// replica is available.
+func getSignerPool(endpoints []string, tlsConfig *tls.Config, sFactory signerFactory, hRegister healthRegister) (*signerpool.Pool, error) {
+	var replicas []signerpool.Endpoint
+	for _, endpoint := range endpoints {
+		hostname, port, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust service endpoint %s: %s", endpoint, err.Error())
+		}
+		notarySigner, err := sFactory(hostname, port, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, signerpool.Endpoint{Name: endpoint, Signer: notarySigner})
+	}
+	logrus.Infof("Using remote signing service with replicas %s", strings.Join(endpoints, ", "))
+	pool := signerpool.NewPool(replicas...)
+
+	duration := 10 * time.Second
+	hRegister(
+		"Trust operational",
+		duration,
+		func() error {
+			err := pool.CheckHealth(duration, notary.HealthCheckOverall)
+			if err != nil {
+				logrus.Error("Trust not fully operational: ", err.Error())
+			}
+			return err
+		},
+	)
+	return pool, nil
+}
+
+// localKeyAlias is the passphrase alias that keys in SQL key storage are encrypted under
+const localKeyAlias = "apostille"
+
+// getLocalTrustService parses `trust_service.key_storage` and returns a trust service that keeps its own keys, for
+// deployments without a notary-signer. Without key storage, or with the memory backend, ED25519 keys are generated in
+// memory and are lost on restart. The file and SQL backends persist keys of `trust_service.key_algorithm` encrypted
+// with `trust_service.key_storage.passphrase`; SQL databases need the private_keys table from notary-signer's
+// migrations.
+func getLocalTrustService(configuration *viper.Viper, hRegister healthRegister) (signed.CryptoService, string, error) {
+	backend := configuration.GetString("trust_service.key_storage.backend")
+	if backend == "" || backend == notary.MemoryBackend {
+		logrus.Warn("Using local signing service with in-memory keys, which requires ED25519 and loses keys on restart. " +
+			"Ignoring all other trust_service parameters, including keyAlgorithm")
+		return signed.NewEd25519(), data.ED25519Key, nil
+	}
+
+	keyAlgo := configuration.GetString("trust_service.key_algorithm")
+	if keyAlgo == "" {
+		keyAlgo = data.ED25519Key
+	}
+	if keyAlgo != data.ED25519Key && keyAlgo != data.ECDSAKey && keyAlgo != data.RSAKey {
+		return nil, "", fmt.Errorf("invalid key algorithm configured: %s", keyAlgo)
+	}
+	keyPassphrase := configuration.GetString("trust_service.key_storage.passphrase")
+	if keyPassphrase == "" {
+		return nil, "", fmt.Errorf("must provide a passphrase to encrypt keys in %s key storage", backend)
+	}
+	retriever := passphrase.ConstantRetriever(keyPassphrase)
+
+	switch backend {
+	case "file":
+		dir := utils.GetPathRelativeToConfig(configuration, "trust_service.key_storage.directory")
+		if dir == "" {
+			return nil, "", fmt.Errorf("must provide a directory for file key storage")
+		}
+		keyStore, err := trustmanager.NewKeyFileStore(dir, retriever)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to open key storage in %s: %s", dir, err.Error())
+		}
+		logrus.Infof("Using local signing service with %s keys in %s", keyAlgo, dir)
+		return cryptoservice.NewCryptoService(keyStore), keyAlgo, nil
+
+	case notary.MySQLBackend, notary.SQLiteBackend, notary.PostgresBackend:
+		storeConfig, err := parseSQLStorage(configuration, "trust_service.key_storage")
+		if err != nil {
+			return nil, "", err
+		}
+		dbStore, err := keydbstore.NewSQLKeyDBStore(retriever, localKeyAlias, storeConfig.Backend, storeConfig.Source)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error starting %s driver: %s", backend, err.Error())
+		}
+		hRegister("Trust operational", time.Minute, dbStore.HealthCheck)
+		logrus.Infof("Using local signing service with %s keys in %s", keyAlgo, backend)
+		return keydbstore.NewCachedKeyService(sqlKeyService{dbStore}), keyAlgo, nil
+	}
+	return nil, "", fmt.Errorf("%s is not a supported key storage backend", backend)
+}
+
+// sqlKeyService generates the RSA keys that SQL key storage can hold but not generate itself
+type sqlKeyService struct {
+	*keydbstore.SQLKeyDBStore
+}
+
+// Create generates a key for a role and stores it
+func (s sqlKeyService) Create(role data.RoleName, gun data.GUN, algorithm string) (data.PublicKey, error) {
+	if algorithm != data.RSAKey {
+		return s.SQLKeyDBStore.Create(role, gun, algorithm)
+	}
+	privKey, err := tufutils.GenerateKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.AddKey(role, gun, privKey); err != nil {
+		return nil, fmt.Errorf("failed to store key: %v", err)
+	}
+	return data.PublicKeyFromPrivate(privKey), nil
+}
+
 // getCacheConfig parses the cache configurations for GET-ting current and checksummed metadata,
 // returning the configuration for current (non-content-addressed) metadata
 // first, then the configuration for consistent (content-addressed) metadata
@@ -289,203 +624,411 @@ func getCacheConfig(configuration *viper.Viper) (current, consistent utils.Cache
 	return
 }
 
-func getQuayRoot(configuration *viper.Viper, cs signed.CryptoService, store notaryStorage.MetaStore) error {
-	shouldGenerate := configuration.GetString("root_storage.root") == "generate"
-	if !shouldGenerate {
-		return nil
+// getRefresher parses the configuration for re-signing alternate-rooted metadata before it expires. Refreshing is
+// enabled by default, and can be disabled by setting `refresher.interval` to 0. The lead time must be shorter than
+// the expiry of every online role, or each pass would re-sign everything; the default is shortened to fit.
+func getRefresher(configuration *viper.Viper, store notaryStorage.MetaStore) (*storage.Refresher, error) {
+	refresherConfig := storage.RefresherConfig{
+		Interval:  time.Hour,
+		LeadTime:  72 * time.Hour,
+		BatchSize: 100,
 	}
-	rootMetaStore := storage.WriteOnlyStore{MetaStore: storage.NewChannelMetastore(store, storage.Root)}
-
-	gun := data.GUN(configuration.GetString("root_storage.rootGUN"))
-
-	logrus.Infof("Generating root repo for %s", gun.String())
 
-	rootPublicKey, err := cs.Create(data.CanonicalRootRole, gun, data.ECDSAKey)
-	if err != nil {
-		return err
+	var err error
+	if configuration.IsSet("refresher.interval") {
+		refresherConfig.Interval, err = time.ParseDuration(configuration.GetString("refresher.interval"))
+		if err != nil || refresherConfig.Interval < 0 {
+			return nil, fmt.Errorf("invalid refresher interval: %s", configuration.GetString("refresher.interval"))
+		}
 	}
-	rootKey, _, err := cs.GetPrivateKey(rootPublicKey.ID())
-	if err != nil {
-		return err
+	if refresherConfig.Interval == 0 {
+		logrus.Warn("Refreshing alternate-rooted metadata is disabled")
+		return nil, nil
+	}
+	if configuration.IsSet("refresher.lead_time") {
+		refresherConfig.LeadTime, err = time.ParseDuration(configuration.GetString("refresher.lead_time"))
+		if err != nil || refresherConfig.LeadTime <= 0 {
+			return nil, fmt.Errorf("invalid refresher lead time: %s", configuration.GetString("refresher.lead_time"))
+		}
+	}
+	if configuration.IsSet("refresher.batch_size") {
+		refresherConfig.BatchSize, err = strconv.Atoi(configuration.GetString("refresher.batch_size"))
+		if err != nil || refresherConfig.BatchSize <= 0 {
+			return nil, fmt.Errorf("invalid refresher batch size: %s", configuration.GetString("refresher.batch_size"))
+		}
 	}
 
-	// Generate root public key cert
-	startTime := time.Now()
-	cert, err := cryptoservice.GenerateCertificate(rootKey, gun, startTime, startTime.Add(notary.Year*10))
-	if err != nil {
-		return err
+	multiplexingStore, ok := store.(*storage.MultiplexingStore)
+	if !ok {
+		return nil, fmt.Errorf("alternate-rooted metadata can only be refreshed in a multiplexing store")
 	}
-	x509PublicKey := tufUtils.CertToKey(cert)
-	if x509PublicKey == nil {
-		return fmt.Errorf("cannot use regenerated certificate: format %v", cert.PublicKeyAlgorithm)
+	shortestRole := data.CanonicalTimestampRole
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole} {
+		if multiplexingStore.Generation.Expiry(role) < multiplexingStore.Generation.Expiry(shortestRole) {
+			shortestRole = role
+		}
+	}
+	if expiry := multiplexingStore.Generation.Expiry(shortestRole); refresherConfig.LeadTime >= expiry {
+		if configuration.IsSet("refresher.lead_time") {
+			return nil, fmt.Errorf("refresher lead time %v must be shorter than the %v expiry of %s", refresherConfig.LeadTime, expiry, shortestRole)
+		}
+		refresherConfig.LeadTime = expiry / 2
+		logrus.Infof("Refreshing alternate-rooted metadata %v before expiry, half of the %v expiry of %s", refresherConfig.LeadTime, expiry, shortestRole)
 	}
+	return storage.NewRefresher(multiplexingStore, refresherConfig), nil
+}
 
-	// Generate root role
-	rootRole := data.NewBaseRole(data.CanonicalRootRole, notary.MinThreshold, x509PublicKey)
+// parseConfig parses the configuration file and sets the log level from it
+func parseConfig(configFilePath string) (*viper.Viper, error) {
+	config := viper.New()
+	utils.SetupViper(config, envPrefix)
 
-	// Generate snapshot role
-	snapshotKey, err := cs.Create(data.CanonicalSnapshotRole, gun, data.ECDSAKey)
-	if err != nil {
-		return err
+	// parse viper config
+	if err := utils.ParseViper(config, configFilePath); err != nil {
+		return nil, err
 	}
-	snapshotRole := data.NewBaseRole(
-		data.CanonicalSnapshotRole,
-		notary.MinThreshold,
-		snapshotKey,
-	)
 
-	// Generate targets role
-	targetsKey, err := cs.Create(data.CanonicalTargetsRole, gun, data.ECDSAKey)
+	// set default error level
+	lvl, err := utils.ParseLogLevel(config, logrus.ErrorLevel)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	targetsRole := data.NewBaseRole(
-		data.CanonicalTargetsRole,
-		notary.MinThreshold,
-		targetsKey,
-	)
+	logrus.SetLevel(lvl)
+	return config, nil
+}
 
-	// Generate timestamp role
-	timestampKey, err := cs.Create(data.CanonicalTimestampRole, gun, data.ECDSAKey)
-	if err != nil {
-		return err
+// userRootOptions maps a user to a TUF root in `auth.tuf_root.users`
+type userRootOptions struct {
+	Name string `mapstructure:"name"`
+	Root string `mapstructure:"root"`
+}
+
+// getRootMapping parses `auth.tuf_root`, which picks the TUF root for users of access controllers that don't pick
+// one themselves, such as htpasswd and registry token auth. Users can be mapped to "signer", to one of the alternate
+// roots, or to "$disabled".
+func getRootMapping(configuration *viper.Viper, roots []*storage.AlternateRootStore) (auth.RootMapping, error) {
+	validRoots := map[string]bool{"signer": true, auth.TufDisabled: true}
+	for _, root := range roots {
+		validRoots[root.Name] = true
+	}
+
+	mapping := auth.RootMapping{
+		Default: configuration.GetString("auth.tuf_root.default"),
+	}
+	if mapping.Default != "" && !validRoots[mapping.Default] {
+		return auth.RootMapping{}, fmt.Errorf("invalid default tuf root: %s", mapping.Default)
 	}
-	timestampRole := data.NewBaseRole(
-		data.CanonicalTimestampRole,
-		notary.MinThreshold,
-		timestampKey,
-	)
 
-	// Generate full repo
-	repo := tuf.NewRepo(cs)
-	err = repo.InitRoot(rootRole, timestampRole, snapshotRole, targetsRole, false)
+	var users []userRootOptions
+	if err := configuration.MarshalKey("auth.tuf_root.users", &users); err != nil {
+		return auth.RootMapping{}, fmt.Errorf("invalid auth.tuf_root.users: %s", err.Error())
+	}
+	for _, user := range users {
+		if user.Name == "" {
+			return auth.RootMapping{}, fmt.Errorf("a user name is required for every tuf root mapping")
+		}
+		if !validRoots[user.Root] {
+			return auth.RootMapping{}, fmt.Errorf("invalid tuf root for %s: %s", user.Name, user.Root)
+		}
+		if _, ok := mapping.Users[user.Name]; ok {
+			return auth.RootMapping{}, fmt.Errorf("tuf root for %s is mapped more than once", user.Name)
+		}
+		if mapping.Users == nil {
+			mapping.Users = make(map[string]string)
+		}
+		mapping.Users[user.Name] = user.Root
+	}
+	return mapping, nil
+}
+
+// admissionRuleOptions is an entry of `admission.rules`
+type admissionRuleOptions struct {
+	Namespaces    []string `mapstructure:"namespaces"`
+	Prefixes      []string `mapstructure:"gun_prefixes"`
+	Root          string   `mapstructure:"root"`
+	RequireDigest bool     `mapstructure:"require_digest"`
+}
+
+// getAdmissionPolicy parses `admission.rules`, which decide the images of pods a Kubernetes admission webhook
+// requires to be signed, and whether they are checked against the signer root or one of the alternate roots. If no
+// rules are configured, admission control is disabled. Otherwise `admission.token_file` holds the bearer token the
+// Kubernetes API server authenticates with.
+func getAdmissionPolicy(configuration *viper.Viper, roots []*storage.AlternateRootStore) (*server.AdmissionPolicy, error) {
+	var ruleOptions []admissionRuleOptions
+	if err := configuration.MarshalKey("admission.rules", &ruleOptions); err != nil {
+		return nil, fmt.Errorf("invalid admission.rules: %s", err.Error())
+	}
+	if len(ruleOptions) == 0 {
+		return nil, nil
+	}
+	tokenFile := utils.GetPathRelativeToConfig(configuration, "admission.token_file")
+	if tokenFile == "" {
+		return nil, fmt.Errorf("admission.rules require admission.token_file")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to read admission token: %s", err.Error())
+	}
+	policy := &server.AdmissionPolicy{Token: strings.TrimSpace(string(token))}
+	if policy.Token == "" {
+		return nil, fmt.Errorf("admission token file %s is empty", tokenFile)
 	}
 
-	if _, err = repo.InitTargets(data.CanonicalTargetsRole); err != nil {
-		return err
+	validRoots := map[string]bool{"signer": true}
+	for _, root := range roots {
+		validRoots[root.Name] = true
 	}
-	if err = repo.InitSnapshot(); err != nil {
-		return err
+	for _, options := range ruleOptions {
+		if !validRoots[options.Root] {
+			return nil, fmt.Errorf("invalid tuf root for admission rule: %s", options.Root)
+		}
+		policy.Rules = append(policy.Rules, server.AdmissionRule{
+			Namespaces:    options.Namespaces,
+			Prefixes:      options.Prefixes,
+			Root:          options.Root,
+			RequireDigest: options.RequireDigest,
+		})
 	}
-	if err = repo.InitTimestamp(); err != nil {
-		return err
+	logrus.Infof("Checking pod images against %d admission rules", len(policy.Rules))
+	return policy, nil
+}
+
+// auditSinkOptions is an entry of `audit.sinks`
+type auditSinkOptions struct {
+	Type    string
+	Options map[string]interface{}
+}
+
+// getAuditor parses `audit.sinks`, the list of sinks that changes to trust data are recorded in. If it is unset,
+// changes aren't audited.
+func getAuditor(configuration *viper.Viper) (*audit.Auditor, error) {
+	if !configuration.IsSet("audit.sinks") {
+		return nil, nil
+	}
+	var options []auditSinkOptions
+	if err := configuration.MarshalKey("audit.sinks", &options); err != nil {
+		return nil, fmt.Errorf("invalid audit.sinks: %s", err.Error())
+	}
+	sinks := make([]audit.Sink, 0, len(options))
+	for _, option := range options {
+		sink, err := audit.NewSink(option.Type, option.Options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s audit sink: %s", option.Type, err.Error())
+		}
+		sinks = append(sinks, sink)
+		logrus.Infof("Writing audit log to %s sink", option.Type)
 	}
+	return audit.New(sinks...), nil
+}
 
-	rootSigned, err := repo.SignRoot(data.DefaultExpires(data.CanonicalRootRole), nil)
-	if err != nil {
-		return err
+// webhookEndpointOptions is an entry of `webhooks.endpoints`
+type webhookEndpointOptions struct {
+	URL    string
+	Secret string
+}
+
+// getWebhookNotifier parses `webhooks`, the endpoints that are notified of changes to trust data. If no endpoints are
+// configured, no notifications are sent. Deliveries are kept in `webhooks.queue_dir` until they succeed; without it
+// they are kept in memory, and lost when apostille stops.
+func getWebhookNotifier(configuration *viper.Viper) (*webhook.Notifier, error) {
+	if !configuration.IsSet("webhooks.endpoints") {
+		return nil, nil
 	}
-	targetsSigned, err := repo.SignTargets(data.CanonicalTargetsRole, data.DefaultExpires(data.CanonicalTargetsRole))
-	if err != nil {
-		return err
+	var endpointOptions []webhookEndpointOptions
+	if err := configuration.MarshalKey("webhooks.endpoints", &endpointOptions); err != nil {
+		return nil, fmt.Errorf("invalid webhooks.endpoints: %s", err.Error())
 	}
-	ssSigned, err := repo.SignSnapshot(data.DefaultExpires(data.CanonicalSnapshotRole))
-	if err != nil {
-		return err
+	if len(endpointOptions) == 0 {
+		return nil, nil
 	}
-	tsSigned, err := repo.SignTimestamp(data.DefaultExpires(data.CanonicalTimestampRole))
-	if err != nil {
-		return err
+
+	webhookConfig := webhook.Config{}
+	for _, options := range endpointOptions {
+		endpoint, err := url.Parse(options.URL)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid webhook endpoint url: %s", options.URL)
+		}
+		if options.Secret == "" {
+			logrus.Warnf("Webhook notifications to %s will not be signed", options.URL)
+		}
+		webhookConfig.Endpoints = append(webhookConfig.Endpoints, webhook.Endpoint{URL: options.URL, Secret: options.Secret})
 	}
 
-	rootBytes, err := json.Marshal(rootSigned)
-	if err != nil {
-		return err
+	if queueDir := configuration.GetString("webhooks.queue_dir"); queueDir != "" {
+		queue, err := webhook.NewDirQueue(queueDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use webhook queue directory %s: %s", queueDir, err.Error())
+		}
+		webhookConfig.Queue = queue
+	} else {
+		logrus.Warn("No webhooks.queue_dir configured, undelivered webhooks will be lost when apostille stops")
 	}
-	targetsBytes, err := json.Marshal(targetsSigned)
-	if err != nil {
-		return err
+
+	var err error
+	if configuration.IsSet("webhooks.max_attempts") {
+		webhookConfig.MaxAttempts, err = strconv.Atoi(configuration.GetString("webhooks.max_attempts"))
+		if err != nil || webhookConfig.MaxAttempts <= 0 {
+			return nil, fmt.Errorf("invalid webhook max attempts: %s", configuration.GetString("webhooks.max_attempts"))
+		}
 	}
-	ssBytes, err := json.Marshal(ssSigned)
+	for key, duration := range map[string]*time.Duration{
+		"webhooks.min_backoff": &webhookConfig.MinBackoff,
+		"webhooks.max_backoff": &webhookConfig.MaxBackoff,
+		"webhooks.timeout":     &webhookConfig.Timeout,
+	} {
+		if !configuration.IsSet(key) {
+			continue
+		}
+		*duration, err = time.ParseDuration(configuration.GetString(key))
+		if err != nil || *duration <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", key, configuration.GetString(key))
+		}
+	}
+	return webhook.New(webhookConfig), nil
+}
+
+// getSimpleSigner parses the key that simple signing signatures are signed with, if one is configured
+func getSimpleSigner(configuration *viper.Viper) (*simplesigning.Signer, error) {
+	keyFile := utils.GetPathRelativeToConfig(configuration, "trust_service.simple_signing.key_file")
+	if keyFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(keyFile)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to read simple signing key: %s", err.Error())
 	}
-	tsBytes, err := json.Marshal(tsSigned)
+	defer f.Close()
+	signer, err := simplesigning.LoadSigner(f, configuration.GetString("trust_service.simple_signing.passphrase"))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid simple signing key %s: %s", keyFile, err.Error())
 	}
+	logrus.Infof("Serving simple signing signatures signed by key %s", signer.KeyID())
+	return signer, nil
+}
 
-	updates := []notaryStorage.MetaUpdate{
-		{
-			Role:     data.CanonicalRootRole,
-			Version:  1,
-			Data:     rootBytes,
-			Channels: []*notaryStorage.Channel{&storage.Root},
-		},
-		{
-			Role:     data.CanonicalTargetsRole,
-			Version:  1,
-			Data:     targetsBytes,
-			Channels: []*notaryStorage.Channel{&storage.Root},
-		},
-		{
-			Role:     data.CanonicalSnapshotRole,
-			Version:  1,
-			Data:     ssBytes,
-			Channels: []*notaryStorage.Channel{&storage.Root},
-		},
-		{
-			Role:     data.CanonicalTimestampRole,
-			Version:  1,
-			Data:     tsBytes,
-			Channels: []*notaryStorage.Channel{&storage.Root},
-		},
+// getShutdownTimeout parses how long the servers wait for in-flight requests to finish when stopping
+func getShutdownTimeout(configuration *viper.Viper) (time.Duration, error) {
+	if !configuration.IsSet("server.shutdown_timeout") {
+		return server.DefaultShutdownTimeout, nil
+	}
+	timeout, err := time.ParseDuration(configuration.GetString("server.shutdown_timeout"))
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid shutdown timeout: %s", configuration.GetString("server.shutdown_timeout"))
 	}
-	return rootMetaStore.UpdateMany(gun, updates)
+	return timeout, nil
 }
 
-// parseServerConfig parses the config file into a Config struct
-func parseServerConfig(configFilePath string) (context.Context, context.Context, server.Config, server.Config, error) {
-	config := viper.New()
-	utils.SetupViper(config, envPrefix)
+// contextHealthRegister returns a healthRegister that runs periodic health checks until the context is cancelled
+func contextHealthRegister(ctx context.Context) healthRegister {
+	return func(name string, period time.Duration, check health.CheckFunc) {
+		updater := health.NewStatusUpdater()
+		go func() {
+			ticker := time.NewTicker(period)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					updater.Update(check.Check())
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		health.Register(name, updater)
+	}
+}
 
-	configError := func(err error) (context.Context, context.Context, server.Config, server.Config, error) {
-		return nil, nil, server.Config{}, server.Config{}, err
+// parseServerConfig parses the config file into a Config struct. Cancelling `ctx` stops the servers, refresher,
+// health checks and webhook deliveries that are configured.
+func parseServerConfig(ctx context.Context, configFilePath string) (context.Context, context.Context, server.Config, server.Config, *storage.Refresher, error) {
+	configError := func(err error) (context.Context, context.Context, server.Config, server.Config, *storage.Refresher, error) {
+		return nil, nil, server.Config{}, server.Config{}, nil, err
 	}
 
-	// parse viper config
-	if err := utils.ParseViper(config, configFilePath); err != nil {
+	config, err := parseConfig(configFilePath)
+	if err != nil {
 		return configError(err)
 	}
 
-	ctx := context.Background()
-	adminCtx := context.Background()
-
-	// set default error level
-	lvl, err := utils.ParseLogLevel(config, logrus.ErrorLevel)
+	auditor, err := getAuditor(config)
 	if err != nil {
 		return configError(err)
 	}
-	logrus.SetLevel(lvl)
+	ctx = audit.NewContext(ctx, auditor)
+
+	adminCtx := ctx
+	hRegister := contextHealthRegister(ctx)
 
 	prefixes, err := getRequiredGunPrefixes(config)
 	if err != nil {
 		return configError(err)
 	}
 
-	trust, keyAlgo, err := getTrustService(config, getNotarySigner, health.RegisterPeriodicFunc)
+	trust, keyAlgo, err := getTrustService(config, getNotarySigner, hRegister)
 	if err != nil {
 		return configError(err)
 	}
 	ctx = context.WithValue(ctx, notary.CtxKeyKeyAlgo, keyAlgo)
 
+	simpleSigner, err := getSimpleSigner(config)
+	if err != nil {
+		return configError(err)
+	}
+	if simpleSigner != nil {
+		ctx = context.WithValue(ctx, server.CtxKeySimpleSigner, simpleSigner)
+	}
+
 	rootBackend := config.GetString("root_storage.backend")
 	logrus.Infof("Using %s admin backend", rootBackend)
 
-	adminStore, err := getBaseStore(config, health.RegisterPeriodicFunc, rootBackend, "root_storage", "admin")
+	adminStore, err := getBaseStore(config, hRegister, rootBackend, "root_storage", "admin")
 	if err != nil {
 		return configError(err)
 	}
 	adminMetaStore := storage.NewChannelMetastore(adminStore, storage.Root)
 	adminCtx = context.WithValue(adminCtx, notary.CtxKeyMetaStore, adminMetaStore)
 
-	store, err := getStore(config, trust, health.RegisterPeriodicFunc)
+	store, err := getStore(config, trust, hRegister)
 	if err != nil {
 		return configError(err)
 	}
+	if err := getQuayRoots(config, trust, store.(*storage.MultiplexingStore)); err != nil {
+		return configError(err)
+	}
 	ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, store)
+	adminCtx = context.WithValue(adminCtx, server.CtxKeyMultiplexingStore, store)
+
+	notifier, err := getWebhookNotifier(config)
+	if err != nil {
+		return configError(err)
+	}
+	if notifier != nil {
+		store.(*storage.MultiplexingStore).Notifier = notifier
+		go notifier.Run(ctx)
+	}
+
+	refresher, err := getRefresher(config, store)
+	if err != nil {
+		return configError(err)
+	}
+
+	rootMapping, err := getRootMapping(config, store.(*storage.MultiplexingStore).AlternateRoots())
+	if err != nil {
+		return configError(err)
+	}
+
+	admissionPolicy, err := getAdmissionPolicy(config, store.(*storage.MultiplexingStore).AlternateRoots())
+	if err != nil {
+		return configError(err)
+	}
+	if admissionPolicy != nil {
+		ctx = context.WithValue(ctx, server.CtxKeyAdmissionPolicy, admissionPolicy)
+	}
+
+	shutdownTimeout, err := getShutdownTimeout(config)
+	if err != nil {
+		return configError(err)
+	}
 
 	currentCache, consistentCache, err := getCacheConfig(config)
 	if err != nil {
@@ -502,28 +1045,36 @@ func parseServerConfig(configFilePath string) (context.Context, context.Context,
 		return configError(err)
 	}
 
+	adminTLSConfig, adminAuthMethod, adminAuthOpts, err := getAdminAuth(config, tlsConfig)
+	if err != nil {
+		return configError(err)
+	}
+
 	serverConfig := server.Config{
 		Addr:                         httpAddr,
 		TLSConfig:                    tlsConfig,
 		Trust:                        trust,
 		AuthMethod:                   config.GetString("auth.type"),
 		AuthOpts:                     config.Get("auth.options"),
+		RootMapping:                  rootMapping,
 		RepoPrefixes:                 prefixes,
 		CurrentCacheControlConfig:    currentCache,
 		ConsistentCacheControlConfig: consistentCache,
+		ShutdownTimeout:              shutdownTimeout,
 		Admin: false,
 	}
 
 	adminServerConfig := server.Config{
 		Addr:                         adminHTTPAddr,
-		TLSConfig:                    tlsConfig,
+		TLSConfig:                    adminTLSConfig,
 		Trust:                        trust,
-		AuthMethod:                   "admin",
-		AuthOpts:                     nil,
+		AuthMethod:                   adminAuthMethod,
+		AuthOpts:                     adminAuthOpts,
 		RepoPrefixes:                 nil,
 		CurrentCacheControlConfig:    currentCache,
 		ConsistentCacheControlConfig: consistentCache,
+		ShutdownTimeout:              shutdownTimeout,
 		Admin: true,
 	}
-	return ctx, adminCtx, serverConfig, adminServerConfig, nil
+	return ctx, adminCtx, serverConfig, adminServerConfig, refresher, nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/coreos-inc/apostille/storage"
+)
+
+// fsckCommand is the subcommand that checks the signer-rooted and alternate-rooted metadata of every repository
+const fsckCommand = "fsck"
+
+// parseFsckFlags parses the flags of the fsck command into the config file path and check options.
+// The config file defaults to the one given before the command.
+func parseFsckFlags(defaultConfigFile string, args []string) (string, storage.FsckOptions, error) {
+	var (
+		configFile string
+		roots      string
+		options    storage.FsckOptions
+	)
+	flags := flag.NewFlagSet(fsckCommand, flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", defaultConfigFile, "Path to configuration file")
+	flags.StringVar(&roots, "roots", "", "Comma-separated names of the alternate roots to check (default all)")
+	flags.StringVar(&options.Prefix, "prefix", "", "Only check repositories whose GUN starts with this prefix")
+	flags.StringVar(&options.StartAfter, "start-after", "0", "Resume after this change ID, as printed by a previous run")
+	flags.IntVar(&options.BatchSize, "batch-size", 100, "Number of changes to read from storage at a time")
+	flags.BoolVar(&options.Repair, "repair", false, "Re-swizzle repositories with inconsistent alternate-rooted metadata")
+	if err := flags.Parse(args); err != nil {
+		return "", storage.FsckOptions{}, err
+	}
+	if options.BatchSize <= 0 {
+		return "", storage.FsckOptions{}, fmt.Errorf("batch size must be positive")
+	}
+	if roots != "" {
+		options.Roots = strings.Split(roots, ",")
+	}
+	return configFile, options, nil
+}
+
+// runFsck checks the metadata of every repository, and writes the report to `out`. It fails if any problems were
+// found that weren't repaired, so that it can be used in scripts.
+func runFsck(defaultConfigFile string, args []string, out io.Writer) error {
+	configFile, options, err := parseFsckFlags(defaultConfigFile, args)
+	if err != nil {
+		return err
+	}
+	store, err := getCommandStore(configFile)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	report, fsckErr := store.Fsck(ctx, options)
+	if report != nil {
+		if err := writeJSON(out, report); err != nil {
+			return err
+		}
+	}
+	if fsckErr != nil {
+		if report != nil {
+			return fmt.Errorf("fsck stopped, resume with -start-after %s: %s", report.LastChangeID, fsckErr.Error())
+		}
+		return fsckErr
+	}
+	if unrepaired := report.Unrepaired(); unrepaired > 0 {
+		return fmt.Errorf("found %d inconsistencies", unrepaired)
+	}
+	return nil
+}
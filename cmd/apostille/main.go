@@ -1,12 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/coreos-inc/apostille/server"
+	"github.com/coreos-inc/apostille/storage"
+	"github.com/docker/distribution/health"
+	"golang.org/x/net/context"
 )
 
 type cmdFlags struct {
@@ -24,26 +33,128 @@ func main() {
 
 	flag.Parse()
 
-	ctx, adminCtx, serverConfig, adminServerConfig, err := parseServerConfig(flagStorage.configFile)
+	switch flag.Arg(0) {
+	case reswizzleCommand:
+		if err := runReswizzle(flagStorage.configFile, flag.Args()[1:], os.Stdout); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	case fsckCommand:
+		if err := runFsck(flagStorage.configFile, flag.Args()[1:], os.Stdout); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	case rootCSRCommand:
+		if err := runRootCSR(flagStorage.configFile, flag.Args()[1:], os.Stdout); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	case rootCertCommand:
+		if err := runRootCert(flagStorage.configFile, flag.Args()[1:], os.Stdout); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	case pinningBundleCommand:
+		if err := runPinningBundle(flagStorage.configFile, flag.Args()[1:], os.Stdout); err != nil {
+			logrus.Fatal(err.Error())
+		}
+		return
+	}
+
+	// SIGINT and SIGTERM stop both servers, letting in-flight requests finish
+	baseCtx, cancel := interruptibleContext()
+	defer cancel()
+
+	ctx, adminCtx, serverConfig, adminServerConfig, refresher, err := parseServerConfig(baseCtx, flagStorage.configFile)
 	if err != nil {
 		logrus.Fatal(err.Error())
 	}
 
-	go func() {
-		err = server.Run(adminCtx, adminServerConfig)
-		if err != nil {
-			logrus.Fatal(err.Error())
+	var refreshing sync.WaitGroup
+	if refresher != nil {
+		refreshing.Add(1)
+		go func() {
+			defer refreshing.Done()
+			refresher.Run(ctx)
+		}()
+	}
+
+	err = runServers(ctx, adminCtx, cancel, serverConfig, adminServerConfig)
+	cancel()
+	refreshing.Wait()
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
+	logrus.Info("apostille stopped")
+}
+
+// runServers runs the public and admin servers until their contexts are cancelled, and waits for both to stop.
+// If either server fails, `cancel` is called to stop the other one, and the error is returned.
+func runServers(ctx, adminCtx context.Context, cancel context.CancelFunc, serverConfig, adminServerConfig server.Config) error {
+	var running sync.WaitGroup
+	errs := make(chan error, 2)
+	run := func(ctx context.Context, config server.Config) {
+		defer running.Done()
+		if err := server.Run(ctx, config); err != nil {
+			errs <- err
+			cancel()
 		}
-	}()
+	}
 
-	err = server.Run(ctx, serverConfig)
+	running.Add(2)
+	go run(adminCtx, adminServerConfig)
+	go run(ctx, serverConfig)
+	running.Wait()
 
+	close(errs)
+	return <-errs
+}
+
+// getCommandStore parses the configuration file and returns the store that commands operate on. Unlike the server,
+// commands never create alternate roots, and don't register health checks since nothing serves them.
+func getCommandStore(configFile string) (*storage.MultiplexingStore, error) {
+	config, err := parseConfig(configFile)
 	if err != nil {
-		logrus.Fatal(err.Error())
+		return nil, err
+	}
+	noHealthChecks := func(string, time.Duration, health.CheckFunc) {}
+	trust, _, err := getTrustService(config, getNotarySigner, noHealthChecks)
+	if err != nil {
+		return nil, err
 	}
+	store, err := getStore(config, trust, noHealthChecks)
+	if err != nil {
+		return nil, err
+	}
+	return store.(*storage.MultiplexingStore), nil
+}
+
+// interruptibleContext returns a context that is cancelled when the process is interrupted or terminated, so that
+// commands can stop cleanly and report where to resume from
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			logrus.Warn("interrupted, stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// writeJSON writes the machine-readable output of a command
+func writeJSON(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
 }
 
 func usage() {
-	fmt.Println("usage:", os.Args[0])
+	fmt.Println("usage:", os.Args[0], "[reswizzle|fsck|root-csr|root-cert|pinning-bundle]")
 	flag.PrintDefaults()
 }
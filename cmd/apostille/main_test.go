@@ -3,30 +3,44 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/coreos-inc/apostille/auth"
+	"github.com/coreos-inc/apostille/server"
+	"github.com/coreos-inc/apostille/signerpool"
 	"github.com/coreos-inc/apostille/storage"
 	"github.com/docker/distribution/health"
 	"github.com/docker/notary"
 	"github.com/docker/notary/cryptoservice"
 	pb "github.com/docker/notary/proto"
+	notaryStorage "github.com/docker/notary/server/storage"
 	"github.com/docker/notary/signer"
 	"github.com/docker/notary/signer/api"
 	"github.com/docker/notary/signer/client"
+	"github.com/docker/notary/signer/keydbstore"
 	"github.com/docker/notary/trustmanager"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/signed"
+	tufutils "github.com/docker/notary/tuf/utils"
 	"github.com/docker/notary/utils"
+	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
@@ -268,6 +282,104 @@ func TestGetLocalTrustService(t *testing.T) {
 	require.Equal(t, 0, registerCalled)
 }
 
+// A local trust service with file key storage keeps its keys, encrypted with
+// the passphrase, across restarts.  No health function is configured.
+func TestGetLocalTrustServiceFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apostille-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configTemplate := `{"trust_service": {"type": "local", "key_algorithm": "%s",
+		"key_storage": {"backend": "file", "directory": %q, "passphrase": "%s"}}}`
+
+	for _, keyAlgo := range []string{data.ED25519Key, data.ECDSAKey, data.RSAKey} {
+		var registerCalled = 0
+		trust, algo, err := getTrustService(configure(fmt.Sprintf(configTemplate, keyAlgo, dir, "passphrase")),
+			getNotarySigner, fakeRegisterer(&registerCalled))
+		require.NoError(t, err)
+		require.Equal(t, keyAlgo, algo)
+		require.Equal(t, 0, registerCalled)
+
+		pubKey, err := trust.Create(data.CanonicalTimestampRole, "quay.io/signingUser/testRepo", algo)
+		require.NoError(t, err)
+		require.Equal(t, keyAlgo, pubKey.Algorithm())
+
+		// a restarted trust service reads the key back with the same passphrase
+		restarted, _, err := getTrustService(configure(fmt.Sprintf(configTemplate, keyAlgo, dir, "passphrase")),
+			getNotarySigner, fakeRegisterer(&registerCalled))
+		require.NoError(t, err)
+		privKey, role, err := restarted.GetPrivateKey(pubKey.ID())
+		require.NoError(t, err)
+		require.Equal(t, data.CanonicalTimestampRole, role)
+		require.Equal(t, pubKey.Public(), privKey.Public())
+
+		// but not with another one, because the key is encrypted on disk
+		wrongPassphrase, _, err := getTrustService(configure(fmt.Sprintf(configTemplate, keyAlgo, dir, "wrong")),
+			getNotarySigner, fakeRegisterer(&registerCalled))
+		require.NoError(t, err)
+		_, _, err = wrongPassphrase.GetPrivateKey(pubKey.ID())
+		require.Error(t, err)
+	}
+}
+
+// A local trust service with SQL key storage keeps its keys in the database,
+// including the RSA keys that the database key store can't generate itself.
+// A health function is configured.
+func TestGetLocalTrustServiceSQLStorage(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "sqlite3")
+	require.NoError(t, err)
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	db, err := gorm.Open(notary.SQLiteBackend, tmpFile.Name())
+	require.NoError(t, err)
+	require.NoError(t, db.CreateTable(&keydbstore.GormPrivateKey{}).Error)
+	require.NoError(t, db.Close())
+
+	configTemplate := `{"trust_service": {"type": "local", "key_algorithm": "%s",
+		"key_storage": {"backend": "%s", "db_url": %q, "passphrase": "passphrase"}}}`
+
+	for _, keyAlgo := range []string{data.ECDSAKey, data.RSAKey} {
+		config := fmt.Sprintf(configTemplate, keyAlgo, notary.SQLiteBackend, tmpFile.Name())
+		var registerCalled = 0
+		trust, algo, err := getTrustService(configure(config), getNotarySigner, fakeRegisterer(&registerCalled))
+		require.NoError(t, err)
+		require.Equal(t, keyAlgo, algo)
+		require.Equal(t, 1, registerCalled)
+
+		pubKey, err := trust.Create(data.CanonicalSnapshotRole, "quay.io/signingUser/testRepo", algo)
+		require.NoError(t, err)
+		require.Equal(t, keyAlgo, pubKey.Algorithm())
+
+		restarted, _, err := getTrustService(configure(config), getNotarySigner, fakeRegisterer(&registerCalled))
+		require.NoError(t, err)
+		privKey, role, err := restarted.GetPrivateKey(pubKey.ID())
+		require.NoError(t, err)
+		require.Equal(t, data.CanonicalSnapshotRole, role)
+		require.Equal(t, pubKey.Public(), privKey.Public())
+	}
+}
+
+// Local key storage needs a supported backend, a passphrase, somewhere to
+// keep the keys, and a valid key algorithm.
+func TestGetLocalTrustServiceInvalidStorage(t *testing.T) {
+	invalids := map[string]string{
+		`{"backend": "file", "directory": "/tmp/keys"}`:                                                     "must provide a passphrase",
+		`{"backend": "file", "passphrase": "passphrase"}`:                                                   "must provide a directory",
+		`{"backend": "sqlite3", "passphrase": "passphrase"}`:                                                "must provide a non-empty database source",
+		`{"backend": "rethinkdb", "passphrase": "passphrase"}`:                                              "not a supported key storage backend",
+		`{"backend": "file", "directory": "/tmp/keys", "passphrase": "passphrase"}, "key_algorithm": "meh"`: "invalid key algorithm",
+	}
+	for keyStorage, message := range invalids {
+		var registerCalled = 0
+		config := fmt.Sprintf(`{"trust_service": {"type": "local", "key_storage": %s}}`, keyStorage)
+		_, _, err := getTrustService(configure(config), getNotarySigner, fakeRegisterer(&registerCalled))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), message)
+		require.Equal(t, 0, registerCalled)
+	}
+}
+
 // Invalid key algorithms result in an error if a remote trust service was
 // specified.
 func TestGetTrustServiceInvalidKeyAlgorithm(t *testing.T) {
@@ -361,6 +473,39 @@ func TestGetTrustServiceNoTLSConfig(t *testing.T) {
 	require.Equal(t, 1, registerCalled)
 }
 
+// If several notary-signer endpoints are configured, a pool of all of them is
+// used, and a single health function checks them all.
+func TestGetTrustServiceEndpoints(t *testing.T) {
+	configTemplate := `{
+		"trust_service": {
+			"type": "remote",
+			"endpoints": [%s],
+			"key_algorithm": "ecdsa"
+		}
+	}`
+	var registerCalled = 0
+
+	var addrs []string
+	var fakeNewSigner = func(hostname, port string, _ *tls.Config) (*client.NotarySigner, error) {
+		addrs = append(addrs, net.JoinHostPort(hostname, port))
+		return &client.NotarySigner{}, nil
+	}
+
+	trust, algo, err := getTrustService(configure(fmt.Sprintf(configTemplate, `"signer1:7899", "signer2:7899"`)),
+		fakeNewSigner, fakeRegisterer(&registerCalled))
+	require.NoError(t, err)
+	require.IsType(t, &signerpool.Pool{}, trust)
+	require.Equal(t, "ecdsa", algo)
+	require.Equal(t, []string{"signer1:7899", "signer2:7899"}, addrs)
+	require.Equal(t, 1, registerCalled)
+
+	_, _, err = getTrustService(configure(fmt.Sprintf(configTemplate, `"signer1"`)),
+		fakeNewSigner, fakeRegisterer(&registerCalled))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid trust service endpoint signer1")
+	require.Equal(t, 1, registerCalled)
+}
+
 // The rest of the functionality of getTrustService depends upon
 // utils.ConfigureClientTLS, so this test just asserts that if successful,
 // the correct tls.Config is returned based on all the configuration parameters
@@ -468,6 +613,50 @@ func TestGetMemoryStore(t *testing.T) {
 	require.Equal(t, 0, registerCalled)
 }
 
+func TestGetStoreRootCacheTTL(t *testing.T) {
+	var registerCalled = 0
+
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+
+	config := fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	store, err := getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+	require.NoError(t, err)
+	require.Equal(t, storage.DefaultRootCacheTTL, store.(*storage.MultiplexingStore).RootCacheTTL)
+
+	config = fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s", "cache_ttl": "5s"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	store, err = getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, store.(*storage.MultiplexingStore).RootCacheTTL)
+
+	config = fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s", "cache_ttl": "soon"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	_, err = getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+	require.Error(t, err)
+}
+
+func TestGetStoreRootCAs(t *testing.T) {
+	var registerCalled = 0
+
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+
+	config := fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	store, err := getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+	require.NoError(t, err)
+	require.Nil(t, store.(*storage.MultiplexingStore).RootCAs)
+
+	config = fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s", "ca_file": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend, Root)
+	store, err = getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+	require.NoError(t, err)
+	require.NotNil(t, store.(*storage.MultiplexingStore).RootCAs)
+
+	for _, caFile := range []string{"missing.crt", Key} {
+		config = fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s", "ca_file": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend, caFile)
+		_, err = getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+		require.Error(t, err)
+	}
+}
+
 func TestGetCacheConfig(t *testing.T) {
 	defaults := `{}`
 	valid := `{"caching": {"max_age": {"current_metadata": 0, "consistent_metadata": 31536000}}}`
@@ -519,3 +708,764 @@ func TestGetGUNPRefixes(t *testing.T) {
 		require.Error(t, err, "expected error with %s", invalid)
 	}
 }
+
+func TestGetAlternateRoots(t *testing.T) {
+	roots, err := getAlternateRoots(configure(`{"root_storage": {"rootGUN": "quay.dev"}}`))
+	require.NoError(t, err)
+	require.Equal(t, []storage.AlternateRootConfig{
+		{
+			Name:    storage.DefaultAlternateRootName,
+			Channel: storage.AlternateRoot,
+			RootGUN: "quay.dev",
+		},
+	}, roots)
+
+	roots, err = getAlternateRoots(configure(`{"alternate_roots": [
+		{"name": "quay", "channel_id": 3, "rootGUN": "quay.io", "gun_prefixes": ["quay.io/"]},
+		{"name": "tenant", "channel_id": 5, "rootGUN": "tenant.io"}
+	]}`))
+	require.NoError(t, err)
+	require.Equal(t, []storage.AlternateRootConfig{
+		{
+			Name:     "quay",
+			Channel:  notaryStorage.Channel{ID: 3, Name: "quay"},
+			RootGUN:  "quay.io",
+			Prefixes: []string{"quay.io/"},
+		},
+		{
+			Name:    "tenant",
+			Channel: notaryStorage.Channel{ID: 5, Name: "tenant"},
+			RootGUN: "tenant.io",
+		},
+	}, roots)
+
+	invalids := []string{
+		`{"alternate_roots": []}`,
+		`{"alternate_roots": [{"channel_id": 3, "rootGUN": "quay.io"}]}`,
+		`{"alternate_roots": [{"name": "signer", "channel_id": 3, "rootGUN": "quay.io"}]}`,
+		`{"alternate_roots": [{"name": "quay", "channel_id": 1, "rootGUN": "quay.io"}]}`,
+		`{"alternate_roots": [{"name": "quay", "channel_id": 4, "rootGUN": "quay.io"}]}`,
+		`{"alternate_roots": [{"name": "quay", "channel_id": 3}]}`,
+		`{"alternate_roots": [{"name": "quay", "channel_id": 3, "rootGUN": "quay.io", "gun_prefixes": ["quay.io"]}]}`,
+		`{"alternate_roots": [{"name": "quay", "channel_id": 3, "rootGUN": "quay.io"}, {"name": "quay", "channel_id": 5, "rootGUN": "quay.io"}]}`,
+		`{"alternate_roots": [{"name": "quay", "channel_id": 3, "rootGUN": "quay.io"}, {"name": "other", "channel_id": 3, "rootGUN": "other.io"}]}`,
+	}
+	for _, invalid := range invalids {
+		_, err := getAlternateRoots(configure(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestParseReswizzleFlags(t *testing.T) {
+	configFile, options, err := parseReswizzleFlags("default.json", []string{})
+	require.NoError(t, err)
+	require.Equal(t, "default.json", configFile)
+	require.Equal(t, storage.ReswizzleOptions{StartAfter: "0", BatchSize: 100}, options)
+
+	configFile, options, err = parseReswizzleFlags("default.json", []string{
+		"-config", "other.json", "-roots", "quay,partner", "-prefix", "quay.io/", "-start-after", "42", "-rate", "2.5", "-batch-size", "10",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "other.json", configFile)
+	require.Equal(t, storage.ReswizzleOptions{
+		Roots:      []string{"quay", "partner"},
+		Prefix:     "quay.io/",
+		StartAfter: "42",
+		Rate:       2.5,
+		BatchSize:  10,
+	}, options)
+
+	for _, args := range [][]string{{"-rate", "-1"}, {"-batch-size", "0"}, {"-unknown"}} {
+		_, _, err := parseReswizzleFlags("", args)
+		require.Error(t, err, "%v", args)
+	}
+}
+
+func TestRunReswizzle(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apostille-reswizzle")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.json")
+	config := fmt.Sprintf(`{"trust_service": {"type": "local"}, "storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`,
+		notary.MemoryBackend, notary.MemoryBackend)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0600))
+
+	var out bytes.Buffer
+	require.NoError(t, runReswizzle(configFile, []string{"-prefix", "quay.io/"}, &out))
+	var result storage.ReswizzleResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Empty(t, result.GUNs)
+	require.Equal(t, "0", result.LastChangeID)
+
+	require.Error(t, runReswizzle(configFile, []string{"-roots", "missing"}, &out))
+}
+
+func TestParseFsckFlags(t *testing.T) {
+	configFile, options, err := parseFsckFlags("default.json", []string{})
+	require.NoError(t, err)
+	require.Equal(t, "default.json", configFile)
+	require.Equal(t, storage.FsckOptions{StartAfter: "0", BatchSize: 100}, options)
+
+	configFile, options, err = parseFsckFlags("default.json", []string{
+		"-config", "other.json", "-roots", "quay", "-prefix", "quay.io/", "-start-after", "42", "-batch-size", "10", "-repair",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "other.json", configFile)
+	require.Equal(t, storage.FsckOptions{
+		Roots:      []string{"quay"},
+		Prefix:     "quay.io/",
+		StartAfter: "42",
+		BatchSize:  10,
+		Repair:     true,
+	}, options)
+
+	for _, args := range [][]string{{"-batch-size", "0"}, {"-unknown"}} {
+		_, _, err := parseFsckFlags("", args)
+		require.Error(t, err, "%v", args)
+	}
+}
+
+func TestRunFsck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apostille-fsck")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.json")
+	config := fmt.Sprintf(`{"trust_service": {"type": "local"}, "storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`,
+		notary.MemoryBackend, notary.MemoryBackend)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0600))
+
+	var out bytes.Buffer
+	require.NoError(t, runFsck(configFile, []string{"-repair"}, &out))
+	var report storage.FsckReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Equal(t, 0, report.Checked)
+	require.Empty(t, report.Problems)
+
+	require.Error(t, runFsck(configFile, []string{"-roots", "missing"}, &out))
+}
+
+func TestParseRootCertFlags(t *testing.T) {
+	configFile, csrOptions, err := parseRootCSRFlags("default.json", []string{})
+	require.NoError(t, err)
+	require.Equal(t, "default.json", configFile)
+	require.Equal(t, rootCSROptions{Root: storage.DefaultAlternateRootName}, csrOptions)
+
+	configFile, csrOptions, err = parseRootCSRFlags("default.json", []string{"-config", "other.json", "-root", "partner", "-common-name", "partner.io/*"})
+	require.NoError(t, err)
+	require.Equal(t, "other.json", configFile)
+	require.Equal(t, rootCSROptions{Root: "partner", CommonName: "partner.io/*"}, csrOptions)
+
+	configFile, certOptions, err := parseRootCertFlags("default.json", []string{"-root", "partner", "-cert", "root.pem", "-dry-run"})
+	require.NoError(t, err)
+	require.Equal(t, "default.json", configFile)
+	require.Equal(t, rootCertOptions{Root: "partner", CertFile: "root.pem", DryRun: true}, certOptions)
+
+	for _, args := range [][]string{{}, {"-unknown"}} {
+		_, _, err := parseRootCertFlags("", args)
+		require.Error(t, err, "%v", args)
+	}
+}
+
+func TestRunRootCSR(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apostille-root-csr")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.json")
+
+	dbFile := filepath.Join(tmpDir, "keys.db")
+	db, err := gorm.Open(notary.SQLiteBackend, dbFile)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateTable(&keydbstore.GormPrivateKey{}).Error)
+	require.NoError(t, db.Close())
+
+	// root keys are kept across commands, and in-memory keys can't sign certificate requests
+	for _, keyStorage := range []string{
+		`{"backend": "file", "directory": "keys", "passphrase": "pass"}`,
+		fmt.Sprintf(`{"backend": "%s", "db_url": %q, "passphrase": "pass"}`, notary.SQLiteBackend, dbFile),
+	} {
+		config := fmt.Sprintf(`{"trust_service": {"type": "local", "key_storage": %s},
+			"storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`, keyStorage, notary.MemoryBackend, notary.MemoryBackend)
+		require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0600))
+
+		var out bytes.Buffer
+		require.NoError(t, runRootCSR(configFile, []string{}, &out), keyStorage)
+		block, _ := pem.Decode(out.Bytes())
+		require.NotNil(t, block)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		require.NoError(t, csr.CheckSignature())
+		require.Equal(t, "*", csr.Subject.CommonName)
+
+		require.Error(t, runRootCSR(configFile, []string{"-root", "missing"}, &out))
+
+		// the certificate is validated before anything is changed
+		certFile := filepath.Join(tmpDir, "root.pem")
+		require.NoError(t, ioutil.WriteFile(certFile, out.Bytes(), 0600))
+		require.Error(t, runRootCert(configFile, []string{"-cert", certFile}, &out))
+		require.Error(t, runRootCert(configFile, []string{"-cert", filepath.Join(tmpDir, "missing.pem")}, &out))
+	}
+}
+
+func TestParsePinningBundleFlags(t *testing.T) {
+	configFile, options, err := parsePinningBundleFlags("default.json", []string{})
+	require.NoError(t, err)
+	require.Equal(t, "default.json", configFile)
+	require.Equal(t, pinningBundleOptions{}, options)
+
+	configFile, options, err = parsePinningBundleFlags("default.json", []string{"-config", "other.json", "-root", "partner", "-out", "pinning.json"})
+	require.NoError(t, err)
+	require.Equal(t, "other.json", configFile)
+	require.Equal(t, pinningBundleOptions{Root: "partner", OutFile: "pinning.json"}, options)
+
+	_, _, err = parsePinningBundleFlags("", []string{"-unknown"})
+	require.Error(t, err)
+}
+
+func TestRunPinningBundle(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apostille-pinning")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.json")
+	config := fmt.Sprintf(`{"trust_service": {"type": "local"}, "storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`,
+		notary.MemoryBackend, notary.MemoryBackend)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0600))
+
+	// commands don't generate roots, so there is no root to pin in memory storage
+	outFile := filepath.Join(tmpDir, "pinning.json")
+	var out bytes.Buffer
+	require.Error(t, runPinningBundle(configFile, []string{"-out", outFile}, &out))
+	require.Error(t, runPinningBundle(configFile, []string{"-root", "missing"}, &out))
+	_, err = os.Stat(outFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestGetRefresher(t *testing.T) {
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+
+	var registerCalled = 0
+	config := fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	store, err := getStore(configure(config), trust, fakeRegisterer(&registerCalled))
+	require.NoError(t, err)
+
+	valids := []string{
+		`{}`,
+		`{"refresher": {"interval": "10m", "lead_time": "24h", "batch_size": 10}}`,
+	}
+	invalids := []string{
+		`{"refresher": {"interval": "nope"}}`,
+		`{"refresher": {"interval": "-1h"}}`,
+		`{"refresher": {"lead_time": "0s"}}`,
+		`{"refresher": {"batch_size": 0}}`,
+		`{"refresher": {"batch_size": "many"}}`,
+	}
+
+	for _, valid := range valids {
+		refresher, err := getRefresher(configure(valid), store)
+		require.NoError(t, err)
+		require.NotNil(t, refresher)
+	}
+	for _, invalid := range invalids {
+		_, err := getRefresher(configure(invalid), store)
+		require.Error(t, err, "expected error with %s", invalid)
+	}
+
+	refresher, err := getRefresher(configure(`{"refresher": {"interval": "0s"}}`), store)
+	require.NoError(t, err)
+	require.Nil(t, refresher)
+
+	_, err = getRefresher(configure(`{}`), notaryStorage.NewMemStorage())
+	require.Error(t, err)
+
+	// the lead time has to be shorter than the shortest online role expiry, and the default is shortened to fit
+	store.(*storage.MultiplexingStore).Generation.Expiries = map[data.RoleName]time.Duration{data.CanonicalSnapshotRole: 48 * time.Hour}
+	refresher, err = getRefresher(configure(`{}`), store)
+	require.NoError(t, err)
+	require.NotNil(t, refresher)
+	for _, invalid := range []string{
+		`{"refresher": {"lead_time": "72h"}}`,
+		`{"refresher": {"lead_time": "48h"}}`,
+	} {
+		_, err := getRefresher(configure(invalid), store)
+		require.Error(t, err, "expected error with %s", invalid)
+	}
+	refresher, err = getRefresher(configure(`{"refresher": {"lead_time": "24h"}}`), store)
+	require.NoError(t, err)
+	require.NotNil(t, refresher)
+}
+
+func TestGetQuayRootGenerateIfMissing(t *testing.T) {
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+	store := notaryStorage.NewMemStorage()
+	rootMetaStore := storage.NewChannelMetastore(store, storage.Root)
+	root := storage.AlternateRootConfig{Name: storage.DefaultAlternateRootName, RootGUN: "quay.dev"}
+	config := configure(`{"root_storage": {"root": "generate-if-missing"}}`)
+
+	require.NoError(t, getQuayRoot(config, trust, store, root, storage.DefaultGenerationConfig()))
+	_, generated, err := rootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+
+	// restarting doesn't replace the root
+	require.NoError(t, getQuayRoot(config, trust, store, root, storage.DefaultGenerationConfig()))
+	_, stored, err := rootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, generated, stored)
+
+	require.Error(t, getQuayRoot(configure(`{"root_storage": {"root": "sometimes"}}`), trust, store, root, storage.DefaultGenerationConfig()))
+}
+
+func TestGetGenerationConfig(t *testing.T) {
+	generation, err := getGenerationConfig(configure(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, storage.DefaultGenerationConfig(), generation)
+
+	generation, err = getGenerationConfig(configure(`{"root_storage": {"generation": {
+		"key_algorithms": {"root": "rsa", "timestamp": "ed25519"},
+		"root_keys": 3,
+		"root_threshold": 2,
+		"certificate_validity": "87600h",
+		"expiries": {"targets": "720h", "timestamp": "1h"}
+	}}}`))
+	require.NoError(t, err)
+	require.Equal(t, storage.GenerationConfig{
+		KeyAlgorithms: map[data.RoleName]string{
+			data.CanonicalRootRole:      data.RSAKey,
+			data.CanonicalTimestampRole: data.ED25519Key,
+		},
+		RootKeys:            3,
+		RootThreshold:       2,
+		CertificateValidity: 87600 * time.Hour,
+		Expiries: map[data.RoleName]time.Duration{
+			data.CanonicalTargetsRole:   720 * time.Hour,
+			data.CanonicalTimestampRole: time.Hour,
+		},
+	}, generation)
+
+	invalids := []string{
+		`{"root_storage": {"generation": {"key_algorithms": {"root": "ed25519"}}}}`,
+		`{"root_storage": {"generation": {"key_algorithms": {"targets/releases": "ecdsa"}}}}`,
+		`{"root_storage": {"generation": {"root_threshold": 2}}}`,
+		`{"root_storage": {"generation": {"certificate_validity": "forever"}}}`,
+		`{"root_storage": {"generation": {"expiries": {"snapshot": "-1h"}}}}`,
+		`{"root_storage": {"generation": {"expiries": {"timestamp": "daily"}}}}`,
+		`{"root_storage": {"generation": "everything"}}`,
+	}
+	for _, config := range invalids {
+		_, err := getGenerationConfig(configure(config))
+		require.Error(t, err, config)
+	}
+}
+
+// generated roots have the keys, threshold and expiries of the generation config
+func TestGenerateRootWithGenerationConfig(t *testing.T) {
+	trust := cryptoservice.NewCryptoService(trustmanager.NewKeyMemoryStore(constPass))
+	rootMetaStore := storage.NewChannelMetastore(notaryStorage.NewMemStorage(), storage.Root)
+	gun := data.GUN("quay.dev")
+	generation := storage.DefaultGenerationConfig()
+	generation.KeyAlgorithms = map[data.RoleName]string{data.CanonicalTimestampRole: data.ED25519Key}
+	generation.RootKeys = 3
+	generation.RootThreshold = 2
+	generation.CertificateValidity = 24 * time.Hour
+	generation.Expiries = map[data.RoleName]time.Duration{data.CanonicalTimestampRole: time.Hour}
+	require.NoError(t, generateRoot(trust, rootMetaStore, gun, generation))
+
+	_, rootBytes, err := rootMetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	rootSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(rootBytes, rootSigned))
+	signedRoot, err := data.RootFromSigned(rootSigned)
+	require.NoError(t, err)
+	rootRole, err := signedRoot.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Len(t, rootRole.ListKeys(), 3)
+	require.Equal(t, 2, rootRole.Threshold)
+	require.Len(t, rootSigned.Signatures, 3)
+	for _, key := range rootRole.ListKeys() {
+		cert, err := tufutils.LoadCertFromPEM(key.Public())
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(24*time.Hour), cert.NotAfter, time.Minute)
+	}
+	require.WithinDuration(t, data.DefaultExpires(data.CanonicalRootRole), signedRoot.Signed.Expires, time.Minute)
+
+	timestampRole, err := signedRoot.BuildBaseRole(data.CanonicalTimestampRole)
+	require.NoError(t, err)
+	require.Equal(t, data.ED25519Key, timestampRole.ListKeys()[0].Algorithm())
+	_, tsBytes, err := rootMetaStore.GetCurrent(gun, data.CanonicalTimestampRole)
+	require.NoError(t, err)
+	tsSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(tsBytes, tsSigned))
+	signedTimestamp, err := data.TimestampFromSigned(tsSigned)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), signedTimestamp.Signed.Expires, time.Minute)
+}
+
+func TestGetQuayRootImport(t *testing.T) {
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+	root := storage.AlternateRootConfig{Name: storage.DefaultAlternateRootName, RootGUN: "quay.dev"}
+
+	// generate a root to export
+	exportStore := storage.NewChannelMetastore(notaryStorage.NewMemStorage(), storage.Root)
+	require.NoError(t, generateRoot(trust, exportStore, root.RootGUN, storage.DefaultGenerationConfig()))
+	_, rootBytes, err := exportStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	rootSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(rootBytes, rootSigned))
+	signedRoot, err := data.RootFromSigned(rootSigned)
+	require.NoError(t, err)
+	rootRole, err := signedRoot.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Len(t, rootRole.ListKeys(), 1)
+
+	tmpDir, err := ioutil.TempDir("", "apostille-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	rootFile := filepath.Join(tmpDir, "root.json")
+	certFile := filepath.Join(tmpDir, "root.crt")
+	require.NoError(t, ioutil.WriteFile(rootFile, rootBytes, 0600))
+	require.NoError(t, ioutil.WriteFile(certFile, rootRole.ListKeys()[0].Public(), 0600))
+
+	config := configure(fmt.Sprintf(`{"root_storage": {"root": "import", "root_file": "%s", "root_cert": "%s"}}`, rootFile, certFile))
+	store := notaryStorage.NewMemStorage()
+	rootMetaStore := storage.NewChannelMetastore(store, storage.Root)
+	require.NoError(t, getQuayRoot(config, trust, store, root, storage.DefaultGenerationConfig()))
+	_, stored, err := rootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, rootBytes, stored)
+	_, _, err = rootMetaStore.GetCurrent(root.RootGUN, data.CanonicalTimestampRole)
+	require.NoError(t, err)
+
+	// importing the same root again is fine
+	require.NoError(t, getQuayRoot(config, trust, store, root, storage.DefaultGenerationConfig()))
+
+	// a different stored root is refused
+	otherStore := notaryStorage.NewMemStorage()
+	require.NoError(t, generateRoot(trust, storage.NewChannelMetastore(otherStore, storage.Root), root.RootGUN, storage.DefaultGenerationConfig()))
+	require.Error(t, getQuayRoot(config, trust, otherStore, root, storage.DefaultGenerationConfig()))
+
+	// the certificate must be for the root gun
+	require.Error(t, getQuayRoot(config, trust, notaryStorage.NewMemStorage(), storage.AlternateRootConfig{Name: root.Name, RootGUN: "other.dev"}, storage.DefaultGenerationConfig()))
+
+	// the files are required
+	require.Error(t, getQuayRoot(configure(`{"root_storage": {"root": "import"}}`), trust, store, root, storage.DefaultGenerationConfig()))
+}
+
+func TestGetQuayRootImportRotated(t *testing.T) {
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+	root := storage.AlternateRootConfig{Name: storage.DefaultAlternateRootName, RootGUN: "quay.dev"}
+
+	// export a root that has been rotated twice
+	exportStore := notaryStorage.NewMemStorage()
+	require.NoError(t, generateRoot(trust, storage.NewChannelMetastore(exportStore, storage.Root), root.RootGUN, storage.DefaultGenerationConfig()))
+	exporter := storage.NewMultiplexingStore(notaryStorage.NewMemStorage(), exportStore, trust, storage.SignerRoot, storage.AlternateRoot, storage.Root, root.RootGUN, "targets/releases")
+	for i := 0; i < 2; i++ {
+		_, err = exporter.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalTimestampRole}, false, false)
+		require.NoError(t, err)
+	}
+	_, rootBytes, err := storage.NewChannelMetastore(exportStore, storage.Root).GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	rootSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(rootBytes, rootSigned))
+	signedRoot, err := data.RootFromSigned(rootSigned)
+	require.NoError(t, err)
+	require.Equal(t, 3, signedRoot.Signed.Version)
+	rootRole, err := signedRoot.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "apostille-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	rootFile := filepath.Join(tmpDir, "root.json")
+	certFile := filepath.Join(tmpDir, "root.crt")
+	require.NoError(t, ioutil.WriteFile(rootFile, rootBytes, 0600))
+	require.NoError(t, ioutil.WriteFile(certFile, rootRole.ListKeys()[0].Public(), 0600))
+	config := configure(fmt.Sprintf(`{"root_storage": {"root": "import", "root_file": "%s", "root_cert": "%s"}}`, rootFile, certFile))
+
+	// the imported root keeps its version, and the rest of the root repo is numbered to match
+	store := notaryStorage.NewMemStorage()
+	rootMetaStore := storage.NewChannelMetastore(store, storage.Root)
+	require.NoError(t, getQuayRoot(config, trust, store, root, storage.DefaultGenerationConfig()))
+	_, stored, err := rootMetaStore.GetVersion(root.RootGUN, data.CanonicalRootRole, 3)
+	require.NoError(t, err)
+	require.Equal(t, rootBytes, stored)
+	for _, role := range []data.RoleName{data.CanonicalRootRole, data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		_, meta, err := rootMetaStore.GetCurrent(root.RootGUN, role)
+		require.NoError(t, err)
+		var versioned struct {
+			Signed struct {
+				Version int `json:"version"`
+			} `json:"signed"`
+		}
+		require.NoError(t, json.Unmarshal(meta, &versioned))
+		require.Equal(t, 3, versioned.Signed.Version, role.String())
+	}
+
+	// the imported root can be rotated further
+	importer := storage.NewMultiplexingStore(notaryStorage.NewMemStorage(), store, trust, storage.SignerRoot, storage.AlternateRoot, storage.Root, root.RootGUN, "targets/releases")
+	result, err := importer.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalTimestampRole}, false, false)
+	require.NoError(t, err)
+	require.Equal(t, 4, result.Version)
+
+	// importing the root again is fine once it has been rotated, but not once it has been replaced
+	require.NoError(t, getQuayRoot(config, trust, store, root, storage.DefaultGenerationConfig()))
+	otherStore := notaryStorage.NewMemStorage()
+	require.NoError(t, generateRoot(trust, storage.NewChannelMetastore(otherStore, storage.Root), root.RootGUN, storage.DefaultGenerationConfig()))
+	other := storage.NewMultiplexingStore(notaryStorage.NewMemStorage(), otherStore, trust, storage.SignerRoot, storage.AlternateRoot, storage.Root, root.RootGUN, "targets/releases")
+	for i := 0; i < 3; i++ {
+		_, err = other.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalTimestampRole}, false, false)
+		require.NoError(t, err)
+	}
+	require.Error(t, getQuayRoot(config, trust, otherStore, root, storage.DefaultGenerationConfig()))
+}
+
+func TestRunServers(t *testing.T) {
+	trust := signed.NewEd25519()
+	serverConfig := server.Config{Addr: "127.0.0.1:0", Trust: trust, AuthMethod: "testing", ShutdownTimeout: time.Second}
+	adminServerConfig := server.Config{Addr: "127.0.0.1:0", Trust: trust, AuthMethod: "admin", Admin: true, ShutdownTimeout: time.Second}
+
+	// cancelling stops both servers
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- runServers(ctx, ctx, cancel, serverConfig, adminServerConfig)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers did not stop")
+	}
+
+	// a server that fails stops the other one
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	serverConfig.AuthMethod = "nope"
+	go func() {
+		stopped <- runServers(ctx, ctx, cancel, serverConfig, adminServerConfig)
+	}()
+	select {
+	case err := <-stopped:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers did not stop")
+	}
+}
+
+func TestGetShutdownTimeout(t *testing.T) {
+	timeout, err := getShutdownTimeout(configure(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, server.DefaultShutdownTimeout, timeout)
+
+	timeout, err = getShutdownTimeout(configure(`{"server": {"shutdown_timeout": "5s"}}`))
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, timeout)
+
+	for _, invalid := range []string{`"soon"`, `"0s"`, `"-1s"`} {
+		_, err := getShutdownTimeout(configure(`{"server": {"shutdown_timeout": ` + invalid + `}}`))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestGetRootMapping(t *testing.T) {
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+	config := fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	store, err := getStore(configure(config), trust, fakeRegisterer(new(int)))
+	require.NoError(t, err)
+	roots := store.(*storage.MultiplexingStore).AlternateRoots()
+
+	mapping, err := getRootMapping(configure(`{}`), roots)
+	require.NoError(t, err)
+	require.True(t, mapping.IsEmpty())
+
+	mapping, err = getRootMapping(configure(`{"auth": {"tuf_root": {
+		"default": "quay",
+		"users": [{"name": "CI-Bot", "root": "signer"}, {"name": "guest", "root": "$disabled"}]
+	}}}`), roots)
+	require.NoError(t, err)
+	require.Equal(t, auth.RootMapping{
+		Default: "quay",
+		Users:   map[string]string{"CI-Bot": "signer", "guest": auth.TufDisabled},
+	}, mapping)
+
+	invalids := []string{
+		`{"auth": {"tuf_root": {"default": "admin"}}}`,
+		`{"auth": {"tuf_root": {"users": [{"name": "ci", "root": "missing"}]}}}`,
+		`{"auth": {"tuf_root": {"users": [{"root": "signer"}]}}}`,
+		`{"auth": {"tuf_root": {"users": [{"name": "ci", "root": "signer"}, {"name": "ci", "root": "quay"}]}}}`,
+		`{"auth": {"tuf_root": {"users": "ci"}}}`,
+	}
+	for _, invalid := range invalids {
+		_, err := getRootMapping(configure(invalid), roots)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestGetAdminAuth(t *testing.T) {
+	publicTLS := &tls.Config{}
+	tlsConfig, method, options, err := getAdminAuth(configure(`{"server": {"admin_http_addr": ":2345"}}`), publicTLS)
+	require.NoError(t, err)
+	require.Equal(t, publicTLS, tlsConfig)
+	require.Equal(t, auth.AdminAuth, method)
+	require.Nil(t, options)
+
+	_, _, _, err = getAdminAuth(configure(fmt.Sprintf(`{
+		"server": {"admin_tls": {"tls_cert_file": "%s", "tls_key_file": "%s"}}
+	}`, Cert, Key)), publicTLS)
+	require.Error(t, err)
+
+	tlsConfig, method, options, err = getAdminAuth(configure(fmt.Sprintf(`{
+		"server": {
+			"admin_tls": {
+				"tls_cert_file": "%s",
+				"tls_key_file": "%s",
+				"client_ca_file": "%s",
+				"allowed_subjects": ["ops"],
+				"allowed_sans": ["admin.example.com"]
+			}
+		}
+	}`, Cert, Key, Root)), publicTLS)
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+	require.NotNil(t, tlsConfig.ClientCAs)
+	require.Equal(t, auth.AdminCertAuth, method)
+	require.Equal(t, []string{"ops"}, options["allowedSubjects"])
+	require.Equal(t, []string{"admin.example.com"}, options["allowedSANs"])
+
+	ac, err := auth.GetAccessController(method, options, auth.RootMapping{})
+	require.NoError(t, err)
+	require.IsType(t, &auth.CertAccessController{}, ac)
+}
+
+func TestGetAuditor(t *testing.T) {
+	auditor, err := getAuditor(configure(`{}`))
+	require.NoError(t, err)
+	require.Nil(t, auditor)
+
+	auditor, err = getAuditor(configure(`{"audit": {"sinks": [{"type": "stdout"}]}}`))
+	require.NoError(t, err)
+	require.NotNil(t, auditor)
+
+	for _, config := range []string{
+		`{"audit": {"sinks": [{"type": "missing"}]}}`,
+		`{"audit": {"sinks": [{"type": "file"}]}}`,
+		`{"audit": {"sinks": "stdout"}}`,
+	} {
+		_, err = getAuditor(configure(config))
+		require.Error(t, err, config)
+	}
+}
+
+func TestGetWebhookNotifier(t *testing.T) {
+	notifier, err := getWebhookNotifier(configure(`{}`))
+	require.NoError(t, err)
+	require.Nil(t, notifier)
+
+	notifier, err = getWebhookNotifier(configure(`{"webhooks": {"endpoints": [{"url": "https://example.com/hook", "secret": "s"}]}}`))
+	require.NoError(t, err)
+	require.NotNil(t, notifier)
+
+	queueDir, err := ioutil.TempDir("", "webhooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(queueDir)
+	notifier, err = getWebhookNotifier(configure(fmt.Sprintf(`{"webhooks": {
+		"endpoints": [{"url": "https://example.com/hook"}, {"url": "http://other.example.com"}],
+		"queue_dir": %q,
+		"max_attempts": 5,
+		"min_backoff": "2s",
+		"max_backoff": "1h",
+		"timeout": "30s"
+	}}`, filepath.Join(queueDir, "queue"))))
+	require.NoError(t, err)
+	require.NotNil(t, notifier)
+	_, err = os.Stat(filepath.Join(queueDir, "queue"))
+	require.NoError(t, err)
+
+	for _, config := range []string{
+		`{"webhooks": {"endpoints": "https://example.com/hook"}}`,
+		`{"webhooks": {"endpoints": [{"url": "example.com/hook"}]}}`,
+		`{"webhooks": {"endpoints": [{"url": "ftp://example.com/hook"}]}}`,
+		`{"webhooks": {"endpoints": [{"url": "https://example.com/hook"}], "max_attempts": 0}}`,
+		`{"webhooks": {"endpoints": [{"url": "https://example.com/hook"}], "min_backoff": "soon"}}`,
+		`{"webhooks": {"endpoints": [{"url": "https://example.com/hook"}], "timeout": "-1s"}}`,
+	} {
+		_, err = getWebhookNotifier(configure(config))
+		require.Error(t, err, config)
+	}
+}
+
+func TestGetSimpleSigner(t *testing.T) {
+	signer, err := getSimpleSigner(configure(`{}`))
+	require.NoError(t, err)
+	require.Nil(t, signer)
+
+	dir, err := ioutil.TempDir("", "simplesigning")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entity, err := openpgp.NewEntity("apostille", "", "", nil)
+	require.NoError(t, err)
+	keyFile, err := os.Create(filepath.Join(dir, "key.asc"))
+	require.NoError(t, err)
+	w, err := armor.Encode(keyFile, openpgp.PrivateKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.SerializePrivate(w, nil))
+	require.NoError(t, w.Close())
+	require.NoError(t, keyFile.Close())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "invalid.asc"), []byte("not a key"), 0600))
+
+	signer, err = getSimpleSigner(configure(fmt.Sprintf(`{"trust_service": {"simple_signing": {"key_file": %q}}}`, keyFile.Name())))
+	require.NoError(t, err)
+	require.Equal(t, entity.PrimaryKey.KeyIdString(), signer.KeyID())
+
+	for _, name := range []string{"missing.asc", "invalid.asc"} {
+		_, err = getSimpleSigner(configure(fmt.Sprintf(`{"trust_service": {"simple_signing": {"key_file": %q}}}`, filepath.Join(dir, name))))
+		require.Error(t, err, name)
+	}
+}
+
+func TestGetAdmissionPolicy(t *testing.T) {
+	trust, err := testTrustService(t)
+	require.NoError(t, err)
+	config := fmt.Sprintf(`{"storage": {"backend": "%s"}, "root_storage": {"backend": "%s"}}`, notary.MemoryBackend, notary.MemoryBackend)
+	store, err := getStore(configure(config), trust, fakeRegisterer(new(int)))
+	require.NoError(t, err)
+	roots := store.(*storage.MultiplexingStore).AlternateRoots()
+
+	policy, err := getAdmissionPolicy(configure(`{}`), roots)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	dir, err := ioutil.TempDir("", "admission")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("kube-apiserver-token\n"), 0600))
+	emptyFile := filepath.Join(dir, "empty")
+	require.NoError(t, ioutil.WriteFile(emptyFile, nil, 0600))
+
+	policy, err = getAdmissionPolicy(configure(fmt.Sprintf(`{"admission": {"token_file": %q, "rules": [
+		{"namespaces": ["prod"], "gun_prefixes": ["quay.io/"], "root": "quay"},
+		{"root": "signer", "require_digest": true}
+	]}}`, tokenFile)), roots)
+	require.NoError(t, err)
+	require.Equal(t, &server.AdmissionPolicy{Rules: []server.AdmissionRule{
+		{Namespaces: []string{"prod"}, Prefixes: []string{"quay.io/"}, Root: "quay"},
+		{Root: "signer", RequireDigest: true},
+	}, Token: "kube-apiserver-token"}, policy)
+
+	for _, invalid := range []string{
+		`{"admission": {"rules": [{"root": "signer"}]}}`,
+		fmt.Sprintf(`{"admission": {"token_file": %q, "rules": [{"root": "signer"}]}}`, filepath.Join(dir, "missing")),
+		fmt.Sprintf(`{"admission": {"token_file": %q, "rules": [{"root": "signer"}]}}`, emptyFile),
+		fmt.Sprintf(`{"admission": {"token_file": %q, "rules": [{"root": "missing"}]}}`, tokenFile),
+		fmt.Sprintf(`{"admission": {"token_file": %q, "rules": [{"gun_prefixes": ["quay.io/"]}]}}`, tokenFile),
+		`{"admission": {"rules": "quay"}}`,
+	} {
+		_, err := getAdmissionPolicy(configure(invalid), roots)
+		require.Error(t, err, invalid)
+	}
+}
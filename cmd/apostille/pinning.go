@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+)
+
+// pinningBundleCommand is the subcommand that writes the trust pinning bundle of an alternate root
+const pinningBundleCommand = "pinning-bundle"
+
+// pinningBundleOptions are the flags of the pinning-bundle command
+type pinningBundleOptions struct {
+	Root    string
+	OutFile string
+}
+
+// parsePinningBundleFlags parses the flags of the pinning-bundle command into the config file path and the bundle to
+// write. The config file defaults to the one given before the command.
+func parsePinningBundleFlags(defaultConfigFile string, args []string) (string, pinningBundleOptions, error) {
+	var (
+		configFile string
+		options    pinningBundleOptions
+	)
+	flags := flag.NewFlagSet(pinningBundleCommand, flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", defaultConfigFile, "Path to configuration file")
+	flags.StringVar(&options.Root, "root", "", "Name of the alternate root (default the first one)")
+	flags.StringVar(&options.OutFile, "out", "", "Path to write the bundle to (default standard output)")
+	if err := flags.Parse(args); err != nil {
+		return "", pinningBundleOptions{}, err
+	}
+	return configFile, options, nil
+}
+
+// runPinningBundle writes the trust pinning bundle of an alternate root, the same one served at /_trust/pinning, to
+// a file for distribution or to `out`
+func runPinningBundle(defaultConfigFile string, args []string, out io.Writer) error {
+	configFile, options, err := parsePinningBundleFlags(defaultConfigFile, args)
+	if err != nil {
+		return err
+	}
+	store, err := getCommandStore(configFile)
+	if err != nil {
+		return err
+	}
+	bundle, err := store.PinningBundle(options.Root)
+	if err != nil {
+		return err
+	}
+	if options.OutFile == "" {
+		return writeJSON(out, bundle)
+	}
+	file, err := os.OpenFile(options.OutFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(file, bundle); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/coreos-inc/apostille/storage"
+)
+
+// reswizzleCommand is the subcommand that regenerates the alternate-rooted metadata of every repository
+const reswizzleCommand = "reswizzle"
+
+// parseReswizzleFlags parses the flags of the reswizzle command into the config file path and re-swizzling options.
+// The config file defaults to the one given before the command.
+func parseReswizzleFlags(defaultConfigFile string, args []string) (string, storage.ReswizzleOptions, error) {
+	var (
+		configFile string
+		roots      string
+		options    storage.ReswizzleOptions
+	)
+	flags := flag.NewFlagSet(reswizzleCommand, flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", defaultConfigFile, "Path to configuration file")
+	flags.StringVar(&roots, "roots", "", "Comma-separated names of the alternate roots to re-swizzle under (default all)")
+	flags.StringVar(&options.Prefix, "prefix", "", "Only re-swizzle repositories whose GUN starts with this prefix")
+	flags.StringVar(&options.StartAfter, "start-after", "0", "Resume after this change ID, as printed by a previous run")
+	flags.Float64Var(&options.Rate, "rate", 0, "Maximum number of repositories to re-swizzle per second (0 is unlimited)")
+	flags.IntVar(&options.BatchSize, "batch-size", 100, "Number of changes to read from storage at a time")
+	if err := flags.Parse(args); err != nil {
+		return "", storage.ReswizzleOptions{}, err
+	}
+	if options.Rate < 0 {
+		return "", storage.ReswizzleOptions{}, fmt.Errorf("rate must not be negative")
+	}
+	if options.BatchSize <= 0 {
+		return "", storage.ReswizzleOptions{}, fmt.Errorf("batch size must be positive")
+	}
+	if roots != "" {
+		options.Roots = strings.Split(roots, ",")
+	}
+	return configFile, options, nil
+}
+
+// runReswizzle regenerates the alternate-rooted metadata of every repository from its signer-rooted metadata, and
+// writes the result to `out`. Interrupting it stops after the current repository; the printed last change ID can be
+// passed to -start-after to resume.
+func runReswizzle(defaultConfigFile string, args []string, out io.Writer) error {
+	configFile, options, err := parseReswizzleFlags(defaultConfigFile, args)
+	if err != nil {
+		return err
+	}
+	store, err := getCommandStore(configFile)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	result, reswizzleErr := store.ReswizzleAll(ctx, options)
+	if result != nil {
+		if err := writeJSON(out, result); err != nil {
+			return err
+		}
+	}
+	if reswizzleErr != nil {
+		if result != nil {
+			return fmt.Errorf("re-swizzle stopped, resume with -start-after %s: %s", result.LastChangeID, reswizzleErr.Error())
+		}
+		return reswizzleErr
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos-inc/apostille/storage"
+	"github.com/docker/notary"
+	"github.com/docker/notary/cryptoservice"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	tufUtils "github.com/docker/notary/tuf/utils"
+	"github.com/spf13/viper"
+)
+
+// Modes for `root_storage.root`, which controls how the root repos of alternate roots are created on startup
+const (
+	// rootModeGenerate generates a new root on every start, rotating the root for every client
+	rootModeGenerate = "generate"
+	// rootModeGenerateIfMissing generates a new root only if none is stored yet
+	rootModeGenerateIfMissing = "generate-if-missing"
+	// rootModeImport imports an existing root.json and root certificate from disk
+	rootModeImport = "import"
+)
+
+// rootSource is where the root repo of an alternate root is imported from
+type rootSource struct {
+	rootFile string
+	certFile string
+}
+
+// getRootSource parses the files that the root repo of an alternate root is imported from. The default root is
+// imported from `root_storage.root_file` and `root_storage.root_cert`; roots listed in `alternate_roots` use the
+// `root_file` and `root_cert` of their entry.
+func getRootSource(configuration *viper.Viper, root storage.AlternateRootConfig) (rootSource, error) {
+	var source rootSource
+	if !configuration.IsSet("alternate_roots") {
+		source = rootSource{
+			rootFile: configuration.GetString("root_storage.root_file"),
+			certFile: configuration.GetString("root_storage.root_cert"),
+		}
+	} else {
+		var options []alternateRootOptions
+		if err := configuration.MarshalKey("alternate_roots", &options); err != nil {
+			return rootSource{}, fmt.Errorf("invalid alternate_roots: %s", err.Error())
+		}
+		for _, option := range options {
+			if option.Name == root.Name {
+				source = rootSource{
+					rootFile: option.RootFile,
+					certFile: option.RootCert,
+				}
+			}
+		}
+	}
+	if source.rootFile == "" || source.certFile == "" {
+		return rootSource{}, fmt.Errorf("a root file and root certificate are required to import the %s root", root.Name)
+	}
+	return source, nil
+}
+
+// getQuayRoots makes sure the root repo of every alternate root of a store exists, according to `root_storage.root`
+func getQuayRoots(configuration *viper.Viper, cs signed.CryptoService, store *storage.MultiplexingStore) error {
+	for _, root := range store.AlternateRoots() {
+		if err := getQuayRoot(configuration, cs, root.RootMetaStore, root.AlternateRootConfig, store.Generation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getQuayRoot makes sure the root repo for an alternate root exists in the root store, according to
+// `root_storage.root`. If it is unset, the root repo must have been created some other way. Generated roots use the
+// keys of the generation config, and both generated and imported roots are first signed with its expiries.
+func getQuayRoot(configuration *viper.Viper, cs signed.CryptoService, store notaryStorage.MetaStore, root storage.AlternateRootConfig, generation storage.GenerationConfig) error {
+	rootMetaStore := storage.NewChannelMetastore(store, storage.Root)
+
+	switch mode := configuration.GetString("root_storage.root"); mode {
+	case "":
+		return nil
+	case rootModeGenerate:
+		logrus.Warnf("Generating a new root for %s on every start; clients will see the root rotate on restart", root.RootGUN)
+		return generateRoot(cs, rootMetaStore, root.RootGUN, generation)
+	case rootModeGenerateIfMissing:
+		existing, err := getStoredRoot(rootMetaStore, root.RootGUN)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			logrus.Infof("Using stored root for %s", root.RootGUN)
+			return nil
+		}
+		err = generateRoot(cs, rootMetaStore, root.RootGUN, generation)
+		if err != nil {
+			// another replica may have generated the root first
+			if existing, _ := getStoredRoot(rootMetaStore, root.RootGUN); existing != nil {
+				logrus.Infof("Root for %s was generated concurrently, using stored root", root.RootGUN)
+				return nil
+			}
+		}
+		return err
+	case rootModeImport:
+		source, err := getRootSource(configuration, root)
+		if err != nil {
+			return err
+		}
+		return importRoot(cs, rootMetaStore, root.RootGUN, source, generation)
+	default:
+		return fmt.Errorf("%s is not a supported root_storage.root mode", mode)
+	}
+}
+
+// getStoredRoot returns the root stored for a gun in the root store, or nil if there isn't one
+func getStoredRoot(rootMetaStore notaryStorage.MetaStore, gun data.GUN) ([]byte, error) {
+	_, rootBytes, err := rootMetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return rootBytes, nil
+}
+
+// generateRoot creates new root, targets, snapshot and timestamp keys and stores a new root repo for a gun, with the
+// keys, threshold and expiries of a generation config
+func generateRoot(cs signed.CryptoService, rootMetaStore notaryStorage.MetaStore, gun data.GUN, generation storage.GenerationConfig) error {
+	logrus.Infof("Generating root repo for %s", gun.String())
+
+	// Generate root keys, each wrapped in a certificate
+	var rootKeys []data.PublicKey
+	for i := 0; i < generation.RootKeys; i++ {
+		rootPublicKey, err := cs.Create(data.CanonicalRootRole, gun, generation.KeyAlgorithm(data.CanonicalRootRole))
+		if err != nil {
+			return err
+		}
+		rootKey, _, err := cs.GetPrivateKey(rootPublicKey.ID())
+		if err != nil {
+			return err
+		}
+		startTime := time.Now()
+		cert, err := cryptoservice.GenerateCertificate(rootKey, gun, startTime, startTime.Add(generation.CertificateValidity))
+		if err != nil {
+			return err
+		}
+		x509PublicKey := tufUtils.CertToKey(cert)
+		if x509PublicKey == nil {
+			return fmt.Errorf("cannot use regenerated certificate: format %v", cert.PublicKeyAlgorithm)
+		}
+		rootKeys = append(rootKeys, x509PublicKey)
+	}
+	rootRole := data.NewBaseRole(data.CanonicalRootRole, generation.RootThreshold, rootKeys...)
+
+	// Generate the online roles
+	onlineRoles := make(map[data.RoleName]data.BaseRole)
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		key, err := cs.Create(role, gun, generation.KeyAlgorithm(role))
+		if err != nil {
+			return err
+		}
+		onlineRoles[role] = data.NewBaseRole(role, notary.MinThreshold, key)
+	}
+
+	// Generate full repo
+	repo := tuf.NewRepo(cs)
+	err := repo.InitRoot(
+		rootRole,
+		onlineRoles[data.CanonicalTimestampRole],
+		onlineRoles[data.CanonicalSnapshotRole],
+		onlineRoles[data.CanonicalTargetsRole],
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
+	rootSigned, err := repo.SignRoot(generation.Expires(data.CanonicalRootRole), nil)
+	if err != nil {
+		return err
+	}
+	rootBytes, err := json.Marshal(rootSigned)
+	if err != nil {
+		return err
+	}
+	return storeRootRepo(rootMetaStore, gun, repo, rootBytes, generation)
+}
+
+// importRoot stores the root repo for a gun from an existing root.json and root certificate. The root must be signed
+// by the certificate's key, and the online keys it lists must be held by the trust service. If a root is already
+// stored for the gun, the imported root must be the same version of it, so that the root can be rotated after it has
+// been imported.
+func importRoot(cs signed.CryptoService, rootMetaStore notaryStorage.MetaStore, gun data.GUN, source rootSource, generation storage.GenerationConfig) error {
+	logrus.Infof("Importing root repo for %s from %s", gun.String(), source.rootFile)
+
+	rootBytes, err := ioutil.ReadFile(source.rootFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tufUtils.LoadCertFromFile(source.certFile)
+	if err != nil {
+		return err
+	}
+	if cert.Subject.CommonName != gun.String() {
+		return fmt.Errorf("root certificate %s is for %s, not %s", source.certFile, cert.Subject.CommonName, gun)
+	}
+
+	rootSigned := &data.Signed{}
+	if err := json.Unmarshal(rootBytes, rootSigned); err != nil {
+		return err
+	}
+	signedRoot, err := data.RootFromSigned(rootSigned)
+	if err != nil {
+		return err
+	}
+	rootRole, err := signedRoot.BuildBaseRole(data.CanonicalRootRole)
+	if err != nil {
+		return err
+	}
+	certKey := tufUtils.CertToKey(cert)
+	if certKey == nil {
+		return fmt.Errorf("cannot use root certificate: format %v", cert.PublicKeyAlgorithm)
+	}
+	if _, ok := rootRole.Keys[certKey.ID()]; !ok {
+		return fmt.Errorf("root certificate %s is not a root key of %s", source.certFile, source.rootFile)
+	}
+	if err := signed.VerifySignatures(rootSigned, rootRole); err != nil {
+		return fmt.Errorf("%s is not signed by its root keys: %s", source.rootFile, err.Error())
+	}
+
+	existing, err := getStoredRoot(rootMetaStore, gun)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if bytes.Equal(existing, rootBytes) {
+			logrus.Infof("Stored root for %s matches %s", gun, source.rootFile)
+			return nil
+		}
+		// the root may have been rotated since it was imported
+		_, stored, err := rootMetaStore.GetVersion(gun, data.CanonicalRootRole, signedRoot.Signed.Version)
+		if err != nil {
+			if _, ok := err.(notaryStorage.ErrNotFound); !ok {
+				return err
+			}
+		}
+		if !bytes.Equal(stored, rootBytes) {
+			return fmt.Errorf("stored root for %s does not descend from %s", gun, source.rootFile)
+		}
+		logrus.Infof("Stored root for %s has been rotated since version %d in %s", gun, signedRoot.Signed.Version, source.rootFile)
+		return nil
+	}
+
+	repo := tuf.NewRepo(cs)
+	repo.Root = signedRoot
+	return storeRootRepo(rootMetaStore, gun, repo, rootBytes, generation)
+}
+
+// storeRootRepo signs new targets, snapshot and timestamp metadata for a repo with its online keys, and stores them
+// along with its root as the root repo for a gun. Every role is stored under the version of the root, which is 1 for a
+// generated root but may be later for an imported one.
+func storeRootRepo(rootMetaStore notaryStorage.MetaStore, gun data.GUN, repo *tuf.Repo, rootBytes []byte, generation storage.GenerationConfig) error {
+	version := repo.Root.Signed.Version
+	if _, err := repo.InitTargets(data.CanonicalTargetsRole); err != nil {
+		return err
+	}
+	if err := repo.InitSnapshot(); err != nil {
+		return err
+	}
+	if err := repo.InitTimestamp(); err != nil {
+		return err
+	}
+	// signing increments the versions
+	repo.Targets[data.CanonicalTargetsRole].Signed.Version = version - 1
+	repo.Snapshot.Signed.Version = version - 1
+	repo.Timestamp.Signed.Version = version - 1
+
+	targetsSigned, err := repo.SignTargets(data.CanonicalTargetsRole, generation.Expires(data.CanonicalTargetsRole))
+	if err != nil {
+		return err
+	}
+	ssSigned, err := repo.SignSnapshot(generation.Expires(data.CanonicalSnapshotRole))
+	if err != nil {
+		return err
+	}
+	tsSigned, err := repo.SignTimestamp(generation.Expires(data.CanonicalTimestampRole))
+	if err != nil {
+		return err
+	}
+
+	targetsBytes, err := json.Marshal(targetsSigned)
+	if err != nil {
+		return err
+	}
+	ssBytes, err := json.Marshal(ssSigned)
+	if err != nil {
+		return err
+	}
+	tsBytes, err := json.Marshal(tsSigned)
+	if err != nil {
+		return err
+	}
+
+	updates := []notaryStorage.MetaUpdate{
+		{
+			Role:     data.CanonicalRootRole,
+			Version:  version,
+			Data:     rootBytes,
+			Channels: []*notaryStorage.Channel{&storage.Root},
+		},
+		{
+			Role:     data.CanonicalTargetsRole,
+			Version:  version,
+			Data:     targetsBytes,
+			Channels: []*notaryStorage.Channel{&storage.Root},
+		},
+		{
+			Role:     data.CanonicalSnapshotRole,
+			Version:  version,
+			Data:     ssBytes,
+			Channels: []*notaryStorage.Channel{&storage.Root},
+		},
+		{
+			Role:     data.CanonicalTimestampRole,
+			Version:  version,
+			Data:     tsBytes,
+			Channels: []*notaryStorage.Channel{&storage.Root},
+		},
+	}
+	return rootMetaStore.UpdateMany(gun, updates)
+}
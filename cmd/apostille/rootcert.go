@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/coreos-inc/apostille/storage"
+)
+
+const (
+	// rootCSRCommand is the subcommand that creates a new root key for an alternate root, and prints a certificate
+	// signing request for it. It requires a local trust service with file or SQL key storage, since keys in
+	// notary-signer can't sign certificate requests.
+	rootCSRCommand = "root-csr"
+	// rootCertCommand is the subcommand that installs a CA-issued certificate as the root key of an alternate root
+	rootCertCommand = "root-cert"
+)
+
+// rootCSROptions are the flags of the root-csr command
+type rootCSROptions struct {
+	Root       string
+	CommonName string
+}
+
+// parseRootCSRFlags parses the flags of the root-csr command into the config file path and the root to request a
+// certificate for. The config file defaults to the one given before the command.
+func parseRootCSRFlags(defaultConfigFile string, args []string) (string, rootCSROptions, error) {
+	var (
+		configFile string
+		options    rootCSROptions
+	)
+	flags := flag.NewFlagSet(rootCSRCommand, flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", defaultConfigFile, "Path to configuration file")
+	flags.StringVar(&options.Root, "root", storage.DefaultAlternateRootName, "Name of the alternate root")
+	flags.StringVar(&options.CommonName, "common-name", "", "Common name to request, a wildcard covering every GUN of the root (default the root's GUN prefix followed by *)")
+	if err := flags.Parse(args); err != nil {
+		return "", rootCSROptions{}, err
+	}
+	return configFile, options, nil
+}
+
+// runRootCSR creates a new root key for an alternate root, and writes a PEM encoded certificate signing request for
+// it to `out`, for the CA to issue a certificate that is installed with the root-cert command. Only the local trust
+// service with key storage is supported.
+func runRootCSR(defaultConfigFile string, args []string, out io.Writer) error {
+	configFile, options, err := parseRootCSRFlags(defaultConfigFile, args)
+	if err != nil {
+		return err
+	}
+	store, err := getCommandStore(configFile)
+	if err != nil {
+		return err
+	}
+	csr, err := store.RootCertificateRequest(options.Root, options.CommonName)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(csr)
+	return err
+}
+
+// rootCertOptions are the flags of the root-cert command
+type rootCertOptions struct {
+	Root     string
+	CertFile string
+	DryRun   bool
+}
+
+// parseRootCertFlags parses the flags of the root-cert command into the config file path and the certificate to
+// install. The config file defaults to the one given before the command.
+func parseRootCertFlags(defaultConfigFile string, args []string) (string, rootCertOptions, error) {
+	var (
+		configFile string
+		options    rootCertOptions
+	)
+	flags := flag.NewFlagSet(rootCertCommand, flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", defaultConfigFile, "Path to configuration file")
+	flags.StringVar(&options.Root, "root", storage.DefaultAlternateRootName, "Name of the alternate root")
+	flags.StringVar(&options.CertFile, "cert", "", "Path to the PEM encoded certificate, followed by its intermediates")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "Only validate the certificate")
+	if err := flags.Parse(args); err != nil {
+		return "", rootCertOptions{}, err
+	}
+	if options.CertFile == "" {
+		return "", rootCertOptions{}, fmt.Errorf("a certificate file is required")
+	}
+	return configFile, options, nil
+}
+
+// runRootCert installs a CA-issued certificate as the root key of an alternate root, re-swizzling the repositories
+// rooted under it, and writes the result to `out`
+func runRootCert(defaultConfigFile string, args []string, out io.Writer) error {
+	configFile, options, err := parseRootCertFlags(defaultConfigFile, args)
+	if err != nil {
+		return err
+	}
+	certPEM, err := ioutil.ReadFile(options.CertFile)
+	if err != nil {
+		return err
+	}
+	store, err := getCommandStore(configFile)
+	if err != nil {
+		return err
+	}
+	result, err := store.InstallRootCertificate(options.Root, certPEM, options.DryRun)
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, result)
+}
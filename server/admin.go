@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/coreos-inc/apostille/audit"
+	"github.com/coreos-inc/apostille/auth"
+	"github.com/coreos-inc/apostille/storage"
+	ctxutil "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	registryAuth "github.com/docker/distribution/registry/auth"
+	"github.com/docker/notary/server/errors"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/utils"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// ctxKey is the type of the context keys apostille sets
+type ctxKey int
+
+const (
+	// CtxKeyMultiplexingStore is the context key for the MultiplexingStore that the admin API manages
+	CtxKeyMultiplexingStore ctxKey = iota
+	// CtxKeySimpleSigner is the context key for the simplesigning.Signer that signs lookaside signatures
+	CtxKeySimpleSigner
+	// CtxKeyAdmissionPolicy is the context key for the AdmissionPolicy that pods are checked against
+	CtxKeyAdmissionPolicy
+)
+
+// rotateRootRequest is the body of a request to rotate the keys of an alternate root
+type rotateRootRequest struct {
+	Roles  []data.RoleName `json:"roles"`
+	DryRun bool            `json:"dry_run"`
+	// Force rotates root keys that have a CA-issued certificate, replacing it with a self-signed one
+	Force bool `json:"force"`
+	// CSR creates the new root key without publishing it, and responds with a certificate signing request for it
+	CSR        bool   `json:"csr"`
+	CommonName string `json:"common_name"`
+}
+
+// RotateRootHandler rotates the keys of an alternate root, and re-swizzles the repos rooted under it.
+// It responds with the new root version and the GUNs that were re-signed. When a CSR is requested, the response holds
+// a certificate signing request for the new root key instead, which replaces the root keys once InstallRootCertHandler
+// installs the issued certificate.
+func RotateRootHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	name := mux.Vars(r)["root"]
+	logger := ctxutil.GetLoggerWithField(ctx, name, "root")
+
+	if ctx.Value(auth.TufRootSigner) != "admin" {
+		return errcode.ErrorCodeDenied.WithDetail("root rotation requires the admin interface")
+	}
+	store, ok := ctx.Value(CtxKeyMultiplexingStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 POST: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+	if _, ok := store.AlternateRootStore(name); !ok {
+		return errors.ErrGenericNotFound.WithDetail(fmt.Sprintf("no alternate root named %s", name))
+	}
+
+	var request rotateRootRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return errors.ErrMalformedJSON.WithDetail(err.Error())
+	}
+	if len(request.Roles) == 0 {
+		return errors.ErrInvalidParams.WithDetail("at least one role to rotate is required")
+	}
+	for _, role := range request.Roles {
+		if !data.IsBaseRole(role) {
+			return errors.ErrInvalidRole.WithDetail(role)
+		}
+	}
+	event := audit.EventFromContext(ctx)
+	event.SetDetails(map[string]interface{}{"root": name, "roles": request.Roles, "dry_run": request.DryRun, "force": request.Force,
+		"csr": request.CSR})
+
+	var (
+		result *storage.RotationResult
+		err    error
+	)
+	if request.CSR {
+		rotatesRoot := false
+		for _, role := range request.Roles {
+			rotatesRoot = rotatesRoot || role == data.CanonicalRootRole
+		}
+		if !rotatesRoot {
+			return errors.ErrInvalidParams.WithDetail("certificate requests are only made when rotating the root role")
+		}
+		result, err = store.RotateAlternateRootCSR(name, request.Roles, request.CommonName, request.DryRun)
+	} else {
+		result, err = store.RotateAlternateRoot(name, request.Roles, request.DryRun, request.Force)
+	}
+	if err != nil {
+		switch err.(type) {
+		case storage.ErrCARootCertificate, storage.ErrInvalidRootCertificate:
+			return errors.ErrInvalidParams.WithDetail(err.Error())
+		}
+		logger.Errorf("500 POST: unable to rotate %v keys: %s", request.Roles, err.Error())
+		return errors.ErrUpdating.WithDetail(err.Error())
+	}
+	// a rotation that only requests a root certificate doesn't publish a new root
+	if !request.DryRun && len(result.Rotated) > 0 {
+		event.AddRole(data.CanonicalRootRole.String(), result.Version)
+	}
+	if request.DryRun {
+		logger.Infof("dry run: rotating %v keys would re-sign %d repos", request.Roles, len(result.GUNs))
+	} else {
+		logger.Infof("rotated %v keys, re-signed %d repos", request.Roles, len(result.GUNs))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// rootCSRRequest is the body of a request for a certificate signing request for a new root key
+type rootCSRRequest struct {
+	CommonName string `json:"common_name"`
+}
+
+// rootCSRResponse holds a PEM encoded certificate signing request for a new root key
+type rootCSRResponse struct {
+	Root string `json:"root"`
+	CSR  string `json:"csr"`
+}
+
+// RootCSRHandler creates a new root key for an alternate root, and responds with a certificate signing request for it
+// to be issued by an external CA. The common name defaults to a wildcard covering every gun rooted under the root.
+func RootCSRHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	name := mux.Vars(r)["root"]
+	logger := ctxutil.GetLoggerWithField(ctx, name, "root")
+
+	if ctx.Value(auth.TufRootSigner) != "admin" {
+		return errcode.ErrorCodeDenied.WithDetail("root certificate requests require the admin interface")
+	}
+	store, ok := ctx.Value(CtxKeyMultiplexingStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 POST: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+	if _, ok := store.AlternateRootStore(name); !ok {
+		return errors.ErrGenericNotFound.WithDetail(fmt.Sprintf("no alternate root named %s", name))
+	}
+
+	var request rootCSRRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return errors.ErrMalformedJSON.WithDetail(err.Error())
+	}
+	audit.EventFromContext(ctx).SetDetails(map[string]interface{}{"root": name, "common_name": request.CommonName})
+
+	csr, err := store.RootCertificateRequest(name, request.CommonName)
+	if err != nil {
+		if _, ok := err.(storage.ErrInvalidRootCertificate); ok {
+			return errors.ErrInvalidParams.WithDetail(err.Error())
+		}
+		logger.Errorf("500 POST: unable to create root certificate request: %s", err.Error())
+		return errors.ErrUpdating.WithDetail(err.Error())
+	}
+	logger.Info("created root key and certificate request")
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rootCSRResponse{Root: name, CSR: string(csr)})
+}
+
+// installRootCertRequest is the body of a request to install a CA-issued root certificate
+type installRootCertRequest struct {
+	// Certificate is the PEM encoded certificate, followed by its intermediates
+	Certificate string `json:"certificate"`
+	DryRun      bool   `json:"dry_run"`
+}
+
+// InstallRootCertHandler replaces the root keys of an alternate root with a CA-issued certificate for a key created by
+// RootCSRHandler, and re-swizzles the repos rooted under it. Certificates that don't chain to the configured CAs or
+// don't cover every gun of the root are rejected. It responds with the new root version and the GUNs that were
+// re-signed.
+func InstallRootCertHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	name := mux.Vars(r)["root"]
+	logger := ctxutil.GetLoggerWithField(ctx, name, "root")
+
+	if ctx.Value(auth.TufRootSigner) != "admin" {
+		return errcode.ErrorCodeDenied.WithDetail("installing root certificates requires the admin interface")
+	}
+	store, ok := ctx.Value(CtxKeyMultiplexingStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 POST: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+	if _, ok := store.AlternateRootStore(name); !ok {
+		return errors.ErrGenericNotFound.WithDetail(fmt.Sprintf("no alternate root named %s", name))
+	}
+
+	var request installRootCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return errors.ErrMalformedJSON.WithDetail(err.Error())
+	}
+	event := audit.EventFromContext(ctx)
+	event.SetDetails(map[string]interface{}{"root": name, "dry_run": request.DryRun})
+
+	result, err := store.InstallRootCertificate(name, []byte(request.Certificate), request.DryRun)
+	if err != nil {
+		if _, ok := err.(storage.ErrInvalidRootCertificate); ok {
+			return errors.ErrInvalidParams.WithDetail(err.Error())
+		}
+		logger.Errorf("500 POST: unable to install root certificate: %s", err.Error())
+		return errors.ErrUpdating.WithDetail(err.Error())
+	}
+	if request.DryRun {
+		logger.Infof("dry run: installing root certificate would re-sign %d repos", len(result.GUNs))
+	} else {
+		event.AddRole(data.CanonicalRootRole.String(), result.Version)
+		logger.Infof("installed root certificate, re-signed %d repos", len(result.GUNs))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// ReswizzleHandler regenerates the alternate-rooted metadata of every repository from its signer-rooted metadata.
+// The body holds storage.ReswizzleOptions, and the response reports the repos that were re-swizzled along with the
+// change ID to resume from.
+func ReswizzleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	logger := ctxutil.GetLogger(ctx)
+
+	if ctx.Value(auth.TufRootSigner) != "admin" {
+		return errcode.ErrorCodeDenied.WithDetail("re-swizzling requires the admin interface")
+	}
+	store, ok := ctx.Value(CtxKeyMultiplexingStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 POST: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+
+	var options storage.ReswizzleOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		return errors.ErrMalformedJSON.WithDetail(err.Error())
+	}
+	audit.EventFromContext(ctx).SetDetails(options)
+	if options.Rate < 0 || options.BatchSize < 0 {
+		return errors.ErrInvalidParams.WithDetail("rate and batch_size must not be negative")
+	}
+	for _, name := range options.Roots {
+		if _, ok := store.AlternateRootStore(name); !ok {
+			return errors.ErrGenericNotFound.WithDetail(fmt.Sprintf("no alternate root named %s", name))
+		}
+	}
+
+	ctx, cancel := closeNotifyContext(ctx, w)
+	defer cancel()
+	result, err := store.ReswizzleAll(ctx, options)
+	if err != nil {
+		logger.Errorf("500 POST: unable to re-swizzle: %s", err.Error())
+		return errors.ErrUpdating.WithDetail(err.Error())
+	}
+	logger.Infof("re-swizzled %d repos, %d failed", len(result.GUNs), len(result.Failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// FsckHandler checks the signer-rooted and alternate-rooted metadata of every repository for inconsistencies,
+// optionally repairing them. The body holds storage.FsckOptions, and the response is the report.
+func FsckHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	logger := ctxutil.GetLogger(ctx)
+
+	if ctx.Value(auth.TufRootSigner) != "admin" {
+		return errcode.ErrorCodeDenied.WithDetail("consistency checks require the admin interface")
+	}
+	store, ok := ctx.Value(CtxKeyMultiplexingStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 POST: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+
+	var options storage.FsckOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		return errors.ErrMalformedJSON.WithDetail(err.Error())
+	}
+	audit.EventFromContext(ctx).SetDetails(options)
+	if options.BatchSize < 0 {
+		return errors.ErrInvalidParams.WithDetail("batch_size must not be negative")
+	}
+	for _, name := range options.Roots {
+		if _, ok := store.AlternateRootStore(name); !ok {
+			return errors.ErrGenericNotFound.WithDetail(fmt.Sprintf("no alternate root named %s", name))
+		}
+	}
+
+	ctx, cancel := closeNotifyContext(ctx, w)
+	defer cancel()
+	report, err := store.Fsck(ctx, options)
+	if err != nil {
+		logger.Errorf("500 POST: unable to check consistency: %s", err.Error())
+		return errors.ErrUpdating.WithDetail(err.Error())
+	}
+	logger.Infof("checked %d repos, found %d problems, %d unrepaired", report.Checked, len(report.Problems), report.Unrepaired())
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
+
+// closeNotifyContext returns a context that is cancelled when the client goes away, so that long-running admin
+// requests stop, and can be resumed from the last change ID the client was sent
+func closeNotifyContext(ctx context.Context, w http.ResponseWriter) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	notifier, ok := w.(http.CloseNotifier)
+	if !ok {
+		return ctx, cancel
+	}
+	closed := notifier.CloseNotify()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// AdminHandler serves the admin API, and passes every other request on to `next`
+func AdminHandler(ac registryAuth.AccessController, ctx context.Context, trust signed.CryptoService, next http.Handler) http.Handler {
+	r := mux.NewRouter()
+	authWrapper := utils.RootHandlerFactory(ctx, ac, trust)
+
+	r.Methods("POST").Path("/admin/roots/{root}/rotate").Handler(authWrapper(auditedHandler(audit.ActionRotateRoot, RotateRootHandler), "*"))
+	r.Methods("POST").Path("/admin/roots/{root}/csr").Handler(authWrapper(auditedHandler(audit.ActionRootCSR, RootCSRHandler), "*"))
+	r.Methods("POST").Path("/admin/roots/{root}/certificate").Handler(authWrapper(auditedHandler(audit.ActionInstallRootCert, InstallRootCertHandler), "*"))
+	r.Methods("POST").Path("/admin/reswizzle").Handler(authWrapper(auditedHandler(audit.ActionReswizzle, ReswizzleHandler), "*"))
+	r.Methods("POST").Path("/admin/fsck").Handler(authWrapper(auditedHandler(audit.ActionFsck, FsckHandler), "*"))
+	r.PathPrefix("/").Handler(next)
+
+	return r
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos-inc/apostille/storage"
+	ctxutil "github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/notary"
+	"github.com/docker/notary/server/errors"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"golang.org/x/net/context"
+)
+
+// defaultRegistry is the registry of image references that don't name one, the same as docker
+const defaultRegistry = "docker.io"
+
+// AdmissionRule picks the images that must be signed, and the root their signatures are checked against
+type AdmissionRule struct {
+	// Namespaces are the pod namespaces the rule applies to; a rule without namespaces applies to every namespace
+	Namespaces []string
+	// Prefixes are the gun prefixes the rule applies to; a rule without prefixes applies to every gun
+	Prefixes []string
+	// Root is "signer" to check images against the trust data signers push, or the name of an alternate root
+	Root string
+	// RequireDigest rejects images that aren't referenced by digest. A tag is only checked when the pod is admitted,
+	// so it can be pushed again before the image is pulled.
+	RequireDigest bool
+}
+
+// AdmissionPolicy decides which images of a pod must be signed. Each image is checked against the root of the first
+// rule that matches it, and images that no rule matches are admitted without a signature.
+type AdmissionPolicy struct {
+	Rules []AdmissionRule
+	// Token is the bearer token that the Kubernetes API server authenticates to the webhook with
+	Token string
+}
+
+// authorized returns whether a request carries the policy's bearer token
+func (policy *AdmissionPolicy) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if policy.Token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(policy.Token)) == 1
+}
+
+// ruleFor returns the first rule that matches an image's gun in a namespace
+func (policy *AdmissionPolicy) ruleFor(namespace string, gun data.GUN) (AdmissionRule, bool) {
+	for _, rule := range policy.Rules {
+		if matchesAny(namespace, rule.Namespaces, func(namespace, ruleNamespace string) bool { return namespace == ruleNamespace }) &&
+			matchesAny(gun.String(), rule.Prefixes, strings.HasPrefix) {
+			return rule, true
+		}
+	}
+	return AdmissionRule{}, false
+}
+
+// matchesAny returns whether a value matches any of a rule's patterns, or true if the rule has no patterns
+func matchesAny(value string, patterns []string, match func(value, pattern string) bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if match(value, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdmissionReview is the request and response of a Kubernetes ValidatingAdmissionWebhook
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// AdmissionRequest is the part of an admission request that apostille reads
+type AdmissionRequest struct {
+	UID       string           `json:"uid"`
+	Kind      GroupVersionKind `json:"kind"`
+	Namespace string           `json:"namespace,omitempty"`
+	Operation string           `json:"operation,omitempty"`
+	Object    json.RawMessage  `json:"object,omitempty"`
+}
+
+// GroupVersionKind identifies the type of the object being admitted
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+// AdmissionResponse admits or rejects the object of an admission request
+type AdmissionResponse struct {
+	UID     string           `json:"uid"`
+	Allowed bool             `json:"allowed"`
+	Status  *AdmissionStatus `json:"status,omitempty"`
+}
+
+// AdmissionStatus explains why an object was rejected
+type AdmissionStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// admissionPod is the part of a pod that apostille reads
+type admissionPod struct {
+	Spec struct {
+		InitContainers      []admissionContainer `json:"initContainers"`
+		Containers          []admissionContainer `json:"containers"`
+		EphemeralContainers []admissionContainer `json:"ephemeralContainers"`
+	} `json:"spec"`
+}
+
+type admissionContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// AdmissionHandler implements the Kubernetes ValidatingAdmissionWebhook AdmissionReview protocol for pods. Every image
+// of a pod that the AdmissionPolicy requires to be signed is checked against the stored trust data of the rule's
+// root: a tagged image must be a signed target with the same digest, if the reference has one, and an image referenced
+// only by digest must be the digest of some signed target. Nodes pull images referenced only by tag by the tag, so
+// such images aren't pinned to the signed digest unless the rule requires digests. Objects other than pods are
+// admitted. The Kubernetes API server doesn't have registry credentials, so it authenticates with the policy's bearer
+// token instead.
+func AdmissionHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	logger := ctxutil.GetLogger(ctx)
+
+	policy, ok := ctx.Value(CtxKeyAdmissionPolicy).(*AdmissionPolicy)
+	if !ok {
+		return errors.ErrGenericNotFound.WithDetail("admission control is not configured")
+	}
+	if !policy.authorized(r) {
+		return errcode.ErrorCodeUnauthorized.WithDetail("the admission webhook requires its bearer token")
+	}
+	store, ok := ctx.Value(notary.CtxKeyMetaStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 POST: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+	cryptoService, ok := ctx.Value(notary.CtxKeyCryptoSvc).(signed.CryptoService)
+	if !ok {
+		return errors.ErrNoCryptoService.WithDetail(nil)
+	}
+
+	var review AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		return errors.ErrMalformedJSON.WithDetail(nil)
+	}
+	request := review.Request
+	response := &AdmissionResponse{UID: request.UID, Allowed: true}
+
+	if request.Kind.Group == "" && request.Kind.Kind == "Pod" {
+		var pod admissionPod
+		if err := json.Unmarshal(request.Object, &pod); err != nil {
+			return errors.ErrMalformedJSON.WithDetail(nil)
+		}
+		containers := append(append(pod.Spec.InitContainers, pod.Spec.Containers...), pod.Spec.EphemeralContainers...)
+
+		var denials []string
+		for _, container := range containers {
+			if err := checkImage(logger, policy, store, cryptoService, request.Namespace, container.Image); err != nil {
+				denials = append(denials, fmt.Sprintf("container %s: %s", container.Name, err.Error()))
+			}
+		}
+		if len(denials) > 0 {
+			logger.Infof("rejecting pod in namespace %s: %s", request.Namespace, strings.Join(denials, "; "))
+			response.Allowed = false
+			response.Status = &AdmissionStatus{
+				Code:    http.StatusForbidden,
+				Message: strings.Join(denials, "; "),
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(AdmissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response:   response,
+	})
+}
+
+// checkImage checks that an image is signed, if the policy requires it to be
+func checkImage(logger ctxutil.Logger, policy *AdmissionPolicy, store *storage.MultiplexingStore, cryptoService signed.CryptoService, namespace, image string) error {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return fmt.Errorf("invalid image reference %s: %s", image, err.Error())
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return fmt.Errorf("invalid image reference %s: no repository", image)
+	}
+	gun := imageGUN(named.Name())
+	rule, ok := policy.ruleFor(namespace, gun)
+	if !ok {
+		return nil
+	}
+
+	var metaStore notaryStorage.MetaStore = store.SignerChannelMetaStore
+	if rule.Root != "signer" {
+		root, ok := store.AlternateRootStore(rule.Root)
+		if !ok {
+			return fmt.Errorf("unknown root %s", rule.Root)
+		}
+		metaStore = root.MetaStore
+	}
+	repo, err := loadTrustedRepo(logger, gun, metaStore, cryptoService)
+	if err != nil {
+		switch err.(type) {
+		case notaryStorage.ErrNotFound, *notaryStorage.ErrNoKey:
+			return fmt.Errorf("%s has no trust data", gun)
+		}
+		logger.Errorf("trust data for %s is invalid: %s", gun, err.Error())
+		return fmt.Errorf("trust data for %s is invalid", gun)
+	}
+
+	digest := ""
+	if digested, ok := ref.(reference.Digested); ok {
+		if digested.Digest().Algorithm() != notary.SHA256 {
+			return fmt.Errorf("%s is not a %s digest", digested.Digest(), notary.SHA256)
+		}
+		digest = digested.Digest().Hex()
+	}
+	if digest == "" && rule.RequireDigest {
+		return fmt.Errorf("%s must be referenced by digest", image)
+	}
+	tagged, isTagged := ref.(reference.Tagged)
+	if !isTagged && digest != "" {
+		for _, target := range listTargets(repo) {
+			if target.Hashes[notary.SHA256] == digest {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s@%s:%s is not signed", gun, notary.SHA256, digest)
+	}
+
+	tag := "latest"
+	if isTagged {
+		tag = tagged.Tag()
+	}
+	target, ok := targetByName(repo, tag)
+	if !ok {
+		return fmt.Errorf("%s:%s is not signed", gun, tag)
+	}
+	if digest != "" && target.Hashes[notary.SHA256] != digest {
+		return fmt.Errorf("%s:%s is signed with a different digest", gun, tag)
+	}
+	return nil
+}
+
+// imageGUN is the gun of an image repository, with the registry and namespace that docker defaults to filled in
+func imageGUN(name string) data.GUN {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return data.GUN(defaultRegistry + "/library/" + name)
+	}
+	if !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		return data.GUN(defaultRegistry + "/" + name)
+	}
+	return data.GUN(name)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/coreos-inc/apostille/audit"
+	"github.com/coreos-inc/apostille/auth"
+	ctxutil "github.com/docker/distribution/context"
+	registryAuth "github.com/docker/distribution/registry/auth"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/utils"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// auditedHandler records every request a handler handles in the audit log, along with who made it and its outcome.
+// The handler can add to the event it is passed in its context.
+func auditedHandler(action string, handler utils.ContextHandler) utils.ContextHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		event := newAuditEvent(ctx, r, action)
+		err := handler(audit.WithEvent(ctx, event), w, r)
+		event.Finish(err)
+		audit.FromContext(ctx).Record(event)
+		return err
+	}
+}
+
+// newAuditEvent creates the audit event for an authorized request
+func newAuditEvent(ctx context.Context, r *http.Request, action string) *audit.Event {
+	event := &audit.Event{
+		Action:    action,
+		RequestID: ctxutil.GetStringValue(ctx, "http.request.id"),
+		GUN:       mux.Vars(r)["gun"],
+		ClientIP:  ctxutil.RemoteIP(r),
+	}
+	event.User, _ = ctx.Value(registryAuth.UserNameKey).(string)
+	event.TokenKind, _ = ctx.Value(auth.TokenKind).(string)
+	event.RootSigner, _ = ctx.Value(auth.TufRootSigner).(string)
+	return event
+}
+
+// auditedMetaStore records the metadata written to a MetaStore in an audit event
+type auditedMetaStore struct {
+	notaryStorage.MetaStore
+	event *audit.Event
+}
+
+// auditMetaStore wraps the MetaStore in a context so that the metadata written to it is recorded in the context's
+// audit event, if it has one
+func auditMetaStore(ctx context.Context, store notaryStorage.MetaStore) notaryStorage.MetaStore {
+	event := audit.EventFromContext(ctx)
+	if event == nil {
+		return store
+	}
+	return &auditedMetaStore{MetaStore: store, event: event}
+}
+
+// UpdateCurrent records the update once it has been written
+func (st *auditedMetaStore) UpdateCurrent(gun data.GUN, update notaryStorage.MetaUpdate) error {
+	if err := st.MetaStore.UpdateCurrent(gun, update); err != nil {
+		return err
+	}
+	st.event.AddRole(update.Role.String(), update.Version)
+	return nil
+}
+
+// UpdateMany records the updates once they have been written
+func (st *auditedMetaStore) UpdateMany(gun data.GUN, updates []notaryStorage.MetaUpdate) error {
+	if err := st.MetaStore.UpdateMany(gun, updates); err != nil {
+		return err
+	}
+	for _, update := range updates {
+		st.event.AddRole(update.Role.String(), update.Version)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coreos-inc/apostille/storage"
+	ctxutil "github.com/docker/distribution/context"
+	"github.com/docker/notary"
+	"github.com/docker/notary/server/errors"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// PinningBundleHandler serves the trust pinning bundle of an alternate root: its current root.json, the certificates
+// and IDs of its root keys, and a notary client `trust_pinning` config that pins them. It is served without
+// authentication so that clients can be configured before they first pull. Without a root in the path, it serves the
+// first alternate root.
+func PinningBundleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	name := mux.Vars(r)["root"]
+	logger := ctxutil.GetLoggerWithField(ctx, name, "root")
+
+	store, ok := ctx.Value(notary.CtxKeyMetaStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 GET: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+	if _, ok := store.AlternateRootStore(name); name != "" && !ok {
+		return errors.ErrGenericNotFound.WithDetail("no such alternate root")
+	}
+
+	bundle, err := store.PinningBundle(name)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return errors.ErrMetadataNotFound.WithDetail(nil)
+		}
+		logger.Errorf("500 GET: unable to build trust pinning bundle: %s", err.Error())
+		return errors.ErrUnknown.WithDetail(nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(bundle)
+}
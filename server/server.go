@@ -3,12 +3,16 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/coreos-inc/apostille/audit"
 	"github.com/coreos-inc/apostille/auth"
 	ctxutil "github.com/docker/distribution/context"
+	"github.com/docker/distribution/health"
 	registryAuth "github.com/docker/distribution/registry/auth"
 	notaryServer "github.com/docker/notary/server"
 	"github.com/docker/notary/tuf/data"
@@ -22,6 +26,7 @@ import (
 	"github.com/docker/notary"
 	"github.com/docker/notary/server/errors"
 	"github.com/docker/notary/server/handlers"
+	notaryStorage "github.com/docker/notary/server/storage"
 )
 
 // Config tells Run how to configure a server
@@ -35,11 +40,20 @@ type Config struct {
 	ConsistentCacheControlConfig utils.CacheControlConfig
 	CurrentCacheControlConfig    utils.CacheControlConfig
 	Admin                        bool
+	// ShutdownTimeout is how long in-flight requests may take to finish once the server is stopped
+	ShutdownTimeout time.Duration
+	// RootMapping picks the TUF root for users of access controllers that don't pick one themselves
+	RootMapping auth.RootMapping
 }
 
+// DefaultShutdownTimeout is how long in-flight requests may take to finish when no ShutdownTimeout is configured
+const DefaultShutdownTimeout = 30 * time.Second
+
 // Run sets up and starts a TLS server that can be cancelled using the
 // given configuration. The context it is passed is the context it should
-// use directly for the TLS server, and generate children off for requests
+// use directly for the TLS server, and generate children off for requests.
+// Cancelling the context stops accepting connections and waits for in-flight
+// requests to finish, for up to the configured ShutdownTimeout.
 func Run(ctx context.Context, conf Config) error {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", conf.Addr)
 	if err != nil {
@@ -56,41 +70,60 @@ func Run(ctx context.Context, conf Config) error {
 		lsnr = tls.NewListener(lsnr, conf.TLSConfig)
 	}
 
-	var ac registryAuth.AccessController
+	ac, err := auth.GetAccessController(conf.AuthMethod, conf.AuthOpts, conf.RootMapping)
+	if err != nil {
+		return err
+	}
+	// stop any background work the access controller does once the server stops
+	if closer, ok := ac.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if checker, ok := ac.(auth.HealthChecker); ok {
+		health.RegisterFunc(fmt.Sprintf("%s auth on %s", conf.AuthMethod, conf.Addr), checker.CheckHealth)
+	}
 
-	if conf.AuthMethod == "quaytoken" {
-		authOptions, ok := conf.AuthOpts.(map[string]interface{})
-		if !ok {
-			return fmt.Errorf("auth.options must be a map[string]interface{}")
-		}
-		ac, err = auth.NewKeyserverAccessController(authOptions)
-		if err != nil {
-			return err
-		}
-	} else if conf.AuthMethod == "testing" {
-		logrus.Warn("Test Auth config enabled - all requests will be authorized as user 'test_user'")
-		ac = auth.NewConstantAccessController("signer")
-	} else if conf.AuthMethod == "admin" {
-		ac = auth.NewConstantAccessController("admin")
-	} else {
-		return fmt.Errorf("No auth config supplied - use 'testing' if mock auth is desired")
+	handler := TrustMultiplexerHandler(ac, ctx, conf.Trust,
+		conf.ConsistentCacheControlConfig,
+		conf.CurrentCacheControlConfig,
+		conf.RepoPrefixes,
+	)
+	if conf.Admin {
+		handler = AdminHandler(ac, ctx, conf.Trust, handler)
 	}
 
 	svr := http.Server{
-		Addr: conf.Addr,
-		Handler: TrustMultiplexerHandler(ac, ctx, conf.Trust,
-			conf.ConsistentCacheControlConfig,
-			conf.CurrentCacheControlConfig,
-			conf.RepoPrefixes,
-		),
+		Addr:    conf.Addr,
+		Handler: handler,
 	}
 	serverName := "apostille"
 	if conf.Admin {
 		serverName += " admin"
 	}
 	logrus.Infof("Starting %s server on %s", serverName, conf.Addr)
-	err = svr.Serve(lsnr)
-	return err
+
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.Serve(lsnr)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := conf.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	logrus.Infof("Stopping %s server, waiting up to %v for in-flight requests", serverName, timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := svr.Shutdown(shutdownCtx); err != nil {
+		svr.Close()
+		return fmt.Errorf("%s server did not stop cleanly: %s", serverName, err.Error())
+	}
+	logrus.Infof("Stopped %s server", serverName)
+	return nil
 }
 
 // GetMetadataHandler returns the json for a specified role and GUN.
@@ -100,40 +133,55 @@ func GetMetadataHandler(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	vars := mux.Vars(r)
 	tufRootSigner := ctx.Value(auth.TufRootSigner)
 	gun := data.GUN(vars["gun"])
-	s := ctx.Value(notary.CtxKeyMetaStore)
 	logger := ctxutil.GetLoggerWithFields(ctx, map[interface{}]interface{}{
 		"gun":     gun,
 		"tufRoot": tufRootSigner,
 	}, "gun", "tufRoot")
 
+	store, err := rootMetaStore(ctx, logger)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, store)
+	return handlers.GetHandler(ctx, w, r)
+}
+
+// rootMetaStore picks the MetaStore holding the metadata of the root of trust the requesting user is served
+func rootMetaStore(ctx context.Context, logger ctxutil.Logger) (notaryStorage.MetaStore, error) {
+	tufRootSigner := ctx.Value(auth.TufRootSigner)
+	s := ctx.Value(notary.CtxKeyMetaStore)
+
 	// If user is listed as a signing user, serve "signer" root
 	// signing users must have push access
+	// any other root name is served from the alternate root with that name
 	switch tufRootSigner {
 	case "signer":
 		store, ok := s.(*storage.MultiplexingStore)
 		if !ok {
 			logger.Error("500 GET: no storage exists")
-			return errors.ErrNoStorage.WithDetail(nil)
-		}
-		ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, store.SignerChannelMetaStore)
-	case "quay":
-		store, ok := s.(*storage.MultiplexingStore)
-		if !ok {
-			logger.Error("500 GET: no storage exists")
-			return errors.ErrNoStorage.WithDetail(nil)
+			return nil, errors.ErrNoStorage.WithDetail(nil)
 		}
-		ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, store.AlternateChannelMetaStore)
+		return store.SignerChannelMetaStore, nil
 	case "admin":
 		store, ok := s.(*storage.ChannelMetastore)
 		if !ok {
 			logger.Error("500 GET: no storage exists")
-			return errors.ErrNoStorage.WithDetail(s)
+			return nil, errors.ErrNoStorage.WithDetail(s)
 		}
-		ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, store)
+		return store, nil
 	default:
-		return errors.ErrMetadataNotFound.WithDetail(fmt.Sprintf("Invalid tuf root signer %s", tufRootSigner))
+		store, ok := s.(*storage.MultiplexingStore)
+		if !ok {
+			logger.Error("500 GET: no storage exists")
+			return nil, errors.ErrNoStorage.WithDetail(nil)
+		}
+		rootName, _ := tufRootSigner.(string)
+		root, ok := store.AlternateRootStore(rootName)
+		if !ok {
+			return nil, errors.ErrMetadataNotFound.WithDetail(fmt.Sprintf("Invalid tuf root signer %s", tufRootSigner))
+		}
+		return root.MetaStore, nil
 	}
-	return handlers.GetHandler(ctx, w, r)
 }
 
 // AtomicUpdateHandler handles the switch to the admin repo if needed
@@ -158,9 +206,18 @@ func AtomicUpdateHandler(ctx context.Context, w http.ResponseWriter, r *http.Req
 		}
 		ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, store)
 	}
+	if store, ok := ctx.Value(notary.CtxKeyMetaStore).(notaryStorage.MetaStore); ok {
+		ctx = context.WithValue(ctx, notary.CtxKeyMetaStore, auditMetaStore(ctx, store))
+	}
 	return handlers.AtomicUpdateHandler(ctx, w, r)
 }
 
+// RotateKeyHandler rotates a server-managed key, recording which one in the audit log
+func RotateKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	audit.EventFromContext(ctx).SetDetails(map[string]string{"role": mux.Vars(r)["tufRole"]})
+	return handlers.RotateKeyHandler(ctx, w, r)
+}
+
 // TrustMutliplexerHandler wraps a standard notary server router and
 // splits access to different trust roots based on request criteria,
 // e.g. username or URL.
@@ -217,7 +274,7 @@ func TrustMultiplexerHandler(ac registryAuth.AccessController, ctx context.Conte
 	// Intercept requests with the `gun` because notary doesn't parse them correctly if they have a *
 	r.Methods("POST").Path("/v2/{gun:.*}/_trust/tuf/").Handler(notaryServer.CreateHandler(
 		"UpdateTUF",
-		AtomicUpdateHandler,
+		auditedHandler(audit.ActionUpdate, AtomicUpdateHandler),
 		invalidGUNErr,
 		false,
 		nil,
@@ -239,7 +296,7 @@ func TrustMultiplexerHandler(ac registryAuth.AccessController, ctx context.Conte
 	r.Methods("POST").Path(
 		"/v2/{gun:.*}/_trust/tuf/{tufRole:snapshot|timestamp}.key").Handler(notaryServer.CreateHandler(
 		"RotateKey",
-		handlers.RotateKeyHandler,
+		auditedHandler(audit.ActionRotateKey, RotateKeyHandler),
 		notFoundError,
 		false,
 		nil,
@@ -249,7 +306,7 @@ func TrustMultiplexerHandler(ac registryAuth.AccessController, ctx context.Conte
 	))
 	r.Methods("DELETE").Path("/v2/{gun:.*}/_trust/tuf/").Handler(notaryServer.CreateHandler(
 		"DeleteTUF",
-		handlers.DeleteHandler,
+		auditedHandler(audit.ActionDelete, handlers.DeleteHandler),
 		notFoundError,
 		false,
 		nil,
@@ -257,6 +314,48 @@ func TrustMultiplexerHandler(ac registryAuth.AccessController, ctx context.Conte
 		authWrapper,
 		repoPrefixes,
 	))
+	// Resolve signed targets for clients that don't walk TUF metadata themselves
+	r.Methods("GET").Path("/v2/{gun:.*}/_trust/targets").Handler(notaryServer.CreateHandler(
+		"GetTargets",
+		GetTargetsHandler,
+		notFoundError,
+		true,
+		utils.NoCacheControl{},
+		[]string{"pull"},
+		authWrapper,
+		repoPrefixes,
+	))
+	r.Methods("GET").Path("/v2/{gun:.*}/_trust/targets/{name:[^/]+}").Handler(notaryServer.CreateHandler(
+		"GetTarget",
+		GetTargetsHandler,
+		notFoundError,
+		true,
+		utils.NoCacheControl{},
+		[]string{"pull"},
+		authWrapper,
+		repoPrefixes,
+	))
+	// Sign targets on behalf of clients that can't sign TUF metadata themselves
+	r.Methods("PUT").Path("/v2/{gun:.*}/_trust/targets/{name:[^/]+}").Handler(notaryServer.CreateHandler(
+		"SignTarget",
+		auditedHandler(audit.ActionSignTarget, SignTargetHandler),
+		notFoundError,
+		false,
+		nil,
+		[]string{"push", "pull"},
+		authWrapper,
+		repoPrefixes,
+	))
+	r.Methods("DELETE").Path("/v2/{gun:.*}/_trust/targets/{name:[^/]+}").Handler(notaryServer.CreateHandler(
+		"RemoveTarget",
+		auditedHandler(audit.ActionRemoveTarget, SignTargetHandler),
+		notFoundError,
+		false,
+		nil,
+		[]string{"push", "pull"},
+		authWrapper,
+		repoPrefixes,
+	))
 	r.Methods("GET").Path("/v2/{gun:.*}/_trust/changefeed").Handler(notaryServer.CreateHandler(
 		"Changefeed",
 		handlers.Changefeed,
@@ -268,6 +367,27 @@ func TrustMultiplexerHandler(ac registryAuth.AccessController, ctx context.Conte
 		repoPrefixes,
 	))
 
+	// Check the images of pods for a Kubernetes ValidatingAdmissionWebhook, which authenticates with its own token
+	noAuthWrapper := utils.RootHandlerFactory(ctx, nil, trust)
+	r.Methods("POST").Path("/admission").Handler(noAuthWrapper(AdmissionHandler))
+
+	// Serve simple signing signatures for podman, CRI-O and skopeo from a signature lookaside, and the key to verify
+	// them with, to anyone, since lookaside clients don't authenticate. The pinning bundle is also served to anyone,
+	// since notary clients fetch it before they are configured to trust the server.
+	r.Methods("GET").Path("/sigstore/key.asc").Handler(noAuthWrapper(SimpleSigningKeyHandler))
+	r.Methods("GET").Path("/sigstore/{gun:.*}@{digest:sha256[=:][a-fA-F0-9]{64}}/signature-{index:[1-9][0-9]*}").Handler(notaryServer.CreateHandler(
+		"GetSimpleSignature",
+		SimpleSignatureHandler,
+		notFoundError,
+		true,
+		utils.NoCacheControl{},
+		nil,
+		noAuthWrapper,
+		repoPrefixes,
+	))
+	r.Methods("GET").Path("/_trust/pinning").Handler(noAuthWrapper(PinningBundleHandler))
+	r.Methods("GET").Path("/_trust/pinning/{root}").Handler(noAuthWrapper(PinningBundleHandler))
+
 	r.Methods("GET", "POST", "PUT", "HEAD", "DELETE").Path("/{other:.*}").Handler(notaryHandler)
 
 	return r
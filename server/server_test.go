@@ -2,25 +2,40 @@ package server
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/coreos-inc/apostille/audit"
 	"github.com/coreos-inc/apostille/auth"
 	"github.com/coreos-inc/apostille/servertest"
+	"github.com/coreos-inc/apostille/simplesigning"
 	"github.com/coreos-inc/apostille/storage"
 	"github.com/coreos-inc/apostille/storagetest"
+	ctxutil "github.com/docker/distribution/context"
 	registryAuth "github.com/docker/distribution/registry/auth"
 	_ "github.com/docker/distribution/registry/auth/silly"
+	canonicaljson "github.com/docker/go/canonical/json"
 	"github.com/docker/notary"
+	"github.com/docker/notary/cryptoservice"
+	"github.com/docker/notary/passphrase"
 	notaryServer "github.com/docker/notary/server"
 	notaryStorage "github.com/docker/notary/server/storage"
 	store "github.com/docker/notary/storage"
+	"github.com/docker/notary/trustmanager"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/signed"
 	"github.com/docker/notary/tuf/testutils"
@@ -28,6 +43,7 @@ import (
 	"github.com/docker/notary/tuf/validation"
 	"github.com/docker/notary/utils"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/net/context"
 	"time"
 )
@@ -526,6 +542,22 @@ func TestSigningUserPushSignerPullNonSignerPull(t *testing.T) {
 	servertest.RemoteEqual(t, client, data.CanonicalSnapshotRole, meta[data.CanonicalSnapshotRole])
 }
 
+func TestUnknownRootPull(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	ac := auth.NewConstantAccessController("signer")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	server, client := testServerAndClient(t, gun, trust, ac)
+	defer server.Close()
+	repo := servertest.CreateRepo(t, gun, trust)
+	servertest.PushRepo(t, repo, client)
+
+	ac.TUFRoot = "unknown"
+
+	_, err := client.GetSized(data.CanonicalRootRole.String(), -1)
+	require.Error(t, err)
+	require.IsType(t, store.ErrMetaNotFound{}, err)
+}
+
 func TestSigningUserPushWithDelegations(t *testing.T) {
 	trust := servertest.TrustServiceMock(t)
 	ac := auth.NewConstantAccessController("signer")
@@ -552,6 +584,229 @@ func TestSigningUserPushWithDelegations(t *testing.T) {
 	servertest.RemoteEqual(t, client, "targets/ci", meta[data.RoleName("targets/ci")])
 }
 
+func TestRotateRootHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), CtxKeyMultiplexingStore, metaStore)
+	ac := auth.NewConstantAccessController("admin")
+	server := httptest.NewServer(AdminHandler(ac, ctx, trust, http.NotFoundHandler()))
+	defer server.Close()
+
+	rotate := func(root, body string) *http.Response {
+		res, err := http.Post(server.URL+"/admin/roots/"+root+"/rotate", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := rotate("quay", `{"roles": ["timestamp"], "dry_run": true}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var result storage.RotationResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	require.Equal(t, "quay", result.Root)
+	require.Equal(t, 2, result.Version)
+	require.True(t, result.DryRun)
+
+	res = rotate("quay", `{"roles": ["timestamp"]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+	root, _, err := metaStore.AlternateRoot("quay")
+	require.NoError(t, err)
+	require.Equal(t, 2, root.Signed.Version)
+
+	for root, body := range map[string]string{
+		"missing": `{"roles": ["timestamp"]}`,
+		"quay":    `{"roles": ["targets/releases"]}`,
+	} {
+		res = rotate(root, body)
+		require.NotEqual(t, http.StatusOK, res.StatusCode, body)
+		res.Body.Close()
+	}
+	res = rotate("quay", `{"roles": []}`)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	// other requests are passed on
+	res, err = http.Get(server.URL + "/v2/")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+
+	// only the admin interface can rotate
+	ac.TUFRoot = "quay"
+	res = rotate("quay", `{"roles": ["timestamp"]}`)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestRootCertificateHandlers(t *testing.T) {
+	// the CSR handler creates a root key that signs the request, so the trust service is local
+	trust := cryptoservice.NewCryptoService(trustmanager.NewKeyMemoryStore(passphrase.ConstantRetriever("pass")))
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), CtxKeyMultiplexingStore, metaStore)
+	ac := auth.NewConstantAccessController("admin")
+	server := httptest.NewServer(AdminHandler(ac, ctx, trust, http.NotFoundHandler()))
+	defer server.Close()
+
+	post := func(root, endpoint string, body interface{}) *http.Response {
+		bodyBytes, err := json.Marshal(body)
+		require.NoError(t, err)
+		res, err := http.Post(server.URL+"/admin/roots/"+root+"/"+endpoint, "application/json", bytes.NewBuffer(bodyBytes))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := post("missing", "csr", map[string]string{})
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+	res = post("quay", "csr", map[string]string{"common_name": "quay.io/*"})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	res = post("quay", "csr", map[string]string{})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var csrResponse rootCSRResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&csrResponse))
+	res.Body.Close()
+	block, _ := pem.Decode([]byte(csrResponse.CSR))
+	require.NotNil(t, block)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+	require.Equal(t, "*", csr.Subject.CommonName)
+
+	// the CA issues a certificate for the request
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Corporate Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(notary.Year),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(notary.Year),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, caCert, csr.PublicKey, caKey)
+	require.NoError(t, err)
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+
+	// it is rejected until the CA is configured
+	res = post("quay", "certificate", map[string]interface{}{"certificate": certPEM})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+	metaStore.RootCAs = x509.NewCertPool()
+	metaStore.RootCAs.AddCert(caCert)
+	res = post("quay", "certificate", map[string]interface{}{"certificate": "not a certificate"})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	res = post("quay", "certificate", map[string]interface{}{"certificate": certPEM})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var result storage.RotationResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	require.Equal(t, 2, result.Version)
+	root, _, err := metaStore.AlternateRoot("quay")
+	require.NoError(t, err)
+	rootRole, err := root.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+	for _, key := range rootRole.ListKeys() {
+		require.Equal(t, data.ECDSAx509Key, key.Algorithm())
+		cert, err := tufutils.LoadCertFromPEM(key.Public())
+		require.NoError(t, err)
+		require.Equal(t, caCert.Subject.CommonName, cert.Issuer.CommonName)
+	}
+
+	// rotating with a certificate request keeps the certificate until the new one is installed
+	res = post("quay", "rotate", map[string]interface{}{"roles": []string{"timestamp"}, "csr": true})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+	res = post("quay", "rotate", map[string]interface{}{"roles": []string{"root", "timestamp"}, "csr": true})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	result = storage.RotationResult{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	require.Equal(t, 3, result.Version)
+	require.Equal(t, []data.RoleName{data.CanonicalTimestampRole}, result.Rotated)
+	block, _ = pem.Decode([]byte(result.CSR))
+	require.NotNil(t, block)
+	csr, err = x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+	root, _, err = metaStore.AlternateRoot("quay")
+	require.NoError(t, err)
+	rootRole, err = root.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+	for _, key := range rootRole.ListKeys() {
+		cert, err := tufutils.LoadCertFromPEM(key.Public())
+		require.NoError(t, err)
+		require.Equal(t, caCert.Subject.CommonName, cert.Issuer.CommonName)
+	}
+
+	// rotating the root keys would replace the certificate with a self-signed one, unless it's forced
+	res = post("quay", "rotate", map[string]interface{}{"roles": []string{"root"}})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+	res = post("quay", "rotate", map[string]interface{}{"roles": []string{"root"}, "force": true})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	// only the admin interface can request and install root certificates
+	ac.TUFRoot = "quay"
+	res = post("quay", "csr", map[string]string{})
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+	res = post("quay", "certificate", map[string]interface{}{"certificate": certPEM})
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestPinningBundleHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), notary.CtxKeyMetaStore, metaStore)
+	// every other request needs credentials
+	ac, err := registryAuth.GetAccessController("silly", map[string]interface{}{"realm": "apostille", "service": "apostille"})
+	require.NoError(t, err)
+	server := httptest.NewServer(TrustMultiplexerHandler(ac, ctx, trust, nil, nil, nil))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/v2/")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res.Body.Close()
+
+	for _, path := range []string{"/_trust/pinning", "/_trust/pinning/quay"} {
+		res, err = http.Get(server.URL + path)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode, path)
+		var bundle storage.PinningBundle
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&bundle))
+		res.Body.Close()
+		require.Equal(t, "quay", bundle.Root)
+		require.Equal(t, data.GUN("quay"), bundle.RootGUN)
+		require.NotEmpty(t, bundle.KeyIDs)
+		require.Equal(t, map[string][]string{"*": bundle.KeyIDs}, bundle.TrustPinning.Certs)
+		require.True(t, bundle.TrustPinning.DisableTOFU)
+	}
+
+	res, err = http.Get(server.URL + "/_trust/pinning/missing")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+}
+
 func testServerAndClient(t *testing.T, gun data.GUN, trust signed.CryptoService, ac registryAuth.AccessController) (*httptest.Server, store.RemoteStore) {
 	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
 	ctx := context.WithValue(context.Background(), notary.CtxKeyMetaStore, metaStore)
@@ -570,3 +825,532 @@ func testServerAndClient(t *testing.T, gun data.GUN, trust signed.CryptoService,
 	require.NoError(t, err)
 	return server, client
 }
+
+func TestReswizzleHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), CtxKeyMultiplexingStore, metaStore)
+	ac := auth.NewConstantAccessController("admin")
+	server := httptest.NewServer(AdminHandler(ac, ctx, trust, http.NotFoundHandler()))
+	defer server.Close()
+
+	reswizzle := func(body string) *http.Response {
+		res, err := http.Post(server.URL+"/admin/reswizzle", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := reswizzle(`{"prefix": "quay.io/", "rate": 10}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var result storage.ReswizzleResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	require.Empty(t, result.GUNs)
+	require.Equal(t, "0", result.LastChangeID)
+
+	res = reswizzle(`{"roots": ["missing"]}`)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+	res = reswizzle(`{"rate": -1}`)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	// only the admin interface can re-swizzle
+	ac.TUFRoot = "quay"
+	res = reswizzle(`{}`)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestFsckHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), CtxKeyMultiplexingStore, metaStore)
+	ac := auth.NewConstantAccessController("admin")
+	server := httptest.NewServer(AdminHandler(ac, ctx, trust, http.NotFoundHandler()))
+	defer server.Close()
+
+	fsck := func(body string) *http.Response {
+		res, err := http.Post(server.URL+"/admin/fsck", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := fsck(`{"repair": true}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var report storage.FsckReport
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&report))
+	res.Body.Close()
+	require.Equal(t, 0, report.Checked)
+	require.Empty(t, report.Problems)
+
+	res = fsck(`{"roots": ["missing"]}`)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+	res = fsck(`{"batch_size": -1}`)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	// only the admin interface can check consistency
+	ac.TUFRoot = "quay"
+	res = fsck(`{}`)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+// recordingSink keeps the audit events it is sent
+type recordingSink struct {
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(event *audit.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	sink := &recordingSink{}
+	ctx := audit.NewContext(context.Background(), audit.New(sink))
+	ctx = context.WithValue(ctx, notary.CtxKeyKeyAlgo, data.ED25519Key)
+	ac := auth.NewConstantAccessController("signer")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	handler := TrustMultiplexerHandler(ac, context.WithValue(ctx, notary.CtxKeyMetaStore, metaStore), trust, nil, nil, nil)
+	adminCtx := context.WithValue(ctx, CtxKeyMultiplexingStore, metaStore)
+	server := httptest.NewServer(AdminHandler(ac, adminCtx, trust, handler))
+	defer server.Close()
+	client, err := store.NewHTTPStore(fmt.Sprintf("%s/v2/%s/_trust/tuf/", server.URL, gun), "", "json", "key", http.DefaultTransport)
+	require.NoError(t, err)
+
+	// pushes record the roles that were written
+	servertest.PushRepo(t, servertest.CreateRepo(t, gun, trust), client)
+	require.Len(t, sink.events, 1)
+	event := sink.events[0]
+	require.Equal(t, audit.ActionUpdate, event.Action)
+	require.Equal(t, audit.OutcomeSuccess, event.Outcome)
+	require.Equal(t, gun.String(), event.GUN)
+	require.Equal(t, "signer", event.RootSigner)
+	require.Equal(t, "127.0.0.1", event.ClientIP)
+	require.Contains(t, event.Roles, audit.RoleVersion{Role: data.CanonicalRootRole.String(), Version: 1})
+
+	// failed pushes are recorded too
+	require.Error(t, client.SetMulti(map[string][]byte{data.CanonicalTargetsRole.String(): []byte("not json")}))
+	require.Len(t, sink.events, 2)
+	require.Equal(t, audit.OutcomeFailure, sink.events[1].Outcome)
+	require.NotEmpty(t, sink.events[1].Error)
+	require.Empty(t, sink.events[1].Roles)
+
+	// admin operations record their options
+	ac.TUFRoot = "admin"
+	res, err := http.Post(server.URL+"/admin/fsck", "application/json", bytes.NewBufferString(`{"prefix": "quay.io/"}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Len(t, sink.events, 3)
+	require.Equal(t, audit.ActionFsck, sink.events[2].Action)
+	require.Equal(t, "admin", sink.events[2].RootSigner)
+	require.Equal(t, storage.FsckOptions{Prefix: "quay.io/"}, sink.events[2].Details)
+
+	// as do deletes
+	ac.TUFRoot = "signer"
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/v2/%s/_trust/tuf/", server.URL, gun), nil)
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Len(t, sink.events, 4)
+	require.Equal(t, audit.ActionDelete, sink.events[3].Action)
+	require.Equal(t, gun.String(), sink.events[3].GUN)
+}
+
+func TestGetTargetsHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	ac := auth.NewConstantAccessController("signer")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	server, client := testServerAndClient(t, gun, trust, ac)
+	defer server.Close()
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	latest, err := data.NewFileMeta(bytes.NewBufferString("latest"), notary.SHA256)
+	require.NoError(t, err)
+	custom := json.RawMessage(`{"built_by":"ci"}`)
+	latest.Custom = (*canonicaljson.RawMessage)(&custom)
+	stable, err := data.NewFileMeta(bytes.NewBufferString("stable"), notary.SHA256)
+	require.NoError(t, err)
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{"latest": latest, "stable": stable})
+	require.NoError(t, err)
+	servertest.PushRepo(t, repo, client)
+
+	get := func(path string) *http.Response {
+		res, err := http.Get(fmt.Sprintf("%s/v2/%s/_trust/targets%s", server.URL, gun, path))
+		require.NoError(t, err)
+		return res
+	}
+	latestDigest := hex.EncodeToString(latest.Hashes[notary.SHA256])
+
+	// signers see their own targets role, other users see the targets stashed under their alternate root
+	for root, role := range map[string]data.RoleName{"signer": data.CanonicalTargetsRole, "quay": "targets/releases"} {
+		ac.TUFRoot = root
+
+		res := get("")
+		require.Equal(t, http.StatusOK, res.StatusCode, root)
+		var targets TrustedTargets
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&targets))
+		res.Body.Close()
+		require.Equal(t, gun, targets.GUN)
+		require.Equal(t, root, targets.Root)
+		require.Len(t, targets.Targets, 2)
+		require.Equal(t, "latest", targets.Targets[0].Name)
+		require.Equal(t, "stable", targets.Targets[1].Name)
+
+		res = get("/latest")
+		require.Equal(t, http.StatusOK, res.StatusCode, root)
+		var target TrustedTarget
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&target))
+		res.Body.Close()
+		require.Equal(t, TrustedTarget{
+			Name:   "latest",
+			Role:   role,
+			Hashes: map[string]string{notary.SHA256: latestDigest},
+			Length: 6,
+			Custom: &custom,
+		}, target)
+
+		res = get("/missing")
+		res.Body.Close()
+		require.Equal(t, http.StatusNotFound, res.StatusCode, root)
+	}
+
+	ac.TUFRoot = "signer"
+	res, err := http.Get(fmt.Sprintf("%s/v2/quay.io/signingUser/missing/_trust/targets", server.URL))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestLoadTrustedRepoExpired(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	logger := ctxutil.GetLogger(context.Background())
+	updates := func(meta map[data.RoleName][]byte, version int) []notaryStorage.MetaUpdate {
+		var updates []notaryStorage.MetaUpdate
+		for role, metaBytes := range meta {
+			updates = append(updates, notaryStorage.MetaUpdate{Role: role, Version: version, Data: metaBytes})
+		}
+		return updates
+	}
+	require.NoError(t, metaStore.UpdateMany(gun, updates(meta, 1)))
+	_, err = loadTrustedRepo(logger, gun, metaStore.SignerChannelMetaStore, trust)
+	require.NoError(t, err)
+
+	// expired targets aren't trusted
+	targets, err := repo.SignTargets(data.CanonicalTargetsRole, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	targetsBytes, err := json.Marshal(targets)
+	require.NoError(t, err)
+	require.NoError(t, repo.UpdateSnapshot(data.CanonicalTargetsRole, targets))
+	snapshot, err := repo.SignSnapshot(time.Now().AddDate(1, 0, 0))
+	require.NoError(t, err)
+	snapshotBytes, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	require.NoError(t, metaStore.UpdateMany(gun, updates(map[data.RoleName][]byte{
+		data.CanonicalTargetsRole:  targetsBytes,
+		data.CanonicalSnapshotRole: snapshotBytes,
+	}, 2)))
+	_, err = loadTrustedRepo(logger, gun, metaStore.SignerChannelMetaStore, trust)
+	require.Error(t, err)
+}
+
+func TestSignTargetHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	ac := auth.NewConstantAccessController("signer")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	server, client := testServerAndClient(t, gun, trust, ac)
+	defer server.Close()
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	latest, err := data.NewFileMeta(bytes.NewBufferString("latest"), notary.SHA256)
+	require.NoError(t, err)
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{"latest": latest})
+	require.NoError(t, err)
+	servertest.PushRepo(t, repo, client)
+
+	do := func(method, name, body string) *http.Response {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s/v2/%s/_trust/targets/%s", server.URL, gun, name), bytes.NewBufferString(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	build, err := data.NewFileMeta(bytes.NewBufferString("build"), notary.SHA256)
+	require.NoError(t, err)
+	buildDigest := hex.EncodeToString(build.Hashes[notary.SHA256])
+
+	// users of an alternate root can't sign TUF metadata themselves, so the server signs for them
+	ac.TUFRoot = "quay"
+	res := do("PUT", "build", fmt.Sprintf(`{"digest":"sha256:%s","length":5}`, buildDigest))
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var versions SignedTargetVersions
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&versions))
+	res.Body.Close()
+	require.Equal(t, SignedTargetVersions{GUN: gun, Name: "build", Versions: map[string]int{"quay": 1}}, versions)
+
+	res = do("GET", "build", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var target TrustedTarget
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&target))
+	res.Body.Close()
+	require.Equal(t, TrustedTarget{
+		Name:   "build",
+		Role:   storage.DefaultServerTargetsRole,
+		Hashes: map[string]string{notary.SHA256: buildDigest},
+		Length: 5,
+	}, target)
+	res = do("GET", "latest", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// server-signed targets are only rooted under the alternate root
+	ac.TUFRoot = "signer"
+	res = do("GET", "build", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	for _, body := range []string{`{"digest":"sha256:abcd","length":5}`, fmt.Sprintf(`{"digest":"%s"}`, buildDigest), "{"} {
+		res = do("PUT", "bad", body)
+		res.Body.Close()
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, body)
+	}
+
+	ac.TUFRoot = "quay"
+	res = do("DELETE", "build", "")
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&versions))
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, map[string]int{"quay": 2}, versions.Versions)
+	res = do("GET", "build", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestSimpleSignatureHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	ac := auth.NewConstantAccessController("signer")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	entity, err := openpgp.NewEntity("apostille", "", "", nil)
+	require.NoError(t, err)
+	// a new key's identities are only self-signed when its private key is serialized
+	require.NoError(t, entity.SerializePrivate(ioutil.Discard, nil))
+	signer, err := simplesigning.NewSigner(entity)
+	require.NoError(t, err)
+
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), notary.CtxKeyMetaStore, metaStore)
+	ctx = context.WithValue(ctx, notary.CtxKeyKeyAlgo, data.ED25519Key)
+	ctx = context.WithValue(ctx, CtxKeySimpleSigner, signer)
+	server := httptest.NewServer(TrustMultiplexerHandler(ac, ctx, trust, nil, nil, nil))
+	defer server.Close()
+	client, err := store.NewHTTPStore(fmt.Sprintf("%s/v2/%s/_trust/tuf/", server.URL, gun), "", "json", "key", http.DefaultTransport)
+	require.NoError(t, err)
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	manifest, err := data.NewFileMeta(bytes.NewBufferString("manifest"), notary.SHA256)
+	require.NoError(t, err)
+	other, err := data.NewFileMeta(bytes.NewBufferString("other"), notary.SHA256)
+	require.NoError(t, err)
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{"stable": manifest, "latest": manifest, "other": other})
+	require.NoError(t, err)
+	servertest.PushRepo(t, repo, client)
+
+	// lookaside clients don't send credentials, even to a server that requires them for everything else
+	sillyAC, err := registryAuth.GetAccessController("silly", map[string]interface{}{"realm": "apostille", "service": "apostille"})
+	require.NoError(t, err)
+	lookaside := httptest.NewServer(TrustMultiplexerHandler(sillyAC, ctx, trust, nil, nil, nil))
+	defer lookaside.Close()
+	digest := hex.EncodeToString(manifest.Hashes[notary.SHA256])
+	get := func(path string) *http.Response {
+		res, err := http.Get(lookaside.URL + "/sigstore/" + path)
+		require.NoError(t, err)
+		return res
+	}
+
+	// there is a signature for each tag of the digest, in order of tag name
+	for i, tag := range []string{"latest", "stable"} {
+		res := get(fmt.Sprintf("%s@sha256=%s/signature-%d", gun, digest, i+1))
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		details, err := openpgp.ReadMessage(res.Body, openpgp.EntityList{entity}, nil, nil)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(details.UnverifiedBody)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.NoError(t, details.SignatureError)
+		require.NotNil(t, details.SignedBy)
+
+		var claim simplesigning.Claim
+		require.NoError(t, json.Unmarshal(body, &claim))
+		require.Equal(t, fmt.Sprintf("%s:%s", gun, tag), claim.Critical.Identity.DockerReference)
+		require.Equal(t, "sha256:"+digest, claim.Critical.Image.DockerManifestDigest)
+	}
+
+	res := get(fmt.Sprintf("%s@sha256:%s/signature-1", gun, digest))
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	for _, path := range []string{
+		fmt.Sprintf("%s@sha256=%s/signature-3", gun, digest),
+		fmt.Sprintf("%s@sha256=%s/signature-1", gun, strings.Repeat("0", 64)),
+		fmt.Sprintf("quay.io/signingUser/missing@sha256=%s/signature-1", digest),
+	} {
+		res = get(path)
+		res.Body.Close()
+		require.Equal(t, http.StatusNotFound, res.StatusCode, path)
+	}
+
+	res = get("key.asc")
+	keyring, err := openpgp.ReadArmoredKeyRing(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, signer.KeyID(), keyring[0].PrimaryKey.KeyIdString())
+
+	// nothing is served unless simple signing is configured
+	unconfigured, _ := testServerAndClient(t, gun, trust, ac)
+	defer unconfigured.Close()
+	for _, path := range []string{fmt.Sprintf("%s@sha256=%s/signature-1", gun, digest), "key.asc"} {
+		res, err = http.Get(unconfigured.URL + "/sigstore/" + path)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusNotFound, res.StatusCode, path)
+	}
+}
+
+func TestAdmissionHandler(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	ac := auth.NewConstantAccessController("signer")
+	// image references are lowercase
+	gun := data.GUN("quay.io/signinguser/testrepo")
+	policy := &AdmissionPolicy{Rules: []AdmissionRule{
+		{Namespaces: []string{"prod"}, Prefixes: []string{"quay.io/"}, Root: "quay"},
+	}, Token: "kube-apiserver-token"}
+
+	metaStore := storagetest.MultiplexingMetaStoreMock(t, trust)
+	ctx := context.WithValue(context.Background(), notary.CtxKeyMetaStore, metaStore)
+	ctx = context.WithValue(ctx, notary.CtxKeyKeyAlgo, data.ED25519Key)
+	ctx = context.WithValue(ctx, CtxKeyAdmissionPolicy, policy)
+	server := httptest.NewServer(TrustMultiplexerHandler(ac, ctx, trust, nil, nil, nil))
+	defer server.Close()
+	client, err := store.NewHTTPStore(fmt.Sprintf("%s/v2/%s/_trust/tuf/", server.URL, gun), "", "json", "key", http.DefaultTransport)
+	require.NoError(t, err)
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	manifest, err := data.NewFileMeta(bytes.NewBufferString("manifest"), notary.SHA256)
+	require.NoError(t, err)
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{"latest": manifest})
+	require.NoError(t, err)
+	servertest.PushRepo(t, repo, client)
+	digest := hex.EncodeToString(manifest.Hashes[notary.SHA256])
+	otherDigest := strings.Repeat("0", 64)
+
+	// the Kubernetes API server has no registry credentials, and authenticates with the policy's token instead
+	sillyAC, err := registryAuth.GetAccessController("silly", map[string]interface{}{"realm": "apostille", "service": "apostille"})
+	require.NoError(t, err)
+	webhook := httptest.NewServer(TrustMultiplexerHandler(sillyAC, ctx, trust, nil, nil, nil))
+	defer webhook.Close()
+	post := func(token string, body []byte) *http.Response {
+		req, err := http.NewRequest("POST", webhook.URL+"/admission", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	review := func(kind, namespace string, images ...string) *AdmissionResponse {
+		var containers []map[string]string
+		for i, image := range images {
+			containers = append(containers, map[string]string{"name": fmt.Sprintf("c%d", i), "image": image})
+		}
+		object, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"containers": containers}})
+		require.NoError(t, err)
+		body, err := json.Marshal(AdmissionReview{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+			Request: &AdmissionRequest{
+				UID:       "uid",
+				Kind:      GroupVersionKind{Version: "v1", Kind: kind},
+				Namespace: namespace,
+				Operation: "CREATE",
+				Object:    object,
+			},
+		})
+		require.NoError(t, err)
+		res := post(policy.Token, body)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var response AdmissionReview
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+		require.Equal(t, "admission.k8s.io/v1", response.APIVersion)
+		require.Equal(t, "uid", response.Response.UID)
+		return response.Response
+	}
+
+	for _, image := range []string{
+		gun.String() + ":latest",
+		gun.String(),
+		fmt.Sprintf("%s@sha256:%s", gun, digest),
+		fmt.Sprintf("%s:latest@sha256:%s", gun, digest),
+	} {
+		require.True(t, review("Pod", "prod", image).Allowed, image)
+	}
+	for _, image := range []string{
+		gun.String() + ":unsigned",
+		fmt.Sprintf("%s@sha256:%s", gun, otherDigest),
+		fmt.Sprintf("%s:latest@sha256:%s", gun, otherDigest),
+		"quay.io/signinguser/missing:latest",
+		"quay.io/Invalid",
+	} {
+		response := review("Pod", "prod", image)
+		require.False(t, response.Allowed, image)
+		require.Equal(t, http.StatusForbidden, response.Status.Code)
+	}
+
+	// images the policy doesn't cover are admitted
+	require.True(t, review("Pod", "dev", gun.String()+":unsigned").Allowed)
+	require.True(t, review("Pod", "prod", "nginx:latest").Allowed)
+	require.True(t, review("Deployment", "prod", gun.String()+":unsigned").Allowed)
+
+	// one unsigned image rejects the whole pod
+	response := review("Pod", "prod", gun.String(), gun.String()+":unsigned")
+	require.False(t, response.Allowed)
+	require.Contains(t, response.Status.Message, "container c1")
+	require.NotContains(t, response.Status.Message, "container c0")
+
+	// requests without the token are refused
+	body, err := json.Marshal(AdmissionReview{Request: &AdmissionRequest{UID: "uid", Kind: GroupVersionKind{Version: "v1", Kind: "Pod"}}})
+	require.NoError(t, err)
+	for _, token := range []string{"", "wrong"} {
+		res := post(token, body)
+		res.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode, token)
+	}
+
+	// the signer root sees the same tags
+	policy.Rules[0].Root = "signer"
+	require.True(t, review("Pod", "prod", gun.String()+":latest").Allowed)
+	require.False(t, review("Pod", "prod", gun.String()+":unsigned").Allowed)
+
+	// tags aren't pinned, so rules can require digests
+	policy.Rules[0].RequireDigest = true
+	require.True(t, review("Pod", "prod", fmt.Sprintf("%s@sha256:%s", gun, digest)).Allowed)
+	require.True(t, review("Pod", "prod", fmt.Sprintf("%s:latest@sha256:%s", gun, digest)).Allowed)
+	response = review("Pod", "prod", gun.String()+":latest")
+	require.False(t, response.Allowed)
+	require.Contains(t, response.Status.Message, "must be referenced by digest")
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos-inc/apostille/simplesigning"
+	"github.com/coreos-inc/apostille/storage"
+	ctxutil "github.com/docker/distribution/context"
+	"github.com/docker/notary"
+	"github.com/docker/notary/server/errors"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// SimpleSignatureHandler serves a simple signing signature from the lookaside at
+// /sigstore/{gun}@sha256={hex}/signature-{index}, so a registries.d lookaside of https://apostille/sigstore/quay.io
+// serves the registry quay.io. The digest may also be written sha256:{hex}.
+//
+// Signatures are generated for the targets of the gun whose sha256 hash is the digest, resolved through the first
+// alternate root covering the gun. There is one signature for each tag of the digest, in order of tag name. Lookaside
+// clients don't authenticate, so signatures are served to anyone who knows the digest.
+func SimpleSignatureHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	gun := data.GUN(vars["gun"])
+	logger := ctxutil.GetLoggerWithFields(ctx, map[interface{}]interface{}{"gun": gun}, "gun")
+
+	signer, ok := ctx.Value(CtxKeySimpleSigner).(*simplesigning.Signer)
+	if !ok {
+		return errors.ErrGenericNotFound.WithDetail("simple signing is not configured")
+	}
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 1 {
+		return errors.ErrMetadataNotFound.WithDetail(nil)
+	}
+	digest := strings.ToLower(vars["digest"][len(notary.SHA256)+1:])
+
+	store, err := coveringRootMetaStore(ctx, gun)
+	if err != nil {
+		return err
+	}
+	cryptoService, ok := ctx.Value(notary.CtxKeyCryptoSvc).(signed.CryptoService)
+	if !ok {
+		return errors.ErrNoCryptoService.WithDetail(nil)
+	}
+	repo, err := loadTrustedRepo(logger, gun, store, cryptoService)
+	if err != nil {
+		switch err.(type) {
+		case notaryStorage.ErrNotFound, *notaryStorage.ErrNoKey:
+			return errors.ErrMetadataNotFound.WithDetail(nil)
+		}
+		logger.Errorf("500 GET: trust data is invalid: %s", err.Error())
+		return errors.ErrUnknown.WithDetail(fmt.Sprintf("trust data for %s is invalid: %s", gun, err.Error()))
+	}
+
+	var tags []string
+	for _, target := range listTargets(repo) {
+		if target.Hashes[notary.SHA256] == digest {
+			tags = append(tags, target.Name)
+		}
+	}
+	if index > len(tags) {
+		return errors.ErrMetadataNotFound.WithDetail(nil)
+	}
+
+	signature, err := signer.Sign(fmt.Sprintf("%s:%s", gun, tags[index-1]), notary.SHA256+":"+digest, time.Now())
+	if err != nil {
+		logger.Errorf("500 GET: unable to sign %s@%s: %s", gun, digest, err.Error())
+		return errors.ErrUnknown.WithDetail(nil)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = w.Write(signature)
+	return err
+}
+
+// SimpleSigningKeyHandler serves the armored public key that simple signing signatures can be verified with
+func SimpleSigningKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	signer, ok := ctx.Value(CtxKeySimpleSigner).(*simplesigning.Signer)
+	if !ok {
+		return errors.ErrGenericNotFound.WithDetail("simple signing is not configured")
+	}
+	publicKey, err := signer.PublicKey()
+	if err != nil {
+		return errors.ErrUnknown.WithDetail(nil)
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	_, err = w.Write(publicKey)
+	return err
+}
+
+// coveringRootMetaStore picks the MetaStore of the first alternate root covering a gun
+func coveringRootMetaStore(ctx context.Context, gun data.GUN) (notaryStorage.MetaStore, error) {
+	store, ok := ctx.Value(notary.CtxKeyMetaStore).(*storage.MultiplexingStore)
+	if !ok {
+		return nil, errors.ErrNoStorage.WithDetail(nil)
+	}
+	for _, root := range store.AlternateRoots() {
+		if root.Covers(gun) {
+			return root.MetaStore, nil
+		}
+	}
+	return nil, errors.ErrMetadataNotFound.WithDetail(nil)
+}
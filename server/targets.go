@@ -0,0 +1,364 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/coreos-inc/apostille/audit"
+	"github.com/coreos-inc/apostille/auth"
+	"github.com/coreos-inc/apostille/storage"
+	ctxutil "github.com/docker/distribution/context"
+	canonicaljson "github.com/docker/go/canonical/json"
+	"github.com/docker/notary"
+	"github.com/docker/notary/server/errors"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/server/timestamp"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/utils"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// releasesRole is the delegation docker content trust signs tags into, and alternate roots stash signer targets in
+var releasesRole = data.RoleName("targets/releases")
+
+// targetRolePriority is the order targets are looked up in, the same as docker content trust. A target in
+// targets/releases (or its delegations) shadows the same target elsewhere.
+var targetRolePriority = []data.RoleName{releasesRole, data.CanonicalTargetsRole}
+
+// TrustedTarget is a target resolved from validated trust data
+type TrustedTarget struct {
+	Name string `json:"name"`
+	// Role is the targets role or delegation the target was found in
+	Role data.RoleName `json:"role"`
+	// Hashes are hex encoded, keyed by algorithm
+	Hashes map[string]string `json:"hashes"`
+	Length int64             `json:"length"`
+	Custom *json.RawMessage  `json:"custom,omitempty"`
+}
+
+// TrustedTargets is every target of a gun, as seen through the root the requesting user is served
+type TrustedTargets struct {
+	GUN     data.GUN        `json:"gun"`
+	Root    string          `json:"root"`
+	Targets []TrustedTarget `json:"targets"`
+}
+
+// TargetRequest is the body of a request to sign a target
+type TargetRequest struct {
+	// Digest is the target's sha256 digest, hex encoded and optionally prefixed with "sha256:"
+	Digest string           `json:"digest"`
+	Length int64            `json:"length"`
+	Custom *json.RawMessage `json:"custom,omitempty"`
+}
+
+// SignedTargetVersions reports the new versions of the server-signed delegation, by alternate root name
+type SignedTargetVersions struct {
+	GUN      data.GUN       `json:"gun"`
+	Name     string         `json:"name"`
+	Versions map[string]int `json:"versions"`
+}
+
+// GetTargetsHandler resolves the targets of a gun, or the single target in the `name` var, from the metadata of the
+// root the requesting user is served. The metadata is validated the way a TUF client would validate it, so only
+// targets that are properly signed and unexpired are returned.
+func GetTargetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	gun := data.GUN(vars["gun"])
+	name, single := vars["name"]
+	tufRootSigner, _ := ctx.Value(auth.TufRootSigner).(string)
+	logger := ctxutil.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"gun":     gun,
+		"tufRoot": tufRootSigner,
+	}, "gun", "tufRoot")
+
+	store, err := rootMetaStore(ctx, logger)
+	if err != nil {
+		return err
+	}
+	cryptoService, ok := ctx.Value(notary.CtxKeyCryptoSvc).(signed.CryptoService)
+	if !ok {
+		return errors.ErrNoCryptoService.WithDetail(nil)
+	}
+
+	repo, err := loadTrustedRepo(logger, gun, store, cryptoService)
+	if err != nil {
+		switch err.(type) {
+		case notaryStorage.ErrNotFound, *notaryStorage.ErrNoKey:
+			return errors.ErrMetadataNotFound.WithDetail(nil)
+		}
+		logger.Errorf("500 GET: trust data is invalid: %s", err.Error())
+		return errors.ErrUnknown.WithDetail(fmt.Sprintf("trust data for %s is invalid: %s", gun, err.Error()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if single {
+		target, ok := targetByName(repo, name)
+		if !ok {
+			return errors.ErrMetadataNotFound.WithDetail(fmt.Sprintf("no trust data for %s", name))
+		}
+		return json.NewEncoder(w).Encode(target)
+	}
+	return json.NewEncoder(w).Encode(TrustedTargets{
+		GUN:     gun,
+		Root:    tufRootSigner,
+		Targets: listTargets(repo),
+	})
+}
+
+// loadTrustedRepo loads a gun's current metadata from a store and validates it, including every delegation that can
+// be reached from the targets role. Delegations that don't validate are left out, so their targets aren't trusted.
+//
+// The stored root is the anchor of trust, so it is only checked to be signed by its own keys and unexpired. Alternate
+// roots are shared by many guns, so their certificates don't name the gun the way a TUF client would require.
+func loadTrustedRepo(logger ctxutil.Logger, gun data.GUN, store notaryStorage.MetaStore, cryptoService signed.CryptoService) (*tuf.Repo, error) {
+	_, rootBytes, err := store.GetCurrent(gun, data.CanonicalRootRole)
+	if err != nil {
+		return nil, err
+	}
+	root, err := verifiedRoot(rootBytes)
+	if err != nil {
+		return nil, err
+	}
+	repo := tuf.NewRepo(nil)
+	repo.Root = root
+	builder := tuf.NewBuilderFromRepo(gun, repo, trustpinning.TrustPinConfig{})
+
+	// the timestamp (and so the snapshot) may be server signed, and is re-signed here if it has expired, the same as
+	// when it is served
+	_, timestampBytes, err := timestamp.GetOrCreateTimestamp(gun, store, cryptoService)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.Load(data.CanonicalTimestampRole, timestampBytes, 1, false); err != nil {
+		return nil, err
+	}
+	snapshotChecksum := repo.Timestamp.Signed.Meta[data.CanonicalSnapshotRole.String()].Hashes[notary.SHA256]
+	_, snapshotBytes, err := store.GetChecksum(gun, data.CanonicalSnapshotRole, hex.EncodeToString(snapshotChecksum))
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.Load(data.CanonicalSnapshotRole, snapshotBytes, 1, false); err != nil {
+		return nil, err
+	}
+	_, targetsBytes, err := store.GetCurrent(gun, data.CanonicalTargetsRole)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.Load(data.CanonicalTargetsRole, targetsBytes, 1, false); err != nil {
+		return nil, err
+	}
+
+	delegations := delegationNames(repo.Targets[data.CanonicalTargetsRole])
+	for len(delegations) > 0 {
+		role := delegations[0]
+		delegations = delegations[1:]
+		if builder.IsLoaded(role) {
+			continue
+		}
+		_, delegationBytes, err := store.GetCurrent(gun, role)
+		if err != nil {
+			if _, ok := err.(notaryStorage.ErrNotFound); ok {
+				continue
+			}
+			return nil, err
+		}
+		if err := builder.Load(role, delegationBytes, 1, false); err != nil {
+			logger.Warnf("ignoring invalid %s delegation: %s", role, err.Error())
+			continue
+		}
+		delegations = append(delegations, delegationNames(repo.Targets[role])...)
+	}
+
+	repo, _, err = builder.Finish()
+	return repo, err
+}
+
+// verifiedRoot checks that a root is signed by a threshold of its own root keys, and hasn't expired
+func verifiedRoot(rootBytes []byte) (*data.SignedRoot, error) {
+	var rootSigned data.Signed
+	if err := json.Unmarshal(rootBytes, &rootSigned); err != nil {
+		return nil, err
+	}
+	root, err := data.RootFromSigned(&rootSigned)
+	if err != nil {
+		return nil, err
+	}
+	rootRole, err := root.BuildBaseRole(data.CanonicalRootRole)
+	if err != nil {
+		return nil, err
+	}
+	if err := signed.VerifySignatures(&rootSigned, rootRole); err != nil {
+		return nil, err
+	}
+	if err := signed.VerifyExpiry(&root.Signed.SignedCommon, data.CanonicalRootRole); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func delegationNames(targets *data.SignedTargets) []data.RoleName {
+	names := make([]data.RoleName, 0, len(targets.Signed.Delegations.Roles))
+	for _, role := range targets.Signed.Delegations.Roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+// listTargets resolves every target in a repo, sorted by name. Roles earlier in targetRolePriority shadow later ones,
+// and within a role's subtree, roles nearer the top shadow those further down.
+func listTargets(repo *tuf.Repo) []TrustedTarget {
+	targets := make(map[string]TrustedTarget)
+	for _, role := range targetRolePriority {
+		skipRoles := utils.RoleNameSliceRemove(targetRolePriority, role)
+		repo.WalkTargets("", role, func(tgt *data.SignedTargets, validRole data.DelegationRole) interface{} {
+			for name, meta := range tgt.Signed.Targets {
+				if _, ok := targets[name]; ok || !validRole.CheckPaths(name) {
+					continue
+				}
+				targets[name] = trustedTarget(name, validRole.Name, meta)
+			}
+			return nil
+		}, skipRoles...)
+	}
+
+	list := make([]TrustedTarget, 0, len(targets))
+	for _, target := range targets {
+		list = append(list, target)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// targetByName resolves a single target, with the same priority as listTargets
+func targetByName(repo *tuf.Repo, name string) (TrustedTarget, bool) {
+	for _, role := range targetRolePriority {
+		var target TrustedTarget
+		found := false
+		skipRoles := utils.RoleNameSliceRemove(targetRolePriority, role)
+		err := repo.WalkTargets(name, role, func(tgt *data.SignedTargets, validRole data.DelegationRole) interface{} {
+			if meta, ok := tgt.Signed.Targets[name]; ok {
+				target, found = trustedTarget(name, validRole.Name, meta), true
+				return tuf.StopWalk{}
+			}
+			return nil
+		}, skipRoles...)
+		if err == nil && found {
+			return target, true
+		}
+	}
+	return TrustedTarget{}, false
+}
+
+func trustedTarget(name string, role data.RoleName, meta data.FileMeta) TrustedTarget {
+	hashes := make(map[string]string, len(meta.Hashes))
+	for algorithm, hash := range meta.Hashes {
+		hashes[algorithm] = hex.EncodeToString(hash)
+	}
+	target := TrustedTarget{
+		Name:   name,
+		Role:   role,
+		Hashes: hashes,
+		Length: meta.Length,
+	}
+	if meta.Custom != nil {
+		custom := json.RawMessage(*meta.Custom)
+		target.Custom = &custom
+	}
+	return target
+}
+
+// SignTargetHandler adds the target in the `name` var to the server-signed delegation of a gun, under every alternate
+// root that covers it, for clients that can't sign TUF metadata themselves. DELETE requests remove the target instead.
+func SignTargetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	gun := data.GUN(vars["gun"])
+	name := vars["name"]
+	tufRootSigner := ctx.Value(auth.TufRootSigner)
+	logger := ctxutil.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"gun":     gun,
+		"tufRoot": tufRootSigner,
+	}, "gun", "tufRoot")
+
+	if tufRootSigner == "admin" {
+		return errors.ErrInvalidParams.WithDetail("targets of the shared root can't be server signed")
+	}
+	store, ok := ctx.Value(notary.CtxKeyMetaStore).(*storage.MultiplexingStore)
+	if !ok {
+		logger.Error("500 PUT: no storage exists")
+		return errors.ErrNoStorage.WithDetail(nil)
+	}
+
+	var add data.Files
+	var remove []string
+	if r.Method == "DELETE" {
+		remove = []string{name}
+		audit.EventFromContext(ctx).SetDetails(map[string]string{"target": name})
+	} else {
+		var req TargetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return errors.ErrMalformedJSON.WithDetail(nil)
+		}
+		meta, err := req.fileMeta()
+		if err != nil {
+			return errors.ErrInvalidParams.WithDetail(err.Error())
+		}
+		add = data.Files{name: meta}
+		audit.EventFromContext(ctx).SetDetails(map[string]string{"target": name, "digest": hex.EncodeToString(meta.Hashes[notary.SHA256])})
+	}
+
+	versions, err := store.SignServerTargets(gun, add, remove)
+	if err != nil {
+		switch err.(type) {
+		case storage.ErrNoAlternateRoot:
+			return errors.ErrInvalidParams.WithDetail(err.Error())
+		case notaryStorage.ErrOldVersion:
+			logger.Errorf("409 %s: %s", r.Method, err.Error())
+			return errors.ErrOldVersion.WithDetail(err)
+		}
+		logger.Errorf("500 %s: unable to sign targets: %s", r.Method, err.Error())
+		return errors.ErrUpdating.WithDetail(nil)
+	}
+	for rootName, version := range versions {
+		audit.EventFromContext(ctx).AddRole(rootName+":"+store.ServerTargetsRole.String(), version)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(SignedTargetVersions{
+		GUN:      gun,
+		Name:     name,
+		Versions: versions,
+	})
+}
+
+// fileMeta validates a target request and converts it to the target's metadata
+func (req TargetRequest) fileMeta() (data.FileMeta, error) {
+	digest, err := hex.DecodeString(strings.TrimPrefix(req.Digest, notary.SHA256+":"))
+	if err != nil || len(digest) != sha256.Size {
+		return data.FileMeta{}, fmt.Errorf("digest must be a hex encoded %s digest", notary.SHA256)
+	}
+	if req.Length <= 0 {
+		return data.FileMeta{}, fmt.Errorf("length must be positive")
+	}
+	meta := data.FileMeta{
+		Length: req.Length,
+		Hashes: data.Hashes{notary.SHA256: digest},
+	}
+	if req.Custom != nil {
+		custom := canonicaljson.RawMessage(*req.Custom)
+		meta.Custom = &custom
+	}
+	return meta, nil
+}
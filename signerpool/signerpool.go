@@ -0,0 +1,279 @@
+// Package signerpool spreads signing across several notary-signer replicas. A Pool is a signed.CryptoService that
+// sends each request to the next healthy replica, fails over to the others when a replica can't be reached, and keeps
+// working without any reachable replica: requests fail until one comes back, rather than apostille refusing to start.
+package signerpool
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var replicaHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "apostille",
+	Subsystem: "signer",
+	Name:      "healthy",
+	Help:      "Whether a notary-signer replica is healthy (1) or unavailable (0).",
+}, []string{"endpoint"})
+
+func init() {
+	prometheus.MustRegister(replicaHealthy)
+}
+
+// Signer is a notary-signer replica, such as a *client.NotarySigner
+type Signer interface {
+	signed.CryptoService
+	CheckHealth(d time.Duration, serviceName string) error
+}
+
+// Endpoint is a named notary-signer replica
+type Endpoint struct {
+	Name   string
+	Signer Signer
+}
+
+// ErrUnavailable is returned when none of the replicas can be reached
+type ErrUnavailable struct {
+	Err error
+}
+
+func (err ErrUnavailable) Error() string {
+	return fmt.Sprintf("no notary-signer is available: %v", err.Err)
+}
+
+// replica tracks whether an Endpoint is healthy
+type replica struct {
+	Endpoint
+	mu      sync.RWMutex
+	healthy bool
+}
+
+func (r *replica) isHealthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.healthy
+}
+
+// setHealthy records whether the replica is healthy, logging when that changes
+func (r *replica) setHealthy(healthy bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if healthy && !r.healthy {
+		logrus.Infof("notary-signer %s is available", r.Name)
+	} else if !healthy && r.healthy {
+		logrus.Warnf("notary-signer %s is unavailable: %v", r.Name, err)
+	}
+	r.healthy = healthy
+	if healthy {
+		replicaHealthy.WithLabelValues(r.Name).Set(1)
+	} else {
+		replicaHealthy.WithLabelValues(r.Name).Set(0)
+	}
+}
+
+// Pool is a signed.CryptoService backed by notary-signer replicas that share their keys. Replicas are assumed to be
+// healthy until a request to them fails with a connection error or a health check fails, and are used again once a
+// request to them succeeds or a health check passes.
+type Pool struct {
+	replicas []*replica
+	next     uint32
+}
+
+// NewPool creates a Pool of replicas. Nothing is sent to them until the pool is used.
+func NewPool(endpoints ...Endpoint) *Pool {
+	pool := &Pool{}
+	for _, endpoint := range endpoints {
+		r := &replica{Endpoint: endpoint, healthy: true}
+		replicaHealthy.WithLabelValues(endpoint.Name).Set(1)
+		pool.replicas = append(pool.replicas, r)
+	}
+	return pool
+}
+
+// order returns the replicas to try for a request: the healthy ones, starting from the next in turn so that requests
+// are spread across them, then the unhealthy ones in case they have recovered since they failed
+func (p *Pool) order() []*replica {
+	if len(p.replicas) == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&p.next, 1)-1) % len(p.replicas)
+	var healthy, unhealthy []*replica
+	for i := range p.replicas {
+		r := p.replicas[(start+i)%len(p.replicas)]
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// do runs an operation against the replicas in order until one of them answers it. A replica that can't be reached is
+// marked unhealthy and the next one is tried; any other result, including errors such as a missing key, is returned.
+func (p *Pool) do(operation func(r *replica) error) error {
+	var err error
+	for _, r := range p.order() {
+		err = operation(r)
+		if !isUnavailable(err) {
+			r.setHealthy(true, nil)
+			return err
+		}
+		r.setHealthy(false, err)
+	}
+	return ErrUnavailable{Err: err}
+}
+
+// isUnavailable returns whether an error means that a replica couldn't handle a request, rather than that the request
+// itself failed
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// CheckHealth checks every replica, marking each healthy or unhealthy. It only fails if no replica is healthy.
+func (p *Pool) CheckHealth(d time.Duration, serviceName string) error {
+	var failures []string
+	for _, r := range p.replicas {
+		err := r.Signer.CheckHealth(d, serviceName)
+		r.setHealthy(err == nil, err)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", r.Name, err.Error()))
+		}
+	}
+	if len(failures) == len(p.replicas) {
+		return ErrUnavailable{Err: fmt.Errorf("%s", strings.Join(failures, "; "))}
+	}
+	return nil
+}
+
+// Create creates a key on the first replica that can be reached
+func (p *Pool) Create(role data.RoleName, gun data.GUN, algorithm string) (data.PublicKey, error) {
+	var pubKey data.PublicKey
+	err := p.do(func(r *replica) (err error) {
+		pubKey, err = r.Signer.Create(role, gun, algorithm)
+		return err
+	})
+	return pubKey, err
+}
+
+// AddKey adds a key through the first replica that can be reached
+func (p *Pool) AddKey(role data.RoleName, gun data.GUN, key data.PrivateKey) error {
+	return p.do(func(r *replica) error {
+		return r.Signer.AddKey(role, gun, key)
+	})
+}
+
+// GetKey returns the public key from the first replica that has it, or nil if none do
+func (p *Pool) GetKey(keyID string) data.PublicKey {
+	for _, r := range p.order() {
+		if pubKey := r.Signer.GetKey(keyID); pubKey != nil {
+			return pubKey
+		}
+	}
+	return nil
+}
+
+// GetPrivateKey looks up a key on the first replica that can be reached. The key it returns signs with that replica,
+// and with the others if that replica becomes unavailable.
+func (p *Pool) GetPrivateKey(keyID string) (data.PrivateKey, data.RoleName, error) {
+	var (
+		privKey data.PrivateKey
+		role    data.RoleName
+		from    *replica
+	)
+	err := p.do(func(r *replica) (err error) {
+		privKey, role, err = r.Signer.GetPrivateKey(keyID)
+		from = r
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &privateKey{PrivateKey: privKey, replica: from, pool: p}, role, nil
+}
+
+// RemoveKey removes a key through the first replica that can be reached
+func (p *Pool) RemoveKey(keyID string) error {
+	return p.do(func(r *replica) error {
+		return r.Signer.RemoveKey(keyID)
+	})
+}
+
+// ListKeys lists the keys of a role on the next replica
+func (p *Pool) ListKeys(role data.RoleName) []string {
+	replicas := p.order()
+	if len(replicas) == 0 {
+		return nil
+	}
+	return replicas[0].Signer.ListKeys(role)
+}
+
+// ListAllKeys lists all keys on the next replica
+func (p *Pool) ListAllKeys() map[string]data.RoleName {
+	replicas := p.order()
+	if len(replicas) == 0 {
+		return nil
+	}
+	return replicas[0].Signer.ListAllKeys()
+}
+
+// privateKey is a key looked up from one replica, that signs with the other replicas if that one becomes unavailable
+type privateKey struct {
+	data.PrivateKey
+	replica *replica
+	pool    *Pool
+}
+
+// Sign signs with the replica the key was looked up from, then with the other replicas if it can't be reached
+func (k *privateKey) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	signature, err := k.PrivateKey.Sign(rand, msg, opts)
+	if !isUnavailable(err) {
+		return signature, err
+	}
+	k.replica.setHealthy(false, err)
+
+	err = k.pool.do(func(r *replica) error {
+		privKey, _, err := r.Signer.GetPrivateKey(k.ID())
+		if err != nil {
+			return err
+		}
+		signature, err = privKey.Sign(rand, msg, opts)
+		return err
+	})
+	return signature, err
+}
+
+// CryptoSigner returns a crypto.Signer that fails over like Sign
+func (k *privateKey) CryptoSigner() crypto.Signer {
+	return cryptoSigner{key: k}
+}
+
+type cryptoSigner struct {
+	key *privateKey
+}
+
+func (s cryptoSigner) Public() crypto.PublicKey {
+	return s.key.PrivateKey.CryptoSigner().Public()
+}
+
+func (s cryptoSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, digest, opts)
+}
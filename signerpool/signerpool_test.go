@@ -0,0 +1,174 @@
+package signerpool
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/docker/notary/cryptoservice"
+	"github.com/docker/notary/passphrase"
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeSigner is a replica whose keys are kept in a CryptoService that it may share with other replicas, like
+// notary-signers sharing a database. Requests to it fail as a gRPC connection failure while it is down.
+type fakeSigner struct {
+	signed.CryptoService
+	down     bool
+	requests int
+}
+
+func (s *fakeSigner) err() error {
+	s.requests++
+	if s.down {
+		return grpc.Errorf(codes.Unavailable, "transport is closing")
+	}
+	return nil
+}
+
+func (s *fakeSigner) CheckHealth(d time.Duration, serviceName string) error {
+	if s.down {
+		return grpc.Errorf(codes.Unavailable, "transport is closing")
+	}
+	return nil
+}
+
+func (s *fakeSigner) Create(role data.RoleName, gun data.GUN, algorithm string) (data.PublicKey, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	return s.CryptoService.Create(role, gun, algorithm)
+}
+
+func (s *fakeSigner) GetKey(keyID string) data.PublicKey {
+	if s.err() != nil {
+		return nil
+	}
+	return s.CryptoService.GetKey(keyID)
+}
+
+func (s *fakeSigner) GetPrivateKey(keyID string) (data.PrivateKey, data.RoleName, error) {
+	if err := s.err(); err != nil {
+		return nil, "", err
+	}
+	privKey, role, err := s.CryptoService.GetPrivateKey(keyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return fakeKey{PrivateKey: privKey, signer: s}, role, nil
+}
+
+// fakeKey signs with its replica, failing while the replica is down
+type fakeKey struct {
+	data.PrivateKey
+	signer *fakeSigner
+}
+
+func (k fakeKey) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := k.signer.err(); err != nil {
+		return nil, err
+	}
+	return k.PrivateKey.Sign(rand, msg, opts)
+}
+
+// newReplicas creates replicas that share their keys
+func newReplicas(n int) ([]*fakeSigner, []Endpoint) {
+	keys := cryptoservice.NewCryptoService(trustmanager.NewKeyMemoryStore(passphrase.ConstantRetriever("pass")))
+	var signers []*fakeSigner
+	var endpoints []Endpoint
+	for i := 0; i < n; i++ {
+		signer := &fakeSigner{CryptoService: keys}
+		signers = append(signers, signer)
+		endpoints = append(endpoints, Endpoint{Name: fmt.Sprintf("signer%d:7899", i), Signer: signer})
+	}
+	return signers, endpoints
+}
+
+func TestPoolSpreadsRequests(t *testing.T) {
+	signers, endpoints := newReplicas(2)
+	pool := NewPool(endpoints...)
+
+	for i := 0; i < 4; i++ {
+		_, err := pool.Create(data.CanonicalTimestampRole, "quay.io/signingUser/testRepo", data.ECDSAKey)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, signers[0].requests)
+	require.Equal(t, 2, signers[1].requests)
+}
+
+func TestPoolFailsOver(t *testing.T) {
+	signers, endpoints := newReplicas(2)
+	pool := NewPool(endpoints...)
+
+	pubKey, err := pool.Create(data.CanonicalTimestampRole, "quay.io/signingUser/testRepo", data.ECDSAKey)
+	require.NoError(t, err)
+	privKey, role, err := pool.GetPrivateKey(pubKey.ID())
+	require.NoError(t, err)
+	require.Equal(t, data.CanonicalTimestampRole, role)
+	first := privKey.(*privateKey).replica.Signer.(*fakeSigner)
+
+	// a key signs with another replica once the one it was looked up from goes down
+	first.down = true
+	msg := []byte("timestamp")
+	signature, err := privKey.Sign(rand.Reader, msg, nil)
+	require.NoError(t, err)
+	verifier := signed.Verifiers[privKey.SignatureAlgorithm()]
+	require.NoError(t, verifier.Verify(pubKey, signature, msg))
+
+	// and the replica that went down isn't tried first until it comes back
+	for _, signer := range signers {
+		signer.requests = 0
+	}
+	for i := 0; i < 4; i++ {
+		require.NotNil(t, pool.GetKey(pubKey.ID()))
+	}
+	require.Equal(t, 0, first.requests)
+
+	first.down = false
+	require.NoError(t, pool.CheckHealth(time.Second, ""))
+	for i := 0; i < 4; i++ {
+		require.NotNil(t, pool.GetKey(pubKey.ID()))
+	}
+	require.Equal(t, 2, first.requests)
+}
+
+func TestPoolDoesNotFailOverRequestErrors(t *testing.T) {
+	signers, endpoints := newReplicas(2)
+	pool := NewPool(endpoints...)
+
+	_, _, err := pool.GetPrivateKey("nonexistent")
+	require.Error(t, err)
+	require.IsType(t, trustmanager.ErrKeyNotFound{}, err)
+	require.Equal(t, 1, signers[0].requests+signers[1].requests)
+}
+
+func TestPoolUnavailable(t *testing.T) {
+	signers, endpoints := newReplicas(2)
+	pool := NewPool(endpoints...)
+	for _, signer := range signers {
+		signer.down = true
+	}
+
+	// the pool works in a degraded state while every replica is down
+	require.IsType(t, ErrUnavailable{}, pool.CheckHealth(time.Second, ""))
+	_, err := pool.Create(data.CanonicalTimestampRole, "quay.io/signingUser/testRepo", data.ECDSAKey)
+	require.IsType(t, ErrUnavailable{}, err)
+	_, _, err = pool.GetPrivateKey("nonexistent")
+	require.IsType(t, ErrUnavailable{}, err)
+	require.Nil(t, pool.GetKey("nonexistent"))
+
+	// until one comes back, even before it is health checked
+	signers[1].down = false
+	pubKey, err := pool.Create(data.CanonicalTimestampRole, "quay.io/signingUser/testRepo", data.ECDSAKey)
+	require.NoError(t, err)
+	require.NotNil(t, pool.GetKey(pubKey.ID()))
+	require.NoError(t, pool.CheckHealth(time.Second, ""))
+}
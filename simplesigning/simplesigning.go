@@ -0,0 +1,198 @@
+// Package simplesigning creates container signatures in the atomic "simple signing" format that podman, CRI-O and
+// skopeo read from a signature lookaside. Each signature is an OpenPGP signed message whose contents are a JSON claim
+// that a docker reference identifies a manifest digest.
+package simplesigning
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// SignatureType is the type of every simple signing claim
+const SignatureType = "atomic container signature"
+
+// Creator is recorded in the optional section of every claim
+const Creator = "apostille"
+
+// Identity is the docker reference a claim is about
+type Identity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+// Image is the manifest a claim is about
+type Image struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+// Critical is the part of a claim that consumers must understand and check
+type Critical struct {
+	Identity Identity `json:"identity"`
+	Image    Image    `json:"image"`
+	Type     string   `json:"type"`
+}
+
+// Optional is the part of a claim that consumers may ignore
+type Optional struct {
+	Creator   string `json:"creator,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// Claim is the signed contents of a simple signing signature
+type Claim struct {
+	Critical Critical `json:"critical"`
+	Optional Optional `json:"optional"`
+}
+
+// NewClaim creates the claim that a docker reference identifies a manifest digest
+func NewClaim(dockerReference, manifestDigest string, now time.Time) Claim {
+	return Claim{
+		Critical: Critical{
+			Identity: Identity{DockerReference: dockerReference},
+			Image:    Image{DockerManifestDigest: manifestDigest},
+			Type:     SignatureType,
+		},
+		Optional: Optional{
+			Creator:   Creator,
+			Timestamp: now.Unix(),
+		},
+	}
+}
+
+// Signer signs simple signing claims with an OpenPGP key
+type Signer struct {
+	entity *openpgp.Entity
+}
+
+// NewSigner creates a Signer from an OpenPGP entity whose primary key is a decrypted RSA or DSA private key, which
+// are the signing keys the OpenPGP implementation supports
+func NewSigner(entity *openpgp.Entity) (*Signer, error) {
+	key := entity.PrivateKey
+	if key == nil {
+		return nil, fmt.Errorf("simple signing key has no private key")
+	}
+	if key.Encrypted {
+		return nil, fmt.Errorf("simple signing key is encrypted")
+	}
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoDSA:
+	default:
+		return nil, fmt.Errorf("simple signing key must be an RSA or DSA key")
+	}
+	return &Signer{entity: entity}, nil
+}
+
+// LoadSigner creates a Signer from the first private key in an ASCII armored OpenPGP key ring, decrypting it with the
+// passphrase if it is encrypted
+func LoadSigner(r io.Reader, passphrase string) (*Signer, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("unable to decrypt simple signing key: %s", err.Error())
+			}
+		}
+		return NewSigner(entity)
+	}
+	return nil, fmt.Errorf("no private key found")
+}
+
+// KeyID is the hex ID of the signing key, which consumers use to find it in their key rings
+func (s *Signer) KeyID() string {
+	return s.entity.PrimaryKey.KeyIdString()
+}
+
+// PublicKey returns the ASCII armored public key, for consumers to verify signatures with
+func (s *Signer) PublicKey() ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.entity.Serialize(w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign creates the signature claiming that a docker reference identifies a manifest digest
+func (s *Signer) Sign(dockerReference, manifestDigest string, now time.Time) ([]byte, error) {
+	claim, err := json.Marshal(NewClaim(dockerReference, manifestDigest, now))
+	if err != nil {
+		return nil, err
+	}
+	return s.signMessage(claim, now)
+}
+
+// signMessage creates a binary OpenPGP signed message: a one-pass signature, the literal data, then the signature
+func (s *Signer) signMessage(message []byte, now time.Time) ([]byte, error) {
+	key := s.entity.PrivateKey
+	config := &packet.Config{
+		DefaultHash: crypto.SHA256,
+		Time:        func() time.Time { return now },
+	}
+
+	var buf bytes.Buffer
+	onePass := &packet.OnePassSignature{
+		SigType:    packet.SigTypeBinary,
+		Hash:       config.Hash(),
+		PubKeyAlgo: key.PubKeyAlgo,
+		KeyId:      key.KeyId,
+		IsLast:     true,
+	}
+	if err := onePass.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	literal, err := packet.SerializeLiteral(nopCloser{&buf}, true, "", uint32(now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := literal.Write(message); err != nil {
+		return nil, err
+	}
+	if err := literal.Close(); err != nil {
+		return nil, err
+	}
+
+	signature := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   key.PubKeyAlgo,
+		Hash:         config.Hash(),
+		CreationTime: now,
+		IssuerKeyId:  &key.KeyId,
+	}
+	h := signature.Hash.New()
+	h.Write(message)
+	if err := signature.Sign(h, key, config); err != nil {
+		return nil, err
+	}
+	if err := signature.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nopCloser stops the literal data packet from closing the buffer the signature is written to after it
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package simplesigning
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// armoredPrivateKey creates a new OpenPGP key and armors its private key ring
+func armoredPrivateKey(t *testing.T) []byte {
+	entity, err := openpgp.NewEntity("apostille", "test", "apostille@example.com", nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.SerializePrivate(w, nil))
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestSign(t *testing.T) {
+	signer, err := LoadSigner(bytes.NewReader(armoredPrivateKey(t)), "")
+	require.NoError(t, err)
+
+	now := time.Unix(1500000000, 0)
+	digest := "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	signature, err := signer.Sign("quay.io/signingUser/testRepo:latest", digest, now)
+	require.NoError(t, err)
+
+	// consumers verify with the published public key
+	publicKey, err := signer.PublicKey()
+	require.NoError(t, err)
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(publicKey))
+	require.NoError(t, err)
+	require.Len(t, keyring, 1)
+	require.Nil(t, keyring[0].PrivateKey)
+
+	details, err := openpgp.ReadMessage(bytes.NewReader(signature), keyring, nil, nil)
+	require.NoError(t, err)
+	require.True(t, details.IsSigned)
+	require.Equal(t, signer.KeyID(), details.SignedBy.PublicKey.KeyIdString())
+	body, err := ioutil.ReadAll(details.UnverifiedBody)
+	require.NoError(t, err)
+	require.NoError(t, details.SignatureError)
+
+	var claim Claim
+	require.NoError(t, json.Unmarshal(body, &claim))
+	require.Equal(t, NewClaim("quay.io/signingUser/testRepo:latest", digest, now), claim)
+	require.Equal(t, SignatureType, claim.Critical.Type)
+
+	// a signature for another key doesn't verify
+	other, err := LoadSigner(bytes.NewReader(armoredPrivateKey(t)), "")
+	require.NoError(t, err)
+	otherKey, err := other.PublicKey()
+	require.NoError(t, err)
+	otherKeyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(otherKey))
+	require.NoError(t, err)
+	details, err = openpgp.ReadMessage(bytes.NewReader(signature), otherKeyring, nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, details.SignedBy)
+}
+
+func TestLoadSignerWithoutPrivateKey(t *testing.T) {
+	signer, err := LoadSigner(bytes.NewReader(armoredPrivateKey(t)), "")
+	require.NoError(t, err)
+	publicKey, err := signer.PublicKey()
+	require.NoError(t, err)
+
+	_, err = LoadSigner(bytes.NewReader(publicKey), "")
+	require.Error(t, err)
+	_, err = LoadSigner(bytes.NewBufferString("not a key"), "")
+	require.Error(t, err)
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+)
+
+// Kinds of TargetChange
+const (
+	TargetAdded   = "added"
+	TargetRemoved = "removed"
+	TargetChanged = "changed"
+)
+
+// TrustChange describes a change to the signer-rooted metadata of a gun, or to the server-signed delegation of a gun
+// under an alternate root
+type TrustChange struct {
+	GUN data.GUN `json:"gun"`
+	// Root is the alternate root that server-signed targets were changed under, and empty for signer-rooted changes
+	Root string `json:"root,omitempty"`
+	// Deleted is true if all of the gun's metadata was deleted
+	Deleted bool `json:"deleted,omitempty"`
+	// Roles are the new versions of the roles that were written
+	Roles []ChangedRole `json:"roles,omitempty"`
+	// Targets are the targets that were added, removed or changed by the targets roles that were written or deleted
+	Targets []TargetChange `json:"targets,omitempty"`
+	// Incomplete is true if the changed targets couldn't all be worked out, so Targets may be missing some
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// ChangedRole is a new version of a role
+type ChangedRole struct {
+	Role    data.RoleName `json:"role"`
+	Version int           `json:"version"`
+}
+
+// TargetChange is a target that was added to, removed from or changed in a targets role. Digest and Length describe
+// the target as it is now, or as it was before it was removed.
+type TargetChange struct {
+	Role   data.RoleName `json:"role"`
+	Name   string        `json:"name"`
+	Change string        `json:"change"`
+	Digest string        `json:"digest,omitempty"`
+	Length int64         `json:"length"`
+}
+
+// ChangeNotifier is told about changes to signer-rooted metadata and server-signed targets once they have been stored. It must not block.
+type ChangeNotifier interface {
+	NotifyChange(change TrustChange)
+}
+
+// Delete removes all metadata for a gun, and notifies the Notifier of the targets that were removed
+func (st *MultiplexingStore) Delete(gun data.GUN) error {
+	var change *TrustChange
+	if st.Notifier != nil {
+		change = &TrustChange{GUN: gun, Deleted: true}
+		removed, err := st.deletedTargets(gun)
+		if err != nil {
+			logrus.Errorf("unable to find the targets deleted from %s: %s", gun, err.Error())
+			change.Incomplete = true
+		}
+		change.Targets = removed
+	}
+
+	if err := st.MetaStore.Delete(gun); err != nil {
+		return err
+	}
+	if change != nil {
+		st.Notifier.NotifyChange(*change)
+	}
+	return nil
+}
+
+// trustChange works out how a set of signer-rooted updates changes a gun, before they are stored. Every role is
+// listed even if the targets of some can't be worked out, in which case the first error is returned.
+func (st *MultiplexingStore) trustChange(gun data.GUN, updates []notaryStorage.MetaUpdate) (TrustChange, error) {
+	change := TrustChange{GUN: gun}
+	var firstErr error
+	for _, update := range updates {
+		change.Roles = append(change.Roles, ChangedRole{Role: update.Role, Version: update.Version})
+		if update.Role != data.CanonicalTargetsRole && !data.IsDelegation(update.Role) {
+			continue
+		}
+		targets, err := st.changedTargets(gun, update)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		change.Targets = append(change.Targets, targets...)
+	}
+	return change, firstErr
+}
+
+// changedTargets lists the targets that a signer-rooted update to a targets role changes
+func (st *MultiplexingStore) changedTargets(gun data.GUN, update notaryStorage.MetaUpdate) ([]TargetChange, error) {
+	previous, err := st.currentTargets(gun, update.Role)
+	if err != nil {
+		return nil, err
+	}
+	current, err := parseTargets(update.Data)
+	if err != nil {
+		return nil, err
+	}
+	return diffTargets(update.Role, previous, current), nil
+}
+
+// deletedTargets lists every target in a gun's targets role and the delegations it reaches
+func (st *MultiplexingStore) deletedTargets(gun data.GUN) ([]TargetChange, error) {
+	var removed []TargetChange
+	seen := map[data.RoleName]bool{}
+	roles := []data.RoleName{data.CanonicalTargetsRole}
+	for len(roles) > 0 {
+		role := roles[0]
+		roles = roles[1:]
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+
+		_, meta, err := st.SignerChannelMetaStore.GetCurrent(gun, role)
+		if err != nil {
+			if _, ok := err.(notaryStorage.ErrNotFound); ok {
+				continue
+			}
+			return removed, err
+		}
+		targets, err := parseSignedTargets(meta)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, diffTargets(role, targets.Targets, nil)...)
+		for _, delegation := range targets.Delegations.Roles {
+			roles = append(roles, delegation.Name)
+		}
+	}
+	return removed, nil
+}
+
+// currentTargets returns the targets a signer-rooted targets role currently has, if it is stored
+func (st *MultiplexingStore) currentTargets(gun data.GUN, role data.RoleName) (data.Files, error) {
+	_, meta, err := st.SignerChannelMetaStore.GetCurrent(gun, role)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseTargets(meta)
+}
+
+// parseTargets reads the targets out of serialized targets metadata
+func parseTargets(meta []byte) (data.Files, error) {
+	targets, err := parseSignedTargets(meta)
+	if err != nil {
+		return nil, err
+	}
+	return targets.Targets, nil
+}
+
+// parseSignedTargets reads serialized targets metadata without verifying it
+func parseSignedTargets(meta []byte) (*data.Targets, error) {
+	var signedTargets struct {
+		Signed data.Targets `json:"signed"`
+	}
+	if err := json.Unmarshal(meta, &signedTargets); err != nil {
+		return nil, err
+	}
+	return &signedTargets.Signed, nil
+}
+
+// diffTargets lists the targets that differ between two versions of a targets role, sorted by name
+func diffTargets(role data.RoleName, previous, current data.Files) []TargetChange {
+	var changes []TargetChange
+	for name, meta := range current {
+		old, ok := previous[name]
+		switch {
+		case !ok:
+			changes = append(changes, targetChange(role, name, TargetAdded, meta))
+		case !meta.Equals(old):
+			changes = append(changes, targetChange(role, name, TargetChanged, meta))
+		}
+	}
+	for name, meta := range previous {
+		if _, ok := current[name]; !ok {
+			changes = append(changes, targetChange(role, name, TargetRemoved, meta))
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+func targetChange(role data.RoleName, name, change string, meta data.FileMeta) TargetChange {
+	return TargetChange{
+		Role:   role,
+		Name:   name,
+		Change: change,
+		Digest: hex.EncodeToString(meta.Hashes[notary.SHA256]),
+		Length: meta.Length,
+	}
+}
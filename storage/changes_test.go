@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"testing"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingNotifier struct {
+	changes []TrustChange
+}
+
+func (n *recordingNotifier) NotifyChange(change TrustChange) {
+	n.changes = append(n.changes, change)
+}
+
+func fileMeta(t *testing.T, contents string) data.FileMeta {
+	meta, err := data.NewFileMeta(bytes.NewBufferString(contents), notary.SHA256)
+	require.NoError(t, err)
+	return meta
+}
+
+func TestNotifyChanges(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	notifier := &recordingNotifier{}
+	metaStore.Notifier = notifier
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	_, err := repo.AddTargets(data.CanonicalTargetsRole, data.Files{
+		"latest": fileMeta(t, "one"),
+		"old":    fileMeta(t, "old"),
+	})
+	require.NoError(t, err)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	require.Len(t, notifier.changes, 1)
+	change := notifier.changes[0]
+	require.Equal(t, gun, change.GUN)
+	require.False(t, change.Deleted)
+	require.Len(t, change.Roles, len(meta))
+	require.Equal(t, []TargetChange{
+		{Role: data.CanonicalTargetsRole, Name: "latest", Change: TargetAdded, Digest: hex.EncodeToString(fileMeta(t, "one").Hashes[notary.SHA256]), Length: 3},
+		{Role: data.CanonicalTargetsRole, Name: "old", Change: TargetAdded, Digest: hex.EncodeToString(fileMeta(t, "old").Hashes[notary.SHA256]), Length: 3},
+	}, change.Targets)
+
+	// retag latest, remove old and add new
+	require.NoError(t, repo.RemoveTargets(data.CanonicalTargetsRole, "old"))
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{
+		"latest": fileMeta(t, "two"),
+		"new":    fileMeta(t, "new!"),
+	})
+	require.NoError(t, err)
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, map[data.RoleName][]byte{
+		data.CanonicalTargetsRole:  meta[data.CanonicalTargetsRole],
+		data.CanonicalSnapshotRole: meta[data.CanonicalSnapshotRole],
+	}, 2)
+
+	require.Len(t, notifier.changes, 2)
+	change = notifier.changes[1]
+	sort.Slice(change.Roles, func(i, j int) bool {
+		return change.Roles[i].Role < change.Roles[j].Role
+	})
+	require.Equal(t, []ChangedRole{
+		{Role: data.CanonicalSnapshotRole, Version: 2},
+		{Role: data.CanonicalTargetsRole, Version: 2},
+	}, change.Roles)
+	require.Equal(t, []TargetChange{
+		{Role: data.CanonicalTargetsRole, Name: "latest", Change: TargetChanged, Digest: hex.EncodeToString(fileMeta(t, "two").Hashes[notary.SHA256]), Length: 3},
+		{Role: data.CanonicalTargetsRole, Name: "new", Change: TargetAdded, Digest: hex.EncodeToString(fileMeta(t, "new!").Hashes[notary.SHA256]), Length: 4},
+		{Role: data.CanonicalTargetsRole, Name: "old", Change: TargetRemoved, Digest: hex.EncodeToString(fileMeta(t, "old").Hashes[notary.SHA256]), Length: 3},
+	}, change.Targets)
+
+	// deleting the gun removes every target
+	require.NoError(t, metaStore.Delete(gun))
+	require.Len(t, notifier.changes, 3)
+	change = notifier.changes[2]
+	require.True(t, change.Deleted)
+	require.Empty(t, change.Roles)
+	require.Len(t, change.Targets, 2)
+	for _, target := range change.Targets {
+		require.Equal(t, TargetRemoved, target.Change)
+	}
+}
+
+func TestNotifyChangesFailedUpdate(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	notifier := &recordingNotifier{}
+	metaStore.Notifier = notifier
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+	require.Len(t, notifier.changes, 1)
+
+	// storing an old version fails, so nothing is notified
+	updates := []notaryStorage.MetaUpdate{{Role: data.CanonicalTargetsRole, Version: 1, Data: meta[data.CanonicalTargetsRole]}}
+	require.Error(t, metaStore.UpdateMany(gun, updates))
+	require.Len(t, notifier.changes, 1)
+}
+
+func TestNotifyChangesIncomplete(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	notifier := &recordingNotifier{}
+	metaStore.Notifier = notifier
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	// the stored targets can't be read, so the targets the push changes can't be worked out
+	corrupt := []byte(`{"signed": {"_type": "Targets", "version": 2, "targets": "none"}}`)
+	require.NoError(t, metaStore.SignerChannelMetaStore.UpdateCurrent(gun, notaryStorage.MetaUpdate{
+		Role:    data.CanonicalTargetsRole,
+		Version: 2,
+		Data:    corrupt,
+	}))
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{"latest": fileMeta(t, "one")})
+	require.NoError(t, err)
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 3)
+
+	// the push is still notified, but flagged as incomplete
+	require.Len(t, notifier.changes, 2)
+	require.False(t, notifier.changes[0].Incomplete)
+	change := notifier.changes[1]
+	require.True(t, change.Incomplete)
+	require.Len(t, change.Roles, len(meta))
+	require.Empty(t, change.Targets)
+
+	// the targets of a deleted gun can't all be listed either
+	require.NoError(t, metaStore.SignerChannelMetaStore.UpdateCurrent(gun, notaryStorage.MetaUpdate{
+		Role:    data.CanonicalTargetsRole,
+		Version: 4,
+		Data:    corrupt,
+	}))
+	require.NoError(t, metaStore.Delete(gun))
+	require.Len(t, notifier.changes, 3)
+	require.True(t, notifier.changes[2].Deleted)
+	require.True(t, notifier.changes[2].Incomplete)
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// signerChainName is the name problems with the signer-rooted chain of trust are reported under
+const signerChainName = "signer"
+
+var fsckProblems = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "apostille",
+	Subsystem: "fsck",
+	Name:      "problems_total",
+	Help:      "Number of inconsistencies found by consistency checks, by chain of trust.",
+}, []string{"root"})
+
+func init() {
+	prometheus.MustRegister(fsckProblems)
+}
+
+// FsckOptions controls a consistency check of all repositories
+type FsckOptions struct {
+	// Roots are the names of the alternate roots to check; every alternate root if empty
+	Roots []string `json:"roots"`
+	// Prefix limits the check to GUNs starting with it
+	Prefix string `json:"prefix"`
+	// StartAfter is the changefeed ID to resume from, as reported by a previous check; "0" starts from the beginning
+	StartAfter string `json:"start_after"`
+	// BatchSize is how many changefeed records are read from the store at a time
+	BatchSize int `json:"batch_size"`
+	// Repair re-swizzles repositories whose alternate-rooted metadata is inconsistent
+	Repair bool `json:"repair"`
+}
+
+// FsckProblem is an inconsistency found in a repository's metadata
+type FsckProblem struct {
+	GUN data.GUN `json:"gun"`
+	// Root is the alternate root whose chain of trust has the problem, or "signer" for the signer-rooted chain
+	Root    string        `json:"root"`
+	Role    data.RoleName `json:"role,omitempty"`
+	Problem string        `json:"problem"`
+	// Repaired is set if re-swizzling fixed the problem
+	Repaired bool `json:"repaired"`
+}
+
+// FsckReport reports what a consistency check found
+type FsckReport struct {
+	// Checked is the number of repositories checked
+	Checked int `json:"checked"`
+	// Problems are the inconsistencies found
+	Problems []FsckProblem `json:"problems"`
+	// LastChangeID is the changefeed ID of the last repository checked, which a later check can resume after
+	LastChangeID string `json:"last_change_id"`
+}
+
+// Unrepaired returns the number of problems that were not repaired
+func (r *FsckReport) Unrepaired() int {
+	count := 0
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// Fsck checks that the signer-rooted and alternate-rooted metadata of every repository is consistent: both chains of
+// trust must load the way a client would load them, the alternate-rooted metadata must be rooted under the current
+// alternate root and not have expired, and the stashed targets must match the signer-rooted targets. With
+// options.Repair, repositories with inconsistent alternate-rooted metadata are re-swizzled and checked again.
+func (st *MultiplexingStore) Fsck(ctx context.Context, options FsckOptions) (*FsckReport, error) {
+	roots, err := st.selectAlternateRoots(options.Roots)
+	if err != nil {
+		return nil, err
+	}
+	if options.StartAfter == "" {
+		options.StartAfter = "0"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+
+	report := &FsckReport{
+		Problems:     []FsckProblem{},
+		LastChangeID: options.StartAfter,
+	}
+	err = WalkGUNs(st.MetaStore, options.StartAfter, options.BatchSize, func(gun data.GUN, changeID string) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if strings.HasPrefix(gun.String(), options.Prefix) {
+			problems, err := st.fsckGUN(roots, gun, options.Repair)
+			if err != nil {
+				return err
+			}
+			if problems != nil {
+				report.Checked++
+				report.Problems = append(report.Problems, problems...)
+			}
+		}
+		report.LastChangeID = changeID
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	logrus.Infof("checked %d repositories, found %d problems, %d unrepaired", report.Checked, len(report.Problems), report.Unrepaired())
+	return report, nil
+}
+
+// fsckGUN checks both chains of trust of a gun, repairing the alternate-rooted chains if asked to. It returns nil if the
+// gun has no signer-rooted metadata, which happens once it is deleted.
+func (st *MultiplexingStore) fsckGUN(roots []*AlternateRootStore, gun data.GUN, repair bool) ([]FsckProblem, error) {
+	if _, _, err := st.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalTimestampRole); err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	problems := []FsckProblem{}
+	signerRepo, role, err := loadChain(tuf.NewRepoBuilder(gun, nil, trustpinning.TrustPinConfig{}), st.SignerChannelMetaStore, gun,
+		data.CanonicalRootRole, data.CanonicalTimestampRole, data.CanonicalSnapshotRole, data.CanonicalTargetsRole)
+	if err != nil {
+		// alternate-rooted metadata is swizzled from the signer-rooted metadata, so it can't be checked or repaired
+		fsckProblems.WithLabelValues(signerChainName).Inc()
+		return append(problems, FsckProblem{GUN: gun, Root: signerChainName, Role: role, Problem: err.Error()}), nil
+	}
+
+	for _, root := range roots {
+		if !root.Covers(gun) {
+			continue
+		}
+		rootProblems, err := st.fsckAlternateRoot(root, gun, signerRepo)
+		if err != nil {
+			return nil, err
+		}
+		fsckProblems.WithLabelValues(root.Name).Add(float64(len(rootProblems)))
+		if len(rootProblems) > 0 && repair {
+			if err := st.Reswizzle(root, gun); err != nil {
+				logrus.Errorf("failed to repair %s under %s root: %s", gun, root.Name, err.Error())
+			} else if remaining, err := st.fsckAlternateRoot(root, gun, signerRepo); err != nil {
+				return nil, err
+			} else if len(remaining) == 0 {
+				logrus.Infof("repaired %s under %s root", gun, root.Name)
+				for i := range rootProblems {
+					rootProblems[i].Repaired = true
+				}
+			}
+		}
+		problems = append(problems, rootProblems...)
+	}
+	return problems, nil
+}
+
+// fsckAlternateRoot checks the chain of trust of a gun under an alternate root against the gun's signer-rooted repo
+func (st *MultiplexingStore) fsckAlternateRoot(root *AlternateRootStore, gun data.GUN, signerRepo *tuf.Repo) ([]FsckProblem, error) {
+	problem := func(role data.RoleName, format string, args ...interface{}) FsckProblem {
+		return FsckProblem{GUN: gun, Root: root.Name, Role: role, Problem: fmt.Sprintf(format, args...)}
+	}
+
+	// the root is validated as the alternate root's own root, since that's who its certificate is for
+	repo, role, err := loadChain(tuf.NewRepoBuilder(root.RootGUN, nil, trustpinning.TrustPinConfig{}), root.MetaStore, gun,
+		data.CanonicalRootRole, data.CanonicalTimestampRole, data.CanonicalSnapshotRole, data.CanonicalTargetsRole, st.stashedTargetsRole)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return []FsckProblem{problem(role, "missing")}, nil
+		}
+		return []FsckProblem{problem(role, "%s", err.Error())}, nil
+	}
+
+	var problems []FsckProblem
+	current, _, err := st.loadAlternateRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	if repo.Root.Signed.Version < current.Signed.Version {
+		problems = append(problems, problem(data.CanonicalRootRole, "rooted under version %d of the alternate root, the current version is %d",
+			repo.Root.Signed.Version, current.Signed.Version))
+	}
+
+	now := time.Now()
+	for _, expiry := range []struct {
+		role    data.RoleName
+		expires time.Time
+	}{
+		{data.CanonicalTimestampRole, repo.Timestamp.Signed.Expires},
+		{data.CanonicalSnapshotRole, repo.Snapshot.Signed.Expires},
+		{data.CanonicalTargetsRole, repo.Targets[data.CanonicalTargetsRole].Signed.Expires},
+	} {
+		if now.After(expiry.expires) {
+			problems = append(problems, problem(expiry.role, "expired at %s", expiry.expires.Format(time.RFC3339)))
+		}
+	}
+
+	stashed := repo.Targets[st.stashedTargetsRole].Signed
+	signerTargets := signerRepo.Targets[data.CanonicalTargetsRole].Signed
+	if stashed.Version != signerTargets.Version {
+		problems = append(problems, problem(st.stashedTargetsRole, "version %d does not match signer-rooted targets version %d",
+			stashed.Version, signerTargets.Version))
+	} else if !reflect.DeepEqual(stashed.Targets, signerTargets.Targets) {
+		problems = append(problems, problem(st.stashedTargetsRole, "targets do not match signer-rooted targets"))
+	}
+	return problems, nil
+}
+
+// loadChain loads a gun's metadata for `roles` from a store into a builder in order, the way a client would, which
+// verifies the signatures on each role and the hashes it is referenced by. If a role can't be loaded, it is returned
+// along with the reason.
+func loadChain(builder tuf.RepoBuilder, store notaryStorage.MetaStore, gun data.GUN, roles ...data.RoleName) (*tuf.Repo, data.RoleName, error) {
+	for _, role := range roles {
+		_, meta, err := store.GetCurrent(gun, role)
+		if err != nil {
+			return nil, role, err
+		}
+		// expiry is checked separately, since it doesn't make the rest of the chain inconsistent
+		if err := builder.Load(role, meta, 1, true); err != nil {
+			return nil, role, err
+		}
+	}
+	repo, _, err := builder.Finish()
+	return repo, "", err
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/coreos-inc/apostille/servertest"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestFsck(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	root := defaultRoot(t, metaStore)
+
+	corrupted := data.GUN("quay.io/signingUser/corrupted")
+	stale := data.GUN("quay.io/signingUser/stale")
+	repos := map[data.GUN]map[data.RoleName][]byte{}
+	for _, gun := range []data.GUN{corrupted, stale} {
+		repo := servertest.CreateRepo(t, gun, trust)
+		meta, err := testutils.SignAndSerialize(repo)
+		require.NoError(t, err)
+		pushMeta(t, metaStore, gun, meta, 1)
+
+		meta, err = testutils.SignAndSerialize(repo)
+		require.NoError(t, err)
+		repos[gun] = meta
+	}
+
+	report, err := metaStore.Fsck(context.Background(), FsckOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Checked)
+	require.Empty(t, report.Problems)
+
+	// a timestamp that isn't signed by the alternate root
+	require.NoError(t, metaStore.MetaStore.UpdateCurrent(corrupted, notaryStorage.MetaUpdate{
+		Role:     data.CanonicalTimestampRole,
+		Version:  2,
+		Data:     repos[corrupted][data.CanonicalTimestampRole],
+		Channels: []*notaryStorage.Channel{&root.Channel},
+	}))
+	// signer-rooted targets that were never swizzled
+	updates := make([]notaryStorage.MetaUpdate, 0, len(repos[stale]))
+	for role, meta := range repos[stale] {
+		updates = append(updates, notaryStorage.MetaUpdate{Role: role, Version: 2, Data: meta})
+	}
+	require.NoError(t, metaStore.MetaStore.UpdateMany(stale, metaStore.setChannels(updates, &SignerRoot)))
+
+	report, err = metaStore.Fsck(context.Background(), FsckOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 2)
+	require.Equal(t, 2, report.Unrepaired())
+	for _, problem := range report.Problems {
+		require.Equal(t, root.Name, problem.Root)
+		switch problem.GUN {
+		case corrupted:
+			require.Equal(t, data.CanonicalTimestampRole, problem.Role)
+		case stale:
+			require.Equal(t, data.RoleName("targets/releases"), problem.Role)
+		default:
+			t.Fatalf("unexpected problem: %v", problem)
+		}
+	}
+
+	// the prefix limits what is checked
+	report, err = metaStore.Fsck(context.Background(), FsckOptions{Prefix: string(stale)})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Checked)
+	require.Len(t, report.Problems, 1)
+
+	report, err = metaStore.Fsck(context.Background(), FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 2)
+	require.Equal(t, 0, report.Unrepaired())
+
+	report, err = metaStore.Fsck(context.Background(), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+}
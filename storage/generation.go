@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/notary"
+	"github.com/docker/notary/tuf/data"
+)
+
+// GenerationConfig controls the keys of the root repos that are generated for alternate roots, and how long the
+// metadata signed for alternate roots is valid for. Roles that aren't configured get notary's defaults.
+type GenerationConfig struct {
+	// KeyAlgorithms are the algorithms of the keys generated for each base role
+	KeyAlgorithms map[data.RoleName]string
+	// RootKeys is the number of root keys generated
+	RootKeys int
+	// RootThreshold is the number of root keys that must sign the root
+	RootThreshold int
+	// CertificateValidity is how long the certificates of generated root keys are valid for
+	CertificateValidity time.Duration
+	// Expiries are how long signed metadata of each base role is valid for; delegations expire like targets
+	Expiries map[data.RoleName]time.Duration
+}
+
+// DefaultGenerationConfig generates a single ECDSA key for each role, with a 10 year root certificate
+func DefaultGenerationConfig() GenerationConfig {
+	return GenerationConfig{
+		RootKeys:            1,
+		RootThreshold:       notary.MinThreshold,
+		CertificateValidity: notary.Year * 10,
+	}
+}
+
+// KeyAlgorithm returns the algorithm of the keys generated for a base role
+func (c GenerationConfig) KeyAlgorithm(role data.RoleName) string {
+	if algorithm, ok := c.KeyAlgorithms[role]; ok {
+		return algorithm
+	}
+	return data.ECDSAKey
+}
+
+// Expires returns when metadata of a role that is signed now expires
+func (c GenerationConfig) Expires(role data.RoleName) time.Time {
+	return time.Now().Add(c.Expiry(role))
+}
+
+// Expiry returns how long metadata of a role is valid for once it is signed
+func (c GenerationConfig) Expiry(role data.RoleName) time.Duration {
+	if data.IsDelegation(role) {
+		role = data.CanonicalTargetsRole
+	}
+	if expiry, ok := c.Expiries[role]; ok {
+		return expiry
+	}
+	// notary only exposes its default expiries as times
+	return data.DefaultExpires(role).Sub(time.Now())
+}
+
+// Validate checks that every role is a base role, that root keys have an algorithm that can be wrapped in a
+// certificate, and that the threshold can be met
+func (c GenerationConfig) Validate() error {
+	for role, algorithm := range c.KeyAlgorithms {
+		if !data.IsBaseRole(role) {
+			return fmt.Errorf("%s is not a base role", role)
+		}
+		switch algorithm {
+		case data.ECDSAKey, data.RSAKey:
+		case data.ED25519Key:
+			if role == data.CanonicalRootRole {
+				return fmt.Errorf("root keys must be %s or %s keys, which can be wrapped in a certificate", data.ECDSAKey, data.RSAKey)
+			}
+		default:
+			return fmt.Errorf("invalid key algorithm for %s: %s", role, algorithm)
+		}
+	}
+	for role, expiry := range c.Expiries {
+		if !data.IsBaseRole(role) {
+			return fmt.Errorf("%s is not a base role", role)
+		}
+		if expiry <= 0 {
+			return fmt.Errorf("invalid expiry for %s: %v", role, expiry)
+		}
+	}
+	if c.RootKeys < 1 {
+		return fmt.Errorf("at least one root key is required")
+	}
+	if c.RootThreshold < 1 || c.RootThreshold > c.RootKeys {
+		return fmt.Errorf("root threshold must be between 1 and the number of root keys (%d)", c.RootKeys)
+	}
+	if c.CertificateValidity <= 0 {
+		return fmt.Errorf("invalid certificate validity: %v", c.CertificateValidity)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerationConfigDefaults(t *testing.T) {
+	generation := DefaultGenerationConfig()
+	require.NoError(t, generation.Validate())
+	for _, role := range data.BaseRoles {
+		require.Equal(t, data.ECDSAKey, generation.KeyAlgorithm(role))
+		require.WithinDuration(t, data.DefaultExpires(role), generation.Expires(role), time.Second)
+	}
+
+	generation.KeyAlgorithms = map[data.RoleName]string{data.CanonicalTimestampRole: data.ED25519Key}
+	generation.Expiries = map[data.RoleName]time.Duration{data.CanonicalTargetsRole: time.Hour}
+	require.NoError(t, generation.Validate())
+	require.Equal(t, data.ED25519Key, generation.KeyAlgorithm(data.CanonicalTimestampRole))
+	require.Equal(t, data.ECDSAKey, generation.KeyAlgorithm(data.CanonicalRootRole))
+	require.WithinDuration(t, time.Now().Add(time.Hour), generation.Expires(data.CanonicalTargetsRole), time.Second)
+	// delegations expire like targets
+	require.WithinDuration(t, time.Now().Add(time.Hour), generation.Expires("targets/releases"), time.Second)
+	require.Equal(t, time.Hour, generation.Expiry("targets/releases"))
+	require.InDelta(t, float64(7*notary.Day), float64(generation.Expiry(data.CanonicalSnapshotRole)), float64(time.Second))
+}
+
+func TestGenerationConfigValidate(t *testing.T) {
+	invalids := []func(*GenerationConfig){
+		func(c *GenerationConfig) {
+			c.KeyAlgorithms = map[data.RoleName]string{"targets/releases": data.ECDSAKey}
+		},
+		func(c *GenerationConfig) {
+			c.KeyAlgorithms = map[data.RoleName]string{data.CanonicalRootRole: data.ED25519Key}
+		},
+		func(c *GenerationConfig) {
+			c.KeyAlgorithms = map[data.RoleName]string{data.CanonicalTargetsRole: "meh"}
+		},
+		func(c *GenerationConfig) { c.Expiries = map[data.RoleName]time.Duration{data.CanonicalSnapshotRole: 0} },
+		func(c *GenerationConfig) { c.Expiries = map[data.RoleName]time.Duration{"targets/releases": time.Hour} },
+		func(c *GenerationConfig) { c.RootKeys = 0 },
+		func(c *GenerationConfig) { c.RootKeys, c.RootThreshold = 2, 3 },
+		func(c *GenerationConfig) { c.RootThreshold = 0 },
+		func(c *GenerationConfig) { c.CertificateValidity = -time.Hour },
+	}
+	for _, invalidate := range invalids {
+		generation := DefaultGenerationConfig()
+		invalidate(&generation)
+		require.Error(t, generation.Validate())
+	}
+}
+
+// swizzled metadata expires according to the store's generation config
+func TestSwizzleUsesGenerationExpiries(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	expiries := map[data.RoleName]time.Duration{
+		data.CanonicalTargetsRole:   48 * time.Hour,
+		data.CanonicalSnapshotRole:  24 * time.Hour,
+		data.CanonicalTimestampRole: time.Hour,
+	}
+	metaStore.Generation.Expiries = expiries
+
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	root, ok := metaStore.AlternateRootStore(DefaultAlternateRootName)
+	require.True(t, ok)
+	for role, expiry := range expiries {
+		_, metaBytes, err := root.MetaStore.GetCurrent(gun, role)
+		require.NoError(t, err)
+		var signed struct {
+			Signed data.SignedCommon `json:"signed"`
+		}
+		require.NoError(t, json.Unmarshal(metaBytes, &signed))
+		require.WithinDuration(t, time.Now().Add(expiry), signed.Signed.Expires, time.Minute, "%s", role)
+	}
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/docker/notary/tuf/data"
+)
+
+// gunLocks serializes read-modify-writes of a gun's alternate-rooted metadata within one apostille. Its zero value is
+// ready to use.
+type gunLocks struct {
+	mu    sync.Mutex
+	locks map[data.GUN]*gunLock
+}
+
+// gunLock is the lock of one gun, which is dropped once nothing holds or waits for it
+type gunLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks a gun, and returns the function that unlocks it
+func (l *gunLocks) lock(gun data.GUN) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[data.GUN]*gunLock)
+	}
+	lock, ok := l.locks[gun]
+	if !ok {
+		lock = &gunLock{}
+		l.locks[gun] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, gun)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	notaryStorage "github.com/docker/notary/server/storage"
@@ -22,121 +26,175 @@ var AlternateRoot = notaryStorage.Channel{
 	Name: "alternate-rooted",
 }
 
-// Root is the root repo that alternate-rooted metadata gets rooted under
+// Root is the channel that the root repos of alternate roots are stored under
 var Root = notaryStorage.Channel{
 	ID:   4,
 	Name: "quay",
 }
 
-// MultiplexingStore implements the MetaStore interface, splitting metadata between two roots
-type MultiplexingStore struct {
-	notaryStorage.MetaStore
-	SignerChannelMetaStore    notaryStorage.MetaStore
-	AlternateChannelMetaStore notaryStorage.MetaStore
-	RootMetaStore             notaryStorage.MetaStore
-	cryptoService             signed.CryptoService
-	stashedTargetsRole        data.RoleName
-	defaultChannel            notaryStorage.Channel
-	alternateRootChannel      notaryStorage.Channel
-	rootChannel               notaryStorage.Channel
-	rootGUN                   data.GUN
+// DefaultAlternateRootName is the name of the alternate root when only one is configured
+const DefaultAlternateRootName = "quay"
+
+// AlternateRootConfig describes a server-managed root that signer-rooted metadata is swizzled under
+type AlternateRootConfig struct {
+	// Name identifies the root, and is matched against the `com.apostille.root` claim of a token
+	Name string
+	// Channel is the channel metadata rooted under this root is stored in
+	Channel notaryStorage.Channel
+	// RootGUN is the gun the root repo is stored under in the root store
+	RootGUN data.GUN
+	// Prefixes are the gun prefixes this root applies to; a root without prefixes applies to every gun
+	Prefixes []string
 }
 
-// NewMultiplexingStore composes a new Multiplexing store instance from underlying stores.
-func NewMultiplexingStore(store, rootStore notaryStorage.MetaStore, cs signed.CryptoService, defaultChannel notaryStorage.Channel, alternateRootChannel notaryStorage.Channel, rootChannel notaryStorage.Channel, rootGUN data.GUN, stashedTargetsRole data.RoleName) *MultiplexingStore {
-	return &MultiplexingStore{
-		MetaStore:                 store,
-		SignerChannelMetaStore:    NewChannelMetastore(store, defaultChannel),
-		AlternateChannelMetaStore: NewChannelMetastore(store, alternateRootChannel),
-		RootMetaStore:             NewChannelMetastore(rootStore, rootChannel),
-		cryptoService:             cs,
-		stashedTargetsRole:        stashedTargetsRole,
-		defaultChannel:            defaultChannel,
-		alternateRootChannel:      alternateRootChannel,
-		rootChannel:               rootChannel,
-		rootGUN:                   rootGUN,
-	}
+// AlternateRootStore holds the stores and the cached root repo for a single alternate root
+type AlternateRootStore struct {
+	AlternateRootConfig
+	// MetaStore reads metadata rooted under this root
+	MetaStore notaryStorage.MetaStore
+	// RootMetaStore reads this root's root repo
+	RootMetaStore notaryStorage.MetaStore
+	cache         alternateRootCache
 }
 
-// fetchAlternateRootRepo gets the root roles that we use to re-root with from the database
-// TODO: load once on startup, and cache
-func (st *MultiplexingStore) fetchAlternateRootRepo() (*tuf.Repo, error) {
-	store := st.RootMetaStore
-	// Get root metadata
-	_, rootBytes, err := store.GetCurrent(st.rootGUN, data.CanonicalRootRole, &st.rootChannel)
-	if err != nil {
-		return nil, err
+// Covers returns whether metadata for a gun should be rooted under this root
+func (root *AlternateRootStore) Covers(gun data.GUN) bool {
+	if len(root.Prefixes) == 0 {
+		return true
 	}
-	rootSigned := &data.Signed{}
-	if err := json.Unmarshal(rootBytes, rootSigned); err != nil {
-		return nil, err
-	}
-	rootSignedRole, err := data.RootFromSigned(rootSigned)
-	if err != nil {
-		return nil, err
-	}
-
-	// Build root roles
-	baseRoles := map[data.RoleName]data.BaseRole{}
-	for _, baseRoleName := range data.BaseRoles {
-		baseRoles[baseRoleName], err = rootSignedRole.BuildBaseRole(baseRoleName)
-		if err != nil {
-			return nil, err
+	for _, prefix := range root.Prefixes {
+		if strings.HasPrefix(gun.String(), prefix) {
+			return true
 		}
 	}
+	return false
+}
 
-	// Generate full repo
-	repo := tuf.NewRepo(st.cryptoService)
-	repo.Root = rootSignedRole
+// MultiplexingStore implements the MetaStore interface, splitting metadata between the signer root and
+// any number of alternate roots
+type MultiplexingStore struct {
+	notaryStorage.MetaStore
+	SignerChannelMetaStore notaryStorage.MetaStore
+	cryptoService          signed.CryptoService
+	stashedTargetsRole     data.RoleName
+	defaultChannel         notaryStorage.Channel
+	rootChannel            notaryStorage.Channel
+	alternateRoots         []*AlternateRootStore
+	gunLocks               gunLocks
+	// RootCacheTTL is how long alternate roots are cached before checking for a new version
+	RootCacheTTL time.Duration
+	// Notifier, if set, is told about every change to signer-rooted metadata and server-signed targets
+	Notifier ChangeNotifier
+	// ServerTargetsRole is the alternate-rooted delegation that SignServerTargets signs targets into
+	ServerTargetsRole data.RoleName
+	// Generation sets how long the metadata signed for alternate roots is valid for, and the keys of rotated roots
+	Generation GenerationConfig
+	// RootCAs are the CAs that installed root certificates must chain to
+	RootCAs *x509.CertPool
+}
 
-	if _, err = repo.InitTargets(data.CanonicalTargetsRole); err != nil {
-		return nil, err
-	}
-	if err = repo.InitSnapshot(); err != nil {
-		return nil, err
-	}
-	if err = repo.InitTimestamp(); err != nil {
-		return nil, err
-	}
+// NewMultiplexingStore composes a new Multiplexing store instance from underlying stores, with a single alternate root
+// named DefaultAlternateRootName that applies to every gun.
+func NewMultiplexingStore(store, rootStore notaryStorage.MetaStore, cs signed.CryptoService, defaultChannel notaryStorage.Channel, alternateRootChannel notaryStorage.Channel, rootChannel notaryStorage.Channel, rootGUN data.GUN, stashedTargetsRole data.RoleName) *MultiplexingStore {
+	return NewMultiplexingStoreWithRoots(store, rootStore, cs, defaultChannel, rootChannel, []AlternateRootConfig{
+		{
+			Name:    DefaultAlternateRootName,
+			Channel: alternateRootChannel,
+			RootGUN: rootGUN,
+		},
+	}, stashedTargetsRole)
+}
 
-	// Re-sign online roles
-	_, err = repo.SignTargets(data.CanonicalTargetsRole, data.DefaultExpires(data.CanonicalTargetsRole))
-	if err != nil {
-		return nil, err
+// NewMultiplexingStoreWithRoots composes a new Multiplexing store instance from underlying stores, with a set of
+// alternate roots. The root repos of all alternate roots are stored under `rootChannel` in the root store.
+func NewMultiplexingStoreWithRoots(store, rootStore notaryStorage.MetaStore, cs signed.CryptoService, defaultChannel notaryStorage.Channel, rootChannel notaryStorage.Channel, roots []AlternateRootConfig, stashedTargetsRole data.RoleName) *MultiplexingStore {
+	alternateRoots := make([]*AlternateRootStore, 0, len(roots))
+	for _, root := range roots {
+		alternateRoots = append(alternateRoots, &AlternateRootStore{
+			AlternateRootConfig: root,
+			MetaStore:           NewChannelMetastore(store, root.Channel),
+			RootMetaStore:       NewChannelMetastore(rootStore, rootChannel),
+		})
 	}
-	_, err = repo.SignSnapshot(data.DefaultExpires(data.CanonicalSnapshotRole))
-	if err != nil {
-		return nil, err
-	}
-	_, err = repo.SignTimestamp(data.DefaultExpires(data.CanonicalTimestampRole))
-	if err != nil {
-		return nil, err
+	return &MultiplexingStore{
+		MetaStore:              store,
+		SignerChannelMetaStore: NewChannelMetastore(store, defaultChannel),
+		cryptoService:          cs,
+		stashedTargetsRole:     stashedTargetsRole,
+		defaultChannel:         defaultChannel,
+		rootChannel:            rootChannel,
+		alternateRoots:         alternateRoots,
+		RootCacheTTL:           DefaultRootCacheTTL,
+		ServerTargetsRole:      DefaultServerTargetsRole,
+		Generation:             DefaultGenerationConfig(),
 	}
+}
 
-	return repo, nil
+// AlternateRoots returns all of the alternate roots, in the order they were configured
+func (st *MultiplexingStore) AlternateRoots() []*AlternateRootStore {
+	return st.alternateRoots
 }
 
+// AlternateRootStore returns the alternate root with the given name
+func (st *MultiplexingStore) AlternateRootStore(name string) (*AlternateRootStore, bool) {
+	for _, root := range st.alternateRoots {
+		if root.Name == name {
+			return root, true
+		}
+	}
+	return nil, false
+}
 
+// alternateRootsFor returns the alternate roots that metadata for a gun is rooted under
+func (st *MultiplexingStore) alternateRootsFor(gun data.GUN) []*AlternateRootStore {
+	var roots []*AlternateRootStore
+	for _, root := range st.alternateRoots {
+		if root.Covers(gun) {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
 
 // UpdateMany updates multiple TUF records at once
-// This updates both the quay root and the signer root
+// This updates the signer root and every alternate root that applies to the gun, then notifies the Notifier
 func (st *MultiplexingStore) UpdateMany(gun data.GUN, updates []notaryStorage.MetaUpdate) error {
+	// swizzling builds on the stored alternate-rooted metadata, which server signing also writes
+	defer st.gunLocks.lock(gun)()
+
+	// the change is worked out from the metadata stored before the update
+	var change *TrustChange
+	if st.Notifier != nil {
+		trustChange, err := st.trustChange(gun, updates)
+		if err != nil {
+			logrus.Errorf("unable to work out the changes to %s: %s", gun, err.Error())
+			trustChange.Incomplete = true
+		}
+		change = &trustChange
+	}
+
 	allUpdates := make([]notaryStorage.MetaUpdate, 0, len(updates)*2)
 	allUpdates = append(allUpdates, st.setChannels(updates, &st.defaultChannel)...)
-	alternateRootUpdates, err := st.swizzleTargets(gun, updates)
-	if err != nil {
-		logrus.Info("Unable to swizzle targets")
-		return err
-	}
+	for _, root := range st.alternateRootsFor(gun) {
+		// swizzling modifies the updates it is given, so each root gets its own copy
+		alternateRootUpdates, err := st.swizzleTargets(root, gun, st.setChannels(updates, &root.Channel))
+		if err != nil {
+			logrus.Infof("Unable to swizzle targets for %s root", root.Name)
+			return err
+		}
 
-	alternateRootUpdates = st.setChannels(alternateRootUpdates, &st.alternateRootChannel)
-	allUpdates = append(allUpdates, alternateRootUpdates...)
+		alternateRootUpdates = st.setChannels(alternateRootUpdates, &root.Channel)
+		allUpdates = append(allUpdates, alternateRootUpdates...)
+	}
 
 	if err := st.MetaStore.UpdateMany(gun, allUpdates); err != nil {
 		logrus.Info("Failed to update metadata")
 		return err
 	}
 
+	if change != nil {
+		st.Notifier.NotifyChange(*change)
+	}
 	return nil
 }
 
@@ -145,15 +203,20 @@ func (st *MultiplexingStore) UpdateMany(gun data.GUN, updates []notaryStorage.Me
 //   - storing the original updates as-is in the signer-rooted store
 //   - copying the uploaded targets file to targets/releases in the alternate-rooted store
 //   - generating a targets file with the online root targets key that delegates to targets/releases
-func (st *MultiplexingStore) swizzleTargets(gun data.GUN, updates []notaryStorage.MetaUpdate) ([]notaryStorage.MetaUpdate, error) {
-	logrus.Debug("swizzling targets role for update")
+func (st *MultiplexingStore) swizzleTargets(root *AlternateRootStore, gun data.GUN, updates []notaryStorage.MetaUpdate) ([]notaryStorage.MetaUpdate, error) {
+	logrus.Debugf("swizzling targets role for update into %s root", root.Name)
 
-	repo, err := st.copyAlternateRoot()
+	repo, err := st.copyAlternateRoot(root)
 	if err != nil {
 		return nil, err
 	}
 
 	signerRootedMetadata, signerRootedMetadataIdx := st.mapUpdatesToRoles(updates)
+	for _, update := range updates {
+		if update.Role == st.ServerTargetsRole {
+			return nil, fmt.Errorf("attempting to overwrite reserved delegation: %s", st.ServerTargetsRole)
+		}
+	}
 
 	if !st.shouldSwizzle(signerRootedMetadataIdx) {
 		logrus.Debug("no target changes to swizzle")
@@ -169,16 +232,81 @@ func (st *MultiplexingStore) swizzleTargets(gun data.GUN, updates []notaryStorag
 		return nil, err
 	}
 
+	if err := st.seedAlternateVersions(root, gun, repo, signerRootedMetadata); err != nil {
+		return nil, err
+	}
+
+	// targets signed by apostille itself are delegated to by the alternate-rooted targets, so they survive the push
+	serverTargetsUpdates, err := st.keepServerTargets(root, gun, repo)
+	if err != nil {
+		return nil, err
+	}
+
 	err = st.stashSignerRootedTargetsRole(repo, signerRootedTargetKeys, signerRootedMetadata)
 	if err != nil {
 		return nil, err
 	}
 
-	updates, err = st.modifyUpdates(updates, repo, signerRootedMetadata, signerRootedMetadataIdx)
+	updates, err = st.modifyUpdates(root, gun, updates, repo, signerRootedMetadataIdx)
 	if err != nil {
 		return nil, err
 	}
-	return updates, nil
+	return append(updates, serverTargetsUpdates...), nil
+}
+
+// seedAlternateVersions sets the versions of the online alternate-rooted roles so that signing them produces
+// versions newer than anything already stored for the gun, whether that was written by a push or by a Refresher
+func (st *MultiplexingStore) seedAlternateVersions(root *AlternateRootStore, gun data.GUN, repo *tuf.Repo, signerRootedMetadata map[data.RoleName]notaryStorage.MetaUpdate) error {
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		version, err := st.nextAlternateVersion(root, gun, role, signerRootedMetadata[role].Version)
+		if err != nil {
+			return err
+		}
+		// signing increments the version, so seed with the one before
+		switch role {
+		case data.CanonicalTargetsRole:
+			repo.Targets[role].Signed.Version = version - 1
+		case data.CanonicalSnapshotRole:
+			repo.Snapshot.Signed.Version = version - 1
+		case data.CanonicalTimestampRole:
+			repo.Timestamp.Signed.Version = version - 1
+		}
+	}
+	return nil
+}
+
+// nextAlternateVersion finds the version the next alternate-rooted update for a role should use: it must be at least
+// `minVersion`, and newer than both the current alternate-rooted and signer-rooted versions. Alternate-rooted
+// metadata that predates independent versioning was stored under the signer-rooted version, so the signer-rooted
+// version is the upper bound on what may already be stored.
+func (st *MultiplexingStore) nextAlternateVersion(root *AlternateRootStore, gun data.GUN, role data.RoleName, minVersion int) (int, error) {
+	version := minVersion
+	for _, store := range []notaryStorage.MetaStore{root.MetaStore, st.SignerChannelMetaStore} {
+		_, current, err := store.GetCurrent(gun, role)
+		if err != nil {
+			if _, ok := err.(notaryStorage.ErrNotFound); ok {
+				continue
+			}
+			return 0, err
+		}
+		currentVersion, err := metaVersion(current)
+		if err != nil {
+			return 0, err
+		}
+		if currentVersion+1 > version {
+			version = currentVersion + 1
+		}
+	}
+	return version, nil
+}
+
+// metaVersion reads the version out of serialized TUF metadata
+func metaVersion(meta []byte) (int, error) {
+	var signedMeta data.SignedMeta
+	if err := json.Unmarshal(meta, &signedMeta); err != nil {
+		return 0, err
+	}
+	return signedMeta.Signed.Version, nil
 }
 
 // setChannels puts a slice of MetaUpdates into a particular set of channels
@@ -191,14 +319,14 @@ func (st *MultiplexingStore) setChannels(updates []notaryStorage.MetaUpdate, cha
 	return channelUpdates
 }
 
-// copyAlternateRoot makes a copy of the global repo, so per-repo changes don't affect it
-func (st *MultiplexingStore) copyAlternateRoot() (*tuf.Repo, error) {
+// copyAlternateRoot makes a copy of an alternate root's repo, so per-repo changes don't affect it
+func (st *MultiplexingStore) copyAlternateRoot(root *AlternateRootStore) (*tuf.Repo, error) {
 	repo := tuf.NewRepo(st.cryptoService)
-	rootRepo, err := st.fetchAlternateRootRepo()
+	signedRoot, _, err := st.loadAlternateRoot(root)
 	if err != nil {
 		return nil, err
 	}
-	repo.Root = rootRepo.Root
+	repo.Root = signedRoot
 
 	if _, err := repo.InitTargets(data.CanonicalTargetsRole); err != nil {
 		return nil, err
@@ -310,56 +438,125 @@ func (st *MultiplexingStore) stashSignerRootedTargetsRole(repo *tuf.Repo, signer
 	repo.Targets[st.stashedTargetsRole] = signedReleases
 
 	// re-sign targets, snapshot, and timestamp - the signer server has all of these keys
-	if _, err = repo.SignTargets(data.CanonicalTargetsRole, data.DefaultExpires(data.CanonicalTimestampRole)); err != nil {
+	if _, err = repo.SignTargets(data.CanonicalTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole)); err != nil {
 		return err
 	}
-	if _, err = repo.SignSnapshot(data.DefaultExpires(data.CanonicalSnapshotRole)); err != nil {
+	if _, err = repo.SignSnapshot(st.Generation.Expires(data.CanonicalSnapshotRole)); err != nil {
 		return err
 	}
-	if _, err = repo.SignTimestamp(data.DefaultExpires(data.CanonicalTimestampRole)); err != nil {
+	if _, err = repo.SignTimestamp(st.Generation.Expires(data.CanonicalTimestampRole)); err != nil {
 		return err
 	}
 	return nil
 }
 
 // modifyUpdates takes a modified repo (post-swizzling) and propagates those changes into the updates array
-func (st *MultiplexingStore) modifyUpdates(updates []notaryStorage.MetaUpdate, repo *tuf.Repo, signerRootedMetadata map[data.RoleName]notaryStorage.MetaUpdate, signerRootedMetadataIdx map[data.RoleName]int) ([]notaryStorage.MetaUpdate, error) {
-	if signerRootedMetadataIdx[data.CanonicalRootRole] > -1 {
-		newRoot, err := repo.Root.MarshalJSON()
-		if err != nil {
-			return nil, err
+func (st *MultiplexingStore) modifyUpdates(root *AlternateRootStore, gun data.GUN, updates []notaryStorage.MetaUpdate, repo *tuf.Repo, signerRootedMetadataIdx map[data.RoleName]int) ([]notaryStorage.MetaUpdate, error) {
+	// the alternate root is versioned independently of the signer root, so the signer root update is replaced
+	// with whatever the gun needs to catch up with the alternate root
+	modified := make([]notaryStorage.MetaUpdate, 0, len(updates)+2)
+	for i, update := range updates {
+		if i != signerRootedMetadataIdx[data.CanonicalRootRole] {
+			modified = append(modified, update)
 		}
-		updates[signerRootedMetadataIdx[data.CanonicalRootRole]].Data = newRoot
 	}
+	rootUpdates, err := st.rootUpdates(root, gun, repo.Root)
+	if err != nil {
+		return nil, err
+	}
+	modified = append(modified, rootUpdates...)
 
-	if signerRootedMetadataIdx[data.CanonicalSnapshotRole] > -1 {
-		newSS, err := repo.Snapshot.MarshalJSON()
-		if err != nil {
-			return nil, err
-		}
-		updates[signerRootedMetadataIdx[data.CanonicalSnapshotRole]].Data = newSS
+	newSS, err := repo.Snapshot.MarshalJSON()
+	if err != nil {
+		return nil, err
 	}
+	modified = setUpdate(modified, data.CanonicalSnapshotRole, repo.Snapshot.Signed.Version, newSS)
 
 	newTargets, err := repo.Targets[data.CanonicalTargetsRole].MarshalJSON()
 	if err != nil {
 		return nil, err
 	}
-	updates[signerRootedMetadataIdx[data.CanonicalTargetsRole]].Data = newTargets
+	modified = setUpdate(modified, data.CanonicalTargetsRole, repo.Targets[data.CanonicalTargetsRole].Signed.Version, newTargets)
 
 	newTS, err := repo.Timestamp.MarshalJSON()
 	if err != nil {
 		return nil, err
 	}
-	updates[signerRootedMetadataIdx[data.CanonicalTimestampRole]].Data = newTS
+	modified = setUpdate(modified, data.CanonicalTimestampRole, repo.Timestamp.Signed.Version, newTS)
 
 	newReleases, err := repo.Targets[st.stashedTargetsRole].MarshalJSON()
 	if err != nil {
 		return nil, err
 	}
-	updates = append(updates, notaryStorage.MetaUpdate{
-		Role:    st.stashedTargetsRole,
-		Data:    newReleases,
-		Version: repo.Targets[st.stashedTargetsRole].Signed.Version,
+	// the stashed targets are the signer's targets as-is, so they only need storing if the signer changed them
+	_, storedReleases, err := root.MetaStore.GetCurrent(gun, st.stashedTargetsRole)
+	if _, ok := err.(notaryStorage.ErrNotFound); err != nil && !ok {
+		return nil, err
+	}
+	if !bytes.Equal(storedReleases, newReleases) {
+		modified = append(modified, notaryStorage.MetaUpdate{
+			Role:    st.stashedTargetsRole,
+			Data:    newReleases,
+			Version: repo.Targets[st.stashedTargetsRole].Signed.Version,
+		})
+	}
+	return modified, nil
+}
+
+// setUpdate replaces the update for a role, or adds one if there isn't an update for the role yet
+func setUpdate(updates []notaryStorage.MetaUpdate, role data.RoleName, version int, meta []byte) []notaryStorage.MetaUpdate {
+	for i := range updates {
+		if updates[i].Role == role {
+			updates[i].Version = version
+			updates[i].Data = meta
+			return updates
+		}
+	}
+	return append(updates, notaryStorage.MetaUpdate{
+		Role:    role,
+		Version: version,
+		Data:    meta,
 	})
-	return updates, nil
+}
+
+// rootUpdates returns the updates that bring the alternate root stored for a gun up to date with the current version
+// of the alternate root. If the gun has an older version, every version in between is included too, so that clients
+// can follow the chain of root rotations. Alternate roots are stored under their own version.
+func (st *MultiplexingStore) rootUpdates(root *AlternateRootStore, gun data.GUN, current *data.SignedRoot) ([]notaryStorage.MetaUpdate, error) {
+	storedVersion := 0
+	_, stored, err := root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	if err == nil {
+		if storedVersion, err = metaVersion(stored); err != nil {
+			return nil, err
+		}
+	} else if _, ok := err.(notaryStorage.ErrNotFound); !ok {
+		return nil, err
+	}
+	if storedVersion >= current.Signed.Version {
+		return nil, nil
+	}
+
+	var updates []notaryStorage.MetaUpdate
+	if storedVersion > 0 {
+		for version := storedVersion + 1; version < current.Signed.Version; version++ {
+			_, intermediate, err := root.RootMetaStore.GetVersion(root.RootGUN, data.CanonicalRootRole, version)
+			if err != nil {
+				return nil, err
+			}
+			updates = append(updates, notaryStorage.MetaUpdate{
+				Role:    data.CanonicalRootRole,
+				Version: version,
+				Data:    intermediate,
+			})
+		}
+	}
+	currentBytes, err := current.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return append(updates, notaryStorage.MetaUpdate{
+		Role:    data.CanonicalRootRole,
+		Version: current.Signed.Version,
+		Data:    currentBytes,
+	}), nil
 }
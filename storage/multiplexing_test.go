@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/coreos-inc/apostille/servertest"
 	notaryStorage "github.com/docker/notary/server/storage"
@@ -14,6 +16,14 @@ import (
 // MultiplexingMetaStoreMock creates a MultiplexingMetaStore prepped with a Root for metadata to be stored under
 func MultiplexingMetaStoreMock(t *testing.T, trust signed.CryptoService) *MultiplexingStore {
 	rootGUN := data.GUN("quay")
+	rootStore := notaryStorage.NewMemStorage()
+	storeRootRepo(t, trust, rootStore, rootGUN)
+
+	return NewMultiplexingStore(notaryStorage.NewMemStorage(), rootStore, trust, SignerRoot, AlternateRoot, Root, rootGUN, "targets/releases")
+}
+
+// storeRootRepo creates a root repo for an alternate root and stores it in the root store
+func storeRootRepo(t *testing.T, trust signed.CryptoService, rootStore notaryStorage.MetaStore, rootGUN data.GUN) {
 	rootChannels := []*notaryStorage.Channel{&Root}
 
 	rootRepo := servertest.CreateRepo(t, rootGUN, trust)
@@ -22,8 +32,6 @@ func MultiplexingMetaStoreMock(t *testing.T, trust signed.CryptoService) *Multip
 	rootJson, targetsJson, ssJson, tsJson, err := testutils.Serialize(r, tg, sn, ts)
 	require.NoError(t, err)
 
-	rootStore := notaryStorage.NewMemStorage()
-
 	updates := []notaryStorage.MetaUpdate{
 		{
 			data.CanonicalRootRole,
@@ -53,8 +61,6 @@ func MultiplexingMetaStoreMock(t *testing.T, trust signed.CryptoService) *Multip
 
 	err = rootStore.UpdateMany(rootGUN, updates)
 	require.NoError(t, err)
-
-	return NewMultiplexingStore(notaryStorage.NewMemStorage(), rootStore, trust, SignerRoot, AlternateRoot, Root, rootGUN, "targets/releases")
 }
 
 func TestSetChannels(t *testing.T) {
@@ -82,3 +88,126 @@ func TestSetChannels(t *testing.T) {
 		require.Equal(t, []*notaryStorage.Channel{&AlternateRoot}, update.Channels)
 	}
 }
+
+// bumpAlternateRoot stores a copy of the default alternate root with a new version in the root store
+func bumpAlternateRoot(t *testing.T, store *MultiplexingStore, version int) {
+	root, ok := store.AlternateRootStore(DefaultAlternateRootName)
+	require.True(t, ok)
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	rootSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(rootBytes, rootSigned))
+	signedRoot, err := data.RootFromSigned(rootSigned)
+	require.NoError(t, err)
+	signedRoot.Signed.Version = version
+	rootSigned, err = signedRoot.ToSigned()
+	require.NoError(t, err)
+	rootBytes, err = json.Marshal(rootSigned)
+	require.NoError(t, err)
+	require.NoError(t, root.RootMetaStore.UpdateCurrent(root.RootGUN, notaryStorage.MetaUpdate{
+		Role:     data.CanonicalRootRole,
+		Version:  version,
+		Data:     rootBytes,
+		Channels: []*notaryStorage.Channel{&Root},
+	}))
+}
+
+func TestAlternateRootCache(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+
+	root, baseRoles, err := metaStore.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, 1, root.Signed.Version)
+	require.Contains(t, baseRoles, data.CanonicalTimestampRole)
+
+	// the returned root is a copy, so modifying it doesn't affect the cache
+	root.Signed.Version = 100
+	root, _, err = metaStore.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, 1, root.Signed.Version)
+
+	// a new root isn't seen until the cache expires
+	bumpAlternateRoot(t, metaStore, 2)
+	root, _, err = metaStore.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, 1, root.Signed.Version)
+
+	metaStore.InvalidateAlternateRoot(DefaultAlternateRootName)
+	root, _, err = metaStore.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, 2, root.Signed.Version)
+
+	// with no ttl, the root store is checked every time
+	metaStore.RootCacheTTL = 0
+	bumpAlternateRoot(t, metaStore, 3)
+	root, _, err = metaStore.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, 3, root.Signed.Version)
+
+	metaStore.RootCacheTTL = time.Hour
+	bumpAlternateRoot(t, metaStore, 4)
+	root, _, err = metaStore.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, 3, root.Signed.Version)
+
+	_, _, err = metaStore.AlternateRoot("missing")
+	require.Error(t, err)
+}
+
+func TestUpdateManyMultipleRoots(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	rootStore := notaryStorage.NewMemStorage()
+	roots := []AlternateRootConfig{
+		{
+			Name:     "quay",
+			Channel:  AlternateRoot,
+			RootGUN:  "quay",
+			Prefixes: []string{"quay.io/"},
+		},
+		{
+			Name:     "other",
+			Channel:  notaryStorage.Channel{ID: 5, Name: "other"},
+			RootGUN:  "other",
+			Prefixes: []string{"other.io/"},
+		},
+		{
+			Name:    "everything",
+			Channel: notaryStorage.Channel{ID: 6, Name: "everything"},
+			RootGUN: "everything",
+		},
+	}
+	for _, root := range roots {
+		storeRootRepo(t, trust, rootStore, root.RootGUN)
+	}
+	metaStore := NewMultiplexingStoreWithRoots(notaryStorage.NewMemStorage(), rootStore, trust, SignerRoot, Root, roots, "targets/releases")
+
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	_, signerRoot, err := metaStore.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, meta[data.CanonicalRootRole], signerRoot)
+
+	for name, covered := range map[string]bool{"quay": true, "other": false, "everything": true} {
+		root, ok := metaStore.AlternateRootStore(name)
+		require.True(t, ok)
+		_, rootBytes, err := root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+		if !covered {
+			require.IsType(t, notaryStorage.ErrNotFound{}, err)
+			continue
+		}
+		require.NoError(t, err)
+
+		// each covering root serves its own root, with the signer targets stashed in the delegation
+		expected, _, err := metaStore.AlternateRoot(name)
+		require.NoError(t, err)
+		expectedBytes, err := json.Marshal(expected)
+		require.NoError(t, err)
+		require.JSONEq(t, string(expectedBytes), string(rootBytes))
+		_, _, err = root.MetaStore.GetCurrent(gun, "targets/releases")
+		require.NoError(t, err)
+	}
+}
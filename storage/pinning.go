@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/docker/notary/tuf/data"
+)
+
+// PinningBundle is what notary clients need to pin an alternate root, rather than trusting it on first use
+type PinningBundle struct {
+	Root    string   `json:"root"`
+	RootGUN data.GUN `json:"root_gun"`
+	Version int      `json:"version"`
+	// RootJSON is the current signed root.json of the alternate root
+	RootJSON json.RawMessage `json:"root_json"`
+	// KeyIDs are the IDs of the root keys, which notary clients pin as certificate IDs
+	KeyIDs []string `json:"key_ids"`
+	// Certificates are the PEM encoded certificate chains of the root keys, by key ID
+	Certificates map[string]string `json:"certificates"`
+	// TrustPinning pins the root keys for every gun rooted under the alternate root
+	TrustPinning TrustPinningConfig `json:"trust_pinning"`
+}
+
+// TrustPinningConfig is the `trust_pinning` section of a notary client configuration
+type TrustPinningConfig struct {
+	Certs       map[string][]string `json:"certs"`
+	DisableTOFU bool                `json:"disable_tofu"`
+}
+
+// PinningBundle returns the trust pinning bundle of the named alternate root. Its trust pinning config pins the
+// current root keys for a wildcard of each of the root's gun prefixes, or for every gun if it has none. Clients only
+// check pins when they first fetch a gun, and follow root rotations after that. An empty name is the first alternate
+// root, which is the only one unless several are configured.
+func (st *MultiplexingStore) PinningBundle(name string) (*PinningBundle, error) {
+	if name == "" && len(st.alternateRoots) > 0 {
+		name = st.alternateRoots[0].Name
+	}
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return nil, fmt.Errorf("no alternate root named %s", name)
+	}
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	if err != nil {
+		return nil, err
+	}
+	signedRoot := &data.Signed{}
+	if err := json.Unmarshal(rootBytes, signedRoot); err != nil {
+		return nil, err
+	}
+	rootMeta, err := data.RootFromSigned(signedRoot)
+	if err != nil {
+		return nil, err
+	}
+	rootRole, err := rootMeta.BuildBaseRole(data.CanonicalRootRole)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &PinningBundle{
+		Root:         root.Name,
+		RootGUN:      root.RootGUN,
+		Version:      rootMeta.Signed.Version,
+		RootJSON:     rootBytes,
+		KeyIDs:       rootRole.ListKeyIDs(),
+		Certificates: make(map[string]string),
+		TrustPinning: TrustPinningConfig{Certs: make(map[string][]string), DisableTOFU: true},
+	}
+	sort.Strings(bundle.KeyIDs)
+	for keyID, key := range rootRole.Keys {
+		switch key.Algorithm() {
+		case data.ECDSAx509Key, data.RSAx509Key:
+			bundle.Certificates[keyID] = string(key.Public())
+		}
+	}
+	wildcards := []string{"*"}
+	if len(root.Prefixes) > 0 {
+		wildcards = make([]string, 0, len(root.Prefixes))
+		for _, prefix := range root.Prefixes {
+			wildcards = append(wildcards, prefix+"*")
+		}
+	}
+	for _, wildcard := range wildcards {
+		bundle.TrustPinning.Certs[wildcard] = bundle.KeyIDs
+	}
+	return bundle, nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary/cryptoservice"
+	"github.com/docker/notary/passphrase"
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinningBundle(t *testing.T) {
+	// the bundle is checked against a CA-issued root certificate, which is requested for a key in a local trust service
+	trust := cryptoservice.NewCryptoService(trustmanager.NewKeyMemoryStore(passphrase.ConstantRetriever("pass")))
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	root := defaultRoot(t, metaStore)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	_, err = metaStore.PinningBundle("missing")
+	require.Error(t, err)
+	bundle, err := metaStore.PinningBundle("")
+	require.NoError(t, err)
+	require.Equal(t, root.Name, bundle.Root)
+	require.Equal(t, root.RootGUN, bundle.RootGUN)
+	require.Equal(t, 1, bundle.Version)
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, rootBytes, []byte(bundle.RootJSON))
+	require.Len(t, bundle.KeyIDs, 1)
+	require.Contains(t, bundle.Certificates, bundle.KeyIDs[0])
+	require.Equal(t, map[string][]string{"*": bundle.KeyIDs}, bundle.TrustPinning.Certs)
+
+	// once its certificate covers every gun, clients with the pins accept the alternate-rooted root of a gun, but not
+	// the signer-rooted one
+	ca, _ := newTestCA(t, "Corporate Root CA", nil)
+	metaStore.RootCAs = x509.NewCertPool()
+	metaStore.RootCAs.AddCert(ca.cert)
+	csrPEM, err := metaStore.RootCertificateRequest(root.Name, "")
+	require.NoError(t, err)
+	_, err = metaStore.InstallRootCertificate(root.Name, issueRootCertificate(t, ca, csrPEM, "*"), false)
+	require.NoError(t, err)
+	bundle, err = metaStore.PinningBundle(root.Name)
+	require.NoError(t, err)
+	require.Equal(t, 2, bundle.Version)
+
+	pins := trustpinning.TrustPinConfig{Certs: bundle.TrustPinning.Certs, DisableTOFU: bundle.TrustPinning.DisableTOFU}
+	_, gunRootBytes, err := root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	gunRootSigned, _ := decodeRoot(t, gunRootBytes)
+	_, err = trustpinning.ValidateRoot(nil, gunRootSigned, gun, pins)
+	require.NoError(t, err)
+	signerRootSigned, _ := decodeRoot(t, meta[data.CanonicalRootRole])
+	_, err = trustpinning.ValidateRoot(nil, signerRootSigned, gun, pins)
+	require.Error(t, err)
+
+	// roots with gun prefixes are only pinned for them
+	root.Prefixes = []string{"quay.io/", "partner.io/"}
+	bundle, err = metaStore.PinningBundle(root.Name)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"quay.io/*": bundle.KeyIDs, "partner.io/*": bundle.KeyIDs}, bundle.TrustPinning.Certs)
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	refreshRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "refresher",
+		Name:      "runs_total",
+		Help:      "Number of passes the refresher has made over all repositories.",
+	})
+	refreshChecked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "refresher",
+		Name:      "guns_checked_total",
+		Help:      "Number of repositories checked for expiring alternate-rooted metadata.",
+	})
+	refreshResigned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "refresher",
+		Name:      "roles_resigned_total",
+		Help:      "Number of alternate-rooted roles re-signed before they expired.",
+	}, []string{"root", "role"})
+	refreshErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "refresher",
+		Name:      "errors_total",
+		Help:      "Number of repositories that could not be refreshed.",
+	})
+	refreshLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "apostille",
+		Subsystem: "refresher",
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time at which the last completed pass finished.",
+	})
+	refreshProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "apostille",
+		Subsystem: "refresher",
+		Name:      "current_run_guns_checked",
+		Help:      "Number of repositories checked so far in the current pass.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(refreshRuns)
+	prometheus.MustRegister(refreshChecked)
+	prometheus.MustRegister(refreshResigned)
+	prometheus.MustRegister(refreshErrors)
+	prometheus.MustRegister(refreshLastRun)
+	prometheus.MustRegister(refreshProgress)
+}
+
+// RefresherConfig tells a Refresher how often to run, and how far ahead of expiry to re-sign
+type RefresherConfig struct {
+	// Interval is the time between passes over all repositories
+	Interval time.Duration
+	// LeadTime is how long before expiry metadata gets re-signed
+	LeadTime time.Duration
+	// BatchSize is how many changefeed records are read from the store at a time
+	BatchSize int
+}
+
+// Refresher periodically re-signs alternate-rooted metadata with the online keys before it expires.
+// Alternate-rooted metadata is otherwise only signed when a signer pushes, so repos that aren't pushed to
+// would serve expired metadata to non-signer clients.
+type Refresher struct {
+	store  *MultiplexingStore
+	config RefresherConfig
+}
+
+// NewRefresher creates a Refresher for the alternate-rooted metadata in a MultiplexingStore
+func NewRefresher(store *MultiplexingStore, config RefresherConfig) *Refresher {
+	return &Refresher{
+		store:  store,
+		config: config,
+	}
+}
+
+// Run refreshes all repositories every interval, until the context is cancelled
+func (r *Refresher) Run(ctx context.Context) {
+	logrus.Infof("refreshing alternate-rooted metadata every %v, %v before expiry", r.config.Interval, r.config.LeadTime)
+	for {
+		if err := r.RefreshAll(ctx); err != nil {
+			logrus.Errorf("failed to refresh alternate-rooted metadata: %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.config.Interval):
+		}
+	}
+}
+
+// RefreshAll makes one pass over every repository, re-signing anything that expires within the lead time
+func (r *Refresher) RefreshAll(ctx context.Context) error {
+	refreshProgress.Set(0)
+	expiresBefore := time.Now().Add(r.config.LeadTime)
+	err := WalkGUNs(r.store.MetaStore, "0", r.config.BatchSize, func(gun data.GUN, _ string) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		refreshChecked.Inc()
+		refreshProgress.Inc()
+		for _, root := range r.store.alternateRootsFor(gun) {
+			if _, err := r.store.RefreshAlternateRoot(root, gun, expiresBefore); err != nil {
+				refreshErrors.Inc()
+				logrus.Errorf("failed to refresh %s-rooted metadata for %s: %s", root.Name, gun, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	refreshRuns.Inc()
+	refreshLastRun.Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// WalkGUNs calls walkFn once for every GUN in the store's changefeed, starting after the change with ID `changeID`.
+// Changes are read `batchSize` at a time. The ID of the change at which the GUN was found is passed to walkFn
+// so that callers can resume from it. Walking stops at the first error returned by walkFn.
+func WalkGUNs(store notaryStorage.MetaStore, changeID string, batchSize int, walkFn func(gun data.GUN, changeID string) error) error {
+	seen := make(map[string]struct{})
+	for {
+		changes, err := store.GetChanges(changeID, batchSize, "")
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			changeID = strconv.FormatUint(uint64(change.ID), 10)
+			if _, ok := seen[change.GUN]; ok {
+				continue
+			}
+			seen[change.GUN] = struct{}{}
+			if err := walkFn(data.GUN(change.GUN), changeID); err != nil {
+				return err
+			}
+		}
+		if len(changes) < batchSize {
+			return nil
+		}
+	}
+}
+
+// RefreshAlternateRoot re-signs the targets, server-signed delegation, snapshot and timestamp rooted under an
+// alternate root for a gun if they expire before `expiresBefore`. Re-signing a role requires re-signing the roles that
+// reference it, so an expiring targets role or delegation also causes a new snapshot and timestamp. It returns the roles that were re-signed. If another
+// apostille stores a change to the gun at the same time, one of them fails with ErrOldVersion.
+func (st *MultiplexingStore) RefreshAlternateRoot(root *AlternateRootStore, gun data.GUN, expiresBefore time.Time) ([]data.RoleName, error) {
+	// the refreshed versions build on the stored ones, which pushes and server signing also write
+	defer st.gunLocks.lock(gun)()
+	store := root.MetaStore
+
+	_, tsBytes, err := store.GetCurrent(gun, data.CanonicalTimestampRole)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			// nothing has been swizzled for this gun (or it was deleted)
+			return nil, nil
+		}
+		return nil, err
+	}
+	_, ssBytes, err := store.GetCurrent(gun, data.CanonicalSnapshotRole)
+	if err != nil {
+		return nil, err
+	}
+	_, targetsBytes, err := store.GetCurrent(gun, data.CanonicalTargetsRole)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := make([]*data.Signed, 3)
+	for i, meta := range [][]byte{tsBytes, ssBytes, targetsBytes} {
+		decoded[i] = &data.Signed{}
+		if err := json.Unmarshal(meta, decoded[i]); err != nil {
+			return nil, err
+		}
+	}
+	timestamp, err := data.TimestampFromSigned(decoded[0])
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := data.SnapshotFromSigned(decoded[1])
+	if err != nil {
+		return nil, err
+	}
+	targets, err := data.TargetsFromSigned(decoded[2], data.CanonicalTargetsRole)
+	if err != nil {
+		return nil, err
+	}
+	// the server-signed delegation is otherwise only re-signed when the server signs targets
+	serverTargets, err := storedTargetsRole(store, gun, st.ServerTargetsRole)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshTargets := targets.Signed.Expires.Before(expiresBefore)
+	refreshServerTargets := serverTargets != nil && serverTargets.Signed.Expires.Before(expiresBefore)
+	refreshSnapshot := refreshTargets || refreshServerTargets || snapshot.Signed.Expires.Before(expiresBefore)
+	refreshTimestamp := refreshSnapshot || timestamp.Signed.Expires.Before(expiresBefore)
+	if !refreshTimestamp {
+		return nil, nil
+	}
+	logrus.Debugf("refreshing %s-rooted metadata for %s", root.Name, gun)
+
+	repo, err := st.loadAlternateRootedRepo(root, gun)
+	if err != nil {
+		return nil, err
+	}
+	repo.Snapshot = snapshot
+	repo.Timestamp = timestamp
+
+	var updates []notaryStorage.MetaUpdate
+	if refreshTargets {
+		// only load targets if it will be re-signed, so that signing the snapshot leaves its meta untouched otherwise
+		repo.Targets[data.CanonicalTargetsRole] = targets
+		update, err := st.refreshRole(root, gun, data.CanonicalTargetsRole, func(version int) (*data.Signed, error) {
+			targets.Signed.Version = version - 1
+			return repo.SignTargets(data.CanonicalTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole))
+		})
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+	if refreshServerTargets {
+		// signing the delegation looks up its keys in the targets role
+		repo.Targets[data.CanonicalTargetsRole] = targets
+		repo.Targets[st.ServerTargetsRole] = serverTargets
+		update, err := st.refreshRole(root, gun, st.ServerTargetsRole, func(version int) (*data.Signed, error) {
+			serverTargets.Signed.Version = version - 1
+			return repo.SignTargets(st.ServerTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole))
+		})
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+		if !refreshTargets {
+			delete(repo.Targets, data.CanonicalTargetsRole)
+		}
+	}
+	if refreshSnapshot {
+		update, err := st.refreshRole(root, gun, data.CanonicalSnapshotRole, func(version int) (*data.Signed, error) {
+			snapshot.Signed.Version = version - 1
+			return repo.SignSnapshot(st.Generation.Expires(data.CanonicalSnapshotRole))
+		})
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+	update, err := st.refreshRole(root, gun, data.CanonicalTimestampRole, func(version int) (*data.Signed, error) {
+		timestamp.Signed.Version = version - 1
+		return repo.SignTimestamp(st.Generation.Expires(data.CanonicalTimestampRole))
+	})
+	if err != nil {
+		return nil, err
+	}
+	updates = append(updates, update)
+
+	updates = st.setChannels(updates, &root.Channel)
+	if err := st.MetaStore.UpdateMany(gun, updates); err != nil {
+		return nil, err
+	}
+	if err := st.checkStored(gun, updates); err != nil {
+		return nil, err
+	}
+
+	refreshed := make([]data.RoleName, 0, len(updates))
+	for _, update := range updates {
+		refreshResigned.WithLabelValues(root.Name, update.Role.String()).Inc()
+		refreshed = append(refreshed, update.Role)
+	}
+	logrus.Infof("refreshed %s-rooted %v for %s", root.Name, refreshed, gun)
+	return refreshed, nil
+}
+
+// loadAlternateRootedRepo creates a repo containing the alternate root stored for a gun, which holds the online keys
+// that alternate-rooted metadata is signed with
+func (st *MultiplexingStore) loadAlternateRootedRepo(root *AlternateRootStore, gun data.GUN) (*tuf.Repo, error) {
+	_, rootBytes, err := root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	if err != nil {
+		return nil, err
+	}
+	rootSigned := &data.Signed{}
+	if err := json.Unmarshal(rootBytes, rootSigned); err != nil {
+		return nil, err
+	}
+	signedRoot, err := data.RootFromSigned(rootSigned)
+	if err != nil {
+		return nil, err
+	}
+	repo := tuf.NewRepo(st.cryptoService)
+	repo.Root = signedRoot
+	return repo, nil
+}
+
+// refreshRole signs a role with the next alternate-rooted version and packages it up as an update
+func (st *MultiplexingStore) refreshRole(root *AlternateRootStore, gun data.GUN, role data.RoleName, sign func(version int) (*data.Signed, error)) (notaryStorage.MetaUpdate, error) {
+	version, err := st.nextAlternateVersion(root, gun, role, 0)
+	if err != nil {
+		return notaryStorage.MetaUpdate{}, err
+	}
+	signed, err := sign(version)
+	if err != nil {
+		return notaryStorage.MetaUpdate{}, err
+	}
+	signedBytes, err := json.Marshal(signed)
+	if err != nil {
+		return notaryStorage.MetaUpdate{}, err
+	}
+	return notaryStorage.MetaUpdate{
+		Role:    role,
+		Version: version,
+		Data:    signedBytes,
+	}, nil
+}
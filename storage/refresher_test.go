@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// pushMeta stores signer-rooted metadata for all roles at a given version, like a push would
+func pushMeta(t *testing.T, store *MultiplexingStore, gun data.GUN, meta map[data.RoleName][]byte, version int) {
+	updates := make([]notaryStorage.MetaUpdate, 0, len(meta))
+	for role, metaBytes := range meta {
+		updates = append(updates, notaryStorage.MetaUpdate{
+			Role:    role,
+			Version: version,
+			Data:    metaBytes,
+		})
+	}
+	require.NoError(t, store.UpdateMany(gun, updates))
+}
+
+// defaultRoot returns the alternate root of a store created by MultiplexingMetaStoreMock
+func defaultRoot(t *testing.T, store *MultiplexingStore) *AlternateRootStore {
+	root, ok := store.AlternateRootStore(DefaultAlternateRootName)
+	require.True(t, ok)
+	return root
+}
+
+func alternateVersion(t *testing.T, store *MultiplexingStore, gun data.GUN, role data.RoleName) int {
+	_, metaBytes, err := defaultRoot(t, store).MetaStore.GetCurrent(gun, role)
+	require.NoError(t, err)
+	version, err := metaVersion(metaBytes)
+	require.NoError(t, err)
+	return version
+}
+
+func TestRefreshAlternateRoot(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	_, signerTimestamp, err := metaStore.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalTimestampRole)
+	require.NoError(t, err)
+
+	// nothing expires soon, so nothing is refreshed
+	refreshed, err := metaStore.RefreshAlternateRoot(defaultRoot(t, metaStore), gun, time.Now())
+	require.NoError(t, err)
+	require.Empty(t, refreshed)
+	require.Equal(t, 1, alternateVersion(t, metaStore, gun, data.CanonicalTimestampRole))
+
+	// everything expires before then, so every online role is refreshed
+	refreshed, err = metaStore.RefreshAlternateRoot(defaultRoot(t, metaStore), gun, time.Now().Add(20*notary.Year))
+	require.NoError(t, err)
+	require.Equal(t, []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole}, refreshed)
+	for _, role := range refreshed {
+		require.Equal(t, 2, alternateVersion(t, metaStore, gun, role))
+	}
+
+	// signer-rooted metadata is untouched
+	_, newSignerTimestamp, err := metaStore.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalTimestampRole)
+	require.NoError(t, err)
+	require.Equal(t, signerTimestamp, newSignerTimestamp)
+
+	// the next push has to be stored after the refreshed versions
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 2)
+	require.Equal(t, 3, alternateVersion(t, metaStore, gun, data.CanonicalTimestampRole))
+}
+
+func TestRefreshAlternateRootServerTargets(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	// the server-signed delegation expires long before the targets that a later push signs
+	metaStore.Generation.Expiries = map[data.RoleName]time.Duration{data.CanonicalTargetsRole: time.Hour}
+	_, err = metaStore.SignServerTargets(gun, data.Files{"v1": fileMeta(t, "one")}, nil)
+	require.NoError(t, err)
+	metaStore.Generation.Expiries = nil
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 2)
+	targetsVersion := alternateVersion(t, metaStore, gun, data.CanonicalTargetsRole)
+
+	refreshed, err := metaStore.RefreshAlternateRoot(defaultRoot(t, metaStore), gun, time.Now().Add(notary.Day))
+	require.NoError(t, err)
+	require.Equal(t, []data.RoleName{DefaultServerTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole}, refreshed)
+	require.Equal(t, targetsVersion, alternateVersion(t, metaStore, gun, data.CanonicalTargetsRole))
+
+	serverTargets := requireServerTargets(t, metaStore, gun)
+	require.Equal(t, 2, serverTargets.Signed.Version)
+	require.True(t, serverTargets.Signed.Expires.After(time.Now().Add(notary.Day)))
+	require.Equal(t, data.Files{"v1": fileMeta(t, "one")}, serverTargets.Signed.Targets)
+
+	// the snapshot covers the stored targets and delegation
+	_, snapshotBytes, err := defaultRoot(t, metaStore).MetaStore.GetCurrent(gun, data.CanonicalSnapshotRole)
+	require.NoError(t, err)
+	var snapshot data.SignedSnapshot
+	require.NoError(t, json.Unmarshal(snapshotBytes, &snapshot))
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, DefaultServerTargetsRole} {
+		_, stored, err := defaultRoot(t, metaStore).MetaStore.GetCurrent(gun, role)
+		require.NoError(t, err)
+		require.NoError(t, data.CheckHashes(stored, role.String(), snapshot.Signed.Meta[role.String()].Hashes))
+	}
+}
+
+func TestRefreshAlternateRootNotSwizzled(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+
+	refreshed, err := metaStore.RefreshAlternateRoot(defaultRoot(t, metaStore), "quay.io/nothing/here", time.Now().Add(20*notary.Year))
+	require.NoError(t, err)
+	require.Empty(t, refreshed)
+}
+
+func TestRefresherRefreshAll(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+
+	guns := []data.GUN{"quay.io/signingUser/one", "quay.io/signingUser/two", "quay.io/signingUser/three"}
+	for _, gun := range guns {
+		meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+		require.NoError(t, err)
+		pushMeta(t, metaStore, gun, meta, 1)
+	}
+
+	var walked []data.GUN
+	require.NoError(t, WalkGUNs(metaStore.MetaStore, "0", 2, func(gun data.GUN, _ string) error {
+		walked = append(walked, gun)
+		return nil
+	}))
+	require.Equal(t, guns, walked)
+
+	refresher := NewRefresher(metaStore, RefresherConfig{
+		Interval:  time.Hour,
+		LeadTime:  20 * notary.Year,
+		BatchSize: 2,
+	})
+	require.NoError(t, refresher.RefreshAll(context.Background()))
+	for _, gun := range guns {
+		require.Equal(t, 2, alternateVersion(t, metaStore, gun, data.CanonicalTimestampRole))
+	}
+}
+
+func TestRefreshAlternateRootConcurrentPush(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	rootStore := notaryStorage.NewMemStorage()
+	storeRootRepo(t, trust, rootStore, "quay")
+	store := &firstOrCreateStore{MetaStore: notaryStorage.NewMemStorage()}
+	replica := NewMultiplexingStore(store, rootStore, trust, SignerRoot, AlternateRoot, Root, "quay", "targets/releases")
+	otherReplica := NewMultiplexingStore(store, rootStore, trust, SignerRoot, AlternateRoot, Root, "quay", "targets/releases")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, replica, gun, meta, 1)
+
+	// a push to the other replica stores the same alternate-rooted versions between this one reading and writing them
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	store.beforeUpdate = func() {
+		pushMeta(t, otherReplica, gun, meta, 2)
+	}
+	_, err = replica.RefreshAlternateRoot(defaultRoot(t, replica), gun, time.Now().Add(20*notary.Year))
+	require.IsType(t, notaryStorage.ErrOldVersion{}, err)
+
+	// the next pass refreshes on top of the push
+	refreshed, err := replica.RefreshAlternateRoot(defaultRoot(t, replica), gun, time.Now().Add(20*notary.Year))
+	require.NoError(t, err)
+	require.Len(t, refreshed, 3)
+	require.Equal(t, 3, alternateVersion(t, replica, gun, data.CanonicalTimestampRole))
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var reswizzled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "apostille",
+	Subsystem: "reswizzle",
+	Name:      "guns_total",
+	Help:      "Number of repositories re-swizzled under an alternate root, by result.",
+}, []string{"root", "result"})
+
+func init() {
+	prometheus.MustRegister(reswizzled)
+}
+
+// ReswizzleOptions controls a pass of re-swizzling over all repositories
+type ReswizzleOptions struct {
+	// Roots are the names of the alternate roots to re-swizzle under; every alternate root if empty
+	Roots []string `json:"roots"`
+	// Prefix limits re-swizzling to GUNs starting with it
+	Prefix string `json:"prefix"`
+	// StartAfter is the changefeed ID to resume from, as reported by a previous pass; "0" starts from the beginning
+	StartAfter string `json:"start_after"`
+	// Rate is the maximum number of repositories re-swizzled per second; 0 is unlimited
+	Rate float64 `json:"rate"`
+	// BatchSize is how many changefeed records are read from the store at a time
+	BatchSize int `json:"batch_size"`
+}
+
+// ReswizzleResult reports what a pass of re-swizzling did
+type ReswizzleResult struct {
+	// GUNs are the repositories that were re-swizzled
+	GUNs []data.GUN `json:"guns"`
+	// Failed maps repositories that could not be re-swizzled to the reason why
+	Failed map[string]string `json:"failed,omitempty"`
+	// LastChangeID is the changefeed ID of the last repository visited, which a later pass can resume after
+	LastChangeID string `json:"last_change_id"`
+}
+
+// ReswizzleAll regenerates the alternate-rooted metadata of every repository from its current signer-rooted metadata.
+// Repositories are found through the changefeed, so a pass that is interrupted (or cancelled through the context) can
+// be resumed from the LastChangeID it reported.
+func (st *MultiplexingStore) ReswizzleAll(ctx context.Context, options ReswizzleOptions) (*ReswizzleResult, error) {
+	roots, err := st.selectAlternateRoots(options.Roots)
+	if err != nil {
+		return nil, err
+	}
+	if options.StartAfter == "" {
+		options.StartAfter = "0"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	var tick <-chan time.Time
+	if options.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / options.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	result := &ReswizzleResult{
+		GUNs:         []data.GUN{},
+		LastChangeID: options.StartAfter,
+	}
+	err = WalkGUNs(st.MetaStore, options.StartAfter, options.BatchSize, func(gun data.GUN, changeID string) error {
+		if !strings.HasPrefix(gun.String(), options.Prefix) {
+			result.LastChangeID = changeID
+			return nil
+		}
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		reswizzledGUN := false
+		for _, root := range roots {
+			if !root.Covers(gun) {
+				continue
+			}
+			err := st.Reswizzle(root, gun)
+			switch err.(type) {
+			case nil:
+				reswizzled.WithLabelValues(root.Name, "success").Inc()
+				reswizzledGUN = true
+			case notaryStorage.ErrNotFound:
+				// the repository was deleted, or has nothing to swizzle
+				reswizzled.WithLabelValues(root.Name, "skipped").Inc()
+			default:
+				reswizzled.WithLabelValues(root.Name, "error").Inc()
+				logrus.Errorf("failed to re-swizzle %s under %s root: %s", gun, root.Name, err.Error())
+				if result.Failed == nil {
+					result.Failed = make(map[string]string)
+				}
+				result.Failed[gun.String()] = err.Error()
+			}
+		}
+		if reswizzledGUN {
+			result.GUNs = append(result.GUNs, gun)
+		}
+		result.LastChangeID = changeID
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	logrus.Infof("re-swizzled %d repositories, %d failed", len(result.GUNs), len(result.Failed))
+	return result, nil
+}
+
+// selectAlternateRoots returns the named alternate roots, or every alternate root if no names are given
+func (st *MultiplexingStore) selectAlternateRoots(names []string) ([]*AlternateRootStore, error) {
+	if len(names) == 0 {
+		return st.alternateRoots, nil
+	}
+	roots := make([]*AlternateRootStore, 0, len(names))
+	for _, name := range names {
+		root, ok := st.AlternateRootStore(name)
+		if !ok {
+			return nil, fmt.Errorf("no alternate root named %s", name)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// Reswizzle re-roots the current signer-rooted metadata of a gun under the current version of an alternate root,
+// re-signing the alternate-rooted targets, snapshot and timestamp. If another apostille stores a change to the gun at
+// the same time, one of them fails with ErrOldVersion.
+func (st *MultiplexingStore) Reswizzle(root *AlternateRootStore, gun data.GUN) error {
+	// swizzling builds on the stored alternate-rooted metadata, which pushes also write
+	defer st.gunLocks.lock(gun)()
+	updates := make([]notaryStorage.MetaUpdate, 0, len(data.BaseRoles))
+	for _, role := range data.BaseRoles {
+		_, meta, err := st.SignerChannelMetaStore.GetCurrent(gun, role)
+		if err != nil {
+			return err
+		}
+		version, err := metaVersion(meta)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, notaryStorage.MetaUpdate{
+			Role:    role,
+			Version: version,
+			Data:    meta,
+		})
+	}
+
+	alternateRootUpdates, err := st.swizzleTargets(root, gun, updates)
+	if err != nil {
+		return err
+	}
+	alternateRootUpdates = st.setChannels(alternateRootUpdates, &root.Channel)
+	if err := st.MetaStore.UpdateMany(gun, alternateRootUpdates); err != nil {
+		return err
+	}
+	return st.checkStored(gun, alternateRootUpdates)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/coreos-inc/apostille/servertest"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestReswizzleAll(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+
+	guns := []data.GUN{"quay.io/signingUser/one", "quay.io/otherUser/two", "quay.io/signingUser/three"}
+	for _, gun := range guns {
+		meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+		require.NoError(t, err)
+		pushMeta(t, metaStore, gun, meta, 1)
+	}
+
+	// only repos with the prefix are re-swizzled
+	result, err := metaStore.ReswizzleAll(context.Background(), ReswizzleOptions{
+		Prefix:    "quay.io/signingUser/",
+		Rate:      1000,
+		BatchSize: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []data.GUN{"quay.io/signingUser/one", "quay.io/signingUser/three"}, result.GUNs)
+	require.Empty(t, result.Failed)
+	require.Equal(t, 2, alternateVersion(t, metaStore, guns[0], data.CanonicalTimestampRole))
+	require.Equal(t, 1, alternateVersion(t, metaStore, guns[1], data.CanonicalTimestampRole))
+	require.Equal(t, 2, alternateVersion(t, metaStore, guns[2], data.CanonicalTimestampRole))
+
+	// resuming after the last change has nothing left to do
+	result, err = metaStore.ReswizzleAll(context.Background(), ReswizzleOptions{StartAfter: result.LastChangeID})
+	require.NoError(t, err)
+	require.Empty(t, result.GUNs)
+
+	// a cancelled pass stops, and reports where to resume from
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = metaStore.ReswizzleAll(ctx, ReswizzleOptions{})
+	require.Error(t, err)
+	require.Equal(t, "0", result.LastChangeID)
+	require.Empty(t, result.GUNs)
+
+	_, err = metaStore.ReswizzleAll(context.Background(), ReswizzleOptions{Roots: []string{"missing"}})
+	require.Error(t, err)
+}
+
+func TestReswizzleConcurrentPush(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	rootStore := notaryStorage.NewMemStorage()
+	storeRootRepo(t, trust, rootStore, "quay")
+	store := &firstOrCreateStore{MetaStore: notaryStorage.NewMemStorage()}
+	replica := NewMultiplexingStore(store, rootStore, trust, SignerRoot, AlternateRoot, Root, "quay", "targets/releases")
+	otherReplica := NewMultiplexingStore(store, rootStore, trust, SignerRoot, AlternateRoot, Root, "quay", "targets/releases")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, replica, gun, meta, 1)
+
+	// a push to the other replica stores the same alternate-rooted versions between this one reading and writing them
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	store.beforeUpdate = func() {
+		pushMeta(t, otherReplica, gun, meta, 2)
+	}
+	err = replica.Reswizzle(defaultRoot(t, replica), gun)
+	require.IsType(t, notaryStorage.ErrOldVersion{}, err)
+
+	require.NoError(t, replica.Reswizzle(defaultRoot(t, replica), gun))
+	require.Equal(t, 3, alternateVersion(t, replica, gun, data.CanonicalTimestampRole))
+}
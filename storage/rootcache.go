@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary/tuf/data"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultRootCacheTTL is how long an alternate root is used before checking the root store for a new version
+const DefaultRootCacheTTL = time.Minute
+
+var (
+	rootCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "root_cache",
+		Name:      "hits_total",
+		Help:      "Number of times the cached alternate root was used without reading the root store.",
+	}, []string{"root"})
+	rootCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "root_cache",
+		Name:      "misses_total",
+		Help:      "Number of times the alternate root had to be read from the root store.",
+	}, []string{"root"})
+	rootCacheVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "apostille",
+		Subsystem: "root_cache",
+		Name:      "version",
+		Help:      "Version of the currently cached alternate root.",
+	}, []string{"root"})
+)
+
+func init() {
+	prometheus.MustRegister(rootCacheHits)
+	prometheus.MustRegister(rootCacheMisses)
+	prometheus.MustRegister(rootCacheVersion)
+}
+
+// alternateRootCache holds a parsed alternate root, so that pushes don't need to read it from the root store
+type alternateRootCache struct {
+	lock      sync.RWMutex
+	root      *data.Signed
+	baseRoles map[data.RoleName]data.BaseRole
+	version   int
+	checked   time.Time
+}
+
+// AlternateRoot returns the root of the named alternate root, along with its base roles.
+// The root is cached for RootCacheTTL; after that the root store is checked and the root is only re-parsed
+// if its version has changed. The returned root is a copy and may be modified, but the base roles are shared.
+func (st *MultiplexingStore) AlternateRoot(name string) (*data.SignedRoot, map[data.RoleName]data.BaseRole, error) {
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("no alternate root named %s", name)
+	}
+	return st.loadAlternateRoot(root)
+}
+
+// InvalidateAlternateRoot forces the next use of the named alternate root to read it from the root store
+func (st *MultiplexingStore) InvalidateAlternateRoot(name string) {
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return
+	}
+	root.cache.lock.Lock()
+	defer root.cache.lock.Unlock()
+	root.cache.root = nil
+}
+
+// loadAlternateRoot returns an alternate root from the cache, reading it from the root store if the cache has expired
+func (st *MultiplexingStore) loadAlternateRoot(root *AlternateRootStore) (*data.SignedRoot, map[data.RoleName]data.BaseRole, error) {
+	cache := &root.cache
+
+	cache.lock.RLock()
+	if cache.root != nil && time.Since(cache.checked) < st.RootCacheTTL {
+		defer cache.lock.RUnlock()
+		rootCacheHits.WithLabelValues(root.Name).Inc()
+		signedRoot, err := data.RootFromSigned(cache.root)
+		return signedRoot, cache.baseRoles, err
+	}
+	cache.lock.RUnlock()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	rootCacheMisses.WithLabelValues(root.Name).Inc()
+
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := metaVersion(rootBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache.root == nil || version != cache.version {
+		if err := cache.load(rootBytes, version); err != nil {
+			return nil, nil, err
+		}
+		rootCacheVersion.WithLabelValues(root.Name).Set(float64(version))
+		logrus.Infof("loaded %s alternate root %s version %d", root.Name, root.RootGUN, version)
+	}
+	cache.checked = time.Now()
+
+	signedRoot, err := data.RootFromSigned(cache.root)
+	return signedRoot, cache.baseRoles, err
+}
+
+// load parses a root and its base roles into the cache. The cache lock must be held.
+func (cache *alternateRootCache) load(rootBytes []byte, version int) error {
+	rootSigned := &data.Signed{}
+	if err := json.Unmarshal(rootBytes, rootSigned); err != nil {
+		return err
+	}
+	rootSignedRole, err := data.RootFromSigned(rootSigned)
+	if err != nil {
+		return err
+	}
+
+	baseRoles := map[data.RoleName]data.BaseRole{}
+	for _, baseRoleName := range data.BaseRoles {
+		baseRoles[baseRoleName], err = rootSignedRole.BuildBaseRole(baseRoleName)
+		if err != nil {
+			return err
+		}
+	}
+
+	cache.root = rootSigned
+	cache.baseRoles = baseRoles
+	cache.version = version
+	return nil
+}
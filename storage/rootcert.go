@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary/tuf/data"
+	tufUtils "github.com/docker/notary/tuf/utils"
+)
+
+// ErrInvalidRootCertificate is returned when a certificate can't be installed as the root key of an alternate root
+type ErrInvalidRootCertificate struct {
+	Reason string
+}
+
+func (err ErrInvalidRootCertificate) Error() string {
+	return fmt.Sprintf("invalid root certificate: %s", err.Reason)
+}
+
+// RootCommonName returns the common name that a root certificate of an alternate root must have for notary clients
+// to accept it for every gun rooted under it: a wildcard for the longest prefix shared by the root's gun prefixes
+func RootCommonName(root *AlternateRootStore) string {
+	if len(root.Prefixes) == 0 {
+		return "*"
+	}
+	common := root.Prefixes[0]
+	for _, prefix := range root.Prefixes[1:] {
+		for !strings.HasPrefix(prefix, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	return common + "*"
+}
+
+// checkRootCommonName checks that a common name is a wildcard that notary clients match to every gun rooted under an
+// alternate root
+func checkRootCommonName(root *AlternateRootStore, commonName string) error {
+	if !strings.HasSuffix(commonName, "*") {
+		return ErrInvalidRootCertificate{Reason: fmt.Sprintf("common name %s is not a wildcard such as %s", commonName, RootCommonName(root))}
+	}
+	wildcard := strings.TrimSuffix(commonName, "*")
+	if len(root.Prefixes) == 0 && wildcard != "" {
+		return ErrInvalidRootCertificate{Reason: fmt.Sprintf("common name %s does not cover every gun", commonName)}
+	}
+	for _, prefix := range root.Prefixes {
+		if !strings.HasPrefix(prefix, wildcard) {
+			return ErrInvalidRootCertificate{Reason: fmt.Sprintf("common name %s does not cover gun prefix %s", commonName, prefix)}
+		}
+	}
+	return nil
+}
+
+// RootCertificateRequest creates a new root key for the named alternate root in the trust service, and returns a PEM
+// encoded certificate signing request for it, to be issued by an external CA and installed with
+// InstallRootCertificate. The common name defaults to RootCommonName. The trust service must be able to sign the
+// request with the key, which keys in notary-signer and ED25519 keys can't; the key is removed again if it can't.
+func (st *MultiplexingStore) RootCertificateRequest(name, commonName string) ([]byte, error) {
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return nil, fmt.Errorf("no alternate root named %s", name)
+	}
+	if commonName == "" {
+		commonName = RootCommonName(root)
+	}
+	if err := checkRootCommonName(root, commonName); err != nil {
+		return nil, err
+	}
+	_, request, err := st.rootCertificateRequest(root, commonName)
+	return request, err
+}
+
+// rootCertificateRequest creates a new root key for an alternate root, and returns its ID and a PEM encoded
+// certificate signing request for it
+func (st *MultiplexingStore) rootCertificateRequest(root *AlternateRootStore, commonName string) (string, []byte, error) {
+	key, err := st.cryptoService.Create(data.CanonicalRootRole, root.RootGUN, st.Generation.KeyAlgorithm(data.CanonicalRootRole))
+	if err != nil {
+		return "", nil, err
+	}
+	request, err := st.certificateRequest(key.ID(), commonName)
+	if err != nil {
+		// the key can't be installed without a certificate
+		st.removeRootKey(key.ID())
+		return "", nil, err
+	}
+	logrus.Infof("created root key %s for %s alternate root, requesting a certificate for %s", key.ID(), root.Name, commonName)
+	return key.ID(), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: request}), nil
+}
+
+// removeRootKey removes a root key that won't be installed from the trust service
+func (st *MultiplexingStore) removeRootKey(keyID string) {
+	if err := st.cryptoService.RemoveKey(keyID); err != nil {
+		logrus.Errorf("unable to remove root key %s: %s", keyID, err.Error())
+	}
+}
+
+// certificateRequest signs a DER encoded certificate signing request for a key in the trust service
+func (st *MultiplexingStore) certificateRequest(keyID, commonName string) ([]byte, error) {
+	privKey, _, err := st.cryptoService.GetPrivateKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	signer := privKey.CryptoSigner()
+	if signer == nil {
+		return nil, fmt.Errorf("%s keys cannot sign a certificate request", privKey.Algorithm())
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	request, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParseCertificateRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := parsed.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("the trust service cannot sign certificate requests for %s keys: %s", privKey.Algorithm(), err.Error())
+	}
+	return request, nil
+}
+
+// InstallRootCertificate replaces the root keys of the named alternate root with a certificate issued by an external
+// CA for a key created by RootCertificateRequest. `certPEM` holds the certificate followed by its intermediates, which
+// must chain to one of RootCAs the way notary clients pinning the CA check it, and the certificate's common name must
+// cover every gun rooted under the alternate root. Like a root key rotation, the new root is also signed by the old
+// root keys, and every gun rooted under the alternate root is re-swizzled. A dry run only validates the certificate.
+func (st *MultiplexingStore) InstallRootCertificate(name string, certPEM []byte, dryRun bool) (*RotationResult, error) {
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return nil, fmt.Errorf("no alternate root named %s", name)
+	}
+	certs, err := tufUtils.LoadCertBundleFromPEM(certPEM)
+	if err != nil {
+		return nil, ErrInvalidRootCertificate{Reason: err.Error()}
+	}
+	leaf, intermediates := certs[0], certs[1:]
+	if err := st.checkRootCertificate(root, leaf, intermediates); err != nil {
+		return nil, err
+	}
+
+	key, err := tufUtils.CertBundleToKey(leaf, intermediates)
+	if err != nil {
+		return nil, ErrInvalidRootCertificate{Reason: err.Error()}
+	}
+	keyID, err := tufUtils.CanonicalKeyID(key)
+	if err != nil {
+		return nil, ErrInvalidRootCertificate{Reason: err.Error()}
+	}
+	if _, role, err := st.cryptoService.GetPrivateKey(keyID); err != nil || role != data.CanonicalRootRole {
+		return nil, ErrInvalidRootCertificate{Reason: fmt.Sprintf("key %s is not a root key held by the trust service", keyID)}
+	}
+
+	repo, err := st.loadRootRepo(root)
+	if err != nil {
+		return nil, err
+	}
+	guns, err := st.alternateRootedGUNs(root)
+	if err != nil {
+		return nil, err
+	}
+	result := &RotationResult{
+		Root:    root.Name,
+		Version: repo.Root.Signed.Version + 1,
+		Rotated: []data.RoleName{data.CanonicalRootRole},
+		DryRun:  dryRun,
+		GUNs:    guns,
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if err := repo.ReplaceBaseKeys(data.CanonicalRootRole, key); err != nil {
+		return nil, err
+	}
+	// the certificate's key is now the only root key
+	repo.Root.Signed.Roles[data.CanonicalRootRole].Threshold = 1
+	if err := st.publishRootRepo(root, repo, result); err != nil {
+		return nil, err
+	}
+	logrus.Infof("installed root certificate for %s issued by %s in %s alternate root, now at version %d",
+		leaf.Subject.CommonName, leaf.Issuer.CommonName, root.Name, result.Version)
+	return result, nil
+}
+
+// checkRootCertificate checks that a certificate is one that notary clients pinning RootCAs accept for every gun
+// rooted under an alternate root
+func (st *MultiplexingStore) checkRootCertificate(root *AlternateRootStore, leaf *x509.Certificate, intermediates []*x509.Certificate) error {
+	if st.RootCAs == nil {
+		return ErrInvalidRootCertificate{Reason: "no root CAs are configured"}
+	}
+	if leaf.IsCA {
+		return ErrInvalidRootCertificate{Reason: "the first certificate must be the root key's certificate, not a CA"}
+	}
+	if err := tufUtils.ValidateCertificate(leaf, true); err != nil {
+		return ErrInvalidRootCertificate{Reason: err.Error()}
+	}
+	if err := checkRootCommonName(root, leaf.Subject.CommonName); err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		if err := tufUtils.ValidateCertificate(intermediate, true); err != nil {
+			return ErrInvalidRootCertificate{Reason: err.Error()}
+		}
+		pool.AddCert(intermediate)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: st.RootCAs, Intermediates: pool}); err != nil {
+		return ErrInvalidRootCertificate{Reason: err.Error()}
+	}
+	return nil
+}
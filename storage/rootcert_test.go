@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary"
+	"github.com/docker/notary/cryptoservice"
+	"github.com/docker/notary/passphrase"
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates, like a corporate CA
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issue signs a certificate for a public key with the CA, returning the certificate and its PEM encoding
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, []byte) {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template.SerialNumber = serial
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(notary.Year)
+	}
+	parent := template
+	if ca.cert != nil {
+		parent = ca.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newTestCA creates a self-signed CA, or an intermediate CA if a parent is given
+func newTestCA(t *testing.T, name string, parent *testCA) (*testCA, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent = &testCA{key: key}
+	}
+	cert, certPEM := parent.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, key.Public())
+	return &testCA{cert: cert, key: key}, certPEM
+}
+
+// issueRootCertificate issues a certificate for a certificate signing request
+func issueRootCertificate(t *testing.T, ca *testCA, csrPEM []byte, commonName string) []byte {
+	block, _ := pem.Decode(csrPEM)
+	require.NotNil(t, block)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+	_, certPEM := ca.issue(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: commonName},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}, csr.PublicKey)
+	return certPEM
+}
+
+func TestRootCommonName(t *testing.T) {
+	for prefixes, commonName := range map[string]string{
+		"":                    "*",
+		"quay.io/":            "quay.io/*",
+		"quay.io/a/,quay.io/": "quay.io/*",
+		"quay.io/,example/":   "*",
+	} {
+		root := &AlternateRootStore{}
+		if prefixes != "" {
+			root.Prefixes = strings.Split(prefixes, ",")
+		}
+		require.Equal(t, commonName, RootCommonName(root))
+		require.NoError(t, checkRootCommonName(root, commonName))
+	}
+
+	root := &AlternateRootStore{AlternateRootConfig: AlternateRootConfig{Prefixes: []string{"quay.io/"}}}
+	require.NoError(t, checkRootCommonName(root, "quay.*"))
+	require.Error(t, checkRootCommonName(root, "quay.io/"))
+	require.Error(t, checkRootCommonName(root, "quay.io/a/*"))
+}
+
+func TestRootCertificateRequestRemoteTrust(t *testing.T) {
+	metaStore := MultiplexingMetaStoreMock(t, servertest.TrustServiceMock(t))
+	_, err := metaStore.RootCertificateRequest(DefaultAlternateRootName, "")
+	require.Error(t, err)
+}
+
+func TestInstallRootCertificate(t *testing.T) {
+	// certificate requests need keys the trust service can sign them with; TestRootCertificateRequestRemoteTrust
+	// covers notary-signer
+	trust := cryptoservice.NewCryptoService(trustmanager.NewKeyMemoryStore(passphrase.ConstantRetriever("pass")))
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	root := defaultRoot(t, metaStore)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	_, oldRootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	_, oldRoot := decodeRoot(t, oldRootBytes)
+	oldRootRole, err := oldRoot.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+
+	ca, caPEM := newTestCA(t, "Corporate Root CA", nil)
+	intermediate, intermediatePEM := newTestCA(t, "Corporate Signing CA", ca)
+
+	// the root covers every gun, so its certificate must too
+	_, err = metaStore.RootCertificateRequest(root.Name, "quay.io/*")
+	require.Error(t, err)
+	_, err = metaStore.RootCertificateRequest("missing", "")
+	require.Error(t, err)
+
+	// keys that can't sign a request aren't left behind
+	rootKeys := trust.ListKeys(data.CanonicalRootRole)
+	generation := metaStore.Generation
+	metaStore.Generation.KeyAlgorithms = map[data.RoleName]string{data.CanonicalRootRole: data.ED25519Key}
+	_, err = metaStore.RootCertificateRequest(root.Name, "")
+	require.Error(t, err)
+	require.Len(t, trust.ListKeys(data.CanonicalRootRole), len(rootKeys))
+	metaStore.Generation = generation
+
+	csrPEM, err := metaStore.RootCertificateRequest(root.Name, "")
+	require.NoError(t, err)
+	bundle := append(issueRootCertificate(t, intermediate, csrPEM, "*"), intermediatePEM...)
+
+	// certificates are only accepted once the CAs are configured
+	_, err = metaStore.InstallRootCertificate(root.Name, bundle, true)
+	require.IsType(t, ErrInvalidRootCertificate{}, err)
+	metaStore.RootCAs = x509.NewCertPool()
+	metaStore.RootCAs.AddCert(ca.cert)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, otherPEM := intermediate.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "*"}}, otherKey.Public())
+	for _, invalid := range [][]byte{
+		[]byte("not a certificate"),
+		// without the intermediate, the certificate doesn't chain to the CA
+		issueRootCertificate(t, intermediate, csrPEM, "*"),
+		// the common name doesn't cover every gun
+		append(issueRootCertificate(t, intermediate, csrPEM, "quay.io/*"), intermediatePEM...),
+		// the CA certificate isn't for the root key
+		append(intermediatePEM, caPEM...),
+		// the trust service doesn't hold the key
+		append(otherPEM, intermediatePEM...),
+	} {
+		_, err = metaStore.InstallRootCertificate(root.Name, invalid, true)
+		require.IsType(t, ErrInvalidRootCertificate{}, err)
+	}
+
+	result, err := metaStore.InstallRootCertificate(root.Name, bundle, true)
+	require.NoError(t, err)
+	require.Equal(t, &RotationResult{
+		Root:    root.Name,
+		Version: 2,
+		Rotated: []data.RoleName{data.CanonicalRootRole},
+		DryRun:  true,
+		GUNs:    []data.GUN{gun},
+	}, result)
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, oldRootBytes, rootBytes)
+
+	result, err = metaStore.InstallRootCertificate(root.Name, bundle, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Version)
+	require.Equal(t, []data.GUN{gun}, result.GUNs)
+	require.Empty(t, result.Failed)
+
+	// clients pinning the CA accept the gun's new root, which is also signed by the old root keys
+	_, gunRootBytes, err := root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	gunRootSigned, gunRoot := decodeRoot(t, gunRootBytes)
+	require.Equal(t, 2, gunRoot.Signed.Version)
+	require.NoError(t, signed.VerifySignatures(gunRootSigned, oldRootRole))
+
+	dir, err := ioutil.TempDir("", "apostille-rootcert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0644))
+	_, err = trustpinning.ValidateRoot(nil, gunRootSigned, gun, trustpinning.TrustPinConfig{
+		CA:          map[string]string{"quay.io/": caFile},
+		DisableTOFU: true,
+	})
+	require.NoError(t, err)
+
+	// rotating the root keys would drop the CA-issued certificate, so it must be forced
+	for _, dryRun := range []bool{true, false} {
+		_, err = metaStore.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalRootRole, data.CanonicalTimestampRole}, dryRun, false)
+		require.Equal(t, ErrCARootCertificate{Root: root.Name, Issuer: "Corporate Signing CA"}, err)
+	}
+	result, err = metaStore.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalTimestampRole}, false, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Version)
+	result, err = metaStore.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalRootRole}, false, true)
+	require.NoError(t, err)
+	require.Equal(t, 4, result.Version)
+	_, err = metaStore.RotateAlternateRoot(root.Name, []data.RoleName{data.CanonicalRootRole}, true, false)
+	require.NoError(t, err)
+}
@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary"
+	"github.com/docker/notary/cryptoservice"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	tufUtils "github.com/docker/notary/tuf/utils"
+)
+
+// RotationResult reports what rotating the keys of an alternate root did, or would do for a dry run
+type RotationResult struct {
+	Root    string            `json:"root"`
+	Version int               `json:"version"`
+	Rotated []data.RoleName   `json:"rotated"`
+	DryRun  bool              `json:"dry_run"`
+	GUNs    []data.GUN        `json:"guns"`
+	Failed  map[string]string `json:"failed,omitempty"`
+	// CSR is the PEM encoded certificate signing request for the new root key of a rotation that requests one
+	CSR string `json:"csr,omitempty"`
+}
+
+// ErrCARootCertificate is returned when rotating the root keys of an alternate root would replace a certificate
+// issued by a CA with a self-signed one
+type ErrCARootCertificate struct {
+	Root   string
+	Issuer string
+}
+
+func (err ErrCARootCertificate) Error() string {
+	return fmt.Sprintf("the root key of %s has a certificate issued by %s, which rotating would replace with a self-signed one", err.Root, err.Issuer)
+}
+
+// RotateAlternateRoot replaces the keys for `roles` of the named alternate root with new keys from the trust service,
+// and stores a new version of its root. If the root keys are rotated, the new root is also signed by the old root keys
+// so that clients can follow the rotation. Every gun rooted under the alternate root is then re-swizzled under the new
+// root. A dry run only reports the new version and the guns that would be re-swizzled.
+//
+// Rotated root keys get self-signed certificates, so rotating root keys that have a CA-issued certificate fails with
+// ErrCARootCertificate unless it is forced: clients pinning the CA, or a wildcard of the old key IDs, would no longer
+// accept the root of a gun they haven't seen yet. RotateAlternateRootCSR rotates them to a CA-issued certificate
+// instead.
+func (st *MultiplexingStore) RotateAlternateRoot(name string, roles []data.RoleName, dryRun, force bool) (*RotationResult, error) {
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return nil, fmt.Errorf("no alternate root named %s", name)
+	}
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("no roles to rotate")
+	}
+	for _, role := range roles {
+		if !data.IsBaseRole(role) {
+			return nil, fmt.Errorf("cannot rotate %s: only base roles can be rotated", role)
+		}
+	}
+
+	repo, err := st.loadRootRepo(root)
+	if err != nil {
+		return nil, err
+	}
+	if !force {
+		for _, role := range roles {
+			if role != data.CanonicalRootRole {
+				continue
+			}
+			if issuer, ok := caIssuedRootCertificate(repo); ok {
+				return nil, ErrCARootCertificate{Root: root.Name, Issuer: issuer}
+			}
+		}
+	}
+	guns, err := st.alternateRootedGUNs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RotationResult{
+		Root:    root.Name,
+		Version: repo.Root.Signed.Version + 1,
+		Rotated: roles,
+		DryRun:  dryRun,
+		GUNs:    guns,
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	for _, role := range roles {
+		if err := st.replaceKey(repo, root.RootGUN, role); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.publishRootRepo(root, repo, result); err != nil {
+		return nil, err
+	}
+	logrus.Infof("rotated %v keys of %s alternate root, now at version %d", roles, root.Name, result.Version)
+	return result, nil
+}
+
+// RotateAlternateRootCSR rotates the keys for `roles` of the named alternate root like RotateAlternateRoot, except
+// that the new root key doesn't get a self-signed certificate: the result holds a certificate signing request for it
+// with the given common name, as RootCertificateRequest returns, and the root keys are only replaced once the issued
+// certificate is installed with InstallRootCertificate. Root keys with a CA-issued certificate can therefore be
+// rotated without forcing it. `roles` must include the root role. A dry run only checks the common name.
+func (st *MultiplexingStore) RotateAlternateRootCSR(name string, roles []data.RoleName, commonName string, dryRun bool) (*RotationResult, error) {
+	root, ok := st.AlternateRootStore(name)
+	if !ok {
+		return nil, fmt.Errorf("no alternate root named %s", name)
+	}
+	rotatesRoot := false
+	online := make([]data.RoleName, 0, len(roles))
+	for _, role := range roles {
+		if role == data.CanonicalRootRole {
+			rotatesRoot = true
+			continue
+		}
+		online = append(online, role)
+	}
+	if !rotatesRoot {
+		return nil, fmt.Errorf("certificate requests are only made for rotated root keys")
+	}
+	if commonName == "" {
+		commonName = RootCommonName(root)
+	}
+	if err := checkRootCommonName(root, commonName); err != nil {
+		return nil, err
+	}
+
+	var (
+		keyID string
+		csr   []byte
+		err   error
+	)
+	if !dryRun {
+		if keyID, csr, err = st.rootCertificateRequest(root, commonName); err != nil {
+			return nil, err
+		}
+	}
+	var result *RotationResult
+	if len(online) > 0 {
+		result, err = st.RotateAlternateRoot(name, online, dryRun, false)
+	} else {
+		// nothing is published until the certificate is installed
+		result, err = st.unrotatedResult(root, dryRun)
+	}
+	if err != nil {
+		if keyID != "" {
+			st.removeRootKey(keyID)
+		}
+		return nil, err
+	}
+	result.CSR = string(csr)
+	return result, nil
+}
+
+// unrotatedResult reports the current version of an alternate root, for rotations that don't publish a new one
+func (st *MultiplexingStore) unrotatedResult(root *AlternateRootStore, dryRun bool) (*RotationResult, error) {
+	repo, err := st.loadRootRepo(root)
+	if err != nil {
+		return nil, err
+	}
+	return &RotationResult{
+		Root:    root.Name,
+		Version: repo.Root.Signed.Version,
+		Rotated: []data.RoleName{},
+		DryRun:  dryRun,
+		GUNs:    []data.GUN{},
+	}, nil
+}
+
+// caIssuedRootCertificate returns the issuer of a root key certificate of a root repo that isn't self-signed, if there
+// is one
+func caIssuedRootCertificate(repo *tuf.Repo) (string, bool) {
+	rootRole, err := repo.GetBaseRole(data.CanonicalRootRole)
+	if err != nil {
+		return "", false
+	}
+	for _, key := range rootRole.ListKeys() {
+		switch key.Algorithm() {
+		case data.ECDSAx509Key, data.RSAx509Key:
+		default:
+			continue
+		}
+		cert, err := tufUtils.LoadCertFromPEM(key.Public())
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			return cert.Issuer.CommonName, true
+		}
+	}
+	return "", false
+}
+
+// publishRootRepo stores a new version of an alternate root's root repo, and re-swizzles the guns of the result under
+// it, recording the guns that failed
+func (st *MultiplexingStore) publishRootRepo(root *AlternateRootStore, repo *tuf.Repo, result *RotationResult) error {
+	if err := st.storeRootRepo(root, repo); err != nil {
+		return err
+	}
+	st.InvalidateAlternateRoot(root.Name)
+
+	guns := result.GUNs
+	result.GUNs = make([]data.GUN, 0, len(guns))
+	for _, gun := range guns {
+		if err := st.Reswizzle(root, gun); err != nil {
+			logrus.Errorf("failed to re-swizzle %s under %s root: %s", gun, root.Name, err.Error())
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			result.Failed[gun.String()] = err.Error()
+			continue
+		}
+		result.GUNs = append(result.GUNs, gun)
+	}
+	return nil
+}
+
+// alternateRootedGUNs lists the guns that have metadata rooted under an alternate root
+func (st *MultiplexingStore) alternateRootedGUNs(root *AlternateRootStore) ([]data.GUN, error) {
+	var guns []data.GUN
+	err := WalkGUNs(st.MetaStore, "0", 100, func(gun data.GUN, _ string) error {
+		if !root.Covers(gun) {
+			return nil
+		}
+		_, _, err := root.MetaStore.GetCurrent(gun, data.CanonicalTimestampRole)
+		if err != nil {
+			if _, ok := err.(notaryStorage.ErrNotFound); ok {
+				return nil
+			}
+			return err
+		}
+		guns = append(guns, gun)
+		return nil
+	})
+	return guns, err
+}
+
+// loadRootRepo loads the current root repo of an alternate root from the root store
+func (st *MultiplexingStore) loadRootRepo(root *AlternateRootStore) (*tuf.Repo, error) {
+	builder := tuf.NewRepoBuilder(root.RootGUN, st.cryptoService, trustpinning.TrustPinConfig{})
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	if err != nil {
+		return nil, err
+	}
+	// the root may have expired, which is a good reason to rotate it
+	if err := builder.Load(data.CanonicalRootRole, rootBytes, 1, true); err != nil {
+		return nil, err
+	}
+	repo, _, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := repo.InitTargets(data.CanonicalTargetsRole); err != nil {
+		return nil, err
+	}
+	if err := repo.InitSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := repo.InitTimestamp(); err != nil {
+		return nil, err
+	}
+	// signing increments the version, so start from the stored versions
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		_, meta, err := root.RootMetaStore.GetCurrent(root.RootGUN, role)
+		if err != nil {
+			return nil, err
+		}
+		version, err := metaVersion(meta)
+		if err != nil {
+			return nil, err
+		}
+		switch role {
+		case data.CanonicalTargetsRole:
+			repo.Targets[role].Signed.Version = version
+		case data.CanonicalSnapshotRole:
+			repo.Snapshot.Signed.Version = version
+		case data.CanonicalTimestampRole:
+			repo.Timestamp.Signed.Version = version
+		}
+	}
+	return repo, nil
+}
+
+// replaceKey replaces the keys of a role with new keys from the trust service, generated as the store's generation
+// config sets: the configured number of root keys and root threshold for the root role, and a single key for the
+// online roles. Root keys are wrapped in a certificate for the gun.
+func (st *MultiplexingStore) replaceKey(repo *tuf.Repo, gun data.GUN, role data.RoleName) error {
+	count, threshold := 1, notary.MinThreshold
+	if role == data.CanonicalRootRole {
+		count, threshold = st.Generation.RootKeys, st.Generation.RootThreshold
+	}
+
+	keys := make([]data.PublicKey, 0, count)
+	for i := 0; i < count; i++ {
+		key, err := st.cryptoService.Create(role, gun, st.Generation.KeyAlgorithm(role))
+		if err != nil {
+			return err
+		}
+		if role == data.CanonicalRootRole {
+			privKey, _, err := st.cryptoService.GetPrivateKey(key.ID())
+			if err != nil {
+				return err
+			}
+			startTime := time.Now()
+			cert, err := cryptoservice.GenerateCertificate(privKey, gun, startTime, startTime.Add(st.Generation.CertificateValidity))
+			if err != nil {
+				return err
+			}
+			if key = tufUtils.CertToKey(cert); key == nil {
+				return fmt.Errorf("cannot use generated certificate: format %v", cert.PublicKeyAlgorithm)
+			}
+		}
+		keys = append(keys, key)
+	}
+	if err := repo.ReplaceBaseKeys(role, keys...); err != nil {
+		return err
+	}
+	repo.Root.Signed.Roles[role].Threshold = threshold
+	return nil
+}
+
+// storeRootRepo signs a new version of every role in an alternate root's root repo, and stores them in the root store
+func (st *MultiplexingStore) storeRootRepo(root *AlternateRootStore, repo *tuf.Repo) error {
+	rootSigned, err := repo.SignRoot(st.Generation.Expires(data.CanonicalRootRole), nil)
+	if err != nil {
+		return err
+	}
+	targetsSigned, err := repo.SignTargets(data.CanonicalTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole))
+	if err != nil {
+		return err
+	}
+	ssSigned, err := repo.SignSnapshot(st.Generation.Expires(data.CanonicalSnapshotRole))
+	if err != nil {
+		return err
+	}
+	tsSigned, err := repo.SignTimestamp(st.Generation.Expires(data.CanonicalTimestampRole))
+	if err != nil {
+		return err
+	}
+
+	updates := make([]notaryStorage.MetaUpdate, 0, 4)
+	for _, signed := range []struct {
+		role    data.RoleName
+		version int
+		meta    *data.Signed
+	}{
+		{data.CanonicalRootRole, repo.Root.Signed.Version, rootSigned},
+		{data.CanonicalTargetsRole, repo.Targets[data.CanonicalTargetsRole].Signed.Version, targetsSigned},
+		{data.CanonicalSnapshotRole, repo.Snapshot.Signed.Version, ssSigned},
+		{data.CanonicalTimestampRole, repo.Timestamp.Signed.Version, tsSigned},
+	} {
+		metaBytes, err := json.Marshal(signed.meta)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, notaryStorage.MetaUpdate{
+			Role:    signed.role,
+			Version: signed.version,
+			Data:    metaBytes,
+		})
+	}
+	return root.RootMetaStore.UpdateMany(root.RootGUN, st.setChannels(updates, &st.rootChannel))
+}
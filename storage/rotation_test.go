@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeRoot parses serialized root metadata
+func decodeRoot(t *testing.T, rootBytes []byte) (*data.Signed, *data.SignedRoot) {
+	rootSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(rootBytes, rootSigned))
+	root, err := data.RootFromSigned(rootSigned)
+	require.NoError(t, err)
+	return rootSigned, root
+}
+
+func TestRotateAlternateRoot(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	root := defaultRoot(t, metaStore)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	_, oldRootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	_, oldRoot := decodeRoot(t, oldRootBytes)
+	oldRootRole, err := oldRoot.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+	_, oldTimestamp, err := root.MetaStore.GetCurrent(gun, data.CanonicalTimestampRole)
+	require.NoError(t, err)
+
+	allRoles := []data.RoleName{data.CanonicalRootRole, data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole}
+
+	// a dry run reports what would happen, but changes nothing
+	result, err := metaStore.RotateAlternateRoot(root.Name, allRoles, true, false)
+	require.NoError(t, err)
+	require.Equal(t, &RotationResult{
+		Root:    root.Name,
+		Version: 2,
+		Rotated: allRoles,
+		DryRun:  true,
+		GUNs:    []data.GUN{gun},
+	}, result)
+	_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, oldRootBytes, rootBytes)
+
+	result, err = metaStore.RotateAlternateRoot(root.Name, allRoles, false, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Version)
+	require.Equal(t, []data.GUN{gun}, result.GUNs)
+	require.Empty(t, result.Failed)
+
+	// the new root has new keys, and is signed by both the old and new root keys
+	_, rootBytes, err = root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+	require.NoError(t, err)
+	newRootSigned, newRoot := decodeRoot(t, rootBytes)
+	require.Equal(t, 2, newRoot.Signed.Version)
+	for _, role := range allRoles {
+		oldRole, err := oldRoot.BuildBaseRole(role)
+		require.NoError(t, err)
+		newRole, err := newRoot.BuildBaseRole(role)
+		require.NoError(t, err)
+		require.False(t, oldRole.Equals(newRole), "%s keys were not rotated", role)
+	}
+	newRootRole, err := newRoot.BuildBaseRole(data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.NoError(t, signed.VerifySignatures(newRootSigned, oldRootRole))
+	require.NoError(t, signed.VerifySignatures(newRootSigned, newRootRole))
+
+	// the gun was re-swizzled under the new root, and still has the old one for clients to rotate from
+	_, gunRootBytes, err := root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	_, gunRoot := decodeRoot(t, gunRootBytes)
+	require.Equal(t, 2, gunRoot.Signed.Version)
+	_, gunOldRootBytes, err := root.MetaStore.GetVersion(gun, data.CanonicalRootRole, 1)
+	require.NoError(t, err)
+	_, gunOldRoot := decodeRoot(t, gunOldRootBytes)
+	require.Equal(t, 1, gunOldRoot.Signed.Version)
+
+	_, timestampBytes, err := root.MetaStore.GetCurrent(gun, data.CanonicalTimestampRole)
+	require.NoError(t, err)
+	require.NotEqual(t, oldTimestamp, timestampBytes)
+	timestampSigned := &data.Signed{}
+	require.NoError(t, json.Unmarshal(timestampBytes, timestampSigned))
+	timestampRole, err := newRoot.BuildBaseRole(data.CanonicalTimestampRole)
+	require.NoError(t, err)
+	require.NoError(t, signed.VerifySignatures(timestampSigned, timestampRole))
+
+	// the signer-rooted metadata is untouched, and the signer can keep pushing
+	_, signerRoot, err := metaStore.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	require.Equal(t, meta[data.CanonicalRootRole], signerRoot)
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 2)
+	_, gunRootBytes, err = root.MetaStore.GetCurrent(gun, data.CanonicalRootRole)
+	require.NoError(t, err)
+	_, gunRoot = decodeRoot(t, gunRootBytes)
+	require.Equal(t, 2, gunRoot.Signed.Version)
+}
+
+func TestRotateAlternateRootInvalid(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+
+	_, err := metaStore.RotateAlternateRoot("missing", []data.RoleName{data.CanonicalTimestampRole}, true, false)
+	require.Error(t, err)
+	_, err = metaStore.RotateAlternateRoot(DefaultAlternateRootName, nil, true, false)
+	require.Error(t, err)
+	_, err = metaStore.RotateAlternateRoot(DefaultAlternateRootName, []data.RoleName{"targets/releases"}, true, false)
+	require.Error(t, err)
+}
+
+// rotated keys follow the generation config, so that a root with several keys can be rotated again
+func TestRotateAlternateRootGenerationConfig(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	root := defaultRoot(t, metaStore)
+	metaStore.Generation.RootKeys = 3
+	metaStore.Generation.RootThreshold = 2
+	metaStore.Generation.KeyAlgorithms = map[data.RoleName]string{data.CanonicalTimestampRole: data.ED25519Key}
+
+	allRoles := []data.RoleName{data.CanonicalRootRole, data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole}
+	for version := 2; version <= 3; version++ {
+		_, oldRootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+		require.NoError(t, err)
+		_, oldRoot := decodeRoot(t, oldRootBytes)
+		oldRootRole, err := oldRoot.BuildBaseRole(data.CanonicalRootRole)
+		require.NoError(t, err)
+
+		result, err := metaStore.RotateAlternateRoot(root.Name, allRoles, false, false)
+		require.NoError(t, err)
+		require.Equal(t, version, result.Version)
+
+		_, rootBytes, err := root.RootMetaStore.GetCurrent(root.RootGUN, data.CanonicalRootRole)
+		require.NoError(t, err)
+		newRootSigned, newRoot := decodeRoot(t, rootBytes)
+		newRootRole, err := newRoot.BuildBaseRole(data.CanonicalRootRole)
+		require.NoError(t, err)
+		require.Len(t, newRootRole.Keys, 3)
+		require.Equal(t, 2, newRootRole.Threshold)
+		for _, key := range newRootRole.ListKeys() {
+			require.Equal(t, data.ECDSAx509Key, key.Algorithm())
+		}
+		require.NoError(t, signed.VerifySignatures(newRootSigned, oldRootRole))
+		require.NoError(t, signed.VerifySignatures(newRootSigned, newRootRole))
+
+		timestampRole, err := newRoot.BuildBaseRole(data.CanonicalTimestampRole)
+		require.NoError(t, err)
+		require.Equal(t, 1, timestampRole.Threshold)
+		for _, key := range timestampRole.ListKeys() {
+			require.Equal(t, data.ED25519Key, key.Algorithm())
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+)
+
+// DefaultServerTargetsRole is the delegation that targets signed by apostille itself are kept in, under each
+// alternate root. It is delegated to, and signed by, the alternate root's online targets keys.
+const DefaultServerTargetsRole data.RoleName = "targets/apostille"
+
+// ErrNoAlternateRoot is returned when server signing is attempted for a gun that no alternate root covers
+type ErrNoAlternateRoot struct {
+	GUN data.GUN
+}
+
+func (err ErrNoAlternateRoot) Error() string {
+	return fmt.Sprintf("no alternate root covers %s", err.GUN)
+}
+
+// SignServerTargets adds and removes targets in the server-signed delegation of a gun under every alternate root that
+// covers it, and re-signs the alternate-rooted targets, snapshot and timestamp to match. The updates for every root
+// are stored atomically, and the Notifier is told about the change under each root. It returns the new version of the
+// delegation under each root, by root name. If another apostille stores a change to the gun at the same time, one of
+// them fails with ErrOldVersion.
+func (st *MultiplexingStore) SignServerTargets(gun data.GUN, add data.Files, remove []string) (map[string]int, error) {
+	roots := st.alternateRootsFor(gun)
+	if len(roots) == 0 {
+		return nil, ErrNoAlternateRoot{GUN: gun}
+	}
+	defer st.gunLocks.lock(gun)()
+
+	var (
+		allUpdates []notaryStorage.MetaUpdate
+		changes    []TrustChange
+	)
+	versions := make(map[string]int, len(roots))
+	for _, root := range roots {
+		previous, err := storedTargetsRole(root.MetaStore, gun, st.ServerTargetsRole)
+		if err != nil {
+			return nil, err
+		}
+		updates, version, err := st.signServerTargets(root, gun, add, remove)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign %s-rooted targets: %s", root.Name, err.Error())
+		}
+		allUpdates = append(allUpdates, st.setChannels(updates, &root.Channel)...)
+		versions[root.Name] = version
+		if st.Notifier != nil {
+			changes = append(changes, st.serverTargetsChange(root, gun, previous, updates))
+		}
+	}
+	if err := st.MetaStore.UpdateMany(gun, allUpdates); err != nil {
+		return nil, err
+	}
+	if err := st.checkStored(gun, allUpdates); err != nil {
+		return nil, err
+	}
+	logrus.Infof("server signed %d targets and removed %d from %s", len(add), len(remove), gun)
+	for _, change := range changes {
+		st.Notifier.NotifyChange(change)
+	}
+	return versions, nil
+}
+
+// checkStored checks that the stored versions written by an update are the ones it wrote. Stores may keep a version
+// that another apostille wrote at the same time rather than failing the update, which loses its change.
+func (st *MultiplexingStore) checkStored(gun data.GUN, updates []notaryStorage.MetaUpdate) error {
+	for _, update := range updates {
+		for _, channel := range update.Channels {
+			_, stored, err := st.MetaStore.GetVersion(gun, update.Role, update.Version, channel)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(stored, update.Data) {
+				logrus.Infof("version %d of %s of %s was written concurrently", update.Version, update.Role, gun)
+				return notaryStorage.ErrOldVersion{}
+			}
+		}
+	}
+	return nil
+}
+
+// serverTargetsChange describes how the updates for one alternate root change the server-signed delegation of a gun
+func (st *MultiplexingStore) serverTargetsChange(root *AlternateRootStore, gun data.GUN, previous *data.SignedTargets, updates []notaryStorage.MetaUpdate) TrustChange {
+	change := TrustChange{GUN: gun, Root: root.Name}
+	var previousTargets data.Files
+	if previous != nil {
+		previousTargets = previous.Signed.Targets
+	}
+	for _, update := range updates {
+		if update.Role != st.ServerTargetsRole {
+			continue
+		}
+		change.Roles = append(change.Roles, ChangedRole{Role: update.Role, Version: update.Version})
+		current, err := parseTargets(update.Data)
+		if err != nil {
+			logrus.Errorf("unable to work out the changes to %s: %s", gun, err.Error())
+			change.Incomplete = true
+			continue
+		}
+		change.Targets = diffTargets(update.Role, previousTargets, current)
+	}
+	return change
+}
+
+// signServerTargets applies a change to the server-signed delegation of a gun under one alternate root, and returns
+// the updates that store it along with the delegation's new version
+func (st *MultiplexingStore) signServerTargets(root *AlternateRootStore, gun data.GUN, add data.Files, remove []string) ([]notaryStorage.MetaUpdate, int, error) {
+	repo, err := st.copyAlternateRoot(root)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// keep the targets role that is already stored, since it delegates to the stashed signer targets
+	storedTargets, err := storedTargetsRole(root.MetaStore, gun, data.CanonicalTargetsRole)
+	if err != nil {
+		return nil, 0, err
+	}
+	if storedTargets != nil {
+		repo.Targets[data.CanonicalTargetsRole] = storedTargets
+	}
+	var storedStash []byte
+	if stash, err := storedTargetsRole(root.MetaStore, gun, st.stashedTargetsRole); err != nil {
+		return nil, 0, err
+	} else if stash != nil {
+		repo.Targets[st.stashedTargetsRole] = stash
+		if storedStash, err = stash.MarshalJSON(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := st.loadServerTargets(root, gun, repo); err != nil {
+		return nil, 0, err
+	}
+
+	if len(add) > 0 {
+		if _, err := repo.AddTargets(st.ServerTargetsRole, add); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := repo.RemoveTargets(st.ServerTargetsRole, remove...); err != nil {
+		return nil, 0, err
+	}
+
+	if err := st.seedAlternateVersions(root, gun, repo, nil); err != nil {
+		return nil, 0, err
+	}
+	if _, err := repo.SignTargets(st.ServerTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := repo.SignTargets(data.CanonicalTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := repo.SignSnapshot(st.Generation.Expires(data.CanonicalSnapshotRole)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := repo.SignTimestamp(st.Generation.Expires(data.CanonicalTimestampRole)); err != nil {
+		return nil, 0, err
+	}
+
+	updates, err := st.rootUpdates(root, gun, repo.Root)
+	if err != nil {
+		return nil, 0, err
+	}
+	roles := []data.RoleName{st.ServerTargetsRole, data.CanonicalTargetsRole}
+	if storedStash != nil {
+		// the stashed targets are re-serialized to hash them into the snapshot, so they are stored again if that changed them
+		if stash, err := repo.Targets[st.stashedTargetsRole].MarshalJSON(); err != nil {
+			return nil, 0, err
+		} else if !bytes.Equal(stash, storedStash) {
+			roles = append(roles, st.stashedTargetsRole)
+		}
+	}
+	for _, role := range roles {
+		meta, err := repo.Targets[role].MarshalJSON()
+		if err != nil {
+			return nil, 0, err
+		}
+		updates = setUpdate(updates, role, repo.Targets[role].Signed.Version, meta)
+	}
+	snapshot, err := repo.Snapshot.MarshalJSON()
+	if err != nil {
+		return nil, 0, err
+	}
+	updates = setUpdate(updates, data.CanonicalSnapshotRole, repo.Snapshot.Signed.Version, snapshot)
+	timestamp, err := repo.Timestamp.MarshalJSON()
+	if err != nil {
+		return nil, 0, err
+	}
+	updates = setUpdate(updates, data.CanonicalTimestampRole, repo.Timestamp.Signed.Version, timestamp)
+	return updates, repo.Targets[st.ServerTargetsRole].Signed.Version, nil
+}
+
+// keepServerTargets carries the server-signed delegation of a gun over into a newly swizzled repo, so that pushes
+// don't drop it. If the alternate root's targets keys have changed since the delegation was signed, it is re-signed
+// with the new keys and returned as an update; otherwise there is nothing new to store.
+func (st *MultiplexingStore) keepServerTargets(root *AlternateRootStore, gun data.GUN, repo *tuf.Repo) ([]notaryStorage.MetaUpdate, error) {
+	_, stored, err := root.MetaStore.GetCurrent(gun, st.ServerTargetsRole)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := st.loadServerTargets(root, gun, repo); err != nil {
+		return nil, err
+	}
+
+	delegation, err := repo.GetDelegationRole(st.ServerTargetsRole)
+	if err != nil {
+		return nil, err
+	}
+	var storedSigned data.Signed
+	if err := json.Unmarshal(stored, &storedSigned); err != nil {
+		return nil, err
+	}
+	if err := signed.VerifySignatures(&storedSigned, delegation.BaseRole); err == nil {
+		return nil, nil
+	}
+
+	logrus.Infof("re-signing %s of %s with the current %s targets keys", st.ServerTargetsRole, gun, root.Name)
+	if _, err := repo.SignTargets(st.ServerTargetsRole, st.Generation.Expires(data.CanonicalTargetsRole)); err != nil {
+		return nil, err
+	}
+	resigned, err := repo.Targets[st.ServerTargetsRole].MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return []notaryStorage.MetaUpdate{{
+		Role:    st.ServerTargetsRole,
+		Version: repo.Targets[st.ServerTargetsRole].Signed.Version,
+		Data:    resigned,
+	}}, nil
+}
+
+// loadServerTargets adds the stored server-signed delegation of a gun, if there is one, to a repo, and delegates it to
+// the current targets keys of the repo's alternate root
+func (st *MultiplexingStore) loadServerTargets(root *AlternateRootStore, gun data.GUN, repo *tuf.Repo) error {
+	serverTargets, err := storedTargetsRole(root.MetaStore, gun, st.ServerTargetsRole)
+	if err != nil {
+		return err
+	}
+	if serverTargets != nil {
+		repo.Targets[st.ServerTargetsRole] = serverTargets
+	}
+
+	targetsRole, err := repo.GetBaseRole(data.CanonicalTargetsRole)
+	if err != nil {
+		return err
+	}
+	var staleKeyIDs []string
+	delegation, err := repo.GetDelegationRole(st.ServerTargetsRole)
+	isNew := err != nil
+	if !isNew {
+		for _, keyID := range delegation.ListKeyIDs() {
+			if _, ok := targetsRole.Keys[keyID]; !ok {
+				staleKeyIDs = append(staleKeyIDs, keyID)
+			}
+		}
+	}
+	if err := repo.UpdateDelegationKeys(st.ServerTargetsRole, targetsRole.ListKeys(), staleKeyIDs, 1); err != nil {
+		return err
+	}
+	if isNew {
+		return repo.UpdateDelegationPaths(st.ServerTargetsRole, []string{""}, []string{}, false)
+	}
+	return nil
+}
+
+// storedTargetsRole loads a targets role from a store, or returns nil if it isn't stored
+func storedTargetsRole(store notaryStorage.MetaStore, gun data.GUN, role data.RoleName) (*data.SignedTargets, error) {
+	_, meta, err := store.GetCurrent(gun, role)
+	if err != nil {
+		if _, ok := err.(notaryStorage.ErrNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var decoded data.Signed
+	if err := json.Unmarshal(meta, &decoded); err != nil {
+		return nil, err
+	}
+	return data.TargetsFromSigned(&decoded, role)
+}
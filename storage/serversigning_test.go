@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/coreos-inc/apostille/servertest"
+	"github.com/docker/notary"
+	notaryStorage "github.com/docker/notary/server/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// alternateTargets loads a targets role stored under the default alternate root
+func alternateTargets(t *testing.T, store *MultiplexingStore, gun data.GUN, role data.RoleName) *data.SignedTargets {
+	targets, err := storedTargetsRole(defaultRoot(t, store).MetaStore, gun, role)
+	require.NoError(t, err)
+	require.NotNil(t, targets)
+	return targets
+}
+
+// requireServerTargets checks that the alternate-rooted targets delegate to the server-signed delegation with the
+// alternate root's targets keys, and that the snapshot covers it
+func requireServerTargets(t *testing.T, store *MultiplexingStore, gun data.GUN) *data.SignedTargets {
+	targets := alternateTargets(t, store, gun, data.CanonicalTargetsRole)
+	var delegation *data.Role
+	for _, role := range targets.Signed.Delegations.Roles {
+		if role.Name == DefaultServerTargetsRole {
+			delegation = role
+		}
+	}
+	require.NotNil(t, delegation)
+
+	root, _, err := store.AlternateRoot(DefaultAlternateRootName)
+	require.NoError(t, err)
+	require.Equal(t, root.Signed.Roles[data.CanonicalTargetsRole].KeyIDs, delegation.KeyIDs)
+
+	_, stored, err := defaultRoot(t, store).MetaStore.GetCurrent(gun, DefaultServerTargetsRole)
+	require.NoError(t, err)
+	var storedSigned data.Signed
+	require.NoError(t, json.Unmarshal(stored, &storedSigned))
+	delegationRole, err := targets.BuildDelegationRole(DefaultServerTargetsRole)
+	require.NoError(t, err)
+	require.NoError(t, signed.VerifySignatures(&storedSigned, delegationRole.BaseRole))
+
+	_, snapshotBytes, err := defaultRoot(t, store).MetaStore.GetCurrent(gun, data.CanonicalSnapshotRole)
+	require.NoError(t, err)
+	var snapshot data.SignedSnapshot
+	require.NoError(t, json.Unmarshal(snapshotBytes, &snapshot))
+	require.Contains(t, snapshot.Signed.Meta, DefaultServerTargetsRole.String())
+
+	return alternateTargets(t, store, gun, DefaultServerTargetsRole)
+}
+
+func TestSignServerTargets(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	repo := servertest.CreateRepo(t, gun, trust)
+	meta, err := testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+	_, signerTargets, err := metaStore.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalTargetsRole)
+	require.NoError(t, err)
+
+	versions, err := metaStore.SignServerTargets(gun, data.Files{"v1": fileMeta(t, "one")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{DefaultAlternateRootName: 1}, versions)
+	serverTargets := requireServerTargets(t, metaStore, gun)
+	require.Equal(t, data.Files{"v1": fileMeta(t, "one")}, serverTargets.Signed.Targets)
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		require.Equal(t, 2, alternateVersion(t, metaStore, gun, role))
+	}
+
+	// signer-rooted metadata is untouched, and the stashed signer targets are still delegated to
+	_, newSignerTargets, err := metaStore.SignerChannelMetaStore.GetCurrent(gun, data.CanonicalTargetsRole)
+	require.NoError(t, err)
+	require.Equal(t, signerTargets, newSignerTargets)
+	alternateTargets(t, metaStore, gun, "targets/releases")
+
+	// a push keeps the server-signed targets
+	_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{"latest": fileMeta(t, "latest")})
+	require.NoError(t, err)
+	meta, err = testutils.SignAndSerialize(repo)
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 2)
+	serverTargets = requireServerTargets(t, metaStore, gun)
+	require.Equal(t, 1, serverTargets.Signed.Version)
+	require.Contains(t, alternateTargets(t, metaStore, gun, "targets/releases").Signed.Targets, "latest")
+
+	// targets are replaced, and removed
+	versions, err = metaStore.SignServerTargets(gun, data.Files{"v2": fileMeta(t, "two")}, []string{"v1"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{DefaultAlternateRootName: 2}, versions)
+	serverTargets = requireServerTargets(t, metaStore, gun)
+	require.Equal(t, data.Files{"v2": fileMeta(t, "two")}, serverTargets.Signed.Targets)
+	require.Equal(t, 4, alternateVersion(t, metaStore, gun, data.CanonicalTimestampRole))
+}
+
+func TestSignServerTargetsRejectsReservedRole(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	meta[DefaultServerTargetsRole] = meta[data.CanonicalTargetsRole]
+	updates := make([]notaryStorage.MetaUpdate, 0, len(meta))
+	for role, metaBytes := range meta {
+		updates = append(updates, notaryStorage.MetaUpdate{Role: role, Version: 1, Data: metaBytes})
+	}
+	require.Error(t, metaStore.UpdateMany(gun, updates))
+}
+
+func TestSignServerTargetsUncoveredGUN(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	rootStore := notaryStorage.NewMemStorage()
+	storeRootRepo(t, trust, rootStore, "quay")
+	metaStore := NewMultiplexingStoreWithRoots(notaryStorage.NewMemStorage(), rootStore, trust, SignerRoot, Root, []AlternateRootConfig{
+		{Name: "quay", Channel: AlternateRoot, RootGUN: "quay", Prefixes: []string{"quay.io/"}},
+	}, "targets/releases")
+
+	_, err := metaStore.SignServerTargets("other.io/signingUser/testRepo", data.Files{"v1": fileMeta(t, "one")}, nil)
+	require.IsType(t, ErrNoAlternateRoot{}, err)
+}
+
+func TestSignServerTargetsNotifies(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+	notifier := &recordingNotifier{}
+	metaStore.Notifier = notifier
+
+	_, err = metaStore.SignServerTargets(gun, data.Files{"v1": fileMeta(t, "one")}, nil)
+	require.NoError(t, err)
+	_, err = metaStore.SignServerTargets(gun, data.Files{"v2": fileMeta(t, "two")}, []string{"v1"})
+	require.NoError(t, err)
+
+	require.Len(t, notifier.changes, 2)
+	require.Equal(t, TrustChange{
+		GUN:   gun,
+		Root:  DefaultAlternateRootName,
+		Roles: []ChangedRole{{Role: DefaultServerTargetsRole, Version: 1}},
+		Targets: []TargetChange{
+			{Role: DefaultServerTargetsRole, Name: "v1", Change: TargetAdded, Digest: hex.EncodeToString(fileMeta(t, "one").Hashes[notary.SHA256]), Length: 3},
+		},
+	}, notifier.changes[0])
+	require.Equal(t, []ChangedRole{{Role: DefaultServerTargetsRole, Version: 2}}, notifier.changes[1].Roles)
+	require.Equal(t, []TargetChange{
+		{Role: DefaultServerTargetsRole, Name: "v1", Change: TargetRemoved, Digest: hex.EncodeToString(fileMeta(t, "one").Hashes[notary.SHA256]), Length: 3},
+		{Role: DefaultServerTargetsRole, Name: "v2", Change: TargetAdded, Digest: hex.EncodeToString(fileMeta(t, "two").Hashes[notary.SHA256]), Length: 3},
+	}, notifier.changes[1].Targets)
+}
+
+func TestSignServerTargetsConcurrently(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	metaStore := MultiplexingMetaStoreMock(t, trust)
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, metaStore, gun, meta, 1)
+
+	const signers = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, signers)
+	for i := 0; i < signers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("v%d", i)
+			_, err := metaStore.SignServerTargets(gun, data.Files{name: fileMeta(t, name)}, nil)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	serverTargets := requireServerTargets(t, metaStore, gun)
+	require.Equal(t, signers, serverTargets.Signed.Version)
+	require.Len(t, serverTargets.Signed.Targets, signers)
+}
+
+// firstOrCreateStore keeps the version of metadata that is already stored rather than failing an update that writes
+// it again, like the SQL store does for versions in other channels than the published one
+type firstOrCreateStore struct {
+	notaryStorage.MetaStore
+	// beforeUpdate, if set, is called once before the next update
+	beforeUpdate func()
+}
+
+func (st *firstOrCreateStore) UpdateMany(gun data.GUN, updates []notaryStorage.MetaUpdate) error {
+	if beforeUpdate := st.beforeUpdate; beforeUpdate != nil {
+		st.beforeUpdate = nil
+		beforeUpdate()
+	}
+	var created []notaryStorage.MetaUpdate
+	for _, update := range updates {
+		if _, _, err := st.GetVersion(gun, update.Role, update.Version, update.Channels...); err != nil {
+			created = append(created, update)
+		}
+	}
+	return st.MetaStore.UpdateMany(gun, created)
+}
+
+func TestSignServerTargetsConcurrentReplicas(t *testing.T) {
+	trust := servertest.TrustServiceMock(t)
+	rootStore := notaryStorage.NewMemStorage()
+	storeRootRepo(t, trust, rootStore, "quay")
+	store := &firstOrCreateStore{MetaStore: notaryStorage.NewMemStorage()}
+	replica := NewMultiplexingStore(store, rootStore, trust, SignerRoot, AlternateRoot, Root, "quay", "targets/releases")
+	otherReplica := NewMultiplexingStore(store, rootStore, trust, SignerRoot, AlternateRoot, Root, "quay", "targets/releases")
+	gun := data.GUN("quay.io/signingUser/testRepo")
+	meta, err := testutils.SignAndSerialize(servertest.CreateRepo(t, gun, trust))
+	require.NoError(t, err)
+	pushMeta(t, replica, gun, meta, 1)
+	notifier := &recordingNotifier{}
+	replica.Notifier = notifier
+
+	// the other replica stores the same versions between this one reading and writing them
+	store.beforeUpdate = func() {
+		_, err := otherReplica.SignServerTargets(gun, data.Files{"other": fileMeta(t, "other")}, nil)
+		require.NoError(t, err)
+	}
+	_, err = replica.SignServerTargets(gun, data.Files{"v1": fileMeta(t, "one")}, nil)
+	require.IsType(t, notaryStorage.ErrOldVersion{}, err)
+	require.Empty(t, notifier.changes)
+	require.Equal(t, data.Files{"other": fileMeta(t, "other")}, requireServerTargets(t, replica, gun).Signed.Targets)
+
+	// retrying builds on the other replica's change
+	_, err = replica.SignServerTargets(gun, data.Files{"v1": fileMeta(t, "one")}, nil)
+	require.NoError(t, err)
+	require.Len(t, notifier.changes, 1)
+	require.Len(t, requireServerTargets(t, replica, gun).Signed.Targets, 2)
+}
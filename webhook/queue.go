@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Delivery is a notification waiting to be delivered to an endpoint
+type Delivery struct {
+	// ID is unique per delivery, and sorts in the order deliveries were queued
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// Queue holds deliveries until they have been delivered or given up on
+type Queue interface {
+	// Push adds a delivery, or replaces the delivery with the same ID
+	Push(delivery *Delivery) error
+	// Remove removes a delivery
+	Remove(id string) error
+	// List returns every delivery, in the order they were queued
+	List() ([]*Delivery, error)
+}
+
+// MemoryQueue is a Queue that loses its deliveries when apostille stops
+type MemoryQueue struct {
+	lock       sync.Mutex
+	deliveries map[string]Delivery
+}
+
+// NewMemoryQueue creates an empty MemoryQueue
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{deliveries: make(map[string]Delivery)}
+}
+
+// Push adds or replaces a delivery
+func (q *MemoryQueue) Push(delivery *Delivery) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+// Remove removes a delivery
+func (q *MemoryQueue) Remove(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.deliveries, id)
+	return nil
+}
+
+// List returns copies of every delivery, in the order they were queued
+func (q *MemoryQueue) List() ([]*Delivery, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	deliveries := make([]*Delivery, 0, len(q.deliveries))
+	for _, delivery := range q.deliveries {
+		delivery := delivery
+		deliveries = append(deliveries, &delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	return deliveries, nil
+}
+
+// DirQueue is a Queue that keeps each delivery in a file in a directory, so that deliveries survive restarts
+type DirQueue struct {
+	dir string
+}
+
+// NewDirQueue creates a DirQueue, creating its directory if needed. Deliveries already in the directory are kept.
+func NewDirQueue(dir string) (*DirQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirQueue{dir: dir}, nil
+}
+
+// Push writes a delivery to its file. The file is replaced atomically, so a crash never leaves half a delivery.
+func (q *DirQueue) Push(delivery *Delivery) error {
+	contents, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(q.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path(delivery.ID))
+}
+
+// Remove deletes a delivery's file
+func (q *DirQueue) Remove(id string) error {
+	if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List reads every delivery in the directory, in the order they were queued. Files that can't be read are logged
+// and skipped.
+func (q *DirQueue) List() ([]*Delivery, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*Delivery, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(q.dir, file.Name()))
+		if err != nil {
+			logrus.Errorf("unable to read webhook delivery %s: %s", file.Name(), err.Error())
+			continue
+		}
+		var delivery Delivery
+		if err := json.Unmarshal(contents, &delivery); err != nil {
+			logrus.Errorf("unable to decode webhook delivery %s: %s", file.Name(), err.Error())
+			continue
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	return deliveries, nil
+}
+
+func (q *DirQueue) path(id string) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s.json", filepath.Base(id)))
+}
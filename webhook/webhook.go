@@ -0,0 +1,324 @@
+// Package webhook notifies external services of changes to trust data, by posting signed JSON payloads to them.
+// Deliveries are queued before they are attempted, and retried with exponential backoff until they succeed or run
+// out of attempts, so every endpoint receives each notification at least once.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos-inc/apostille/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// Headers sent with every notification
+const (
+	// DeliveryHeader identifies the delivery, so that receivers can ignore repeated deliveries
+	DeliveryHeader = "X-Apostille-Delivery"
+	// EventHeader is the event of the payload
+	EventHeader = "X-Apostille-Event"
+	// SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of the payload, keyed with the endpoint's secret.
+	// It is only sent to endpoints with a secret.
+	SignatureHeader = "X-Apostille-Signature"
+)
+
+// Events that are notified
+const (
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Defaults for the optional parts of a Config
+const (
+	DefaultMaxAttempts = 10
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = 10 * time.Minute
+	DefaultTimeout     = 10 * time.Second
+)
+
+// idleWait is how long to wait before checking the queue again when nothing is due
+const idleWait = time.Minute
+
+// Results of delivery attempts
+const (
+	resultDelivered = "delivered"
+	resultFailed    = "failed"
+	resultDropped   = "dropped"
+)
+
+var (
+	deliveryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "apostille",
+		Subsystem: "webhook",
+		Name:      "deliveries_total",
+		Help:      "Number of webhook delivery attempts, by result.",
+	}, []string{"result"})
+	queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "apostille",
+		Subsystem: "webhook",
+		Name:      "queue_length",
+		Help:      "Number of webhook deliveries waiting to be delivered.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(deliveryAttempts)
+	prometheus.MustRegister(queueLength)
+}
+
+// Endpoint is a URL that notifications are posted to
+type Endpoint struct {
+	URL string
+	// Secret keys the HMAC that payloads are signed with. Payloads aren't signed if it is empty.
+	Secret string
+}
+
+// Config configures a Notifier
+type Config struct {
+	Endpoints []Endpoint
+	// Queue holds deliveries until they succeed; a MemoryQueue is used if it is nil
+	Queue Queue
+	// MaxAttempts is how many times a delivery is attempted before it is given up on
+	MaxAttempts int
+	// MinBackoff is how long to wait before retrying a delivery the first time; each retry waits twice as long, up
+	// to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Timeout is how long an endpoint has to respond
+	Timeout time.Duration
+}
+
+// Payload is the body of a notification
+type Payload struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	storage.TrustChange
+}
+
+// Notifier queues a delivery to every endpoint for each change to trust data, and delivers them while it runs
+type Notifier struct {
+	config    Config
+	endpoints map[string]Endpoint
+	client    *http.Client
+	wake      chan struct{}
+}
+
+// New creates a Notifier, filling in defaults for the optional parts of the config
+func New(config Config) *Notifier {
+	if config.Queue == nil {
+		config.Queue = NewMemoryQueue()
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	endpoints := make(map[string]Endpoint, len(config.Endpoints))
+	for _, endpoint := range config.Endpoints {
+		endpoints[endpoint.URL] = endpoint
+	}
+	return &Notifier{
+		config:    config,
+		endpoints: endpoints,
+		client:    &http.Client{Timeout: config.Timeout},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// NotifyChange queues a delivery of the change to every endpoint
+func (n *Notifier) NotifyChange(change storage.TrustChange) {
+	payload := Payload{
+		ID:          newID(),
+		Time:        time.Now().UTC(),
+		Event:       EventUpdate,
+		TrustChange: change,
+	}
+	if change.Deleted {
+		payload.Event = EventDelete
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logrus.Errorf("unable to encode webhook payload for %s: %s", change.GUN, err.Error())
+		return
+	}
+
+	for i, endpoint := range n.config.Endpoints {
+		delivery := &Delivery{
+			ID:          fmt.Sprintf("%s-%d", payload.ID, i),
+			URL:         endpoint.URL,
+			Payload:     body,
+			NextAttempt: payload.Time,
+		}
+		if err := n.config.Queue.Push(delivery); err != nil {
+			deliveryAttempts.WithLabelValues(resultDropped).Inc()
+			logrus.Errorf("unable to queue webhook delivery of %s change to %s: %s", change.GUN, endpoint.URL, err.Error())
+		}
+	}
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued notifications until the context is cancelled. Deliveries that were in progress are retried the
+// next time it runs.
+func (n *Notifier) Run(ctx context.Context) {
+	logrus.Infof("Delivering webhooks to %d endpoints", len(n.config.Endpoints))
+	for {
+		timer := time.NewTimer(n.deliverDue(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logrus.Info("Stopped delivering webhooks")
+			return
+		case <-n.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts every delivery that is due, and returns how long to wait until the next one is
+func (n *Notifier) deliverDue(ctx context.Context) time.Duration {
+	deliveries, err := n.config.Queue.List()
+	if err != nil {
+		logrus.Errorf("unable to list webhook deliveries: %s", err.Error())
+		return n.config.MinBackoff
+	}
+
+	next := idleWait
+	pending := 0
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return 0
+		}
+		if until := time.Until(delivery.NextAttempt); until > 0 {
+			pending++
+			if until < next {
+				next = until
+			}
+			continue
+		}
+		if n.attempt(ctx, delivery) {
+			pending++
+			if until := time.Until(delivery.NextAttempt); until < next {
+				next = until
+			}
+		}
+	}
+	queueLength.Set(float64(pending))
+	return next
+}
+
+// attempt tries to deliver a notification, and returns whether it is still queued to be retried
+func (n *Notifier) attempt(ctx context.Context, delivery *Delivery) bool {
+	endpoint, ok := n.endpoints[delivery.URL]
+	if !ok {
+		logrus.Warnf("dropping webhook delivery %s: %s is no longer a webhook endpoint", delivery.ID, delivery.URL)
+		deliveryAttempts.WithLabelValues(resultDropped).Inc()
+		n.remove(delivery)
+		return false
+	}
+
+	err := n.send(ctx, endpoint, delivery)
+	if err == nil {
+		logrus.Debugf("delivered webhook %s to %s", delivery.ID, delivery.URL)
+		deliveryAttempts.WithLabelValues(resultDelivered).Inc()
+		n.remove(delivery)
+		return false
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= n.config.MaxAttempts {
+		logrus.Errorf("giving up on webhook delivery %s to %s after %d attempts: %s", delivery.ID, delivery.URL, delivery.Attempts, err.Error())
+		deliveryAttempts.WithLabelValues(resultDropped).Inc()
+		n.remove(delivery)
+		return false
+	}
+	delivery.NextAttempt = time.Now().Add(n.backoff(delivery.Attempts))
+	logrus.Warnf("webhook delivery %s to %s failed, retrying at %v: %s", delivery.ID, delivery.URL, delivery.NextAttempt, err.Error())
+	deliveryAttempts.WithLabelValues(resultFailed).Inc()
+	if err := n.config.Queue.Push(delivery); err != nil {
+		logrus.Errorf("unable to requeue webhook delivery %s: %s", delivery.ID, err.Error())
+	}
+	return true
+}
+
+// send posts a delivery's payload to an endpoint, and fails unless the endpoint responds with a 2xx status
+func (n *Notifier) send(ctx context.Context, endpoint Endpoint, delivery *Delivery) error {
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	var payload Payload
+	if err := json.Unmarshal(delivery.Payload, &payload); err == nil {
+		req.Header.Set(EventHeader, payload.Event)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(endpoint.Secret, delivery.Payload))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) remove(delivery *Delivery) {
+	if err := n.config.Queue.Remove(delivery.ID); err != nil {
+		logrus.Errorf("unable to remove webhook delivery %s from the queue: %s", delivery.ID, err.Error())
+	}
+}
+
+// backoff is how long to wait before retrying a delivery that has failed `attempts` times
+func (n *Notifier) backoff(attempts int) time.Duration {
+	backoff := n.config.MinBackoff
+	for i := 1; i < attempts && backoff < n.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > n.config.MaxBackoff {
+		return n.config.MaxBackoff
+	}
+	return backoff
+}
+
+// Sign returns the signature header value of a payload, so that receivers can check that it came from apostille
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newID creates a random ID that sorts after every ID created before it
+func newID() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%020s-%s", strconv.FormatInt(time.Now().UnixNano(), 10), hex.EncodeToString(random))
+}
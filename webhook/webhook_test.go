@@ -0,0 +1,225 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos-inc/apostille/storage"
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// receiver is a webhook endpoint that fails the first `failures` deliveries it receives
+type receiver struct {
+	lock     sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, failures int) (*receiver, *httptest.Server) {
+	r := &receiver{failures: failures, received: make(chan struct{}, 100)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		r.lock.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		failing := r.failures > 0
+		r.failures--
+		r.lock.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		r.received <- struct{}{}
+	}))
+	return r, server
+}
+
+func (r *receiver) wait(t *testing.T, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for delivery %d", i+1)
+		}
+	}
+}
+
+// waitForEmpty waits for every delivery to be removed from a queue
+func waitForEmpty(t *testing.T, queue Queue) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		deliveries, err := queue.List()
+		require.NoError(t, err)
+		if len(deliveries) == 0 {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for the queue to empty")
+}
+
+var testChange = storage.TrustChange{
+	GUN:   data.GUN("quay.io/signingUser/testRepo"),
+	Roles: []storage.ChangedRole{{Role: data.CanonicalTargetsRole, Version: 2}},
+	Targets: []storage.TargetChange{
+		{Role: data.CanonicalTargetsRole, Name: "latest", Change: storage.TargetAdded, Digest: "abcd", Length: 3},
+	},
+}
+
+func TestNotifierDelivers(t *testing.T) {
+	signed, signedServer := newReceiver(t, 0)
+	defer signedServer.Close()
+	unsigned, unsignedServer := newReceiver(t, 0)
+	defer unsignedServer.Close()
+
+	notifier := New(Config{Endpoints: []Endpoint{
+		{URL: signedServer.URL, Secret: "secret"},
+		{URL: unsignedServer.URL},
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	notifier.NotifyChange(testChange)
+	signed.wait(t, 1)
+	unsigned.wait(t, 1)
+
+	req, body := signed.requests[0], signed.bodies[0]
+	require.Equal(t, Sign("secret", body), req.Header.Get(SignatureHeader))
+	require.Equal(t, EventUpdate, req.Header.Get(EventHeader))
+	require.NotEmpty(t, req.Header.Get(DeliveryHeader))
+	require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+	var payload Payload
+	require.NoError(t, json.Unmarshal(body, &payload))
+	require.Equal(t, EventUpdate, payload.Event)
+	require.Equal(t, testChange, payload.TrustChange)
+	require.NotEmpty(t, payload.ID)
+
+	// the same payload goes to every endpoint, but is only signed for endpoints with a secret
+	require.Equal(t, body, unsigned.bodies[0])
+	require.Empty(t, unsigned.requests[0].Header.Get(SignatureHeader))
+	require.NotEqual(t, req.Header.Get(DeliveryHeader), unsigned.requests[0].Header.Get(DeliveryHeader))
+
+	deleted := storage.TrustChange{GUN: testChange.GUN, Deleted: true}
+	notifier.NotifyChange(deleted)
+	signed.wait(t, 1)
+	require.Equal(t, EventDelete, signed.requests[1].Header.Get(EventHeader))
+	require.NoError(t, json.Unmarshal(signed.bodies[1], &payload))
+	require.Equal(t, EventDelete, payload.Event)
+	require.True(t, payload.Deleted)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	r, server := newReceiver(t, 2)
+	defer server.Close()
+
+	queue := NewMemoryQueue()
+	notifier := New(Config{
+		Endpoints:  []Endpoint{{URL: server.URL, Secret: "secret"}},
+		Queue:      queue,
+		MinBackoff: time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	notifier.NotifyChange(testChange)
+	r.wait(t, 3)
+
+	// every attempt is the same delivery
+	for _, req := range r.requests[1:] {
+		require.Equal(t, r.requests[0].Header.Get(DeliveryHeader), req.Header.Get(DeliveryHeader))
+	}
+	require.Equal(t, r.bodies[0], r.bodies[2])
+	waitForEmpty(t, queue)
+}
+
+func TestNotifierGivesUp(t *testing.T) {
+	r, server := newReceiver(t, 100)
+	defer server.Close()
+
+	queue := NewMemoryQueue()
+	notifier := New(Config{
+		Endpoints:   []Endpoint{{URL: server.URL}},
+		Queue:       queue,
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+	})
+	notifier.NotifyChange(testChange)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		deliveries, err := queue.List()
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		require.Equal(t, i, deliveries[0].Attempts)
+		time.Sleep(2 * time.Millisecond << uint(i))
+		notifier.deliverDue(ctx)
+	}
+	r.wait(t, 3)
+
+	deliveries, err := queue.List()
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+}
+
+func TestBackoff(t *testing.T) {
+	notifier := New(Config{MinBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	require.Equal(t, time.Second, notifier.backoff(1))
+	require.Equal(t, 2*time.Second, notifier.backoff(2))
+	require.Equal(t, 8*time.Second, notifier.backoff(4))
+	require.Equal(t, 10*time.Second, notifier.backoff(5))
+	require.Equal(t, 10*time.Second, notifier.backoff(100))
+}
+
+func TestDirQueueSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := NewDirQueue(dir)
+	require.NoError(t, err)
+	r, server := newReceiver(t, 0)
+	defer server.Close()
+	endpoints := []Endpoint{{URL: server.URL, Secret: "secret"}}
+
+	// apostille stops before the change is delivered
+	New(Config{Endpoints: endpoints, Queue: queue}).NotifyChange(testChange)
+	deliveries, err := queue.List()
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	// a corrupt delivery doesn't stop the rest being delivered
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0600))
+
+	queue, err = NewDirQueue(dir)
+	require.NoError(t, err)
+	notifier := New(Config{Endpoints: endpoints, Queue: queue})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	r.wait(t, 1)
+	require.Equal(t, Sign("secret", r.bodies[0]), r.requests[0].Header.Get(SignatureHeader))
+	waitForEmpty(t, queue)
+}
+
+func TestNotifierDropsRemovedEndpoints(t *testing.T) {
+	queue := NewMemoryQueue()
+	New(Config{Endpoints: []Endpoint{{URL: "http://removed.example.com"}}, Queue: queue}).NotifyChange(testChange)
+
+	New(Config{Queue: queue}).deliverDue(context.Background())
+	deliveries, err := queue.List()
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+}